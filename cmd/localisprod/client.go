@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// client calls the control plane API with an API token.
+type client struct {
+	baseURL string
+	token   string
+	org     string
+	http    *http.Client
+}
+
+func newClient(baseURL, token, org string) *client {
+	return &client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		org:     org,
+		// Deploys and resource creation run docker over SSH and can be slow.
+		http: &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// apiError is an error response of the API.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.Status)
+}
+
+// do sends a request to the API path (without the /api prefix) with in as
+// the JSON body, or the raw body if it is a []byte, and decodes the response
+// into out, if not nil. A *[]byte out receives the response as is.
+func (c *client) do(method, path string, in, out any) error {
+	var body io.Reader
+	switch v := in.(type) {
+	case nil:
+	case []byte:
+		// Sent as is, e.g. a YAML manifest.
+		body = bytes.NewReader(v)
+	default:
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.baseURL+"/api"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if _, raw := in.([]byte); in != nil && !raw {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.org != "" {
+		req.Header.Set("X-Org-ID", c.org)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Error == "" {
+			e.Error = strings.TrimSpace(string(data))
+			if e.Error == "" {
+				e.Error = http.StatusText(resp.StatusCode)
+			}
+		}
+		return &apiError{Status: resp.StatusCode, Message: e.Error}
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// failure returns the error reported inside a successful response: the API
+// reports failed SSH commands as 200 with an "error" field, or a "status" of
+// "error" with a "message" or "output".
+func failure(v any) error {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil
+	}
+	if e, _ := m["error"].(string); e != "" {
+		return fmt.Errorf("%s", e)
+	}
+	if s, _ := m["status"].(string); s == "error" {
+		for _, k := range []string{"message", "output"} {
+			if msg, _ := m[k].(string); msg != "" {
+				return fmt.Errorf("%s", strings.TrimSpace(msg))
+			}
+		}
+		return fmt.Errorf("request failed")
+	}
+	return nil
+}
+
+// resolve returns the ID of the item of the collection at path whose ID or
+// name is ref, so commands take names as well as IDs.
+func (c *client) resolve(path, ref string) (string, error) {
+	var items []map[string]any
+	if err := c.do(http.MethodGet, path, nil, &items); err != nil {
+		return "", err
+	}
+	var match []string
+	for _, it := range items {
+		id, _ := it["id"].(string)
+		if id == ref {
+			return id, nil
+		}
+		if name, _ := it["name"].(string); name == ref {
+			match = append(match, id)
+		}
+	}
+	switch len(match) {
+	case 0:
+		return "", fmt.Errorf("no %s named %q", strings.TrimSuffix(strings.TrimPrefix(path, "/"), "s"), ref)
+	case 1:
+		return match[0], nil
+	}
+	return "", fmt.Errorf("%q matches %d items of %s; use the ID", ref, len(match), path)
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// strList is a flag that may be repeated, e.g. --port 80:80 --port 443:443.
+type strList []string
+
+func (l *strList) String() string     { return strings.Join(*l, ",") }
+func (l *strList) Set(v string) error { *l = append(*l, v); return nil }
+
+func commandGroups() []*group {
+	groups := []*group{
+		{name: "whoami", summary: "Show the user the token belongs to", commands: []*command{
+			{name: "show", summary: "Show the current user", run: func(c *cli, args []string) error {
+				return c.getObject(c.flags("whoami show"), args, "/auth/me")
+			}},
+		}},
+		nodeCommands(),
+		serviceCommands(),
+		deploymentCommands(),
+	}
+	for _, r := range managedResources {
+		groups = append(groups, r.commands())
+	}
+	return append(groups, composeCommands(), manifestCommands())
+}
+
+// getObject prints the object at path.
+func (c *cli) getObject(fs *flag.FlagSet, args []string, path string) error {
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	var v any
+	if err := c.api.do(http.MethodGet, path, nil, &v); err != nil {
+		return err
+	}
+	return c.out.object(v)
+}
+
+// list prints the collection at path.
+func (c *cli) list(name string, args []string, path string, columns []column) error {
+	if _, err := parse(c.flags(name), args, 0); err != nil {
+		return err
+	}
+	var v any
+	if err := c.api.do(http.MethodGet, path, nil, &v); err != nil {
+		return err
+	}
+	return c.out.list(v, columns)
+}
+
+// get prints one item of the collection at path, by name or ID.
+func (c *cli) get(name string, args []string, path string) error {
+	pos, err := parse(c.flags(name), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := c.api.resolve(path, pos[0])
+	if err != nil {
+		return err
+	}
+	var v any
+	if err := c.api.do(http.MethodGet, path+"/"+id, nil, &v); err != nil {
+		return err
+	}
+	return c.out.object(v)
+}
+
+// remove deletes one item of the collection at path, by name or ID.
+func (c *cli) remove(name string, args []string, path string) error {
+	pos, err := parse(c.flags(name), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := c.api.resolve(path, pos[0])
+	if err != nil {
+		return err
+	}
+	if err := c.api.do(http.MethodDelete, path+"/"+id, nil, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "deleted %s\n", id)
+	return nil
+}
+
+// action posts body to path and prints the result, failing when the API
+// reports that the action failed.
+func (c *cli) action(path string, body any) error {
+	var v any
+	if err := c.api.do(http.MethodPost, path, body, &v); err != nil {
+		return err
+	}
+	if err := c.out.object(v); err != nil {
+		return err
+	}
+	return failure(v)
+}
+
+// itemAction runs the action sub of one item of the collection at path, e.g.
+// POST /nodes/{id}/ping.
+func (c *cli) itemAction(name string, args []string, path, sub string) error {
+	pos, err := parse(c.flags(name), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := c.api.resolve(path, pos[0])
+	if err != nil {
+		return err
+	}
+	return c.action(path+"/"+id+"/"+sub, nil)
+}
+
+func nodeCommands() *group {
+	columns := cols("id", "name", "host", "port", "username", "status", "schedule")
+	return &group{name: "nodes", summary: "Manage nodes", commands: []*command{
+		{name: "list", summary: "List nodes", run: func(c *cli, args []string) error {
+			return c.list("nodes list", args, "/nodes", columns)
+		}},
+		{name: "get", args: "<node>", summary: "Show a node", run: func(c *cli, args []string) error {
+			return c.get("nodes get", args, "/nodes")
+		}},
+		{name: "add", summary: "Register a node", run: func(c *cli, args []string) error {
+			fs := c.flags("nodes add")
+			name := fs.String("name", "", "node name")
+			host := fs.String("host", "", "host name or IP")
+			port := fs.Int("port", 22, "SSH port")
+			user := fs.String("username", "root", "SSH user")
+			keyFile := fs.String("key-file", "", "private key file")
+			passphrase := fs.String("passphrase", "", "passphrase of the private key")
+			password := fs.String("password", "", "SSH password, instead of a key")
+			generate := fs.Bool("generate-key", false, "generate a key pair and install it using -password")
+			proxy := fs.String("proxy-node", "", "node to dial this node through")
+			if _, err := parse(fs, args, 0); err != nil {
+				return err
+			}
+			body := map[string]any{
+				"name": *name, "host": *host, "port": *port, "username": *user,
+				"key_passphrase": *passphrase, "password": *password, "generate_key": *generate,
+			}
+			if *keyFile != "" {
+				key, err := os.ReadFile(*keyFile)
+				if err != nil {
+					return err
+				}
+				body["private_key"] = string(key)
+			}
+			if *proxy != "" {
+				id, err := c.api.resolve("/nodes", *proxy)
+				if err != nil {
+					return err
+				}
+				body["proxy_node_id"] = id
+			}
+			return c.action("/nodes", body)
+		}},
+		{name: "ping", args: "<node>", summary: "Check SSH connectivity", run: func(c *cli, args []string) error {
+			return c.itemAction("nodes ping", args, "/nodes", "ping")
+		}},
+		{name: "setup-traefik", args: "<node>", summary: "Install Traefik on a node", run: func(c *cli, args []string) error {
+			return c.itemAction("nodes setup-traefik", args, "/nodes", "setup-traefik")
+		}},
+		{name: "delete", args: "<node>", summary: "Remove a node", run: func(c *cli, args []string) error {
+			return c.remove("nodes delete", args, "/nodes")
+		}},
+	}}
+}
+
+// serviceFlags are the flags of services create and update.
+type serviceFlags struct {
+	name, image, dockerfile, command, repo, domain *string
+	env, unsetEnv, ports, volumes                  strList
+	databases, caches, kafkas, monitorings         strList
+}
+
+func newServiceFlags(fs *flag.FlagSet) *serviceFlags {
+	f := &serviceFlags{
+		name:       fs.String("name", "", "service name"),
+		image:      fs.String("image", "", "Docker image"),
+		dockerfile: fs.String("dockerfile", "", "Dockerfile path"),
+		command:    fs.String("command", "", "container command"),
+		repo:       fs.String("repo", "", "GitHub repository (owner/name) whose webhook redeploys it"),
+		domain:     fs.String("domain", "", "expose on this host through Traefik"),
+	}
+	fs.Var(&f.env, "env", "environment variable KEY=VALUE (repeatable)")
+	fs.Var(&f.unsetEnv, "unset-env", "remove an environment variable (update only, repeatable)")
+	fs.Var(&f.ports, "port", "port mapping host:container (repeatable)")
+	fs.Var(&f.volumes, "volume", "volume name:/path (repeatable)")
+	fs.Var(&f.databases, "database", "link a database by name or ID (repeatable)")
+	fs.Var(&f.caches, "cache", "link a cache by name or ID (repeatable)")
+	fs.Var(&f.kafkas, "kafka", "link a Kafka cluster by name or ID (repeatable)")
+	fs.Var(&f.monitorings, "monitoring", "link a monitoring stack by name or ID (repeatable)")
+	return f
+}
+
+// apply sets the flags given on fs in body, the JSON body of a service.
+func (f *serviceFlags) apply(c *cli, fs *flag.FlagSet, body map[string]any) error {
+	set := map[string]bool{}
+	fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+	for flagName, field := range map[string]string{"name": "name", "image": "docker_image", "dockerfile": "dockerfile_path", "command": "command", "repo": "github_repo", "domain": "domain"} {
+		if set[flagName] {
+			body[field] = fs.Lookup(flagName).Value.String()
+		}
+	}
+	env, _ := body["env_vars"].(map[string]any)
+	if env == nil {
+		env = map[string]any{}
+	}
+	for _, kv := range f.env {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("--env %q: expected KEY=VALUE", kv)
+		}
+		env[k] = v
+	}
+	for _, k := range f.unsetEnv {
+		delete(env, k)
+	}
+	body["env_vars"] = env
+	if set["port"] {
+		body["ports"] = []string(f.ports)
+	}
+	if set["volume"] {
+		body["volumes"] = []string(f.volumes)
+	}
+	for flagName, link := range map[string]struct {
+		field, path string
+		refs        strList
+	}{
+		"database":   {"databases", "/databases", f.databases},
+		"cache":      {"caches", "/caches", f.caches},
+		"kafka":      {"kafkas", "/kafkas", f.kafkas},
+		"monitoring": {"monitorings", "/monitorings", f.monitorings},
+	} {
+		if !set[flagName] {
+			continue
+		}
+		ids := []string{}
+		for _, ref := range link.refs {
+			id, err := c.api.resolve(link.path, ref)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		body[link.field] = ids
+	}
+	return nil
+}
+
+func serviceCommands() *group {
+	columns := cols("id", "name", "docker_image", "ports", "last_deployed_at")
+	return &group{name: "services", summary: "Manage services", commands: []*command{
+		{name: "list", summary: "List services", run: func(c *cli, args []string) error {
+			return c.list("services list", args, "/services", columns)
+		}},
+		{name: "get", args: "<service>", summary: "Show a service", run: func(c *cli, args []string) error {
+			return c.get("services get", args, "/services")
+		}},
+		{name: "create", summary: "Create a service", run: func(c *cli, args []string) error {
+			fs := c.flags("services create")
+			f := newServiceFlags(fs)
+			if _, err := parse(fs, args, 0); err != nil {
+				return err
+			}
+			body := map[string]any{}
+			if err := f.apply(c, fs, body); err != nil {
+				return err
+			}
+			return c.action("/services", body)
+		}},
+		{name: "update", args: "<service>", summary: "Change a service; unset flags keep their value", run: func(c *cli, args []string) error {
+			fs := c.flags("services update")
+			f := newServiceFlags(fs)
+			pos, err := parse(fs, args, 1)
+			if err != nil {
+				return err
+			}
+			id, err := c.api.resolve("/services", pos[0])
+			if err != nil {
+				return err
+			}
+			var current map[string]any
+			if err := c.api.do(http.MethodGet, "/services/"+id, nil, &current); err != nil {
+				return err
+			}
+			body := serviceBody(current)
+			if err := f.apply(c, fs, body); err != nil {
+				return err
+			}
+			var v any
+			if err := c.api.do(http.MethodPut, "/services/"+id, body, &v); err != nil {
+				return err
+			}
+			return c.out.object(v)
+		}},
+		{name: "deploy", args: "<service>", summary: "Deploy a service onto a node", run: func(c *cli, args []string) error {
+			fs := c.flags("services deploy")
+			node := fs.String("node", "", "node name or ID")
+			heal := fs.String("heal-policy", "", "heal policy: observe, restart or recreate")
+			pos, err := parse(fs, args, 1)
+			if err != nil {
+				return err
+			}
+			if *node == "" {
+				return fmt.Errorf("services deploy: --node is required")
+			}
+			serviceID, err := c.api.resolve("/services", pos[0])
+			if err != nil {
+				return err
+			}
+			nodeID, err := c.api.resolve("/nodes", *node)
+			if err != nil {
+				return err
+			}
+			return c.action("/deployments", map[string]any{"service_id": serviceID, "node_id": nodeID, "heal_policy": *heal})
+		}},
+		{name: "delete", args: "<service>", summary: "Delete a service", run: func(c *cli, args []string) error {
+			return c.remove("services delete", args, "/services")
+		}},
+	}}
+}
+
+// serviceBody converts a service as the API returns it, with JSON-encoded
+// lists, into the body the API takes to update it.
+func serviceBody(svc map[string]any) map[string]any {
+	body := map[string]any{}
+	for _, k := range []string{"name", "docker_image", "dockerfile_path", "command"} {
+		body[k] = svc[k]
+	}
+	for _, k := range []string{"env_vars", "ports", "volumes", "routes", "databases", "caches", "kafkas", "monitorings"} {
+		if s, ok := svc[k].(string); ok {
+			var v any
+			if json.Unmarshal([]byte(s), &v) == nil {
+				body[k] = v
+			}
+		}
+	}
+	return body
+}
+
+func deploymentCommands() *group {
+	columns := cols("id", "app_name", "node_name", "status", "docker_image", "container_name")
+	return &group{name: "deployments", summary: "Manage deployments", commands: []*command{
+		{name: "list", summary: "List deployments", run: func(c *cli, args []string) error {
+			return c.list("deployments list", args, "/deployments", columns)
+		}},
+		{name: "get", args: "<deployment>", summary: "Show a deployment", run: func(c *cli, args []string) error {
+			return c.get("deployments get", args, "/deployments")
+		}},
+		{name: "logs", args: "<deployment>", summary: "Print container logs", run: func(c *cli, args []string) error {
+			pos, err := parse(c.flags("deployments logs"), args, 1)
+			if err != nil {
+				return err
+			}
+			var v map[string]any
+			if err := c.api.do(http.MethodGet, "/deployments/"+pos[0]+"/logs", nil, &v); err != nil {
+				return err
+			}
+			if c.out.format == formatJSON {
+				if err := c.out.json(v); err != nil {
+					return err
+				}
+			} else {
+				logs, _ := v["logs"].(string)
+				fmt.Fprint(c.stdout, logs)
+			}
+			return failure(v)
+		}},
+		{name: "restart", args: "<deployment>", summary: "Restart the container", run: func(c *cli, args []string) error {
+			return c.itemAction("deployments restart", args, "/deployments", "restart")
+		}},
+		{name: "rollback", args: "<deployment>", summary: "Recreate from the image before the last redeploy", run: func(c *cli, args []string) error {
+			return c.itemAction("deployments rollback", args, "/deployments", "rollback")
+		}},
+		{name: "delete", args: "<deployment>", summary: "Stop and remove a deployment", run: func(c *cli, args []string) error {
+			return c.remove("deployments delete", args, "/deployments")
+		}},
+	}}
+}
+
+// resourceFlag is a flag of a managed resource's create command, sent as
+// field. Int flags are sent as numbers, node flags are resolved to IDs.
+type resourceFlag struct {
+	name, field, usage, def string
+	kind                    string // "string", "int" or "node"
+}
+
+// managedResource is a kind of managed resource with list, get, create and
+// delete commands.
+type managedResource struct {
+	group, path, noun string
+	columns           []column
+	create            []resourceFlag
+}
+
+var managedResources = []*managedResource{
+	{group: "databases", path: "/databases", noun: "database",
+		columns: cols("id", "name", "type", "version", "node_name", "port", "status"),
+		create: []resourceFlag{
+			{name: "name", field: "name", usage: "database name"},
+			{name: "type", field: "type", usage: "database type", def: "postgres"},
+			{name: "version", field: "version", usage: "image version"},
+			{name: "node", field: "node_id", usage: "node name or ID", kind: "node"},
+			{name: "dbname", field: "dbname", usage: "database to create"},
+			{name: "user", field: "db_user", usage: "database user"},
+			{name: "password", field: "password", usage: "password, generated when empty"},
+			{name: "port", field: "port", usage: "host port", kind: "int"},
+			{name: "heal-policy", field: "heal_policy", usage: "observe, restart or recreate"},
+		}},
+	{group: "caches", path: "/caches", noun: "cache",
+		columns: cols("id", "name", "version", "node_name", "port", "status"),
+		create: []resourceFlag{
+			{name: "name", field: "name", usage: "cache name"},
+			{name: "version", field: "version", usage: "Redis version"},
+			{name: "node", field: "node_id", usage: "node name or ID", kind: "node"},
+			{name: "password", field: "password", usage: "password, generated when empty"},
+			{name: "port", field: "port", usage: "host port", kind: "int"},
+			{name: "heal-policy", field: "heal_policy", usage: "observe, restart or recreate"},
+		}},
+	{group: "kafkas", path: "/kafkas", noun: "Kafka cluster",
+		columns: cols("id", "name", "version", "node_name", "port", "status"),
+		create: []resourceFlag{
+			{name: "name", field: "name", usage: "cluster name"},
+			{name: "version", field: "version", usage: "Kafka version"},
+			{name: "node", field: "node_id", usage: "node name or ID", kind: "node"},
+			{name: "port", field: "port", usage: "host port", kind: "int"},
+			{name: "heal-policy", field: "heal_policy", usage: "observe, restart or recreate"},
+		}},
+	{group: "monitorings", path: "/monitorings", noun: "monitoring stack",
+		columns: cols("id", "name", "node_name", "prometheus_port", "grafana_port", "status"),
+		create: []resourceFlag{
+			{name: "name", field: "name", usage: "stack name"},
+			{name: "node", field: "node_id", usage: "node name or ID", kind: "node"},
+			{name: "prometheus-port", field: "prometheus_port", usage: "Prometheus host port", kind: "int"},
+			{name: "grafana-port", field: "grafana_port", usage: "Grafana host port", kind: "int"},
+			{name: "grafana-password", field: "grafana_password", usage: "Grafana admin password, generated when empty"},
+			{name: "heal-policy", field: "heal_policy", usage: "observe, restart or recreate"},
+		}},
+	{group: "object-storages", path: "/object-storages", noun: "object storage",
+		columns: cols("id", "name", "version", "node_name", "s3_port", "status"),
+		create: []resourceFlag{
+			{name: "name", field: "name", usage: "storage name"},
+			{name: "node", field: "node_id", usage: "node name or ID", kind: "node"},
+			{name: "s3-port", field: "s3_port", usage: "S3 API host port", kind: "int"},
+			{name: "version", field: "version", usage: "image version"},
+		}},
+}
+
+func (r *managedResource) commands() *group {
+	return &group{name: r.group, summary: "Manage " + r.noun + "s", commands: []*command{
+		{name: "list", summary: "List " + r.noun + "s", run: func(c *cli, args []string) error {
+			return c.list(r.group+" list", args, r.path, r.columns)
+		}},
+		{name: "get", args: "<" + r.noun + ">", summary: "Show a " + r.noun, run: func(c *cli, args []string) error {
+			return c.get(r.group+" get", args, r.path)
+		}},
+		{name: "create", summary: "Create a " + r.noun, run: func(c *cli, args []string) error {
+			return r.runCreate(c, args)
+		}},
+		{name: "delete", args: "<" + r.noun + ">", summary: "Delete a " + r.noun, run: func(c *cli, args []string) error {
+			return c.remove(r.group+" delete", args, r.path)
+		}},
+	}}
+}
+
+func (r *managedResource) runCreate(c *cli, args []string) error {
+	fs := c.flags(r.group + " create")
+	strs := map[string]*string{}
+	ints := map[string]*int{}
+	for _, f := range r.create {
+		if f.kind == "int" {
+			ints[f.name] = fs.Int(f.name, 0, f.usage)
+		} else {
+			strs[f.name] = fs.String(f.name, f.def, f.usage)
+		}
+	}
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	body := map[string]any{}
+	for _, f := range r.create {
+		switch f.kind {
+		case "int":
+			if *ints[f.name] != 0 {
+				body[f.field] = *ints[f.name]
+			}
+		case "node":
+			if *strs[f.name] == "" {
+				return fmt.Errorf("%s create: --%s is required", r.group, f.name)
+			}
+			id, err := c.api.resolve("/nodes", *strs[f.name])
+			if err != nil {
+				return err
+			}
+			body[f.field] = id
+		default:
+			if *strs[f.name] != "" {
+				body[f.field] = *strs[f.name]
+			}
+		}
+	}
+	return c.action(r.path, body)
+}
+
+func composeCommands() *group {
+	return &group{name: "compose", summary: "Import docker-compose files", commands: []*command{
+		{name: "import", summary: "Parse a docker-compose file into services and managed resources; with --node, create them", run: func(c *cli, args []string) error {
+			fs := c.flags("compose import")
+			var files, env, profiles strList
+			fs.Var(&files, "file", "compose file; repeat to merge override files in order (default docker-compose.yml)")
+			envFile := fs.String("env-file", "", "file of variables for ${VAR} interpolation (default .env next to the first file, if it exists)")
+			fs.Var(&env, "env", "interpolation variable KEY=VALUE (repeatable)")
+			fs.Var(&profiles, "profile", "active profile (repeatable)")
+			node := fs.String("node", "", "create the resources and services on this node")
+			deploy := fs.Bool("deploy", false, "also deploy the services (with --node)")
+			dryRun := fs.Bool("dry-run", false, "only show what --node would create")
+			if _, err := parse(fs, args, 0); err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				files = strList{"docker-compose.yml"}
+			}
+			body, err := composeBody(files, *envFile, env, profiles)
+			if err != nil {
+				return err
+			}
+			var v map[string]any
+			if err := c.api.do(http.MethodPost, "/import/docker-compose", body, &v); err != nil {
+				return err
+			}
+			if *node == "" {
+				if c.out.format == formatJSON {
+					return c.out.json(v)
+				}
+				if err := c.out.list(composeRows(v), cols("kind", "name", "image", "ports")); err != nil {
+					return err
+				}
+				warnings, _ := v["warnings"].([]any)
+				for _, w := range warnings {
+					fmt.Fprintf(c.stdout, "warning: %v\n", w)
+				}
+				return nil
+			}
+
+			nodeID, err := c.api.resolve("/nodes", *node)
+			if err != nil {
+				return err
+			}
+			path := "/import/docker-compose/apply"
+			if *dryRun {
+				path += "?dry_run=true"
+			}
+			var plan map[string]any
+			if err := c.api.do(http.MethodPost, path, map[string]any{"preview": v, "node_id": nodeID, "deploy": *deploy}, &plan); err != nil {
+				return err
+			}
+			return c.plan(plan)
+		}},
+	}}
+}
+
+// composeBody returns the preview request for compose files: the first is
+// the content and the rest override it. The env_file and extends files they
+// refer to are sent along, read relative to the first file as docker compose
+// does.
+func composeBody(files []string, envFile string, env, profiles []string) (map[string]any, error) {
+	var contents []string
+	refs := map[string]string{}
+	dir := filepath.Dir(files[0])
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, string(content))
+		for _, ref := range composeRefs(content) {
+			if data, err := os.ReadFile(filepath.Join(dir, ref)); err == nil {
+				refs[ref] = string(data)
+			}
+		}
+	}
+	body := map[string]any{"content": contents[0], "overrides": contents[1:], "files": refs, "profiles": profiles}
+	optional := envFile == ""
+	if optional {
+		envFile = filepath.Join(dir, ".env")
+	}
+	if data, err := os.ReadFile(envFile); err == nil {
+		body["dotenv"] = string(data)
+	} else if !optional {
+		return nil, err
+	}
+	vars := map[string]string{}
+	for _, kv := range env {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("--env %q: want KEY=VALUE", kv)
+		}
+		vars[k] = v
+	}
+	body["env"] = vars
+	return body, nil
+}
+
+// composeRefs returns the env_file and extends file paths of a compose file.
+func composeRefs(content []byte) []string {
+	var doc struct {
+		Services map[string]struct {
+			EnvFile any `yaml:"env_file"`
+			Extends any `yaml:"extends"`
+		} `yaml:"services"`
+	}
+	_ = yaml.Unmarshal(content, &doc)
+	var refs []string
+	for _, svc := range doc.Services {
+		switch v := svc.EnvFile.(type) {
+		case string:
+			refs = append(refs, v)
+		case []any:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					refs = append(refs, s)
+				} else if m, ok := item.(map[string]any); ok {
+					if p, ok := m["path"].(string); ok {
+						refs = append(refs, p)
+					}
+				}
+			}
+		}
+		if m, ok := svc.Extends.(map[string]any); ok {
+			if f, ok := m["file"].(string); ok {
+				refs = append(refs, f)
+			}
+		}
+	}
+	return refs
+}
+
+// composeRows flattens a compose preview into one row per service or
+// resource.
+func composeRows(preview map[string]any) []any {
+	var rows []any
+	for _, kind := range []string{"services", "databases", "caches", "kafkas", "object_storages"} {
+		items, _ := preview[kind].([]any)
+		for _, it := range items {
+			m, _ := it.(map[string]any)
+			row := map[string]any{"kind": strings.TrimSuffix(kind, "s"), "name": m["name"], "ports": m["ports"]}
+			if img, ok := m["docker_image"]; ok {
+				row["image"] = img
+			} else if t, ok := m["type"]; ok {
+				row["image"] = fmt.Sprintf("%v:%v", t, m["version"])
+			} else {
+				row["image"] = m["version"]
+			}
+			if row["ports"] == nil && m["port"] != nil {
+				row["ports"] = m["port"]
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func manifestCommands() *group {
+	return &group{name: "manifest", summary: "Apply and export declarative manifests", commands: []*command{
+		{name: "apply", summary: "Make the workspace match a manifest; --prune deletes what it does not list", run: func(c *cli, args []string) error {
+			fs := c.flags("manifest apply")
+			file := fs.String("file", "localisprod.yaml", "manifest file, YAML or JSON")
+			dryRun := fs.Bool("dry-run", false, "only show the plan")
+			prune := fs.Bool("prune", false, "delete resources the manifest does not list")
+			if _, err := parse(fs, args, 0); err != nil {
+				return err
+			}
+			content, err := os.ReadFile(*file)
+			if err != nil {
+				return err
+			}
+			q := url.Values{}
+			if *dryRun {
+				q.Set("dry_run", "true")
+			}
+			if *prune {
+				q.Set("prune", "true")
+			}
+			path := "/apply"
+			if len(q) > 0 {
+				path += "?" + q.Encode()
+			}
+			var v map[string]any
+			if err := c.api.do(http.MethodPost, path, content, &v); err != nil {
+				return err
+			}
+			return c.plan(v)
+		}},
+		{name: "export", summary: "Write the workspace as a manifest or a docker-compose file", run: func(c *cli, args []string) error {
+			fs := c.flags("manifest export")
+			format := fs.String("format", "manifest", "manifest or compose")
+			mask := fs.Bool("mask-secrets", false, "leave passwords and secret env vars out")
+			file := fs.String("file", "", "write to this file instead of stdout")
+			if _, err := parse(fs, args, 0); err != nil {
+				return err
+			}
+			q := url.Values{"format": {*format}}
+			if *mask {
+				q.Set("mask_secrets", "true")
+			}
+			var data []byte
+			if err := c.api.do(http.MethodGet, "/export?"+q.Encode(), nil, &data); err != nil {
+				return err
+			}
+			if *file == "" {
+				_, err := c.stdout.Write(data)
+				return err
+			}
+			return os.WriteFile(*file, data, 0o600)
+		}},
+	}}
+}
+
+// plan prints a manifest plan, or the result of applying one, and returns
+// its errors.
+func (c *cli) plan(v map[string]any) error {
+	if c.out.format == formatJSON {
+		if err := c.out.json(v); err != nil {
+			return err
+		}
+	} else {
+		if err := c.out.list(v["changes"], cols("action", "kind", "name", "fields", "status", "error")); err != nil {
+			return err
+		}
+		errs, _ := v["errors"].([]any)
+		for _, e := range errs {
+			fmt.Fprintf(c.stdout, "error: %v\n", e)
+		}
+	}
+	if errs, _ := v["errors"].([]any); len(errs) > 0 {
+		return fmt.Errorf("the plan has %d error(s)", len(errs))
+	}
+	return failure(v)
+}
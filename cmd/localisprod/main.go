@@ -0,0 +1,164 @@
+// Command localisprod is a command-line client for the control plane API.
+// It authenticates with an API token and prints results as tables or JSON:
+//
+//	export LOCALISPROD_URL=https://cluster.example.com
+//	export LOCALISPROD_TOKEN=lp_...
+//	localisprod nodes list
+//	localisprod services deploy web --node worker-1
+//	localisprod -o json deployments list
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// cli holds the state shared by all commands.
+type cli struct {
+	api    *client
+	out    *printer
+	stdout io.Writer
+}
+
+// command is one subcommand of a group, e.g. "nodes list".
+type command struct {
+	name    string
+	args    string // positional arguments, for usage
+	summary string
+	run     func(c *cli, args []string) error
+}
+
+// group is a top-level command such as "nodes".
+type group struct {
+	name     string
+	summary  string
+	commands []*command
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "localisprod:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run parses args and runs the command they name.
+func run(args []string, stdout, stderr io.Writer) error {
+	groups := commandGroups()
+
+	fs := flag.NewFlagSet("localisprod", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", envOr("LOCALISPROD_URL", "http://localhost:8080"), "control plane URL (LOCALISPROD_URL)")
+	token := fs.String("token", os.Getenv("LOCALISPROD_TOKEN"), "API token (LOCALISPROD_TOKEN)")
+	org := fs.String("org", os.Getenv("LOCALISPROD_ORG"), "organization ID to act in, default personal (LOCALISPROD_ORG)")
+	format := fs.String("o", formatTable, "output format: table or json")
+	fs.Usage = func() { usage(stderr, fs, groups) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	rest := fs.Args()
+	if len(rest) == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	var g *group
+	for _, candidate := range groups {
+		if candidate.name == rest[0] {
+			g = candidate
+		}
+	}
+	if g == nil {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", rest[0])
+	}
+	if len(rest) < 2 {
+		groupUsage(stderr, g)
+		return flag.ErrHelp
+	}
+	var cmd *command
+	for _, candidate := range g.commands {
+		if candidate.name == rest[1] {
+			cmd = candidate
+		}
+	}
+	if cmd == nil {
+		groupUsage(stderr, g)
+		return fmt.Errorf("unknown command %q", g.name+" "+rest[1])
+	}
+
+	if *format != formatTable && *format != formatJSON {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if *token == "" {
+		return errors.New("no API token: set LOCALISPROD_TOKEN or pass -token (create one with POST /api/tokens)")
+	}
+	c := &cli{
+		api:    newClient(*server, *token, *org),
+		out:    &printer{w: stdout, format: *format},
+		stdout: stdout,
+	}
+	return cmd.run(c, rest[2:])
+}
+
+// flags returns the flag set of a command. Every command also takes -o.
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.out.format, "o", c.out.format, "output format: table or json")
+	return fs
+}
+
+// parse parses args with fs, allowing flags after positional arguments as in
+// "services deploy web --node n1", and checks the number of positional
+// arguments.
+func parse(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+	if len(pos) != want {
+		return nil, fmt.Errorf("%s: expected %d argument(s), got %d", fs.Name(), want, len(pos))
+	}
+	if f := fs.Lookup("o"); f != nil && f.Value.String() != formatTable && f.Value.String() != formatJSON {
+		return nil, fmt.Errorf("unknown output format %q", f.Value.String())
+	}
+	return pos, nil
+}
+
+func usage(w io.Writer, fs *flag.FlagSet, groups []*group) {
+	fmt.Fprintln(w, "Usage: localisprod [flags] <command> <subcommand> [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, g := range groups {
+		fmt.Fprintf(w, "  %-16s %s\n", g.name, g.summary)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	fs.PrintDefaults()
+}
+
+func groupUsage(w io.Writer, g *group) {
+	fmt.Fprintf(w, "Usage: localisprod %s <subcommand>\n\nSubcommands:\n", g.name)
+	for _, cmd := range g.commands {
+		fmt.Fprintf(w, "  %-40s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeAPI serves canned responses and records the requests it receives.
+type fakeAPI struct {
+	t        *testing.T
+	requests []string
+	bodies   map[string]map[string]any
+}
+
+func newFakeAPI(t *testing.T) (*fakeAPI, *httptest.Server) {
+	f := &fakeAPI{t: t, bodies: map[string]map[string]any{}}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, key)
+	if r.Header.Get("Authorization") != "Bearer lp_test" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"invalid token"}`))
+		return
+	}
+	if r.Body != nil {
+		var body map[string]any
+		if json.NewDecoder(r.Body).Decode(&body) == nil {
+			f.bodies[key] = body
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch key {
+	case "GET /api/nodes":
+		_, _ = w.Write([]byte(`[{"id":"n1","name":"worker-1","host":"10.0.0.1","port":22,"username":"root","status":"online"}]`))
+	case "GET /api/services":
+		_, _ = w.Write([]byte(`[{"id":"s1","name":"web"}]`))
+	case "GET /api/services/s1":
+		_, _ = w.Write([]byte(`{"id":"s1","name":"web","docker_image":"nginx:1","env_vars":"{\"A\":\"1\",\"B\":\"2\"}","ports":"[\"80:80\"]","volumes":"[]","routes":"[]","databases":"[]","caches":"[]","kafkas":"[]","monitorings":"[]"}`))
+	case "PUT /api/services/s1":
+		_, _ = w.Write([]byte(`{"id":"s1","name":"web"}`))
+	case "POST /api/deployments":
+		_, _ = w.Write([]byte(`{"id":"d1","status":"running"}`))
+	case "POST /api/nodes/n1/ping":
+		_, _ = w.Write([]byte(`{"status":"error","message":"ssh: handshake failed"}`))
+	case "GET /api/databases":
+		_, _ = w.Write([]byte(`[{"id":"db1","name":"main"}]`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"not found"}`))
+	}
+}
+
+func runCLI(t *testing.T, srv *httptest.Server, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	err := run(append([]string{"-server", srv.URL, "-token", "lp_test"}, args...), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestNodesList_Table(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	out, err := runCLI(t, srv, "nodes", "list")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "worker-1") {
+		t.Errorf("unexpected table:\n%s", out)
+	}
+}
+
+func TestNodesList_JSON(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	out, err := runCLI(t, srv, "nodes", "list", "-o", "json")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var nodes []map[string]any
+	if err := json.Unmarshal([]byte(out), &nodes); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	if len(nodes) != 1 || nodes[0]["name"] != "worker-1" {
+		t.Errorf("unexpected nodes: %v", nodes)
+	}
+}
+
+func TestOrgHeader(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Org-ID")
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"-server", srv.URL, "-token", "lp_test", "-org", "org-1", "nodes", "list"}, &stdout, &stderr); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got != "org-1" {
+		t.Errorf("X-Org-ID = %q, want org-1", got)
+	}
+}
+
+func TestAPIErrorIsReturned(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	var stdout, stderr bytes.Buffer
+	err := run([]string{"-server", srv.URL, "-token", "lp_wrong", "nodes", "list"}, &stdout, &stderr)
+	if err == nil || !strings.Contains(err.Error(), "invalid token") || !strings.Contains(err.Error(), "401") {
+		t.Errorf("err = %v, want the API error", err)
+	}
+}
+
+func TestFailedActionIsReturned(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	_, err := runCLI(t, srv, "nodes", "ping", "worker-1")
+	if err == nil || !strings.Contains(err.Error(), "handshake failed") {
+		t.Errorf("err = %v, want the ping failure", err)
+	}
+}
+
+func TestServicesDeploy_ResolvesNames(t *testing.T) {
+	f, srv := newFakeAPI(t)
+	if _, err := runCLI(t, srv, "services", "deploy", "web", "--node", "worker-1"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	body := f.bodies["POST /api/deployments"]
+	if body["service_id"] != "s1" || body["node_id"] != "n1" {
+		t.Errorf("deploy body = %v, want service s1 on node n1", body)
+	}
+}
+
+func TestServicesUpdate_KeepsUnsetFields(t *testing.T) {
+	f, srv := newFakeAPI(t)
+	_, err := runCLI(t, srv, "services", "update", "web", "--env", "B=3", "--unset-env", "A", "--database", "main")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	body := f.bodies["PUT /api/services/s1"]
+	if body["docker_image"] != "nginx:1" || body["name"] != "web" {
+		t.Errorf("update dropped unchanged fields: %v", body)
+	}
+	env, _ := body["env_vars"].(map[string]any)
+	if len(env) != 1 || env["B"] != "3" {
+		t.Errorf("env_vars = %v, want only B=3", env)
+	}
+	if ports, _ := body["ports"].([]any); len(ports) != 1 || ports[0] != "80:80" {
+		t.Errorf("ports = %v, want the existing mapping", body["ports"])
+	}
+	if dbs, _ := body["databases"].([]any); len(dbs) != 1 || dbs[0] != "db1" {
+		t.Errorf("databases = %v, want [db1]", body["databases"])
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	_, srv := newFakeAPI(t)
+	if _, err := runCLI(t, srv, "nodes", "explode"); err == nil {
+		t.Error("expected an error for an unknown subcommand")
+	}
+}
+
+func TestManifestApply_SendsFileAsIs(t *testing.T) {
+	var body, query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, query = string(b), r.URL.RawQuery
+		_, _ = w.Write([]byte(`{"changes":[{"action":"create","kind":"service","name":"web"}],"errors":["node \"x\" does not exist"]}`))
+	}))
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "localisprod.yaml")
+	if err := os.WriteFile(file, []byte("services:\n  - name: web\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCLI(t, srv, "manifest", "apply", "--file", file, "--dry-run")
+	if err == nil || !strings.Contains(err.Error(), "1 error") {
+		t.Errorf("err = %v, want the plan errors reported", err)
+	}
+	if body != "services:\n  - name: web\n" || query != "dry_run=true" {
+		t.Errorf("sent body %q with query %q", body, query)
+	}
+	if !strings.Contains(out, "create") || !strings.Contains(out, `error: node "x" does not exist`) {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestManifestExport_WritesFile(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		_, _ = w.Write([]byte("services:\n  web:\n    image: nginx\n"))
+	}))
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "docker-compose.yml")
+
+	if _, err := runCLI(t, srv, "manifest", "export", "--format", "compose", "--mask-secrets", "--file", file); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if query != "format=compose&mask_secrets=true" {
+		t.Errorf("query = %q", query)
+	}
+	if got, _ := os.ReadFile(file); string(got) != "services:\n  web:\n    image: nginx\n" {
+		t.Errorf("file = %q", got)
+	}
+}
+
+func TestComposeImport_AppliesPreviewOnNode(t *testing.T) {
+	var applied map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/nodes":
+			_, _ = w.Write([]byte(`[{"id":"n1","name":"worker-1"}]`))
+		case "/api/import/docker-compose":
+			_, _ = w.Write([]byte(`{"services":[{"name":"web","docker_image":"nginx"}]}`))
+		case "/api/import/docker-compose/apply":
+			_ = json.NewDecoder(r.Body).Decode(&applied)
+			_, _ = w.Write([]byte(`{"changes":[{"action":"create","kind":"service","name":"web","status":"applied"}]}`))
+		}
+	}))
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "docker-compose.yml")
+	if err := os.WriteFile(file, []byte("services:\n  web:\n    image: nginx\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCLI(t, srv, "compose", "import", "--file", file, "--node", "worker-1", "--deploy")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if applied["node_id"] != "n1" || applied["deploy"] != true || applied["preview"] == nil {
+		t.Errorf("apply body = %v", applied)
+	}
+	if !strings.Contains(out, "applied") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
+
+func TestComposeImport_SendsOverridesAndReferencedFiles(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_, _ = w.Write([]byte(`{"services":[],"warnings":["service web: stop_signal is not supported; ignored"]}`))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"docker-compose.yml":          "services:\n  web:\n    image: nginx:${TAG}\n    env_file: web.env\n",
+		"docker-compose.override.yml": "services:\n  web:\n    ports: ['80:80']\n",
+		"web.env":                     "MODE=prod\n",
+		".env":                        "TAG=1.27\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := runCLI(t, srv, "compose", "import", "--file", filepath.Join(dir, "docker-compose.yml"),
+		"--file", filepath.Join(dir, "docker-compose.override.yml"), "--env", "TAG=1.28", "--profile", "debug")
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	files, _ := got["files"].(map[string]any)
+	overrides, _ := got["overrides"].([]any)
+	env, _ := got["env"].(map[string]any)
+	if files["web.env"] != "MODE=prod\n" || len(overrides) != 1 || got["dotenv"] != "TAG=1.27\n" || env["TAG"] != "1.28" {
+		t.Errorf("request = %v", got)
+	}
+	if !strings.Contains(out, "warning: service web: stop_signal") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats.
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// column is a column of a table: its header and the field it shows.
+type column struct {
+	header string
+	field  string
+}
+
+func cols(spec ...string) []column {
+	out := make([]column, 0, len(spec))
+	for _, f := range spec {
+		out = append(out, column{header: strings.ToUpper(strings.ReplaceAll(f, "_", " ")), field: f})
+	}
+	return out
+}
+
+// printer writes API responses as tables or JSON.
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+// json writes v as indented JSON.
+func (p *printer) json(v any) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// list writes a list of objects, one row each with the given columns.
+func (p *printer) list(v any, columns []column) error {
+	if p.format == formatJSON {
+		return p.json(v)
+	}
+	items, _ := v.([]any)
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	headers := make([]string, len(columns))
+	for i, c := range columns {
+		headers[i] = c.header
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, it := range items {
+		m, _ := it.(map[string]any)
+		row := make([]string, len(columns))
+		for i, c := range columns {
+			row[i] = cell(m[c.field])
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// object writes one object as field/value rows, sorted by field.
+func (p *printer) object(v any) error {
+	if p.format == formatJSON {
+		return p.json(v)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return p.json(v)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s\t%s\n", k, cell(m[k]))
+	}
+	return tw.Flush()
+}
+
+// cell formats a JSON value for a table cell. Strings holding JSON arrays or
+// objects, as the API returns for ports or env vars, are shown compacted.
+func cell(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		if s := strings.TrimSpace(x); strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{") {
+			var j any
+			if json.Unmarshal([]byte(s), &j) == nil {
+				b, _ := json.Marshal(j)
+				return string(b)
+			}
+		}
+		return strings.ReplaceAll(x, "\n", " ")
+	case float64:
+		return fmt.Sprint(x)
+	case bool:
+		return fmt.Sprint(x)
+	default:
+		b, _ := json.Marshal(x)
+		return string(b)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/gsarma/localisprod-v2/internal/auth"
 	"github.com/gsarma/localisprod-v2/internal/poller"
 	"github.com/gsarma/localisprod-v2/internal/secret"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
 )
 
@@ -58,6 +59,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to open store: %v", err)
 	}
+	// Pin each node's SSH host key on first contact, and dial nodes behind a
+	// bastion through their jump hosts.
+	sshexec.SetHostKeyStore(s)
+	sshexec.SetProxyResolver(s)
 
 	rootEmail := os.Getenv("ROOT_EMAIL")
 	if rootEmail == "" {
@@ -67,6 +72,13 @@ func main() {
 	if err := s.EnsureManagementNode(); err != nil {
 		log.Fatalf("failed to ensure management node: %v", err)
 	}
+	// A drain runs inside its request; one cut short by a restart leaves its
+	// node draining, which nothing else clears.
+	if n, err := s.ResetDrainingNodes(); err != nil {
+		log.Fatalf("failed to reset draining nodes: %v", err)
+	} else if n > 0 {
+		log.Printf("cordoned %d node(s) left draining by an interrupted drain", n)
+	}
 
 	pollInterval := 5 * time.Minute
 	if v := os.Getenv("POLL_INTERVAL"); v != "" {
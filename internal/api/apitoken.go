@@ -0,0 +1,50 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/audit"
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// apiTokenAuth resolves bearer API tokens to the claims of their user,
+// recording when and from where each was last used. Unknown and expired
+// tokens resolve to nil claims.
+func apiTokenAuth(s *store.Store, rootEmail string) auth.APITokenFunc {
+	return func(r *http.Request, token string) (*auth.Claims, error) {
+		if !auth.IsAPIToken(token) {
+			return nil, nil
+		}
+		t, err := s.GetAPITokenByHash(auth.HashAPIToken(token))
+		if err != nil {
+			return nil, fmt.Errorf("look up token: %w", err)
+		}
+		now := time.Now()
+		if t == nil || t.Expired(now) {
+			return nil, nil
+		}
+		user, err := s.GetUserByID(t.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("look up user of token %s: %w", t.ID, err)
+		}
+		if user == nil {
+			return nil, nil
+		}
+		if err := s.TouchAPIToken(t.ID, now, audit.ClientIP(r)); err != nil {
+			log.Printf("api token %s: record use: %v", t.ID, err)
+		}
+		return &auth.Claims{
+			UserID:    user.ID,
+			Email:     user.Email,
+			Name:      user.Name,
+			AvatarURL: user.AvatarURL,
+			IsRoot:    rootEmail != "" && user.Email == rootEmail,
+			Scope:     t.Scope,
+			TokenName: t.Name,
+		}, nil
+	}
+}
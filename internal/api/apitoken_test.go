@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+func TestAPITokenAuth(t *testing.T) {
+	s, err := store.New(":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := s.UpsertUser("sub-ci", "ci@example.com", "CI", "")
+	issue := func(scope string, expires *time.Time) string {
+		secret, prefix, hash, err := auth.GenerateAPIToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tok := &models.APIToken{ID: prefix, Name: "ci-" + scope, Prefix: prefix, Scope: scope, ExpiresAt: expires, UserID: user.ID, CreatedAt: time.Now().UTC()}
+		if err := s.CreateAPIToken(tok, hash); err != nil {
+			t.Fatal(err)
+		}
+		return secret
+	}
+	past := time.Now().Add(-time.Hour)
+	deploy, expired := issue(models.ScopeDeploy, nil), issue(models.ScopeRead, &past)
+
+	var got *auth.Workspace
+	var claims *auth.Claims
+	h := auth.NewJWTService("secret").MiddlewareWithTokens(apiTokenAuth(s, "ci@example.com"),
+		workspaceMiddleware(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, claims = auth.WorkspaceFromContext(r.Context()), auth.ClaimsFromContext(r.Context())
+		})))
+	do := func(token string) int {
+		got, claims = nil, nil
+		r := httptest.NewRequest(http.MethodGet, "/api/nodes", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := do(deploy); code != http.StatusOK {
+		t.Fatalf("valid token: %d", code)
+	}
+	if claims.UserID != user.ID || claims.Scope != models.ScopeDeploy || !claims.IsRoot {
+		t.Errorf("claims = %+v", claims)
+	}
+	// The personal organization's owner role is capped by the scope.
+	if got.OrgID != user.ID || got.Role != models.RoleDeployer {
+		t.Errorf("workspace = %+v", got)
+	}
+	tokens, _ := s.ListAPITokens(user.ID)
+	for _, tok := range tokens {
+		if tok.Scope == models.ScopeDeploy && (tok.LastUsedAt == nil || tok.LastUsedIP == "") {
+			t.Errorf("use not recorded: %+v", tok)
+		}
+	}
+
+	for name, token := range map[string]string{"expired": expired, "unknown": "lp_nope-nope-nope", "garbage": "x"} {
+		if code := do(token); code != http.StatusUnauthorized {
+			t.Errorf("%s token: expected 401, got %d", name, code)
+		}
+	}
+}
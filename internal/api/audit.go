@@ -0,0 +1,203 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/audit"
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// auditCollections are the API paths whose next segment is a resource ID,
+// with the resource type recorded for them.
+var auditCollections = map[string]string{
+	"nodes":           "node",
+	"services":        "service",
+	"deployments":     "deployment",
+	"databases":       "database",
+	"caches":          "cache",
+	"kafkas":          "kafka",
+	"monitorings":     "monitoring",
+	"object-storages": "object_storage",
+	"canaries":        "canary",
+	"certificates":    "certificate",
+	"firewall/rules":  "firewall_rule",
+	"jump-hosts":      "jump_host",
+	"orgs":            "organization",
+	"tokens":          "api_token",
+}
+
+// auditCaptureLimit caps how much of a response body is kept for the summary.
+const auditCaptureLimit = 64 << 10
+
+// auditTarget derives the resource and action of a mutating request, e.g.
+// DELETE /api/databases/abc is ("database", "abc", "database.delete") and
+// POST /api/nodes/abc/drain is ("node", "abc", "node.drain"). resourcePath is
+// the path the resource is read from, or "" when it has none.
+func auditTarget(method, path string) (resourceType, resourceID, action, resourcePath string) {
+	segs := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/"), "/"), "/")
+	var sub []string
+	coll := ""
+	if len(segs) >= 2 && auditCollections[segs[0]+"/"+segs[1]] != "" {
+		coll = segs[0] + "/" + segs[1]
+		segs = segs[2:]
+	} else if auditCollections[segs[0]] != "" {
+		coll = segs[0]
+		segs = segs[1:]
+	}
+	if coll != "" {
+		resourceType = auditCollections[coll]
+		if len(segs) > 0 {
+			resourceID, sub = segs[0], segs[1:]
+			resourcePath = "/api/" + coll + "/" + resourceID
+		}
+	} else {
+		resourceType = strings.ReplaceAll(segs[0], "-", "_")
+		sub = segs[1:]
+	}
+
+	verb := map[string]string{http.MethodPost: "create", http.MethodPut: "update", http.MethodPatch: "update", http.MethodDelete: "delete"}[method]
+	if len(sub) > 0 && sub[0] == "members" {
+		// The member's user ID is not part of the action.
+		verb = "member." + map[string]string{http.MethodPost: "add", http.MethodPut: "update", http.MethodDelete: "remove"}[method]
+	} else if len(sub) > 0 {
+		verb = strings.Join(sub, ".")
+		if method != http.MethodPost {
+			verb += "." + map[string]string{http.MethodPut: "update", http.MethodPatch: "update", http.MethodDelete: "delete"}[method]
+		}
+	} else if method == http.MethodPost && resourceID != "" {
+		verb = "update"
+	}
+	return resourceType, resourceID, resourceType + "." + verb, resourcePath
+}
+
+// auditMiddleware records every mutating request to next in the audit log of
+// the organization it acts in: the resource as it was before (read through
+// next), the response as the after state, the source IP and whether it
+// succeeded.
+func auditMiddleware(s *store.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := auth.ClaimsFromContext(r.Context())
+		// Dry runs change nothing.
+		if claims == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || r.URL.Query().Get("dry_run") == "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		resourceType, resourceID, action, resourcePath := auditTarget(r.Method, r.URL.Path)
+		before := ""
+		if resourcePath != "" {
+			before = auditSnapshot(next, r, resourcePath)
+		}
+
+		var reqBody []byte
+		if r.Body != nil {
+			reqBody, _ = io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(reqBody))
+		}
+		rec := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		e := &models.AuditEvent{
+			ActorType:    models.AuditActorUser,
+			ActorID:      claims.UserID,
+			ActorName:    claims.Email,
+			Action:       action,
+			ResourceType: resourceType,
+			ResourceID:   resourceID,
+			Before:       before,
+			SourceIP:     audit.ClientIP(r),
+			UserID:       claims.UserID,
+		}
+		if claims.TokenName != "" {
+			e.ActorName += " (token " + claims.TokenName + ")"
+		}
+		if ws := auth.WorkspaceFromContext(r.Context()); ws != nil {
+			e.UserID = ws.OrgID
+		}
+		if resourceType == "organization" && resourceID != "" {
+			// Membership changes go to the log of the organization changed.
+			e.UserID = resourceID
+		}
+		var resp struct {
+			ID    string `json:"id"`
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(rec.body.Bytes(), &resp)
+		switch {
+		case rec.status >= 400:
+			e.Result = models.AuditResultFailure
+			e.Error = resp.Error
+			if e.Error == "" {
+				e.Error = http.StatusText(rec.status)
+			}
+		case resp.Error != "":
+			// SSH failures are reported as 200 with an error field.
+			e.Result = models.AuditResultFailure
+			e.Error = resp.Error
+		default:
+			e.Result = models.AuditResultSuccess
+			if r.Method != http.MethodDelete {
+				// Import requests carry whole compose and dotenv files, with
+				// secrets under keys that cannot be told apart, so they are
+				// never recorded.
+				if e.After = audit.Summary(rec.body.Bytes()); e.After == "" && !strings.HasPrefix(r.URL.Path, "/api/import/") {
+					e.After = audit.Summary(reqBody)
+				}
+			}
+			if e.ResourceID == "" && resp.ID != "" {
+				e.ResourceID = resp.ID
+				if resourceType == "organization" {
+					e.UserID = resp.ID
+				}
+			}
+		}
+		audit.Record(s, e)
+	})
+}
+
+// auditSnapshot reads the resource at path through next as the user of r and
+// returns its summary, or "" when it cannot be read.
+func auditSnapshot(next http.Handler, r *http.Request, path string) string {
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	get.URL.Path = path
+	get.URL.RawQuery = ""
+	get.Body = http.NoBody
+	get.ContentLength = 0
+	rec := httptest.NewRecorder()
+	next.ServeHTTP(rec, get)
+	if rec.Code != http.StatusOK {
+		return ""
+	}
+	return audit.Summary(rec.Body.Bytes())
+}
+
+// auditRecorder passes the response through while keeping its status and the
+// start of its body.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(p []byte) (int, error) {
+	if room := auditCaptureLimit - a.body.Len(); room > 0 {
+		a.body.Write(p[:min(len(p), room)])
+	}
+	return a.ResponseWriter.Write(p)
+}
+
+func (a *auditRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+func TestAuditTarget(t *testing.T) {
+	for _, tc := range []struct {
+		method, path                  string
+		typ, id, action, resourcePath string
+	}{
+		{"POST", "/api/databases", "database", "", "database.create", ""},
+		{"DELETE", "/api/databases/db1", "database", "db1", "database.delete", "/api/databases/db1"},
+		{"PUT", "/api/services/s1", "service", "s1", "service.update", "/api/services/s1"},
+		{"POST", "/api/nodes/n1/drain", "node", "n1", "node.drain", "/api/nodes/n1"},
+		{"DELETE", "/api/nodes/n1/cordon", "node", "n1", "node.cordon.delete", "/api/nodes/n1"},
+		{"PUT", "/api/nodes/n1/host-key", "node", "n1", "node.host-key.update", "/api/nodes/n1"},
+		{"DELETE", "/api/firewall/rules/r1", "firewall_rule", "r1", "firewall_rule.delete", "/api/firewall/rules/r1"},
+		{"POST", "/api/providers/do/provision", "providers", "", "providers.do.provision", ""},
+		{"PUT", "/api/settings", "settings", "", "settings.update", ""},
+		{"POST", "/api/orgs/o1/members", "organization", "o1", "organization.member.add", "/api/orgs/o1"},
+		{"DELETE", "/api/orgs/o1/members/u1", "organization", "o1", "organization.member.remove", "/api/orgs/o1"},
+	} {
+		typ, id, action, path := auditTarget(tc.method, tc.path)
+		if typ != tc.typ || id != tc.id || action != tc.action || path != tc.resourcePath {
+			t.Errorf("auditTarget(%s %s) = %q %q %q %q", tc.method, tc.path, typ, id, action, path)
+		}
+	}
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	s, err := store.New(":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/databases/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`{"id":"db1","name":"main","password":"hunter2"}`))
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPut:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"bad version"}`))
+		}
+	})
+	mux.HandleFunc("/api/databases", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"db2","name":"new","password":"s3cret"}`))
+	})
+	mux.HandleFunc("/api/import/docker-compose/apply", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h := auditMiddleware(s, mux)
+	do := func(method, path, body string) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.RemoteAddr = "203.0.113.7:5555"
+		r = r.WithContext(auth.InjectClaims(r.Context(), &auth.Claims{UserID: "u1", Email: "u1@example.com"}))
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	do(http.MethodGet, "/api/databases/db1", "")
+	do(http.MethodPost, "/api/databases", `{"name":"new","password":"s3cret"}`)
+	do(http.MethodDelete, "/api/databases/db1", "")
+	do(http.MethodPut, "/api/databases/db1", `{"version":"x"}`)
+	do(http.MethodPost, "/api/import/docker-compose/apply", `{"content":"DB_PASS=hunter2","dotenv":"KEY=s3cret"}`)
+
+	evts, err := s.ListAuditEvents("u1", models.AuditFilter{})
+	if err != nil || len(evts) != 4 {
+		t.Fatalf("expected 4 audit events (GET not recorded), got %d: %v", len(evts), err)
+	}
+	byAction := map[string]*models.AuditEvent{}
+	for _, e := range evts {
+		byAction[e.Action] = e
+		if strings.Contains(e.Before+e.After, "hunter2") || strings.Contains(e.Before+e.After, "s3cret") {
+			t.Errorf("secret leaked into %s: %s / %s", e.Action, e.Before, e.After)
+		}
+		if e.SourceIP != "203.0.113.7" || e.ActorID != "u1" || e.ActorType != models.AuditActorUser {
+			t.Errorf("unexpected actor on %s: %+v", e.Action, e)
+		}
+	}
+	if e := byAction["database.create"]; e == nil || e.ResourceID != "db2" || e.Result != models.AuditResultSuccess || !strings.Contains(e.After, `"name":"new"`) {
+		t.Errorf("unexpected create event %+v", e)
+	}
+	if e := byAction["database.delete"]; e == nil || !strings.Contains(e.Before, `"name":"main"`) || e.After != "" {
+		t.Errorf("unexpected delete event %+v", e)
+	}
+	if e := byAction["import.docker-compose.apply"]; e == nil || e.After != "" {
+		t.Errorf("unexpected import event %+v", e)
+	}
+	if e := byAction["database.update"]; e == nil || e.Result != models.AuditResultFailure || e.Error != "bad version" {
+		t.Errorf("unexpected failed update event %+v", e)
+	}
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/compose"
+	"github.com/gsarma/localisprod-v2/internal/manifest"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// ApplyHandler applies declarative manifests. Each change of a plan is sent
+// as an API request through api, the handler chain user requests take, so it
+// is validated, checked against the caller's role and audited exactly as if
+// it had been made by hand.
+type ApplyHandler struct {
+	store *store.Store
+	api   http.Handler
+}
+
+func NewApplyHandler(s *store.Store, api http.Handler) *ApplyHandler {
+	return &ApplyHandler{store: s, api: api}
+}
+
+// applyResult is a plan with the reason it was not, or not fully, applied.
+type applyResult struct {
+	*manifest.Plan
+	Error string `json:"error,omitempty"`
+	// Undo is what a failed compose import removed again.
+	Undo *manifest.Plan `json:"undo,omitempty"`
+}
+
+// Apply takes a YAML or JSON manifest and returns the plan that makes the
+// workspace match it. With dry_run=true the plan is only returned; otherwise
+// it is applied and each change carries its status; a failed change stops the
+// apply without undoing the ones before it. Resources the manifest does not
+// list are only deleted with prune=true; without it their deletes are planned
+// as skipped.
+// POST /api/apply
+func (h *ApplyHandler) Apply(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	prune := r.URL.Query().Get("prune") == "true"
+	role := models.RoleAdmin
+	if dryRun {
+		role = models.RoleViewer
+	}
+	userID := requireRole(w, r, role)
+	if userID == "" {
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	m, err := manifest.Parse(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	st, err := workspaceState(h.store, r, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	plan := manifest.Diff(m, st)
+	if !prune {
+		plan.SkipDeletes()
+	}
+	if dryRun {
+		writeJSON(w, http.StatusOK, applyResult{Plan: plan})
+		return
+	}
+	if len(plan.Errors) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, applyResult{Plan: plan, Error: "nothing was applied: " + strings.Join(plan.Errors, "; ")})
+		return
+	}
+	if err := manifest.Apply(m, st, plan, h.caller(r)); err != nil {
+		// Earlier changes stay applied; the statuses say which.
+		writeJSON(w, http.StatusOK, applyResult{Plan: plan, Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, applyResult{Plan: plan})
+}
+
+// workspaceState loads what the workspace holds. Root also places resources
+// on the management node, as in the node list.
+func workspaceState(s *store.Store, r *http.Request, userID string) (*manifest.State, error) {
+	st := &manifest.State{}
+	var err error
+	if st.Nodes, err = s.ListNodes(userID); err != nil {
+		return nil, err
+	}
+	if isRoot(r) {
+		if mgmt, err := s.GetManagementNode(); err == nil && mgmt != nil {
+			st.Nodes = append([]*models.Node{mgmt}, st.Nodes...)
+		}
+	}
+	if st.Services, err = s.ListServices(userID); err != nil {
+		return nil, err
+	}
+	if st.Deployments, err = s.ListDeployments(userID); err != nil {
+		return nil, err
+	}
+	if st.Databases, err = s.ListDatabases(userID); err != nil {
+		return nil, err
+	}
+	if st.Caches, err = s.ListCaches(userID); err != nil {
+		return nil, err
+	}
+	if st.Kafkas, err = s.ListKafkas(userID); err != nil {
+		return nil, err
+	}
+	if st.Monitorings, err = s.ListMonitorings(userID); err != nil {
+		return nil, err
+	}
+	if st.ObjectStorages, err = s.ListObjectStorages(userID); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// caller sends plan changes through the API as the user of r.
+func (h *ApplyHandler) caller(r *http.Request) manifest.Caller {
+	return func(method, path string, body any) (map[string]any, error) {
+		var reader io.Reader = http.NoBody
+		if body != nil {
+			b, err := json.Marshal(body)
+			if err != nil {
+				return nil, err
+			}
+			reader = bytes.NewReader(b)
+		}
+		req, err := http.NewRequestWithContext(r.Context(), method, "/api"+path, reader)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = r.Header.Clone()
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = r.RemoteAddr
+		rec := httptest.NewRecorder()
+		h.api.ServeHTTP(rec, req)
+
+		var resp map[string]any
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		msg, _ := resp["error"].(string)
+		if status, _ := resp["status"].(string); msg == "" && status == "error" {
+			if msg, _ = resp["message"].(string); msg == "" {
+				msg = "request failed"
+			}
+		}
+		switch {
+		case rec.Code >= 400 && msg == "":
+			return nil, errors.New(http.StatusText(rec.Code))
+		case msg != "":
+			return nil, errors.New(msg)
+		}
+		return resp, nil
+	}
+}
+
+// ImportCompose creates what a docker-compose preview describes on one node:
+// the databases, caches, Kafka clusters and object storages first, then the
+// services, linked to the resources they depend on and with env vars that
+// pointed at compose hostnames rewritten to the new containers, and, with
+// deploy, their deployments. Names already in use are refused, so nothing
+// existing is changed. Unlike Apply, an import is all or nothing: when a
+// change fails, what the import created is deleted again, so it can be
+// retried without its names being refused. With dry_run=true only the plan is
+// returned.
+// POST /api/import/docker-compose/apply
+func (h *ApplyHandler) ImportCompose(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	role := models.RoleAdmin
+	if dryRun {
+		role = models.RoleViewer
+	}
+	userID := requireRole(w, r, role)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		Preview compose.Preview `json:"preview"`
+		NodeID  string          `json:"node_id"`
+		Deploy  bool            `json:"deploy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.NodeID == "" {
+		writeError(w, http.StatusBadRequest, "node_id is required")
+		return
+	}
+	st, err := workspaceState(h.store, r, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	var node *models.Node
+	for _, n := range st.Nodes {
+		if n.ID == body.NodeID {
+			node = n
+		}
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	m, err := body.Preview.Manifest(node.Name, body.Deploy)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if conflicts := compose.Conflicts(m, st); len(conflicts) > 0 {
+		writeError(w, http.StatusConflict, strings.Join(conflicts, "; "))
+		return
+	}
+
+	// Against a workspace of only its nodes the plan is all creates.
+	plan := manifest.Diff(m, &manifest.State{Nodes: st.Nodes})
+	if dryRun {
+		writeJSON(w, http.StatusOK, applyResult{Plan: plan})
+		return
+	}
+	if len(plan.Errors) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, applyResult{Plan: plan, Error: "nothing was applied: " + strings.Join(plan.Errors, "; ")})
+		return
+	}
+
+	// Managed resources come first in the plan. Services are created once the
+	// resources exist, so their env vars can name the new containers.
+	split := 0
+	for split < len(plan.Changes) && plan.Changes[split].Kind != manifest.KindService && plan.Changes[split].Kind != manifest.KindDeployment {
+		split++
+	}
+	resources, services := &manifest.Plan{Changes: plan.Changes[:split]}, &manifest.Plan{Changes: plan.Changes[split:]}
+	call := h.caller(r)
+	if err := manifest.Apply(m, st, resources, call); err != nil {
+		for _, c := range services.Changes {
+			c.Status = manifest.StatusSkipped
+		}
+		h.undoImport(w, r, userID, m, plan, err)
+		return
+	}
+	if st, err = workspaceState(h.store, r, userID); err != nil {
+		h.undoImport(w, r, userID, m, plan, err)
+		return
+	}
+	compose.RewriteEnv(m, compose.Endpoints(m, st))
+	if err := manifest.Apply(m, st, services, call); err != nil {
+		h.undoImport(w, r, userID, m, plan, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, applyResult{Plan: plan})
+}
+
+// undoImport deletes what the failed import of m created, including
+// resources whose create failed after they were stored, and reports failed
+// together with the deletes.
+func (h *ApplyHandler) undoImport(w http.ResponseWriter, r *http.Request, userID string, m *manifest.Manifest, plan *manifest.Plan, failed error) {
+	msg := failed.Error()
+	st, err := workspaceState(h.store, r, userID)
+	if err != nil {
+		writeJSON(w, http.StatusOK, applyResult{Plan: plan, Error: msg + "; what the import created could not be listed for removal: " + err.Error()})
+		return
+	}
+	created := compose.Imported(m, st)
+	undo := manifest.Diff(&manifest.Manifest{}, created)
+	if err := manifest.Apply(&manifest.Manifest{}, created, undo, h.caller(r)); err != nil {
+		msg += "; removing what the import created failed: " + err.Error()
+	} else {
+		msg += "; what the import created was removed"
+	}
+	writeJSON(w, http.StatusOK, applyResult{Plan: plan, Error: msg, Undo: undo})
+}
@@ -0,0 +1,282 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/compose"
+	"github.com/gsarma/localisprod-v2/internal/manifest"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+const applyManifest = `
+services:
+  - name: api
+    docker_image: ghcr.io/acme/api:2
+    ports: ["8080:8080"]
+    env_vars: {LOG_LEVEL: info}
+`
+
+// newApplyHandler returns an apply handler whose changes reach the service
+// handler through a mux, as they reach the full API in the router.
+func newApplyHandler(s *store.Store) *handlers.ApplyHandler {
+	svcH := handlers.NewServiceHandler(s)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/services", svcH.Create)
+	mux.HandleFunc("/api/services/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/services/")
+		switch r.Method {
+		case http.MethodPut:
+			svcH.Update(w, r, id)
+		case http.MethodDelete:
+			svcH.Delete(w, r, id)
+		}
+	})
+	return handlers.NewApplyHandler(s, mux)
+}
+
+func applyRequest(path, body string) *http.Request {
+	return withUserID(httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+}
+
+type applyResponse struct {
+	Changes []manifest.Change `json:"changes"`
+	Errors  []string          `json:"errors"`
+	Error   string            `json:"error"`
+}
+
+func TestApply_DryRunChangesNothing(t *testing.T) {
+	s := newTestStore(t)
+	mustCreateApp(t, s)
+	h := newApplyHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Apply(rec, applyRequest("/api/apply?dry_run=true", applyManifest))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp applyResponse
+	decodeJSON(t, rec, &resp)
+	if len(resp.Changes) != 2 || resp.Changes[0].Action != "create" || resp.Changes[0].Name != "api" ||
+		resp.Changes[1].Action != "delete" || resp.Changes[1].Name != "test-app" {
+		t.Errorf("unexpected plan: %+v", resp.Changes)
+	}
+	if svcs, _ := s.ListServices(testUserID); len(svcs) != 1 || svcs[0].Name != "test-app" {
+		t.Errorf("dry run changed services: %+v", svcs)
+	}
+}
+
+func TestApply_CreatesAndDeletes(t *testing.T) {
+	s := newTestStore(t)
+	mustCreateApp(t, s)
+	h := newApplyHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Apply(rec, applyRequest("/api/apply?prune=true", applyManifest))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp applyResponse
+	decodeJSON(t, rec, &resp)
+	if resp.Error != "" {
+		t.Fatalf("apply failed: %s (%+v)", resp.Error, resp.Changes)
+	}
+	for _, c := range resp.Changes {
+		if c.Status != manifest.StatusApplied {
+			t.Errorf("%s %s: status %q", c.Action, c.Name, c.Status)
+		}
+	}
+	svcs, _ := s.ListServices(testUserID)
+	if len(svcs) != 1 || svcs[0].Name != "api" || svcs[0].EnvVars != `{"LOG_LEVEL":"info"}` {
+		t.Fatalf("services after apply: %+v", svcs)
+	}
+
+	// Applying the same manifest again plans nothing.
+	rec = httptest.NewRecorder()
+	h.Apply(rec, applyRequest("/api/apply?dry_run=true", applyManifest))
+	resp = applyResponse{}
+	decodeJSON(t, rec, &resp)
+	if len(resp.Changes) != 0 {
+		t.Errorf("second plan is not empty: %+v", resp.Changes)
+	}
+}
+
+func TestApply_PartialManifestWithoutPruneDeletesNothing(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s)
+	mustCreateDeployment(t, s, mustCreateApp(t, s).ID, n.ID)
+	db := &models.Database{ID: "db-1", Name: "main", Type: "postgres", NodeID: n.ID, ContainerName: "localisprod-db-main", Status: "running"}
+	if err := s.CreateDatabase(db, testUserID); err != nil {
+		t.Fatal(err)
+	}
+	h := newApplyHandler(s)
+
+	for _, path := range []string{"/api/apply?dry_run=true", "/api/apply"} {
+		rec := httptest.NewRecorder()
+		h.Apply(rec, applyRequest(path, applyManifest))
+		var resp applyResponse
+		decodeJSON(t, rec, &resp)
+		if resp.Error != "" {
+			t.Fatalf("%s: %s (%+v)", path, resp.Error, resp.Changes)
+		}
+		deletes := 0
+		for _, c := range resp.Changes {
+			if c.Action != manifest.ActionDelete {
+				continue
+			}
+			deletes++
+			if c.Status != manifest.StatusSkipped {
+				t.Errorf("%s: delete %s %s has status %q", path, c.Kind, c.Name, c.Status)
+			}
+		}
+		if deletes != 3 { // the deployment, its service and the database
+			t.Errorf("%s: expected the deletes in the plan, got %+v", path, resp.Changes)
+		}
+	}
+	if svcs, _ := s.ListServices(testUserID); len(svcs) != 2 {
+		t.Errorf("services after apply: %+v", svcs)
+	}
+	if deps, _ := s.ListDeployments(testUserID); len(deps) != 1 {
+		t.Errorf("deployments after apply: %+v", deps)
+	}
+	if got, _ := s.GetDatabase("db-1", testUserID); got == nil {
+		t.Error("database was deleted without prune")
+	}
+}
+
+func TestApply_RefusesPlanWithErrors(t *testing.T) {
+	s := newTestStore(t)
+	h := newApplyHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Apply(rec, applyRequest("/api/apply", "kafkas:\n  - name: events\n    node: missing\n"))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp applyResponse
+	decodeJSON(t, rec, &resp)
+	if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0], `node "missing" does not exist`) {
+		t.Errorf("errors = %v", resp.Errors)
+	}
+}
+
+func TestApply_InvalidManifest(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newApplyHandler(newTestStore(t)).Apply(rec, applyRequest("/api/apply", "services: [{name: web}]"))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestApply_ViewerMayOnlyPlan(t *testing.T) {
+	s := newTestStore(t)
+	h := newApplyHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Apply(rec, asMember(httptest.NewRequest(http.MethodPost, "/api/apply?dry_run=true", strings.NewReader(applyManifest)), models.RoleViewer))
+	if rec.Code != http.StatusOK {
+		t.Errorf("viewer dry run: expected 200, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.Apply(rec, asMember(httptest.NewRequest(http.MethodPost, "/api/apply", strings.NewReader(applyManifest)), models.RoleViewer))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("viewer apply: expected 403, got %d", rec.Code)
+	}
+}
+
+func importRequest(t *testing.T, path string, preview *compose.Preview, nodeID string) *http.Request {
+	t.Helper()
+	return postJSON(t, path, map[string]any{"preview": preview, "node_id": nodeID})
+}
+
+func TestImportCompose_DryRunPlansResourcesFirst(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s)
+	p, err := compose.Parse([]byte("services:\n  web:\n    image: nginx\n    depends_on: [db]\n  db:\n    image: postgres:16\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	newApplyHandler(s).ImportCompose(rec, importRequest(t, "/api/import/docker-compose/apply?dry_run=true", p, n.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp applyResponse
+	decodeJSON(t, rec, &resp)
+	if len(resp.Changes) != 2 || resp.Changes[0].Kind != "database" || resp.Changes[1].Kind != "service" {
+		t.Errorf("unexpected plan: %+v", resp.Changes)
+	}
+}
+
+func TestImportCompose_CreatesServicesAndKeepsExisting(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s)
+	mustCreateApp(t, s)
+	p := &compose.Preview{Services: []compose.ParsedService{{Name: "api", DockerImage: "ghcr.io/acme/api:2", EnvVars: map[string]string{"MODE": "prod"}}}}
+
+	rec := httptest.NewRecorder()
+	newApplyHandler(s).ImportCompose(rec, importRequest(t, "/api/import/docker-compose/apply", p, n.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp applyResponse
+	decodeJSON(t, rec, &resp)
+	if resp.Error != "" || len(resp.Changes) != 1 || resp.Changes[0].Status != manifest.StatusApplied {
+		t.Fatalf("unexpected result: %+v", resp)
+	}
+	if svcs, _ := s.ListServices(testUserID); len(svcs) != 2 {
+		t.Errorf("services after import: %+v", svcs)
+	}
+
+	// Importing the same name again is refused.
+	rec = httptest.NewRecorder()
+	newApplyHandler(s).ImportCompose(rec, importRequest(t, "/api/import/docker-compose/apply", p, n.ID))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestImportCompose_UnknownNode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newApplyHandler(newTestStore(t)).ImportCompose(rec, importRequest(t, "/api/import/docker-compose/apply", &compose.Preview{}, "missing"))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestImportCompose_FailureRemovesWhatItCreated(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s)
+	p := &compose.Preview{Services: []compose.ParsedService{{Name: "api", DockerImage: "ghcr.io/acme/api:2"}}}
+	// The test API has no deployments route, so the deploy after the
+	// service create fails.
+	req := func() *http.Request {
+		return postJSON(t, "/api/import/docker-compose/apply", map[string]any{"preview": p, "node_id": n.ID, "deploy": true})
+	}
+
+	rec := httptest.NewRecorder()
+	newApplyHandler(s).ImportCompose(rec, req())
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp applyResponse
+	decodeJSON(t, rec, &resp)
+	if !strings.Contains(resp.Error, "what the import created was removed") {
+		t.Errorf("error = %q", resp.Error)
+	}
+	if svcs, _ := s.ListServices(testUserID); len(svcs) != 0 {
+		t.Errorf("services left after a failed import: %+v", svcs)
+	}
+
+	// A retry is not refused over the service the failed import created.
+	rec = httptest.NewRecorder()
+	newApplyHandler(s).ImportCompose(rec, req())
+	if rec.Code == http.StatusConflict {
+		t.Errorf("retry refused: %s", rec.Body)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// Audit log page sizes.
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 10000
+)
+
+type AuditHandler struct {
+	store *store.Store
+}
+
+func NewAuditHandler(s *store.Store) *AuditHandler {
+	return &AuditHandler{store: s}
+}
+
+// List returns the user's audit events, newest first. Query parameters
+// actor_type, action (exact, or a prefix ending in "."), resource_type,
+// resource_id and result filter; since and until take RFC 3339 times or, for
+// since, a Go duration back from now; limit defaults to 100. format=csv
+// exports the events as a CSV file instead of JSON.
+func (h *AuditHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := requireRole(w, r, models.RoleAdmin)
+	if userID == "" {
+		return
+	}
+	q := r.URL.Query()
+	f := models.AuditFilter{
+		ActorType:    q.Get("actor_type"),
+		Action:       q.Get("action"),
+		ResourceType: q.Get("resource_type"),
+		ResourceID:   q.Get("resource_id"),
+		Result:       q.Get("result"),
+		Limit:        defaultAuditLimit,
+	}
+	if v := q.Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			f.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			f.Since = t
+		} else {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 time or a duration such as 24h")
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "until must be an RFC 3339 time")
+			return
+		}
+		f.Until = t
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		f.Limit = min(n, maxAuditLimit)
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+
+	evts, err := h.store.ListAuditEvents(userID, f)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if evts == nil {
+		evts = []*models.AuditEvent{}
+	}
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, evts)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"created_at", "actor_type", "actor_id", "actor_name", "action", "resource_type", "resource_id", "result", "error", "source_ip", "before", "after"})
+	for _, e := range evts {
+		_ = cw.Write([]string{
+			e.CreatedAt.UTC().Format(time.RFC3339), e.ActorType, e.ActorID, e.ActorName, e.Action,
+			e.ResourceType, e.ResourceID, e.Result, e.Error, e.SourceIP, e.Before, e.After,
+		})
+	}
+	cw.Flush()
+}
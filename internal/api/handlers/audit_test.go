@@ -0,0 +1,51 @@
+package handlers_test
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+func TestAuditList(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewAuditHandler(s)
+	for i, action := range []string{"node.create", "database.delete", "node.drain"} {
+		if err := s.InsertAuditEvent(&models.AuditEvent{
+			ID: action, ActorType: models.AuditActorUser, ActorID: testUserID, Action: action,
+			Result: models.AuditResultSuccess, UserID: testUserID, CreatedAt: time.Now().UTC().Add(time.Duration(i) * time.Second),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.List(rec, getRequest("/api/audit?action=node.&since=1h"))
+	var evts []models.AuditEvent
+	decodeJSON(t, rec, &evts)
+	if len(evts) != 2 || evts[0].Action != "node.drain" {
+		t.Errorf("expected the 2 node events newest first, got %+v", evts)
+	}
+
+	rec = httptest.NewRecorder()
+	h.List(rec, getRequest("/api/audit?format=csv"))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("expected text/csv, got %q", ct)
+	}
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil || len(rows) != 4 || rows[0][4] != "action" || rows[1][4] != "node.drain" {
+		t.Errorf("unexpected CSV %v %v", rows, err)
+	}
+
+	for _, q := range []string{"since=yesterday", "until=1h", "limit=0", "format=xml"} {
+		rec = httptest.NewRecorder()
+		h.List(rec, getRequest("/api/audit?"+q))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", q, rec.Code)
+		}
+	}
+}
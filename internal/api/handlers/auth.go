@@ -111,11 +111,15 @@ func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	me := map[string]interface{}{
 		"id":         claims.UserID,
 		"email":      claims.Email,
 		"name":       claims.Name,
 		"avatar_url": claims.AvatarURL,
 		"is_root":    claims.IsRoot,
-	})
+	}
+	if claims.Scope != "" {
+		me["token_scope"] = claims.Scope
+	}
+	writeJSON(w, http.StatusOK, me)
 }
@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -33,6 +33,8 @@ func (h *CacheHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Password string   `json:"password"`
 		Port     int      `json:"port"`
 		Volumes  []string `json:"volumes"`
+
+		HealPolicy string `json:"heal_policy"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
@@ -42,6 +44,10 @@ func (h *CacheHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "name, node_id, and password are required")
 		return
 	}
+	healPolicy, ok := parseHealPolicy(w, body.HealPolicy)
+	if !ok {
+		return
+	}
 
 	version := body.Version
 	if version == "" {
@@ -61,6 +67,9 @@ func (h *CacheHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusForbidden, "only the root user can create caches on the management node")
 		return
 	}
+	if rejectUnschedulable(w, node) {
+		return
+	}
 
 	// Check for port conflicts before creating the container.
 	if used, err := h.store.IsPortUsedOnNode(body.NodeID, port); err != nil {
@@ -76,7 +85,7 @@ func (h *CacheHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	safeName := strings.ReplaceAll(body.Name, " ", "-")
+	safeName := deployer.SafeName(body.Name)
 	shortID := uuid.New().String()[:8]
 	containerName := fmt.Sprintf("localisprod-db-%s-%s", safeName, shortID)
 
@@ -102,6 +111,7 @@ func (h *CacheHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Volumes:       string(volumesJSON),
 		ContainerName: containerName,
 		Status:        "pending",
+		HealPolicy:    healPolicy,
 		CreatedAt:     time.Now().UTC(),
 	}
 	if err := h.store.CreateCache(c, userID); err != nil {
@@ -109,17 +119,17 @@ func (h *CacheHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	runCfg := sshexec.RunConfig{
-		ContainerName: containerName,
-		Image:         fmt.Sprintf("redis:%s", version),
-		Ports:         []string{fmt.Sprintf("%d:6379", port)},
-		Volumes:       volumes,
-		Restart:       "unless-stopped",
-		Command:       fmt.Sprintf("redis-server --requirepass %s", sshexec.ShellEscape(body.Password)),
+	runCfg := deployer.CacheRunConfig(c)
+	if netErr := deployer.AttachUserNetwork(runner, &runCfg, userID); netErr != nil {
+		_ = h.store.UpdateCacheStatus(c.ID, userID, "failed")
+		c.Status = "failed"
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cache": c,
+			"error": netErr.Error(),
+		})
+		return
 	}
-
-	cmd := sshexec.DockerRunCmd(runCfg)
-	output, runErr := runner.Run(cmd)
+	output, runErr := runner.Run(sshexec.DockerRunCmd(runCfg))
 
 	if runErr != nil {
 		_ = h.store.UpdateCacheStatus(c.ID, userID, "failed")
@@ -137,6 +147,7 @@ func (h *CacheHandler) Create(w http.ResponseWriter, r *http.Request) {
 	_ = h.store.UpdateCacheLastDeployedAt(c.ID, userID, now)
 	c.Status = "running"
 	c.LastDeployedAt = &now
+	reconcileFirewalls(h.store, userID)
 	writeJSON(w, http.StatusCreated, c)
 }
 
@@ -153,6 +164,7 @@ func (h *CacheHandler) List(w http.ResponseWriter, r *http.Request) {
 	if caches == nil {
 		caches = []*models.Cache{}
 	}
+	hideCredentials(r, caches)
 	writeJSON(w, http.StatusOK, caches)
 }
 
@@ -170,6 +182,7 @@ func (h *CacheHandler) Get(w http.ResponseWriter, r *http.Request, id string) {
 		writeError(w, http.StatusNotFound, "cache not found")
 		return
 	}
+	hideCredentials(r, c)
 	writeJSON(w, http.StatusOK, c)
 }
 
@@ -197,16 +210,7 @@ func (h *CacheHandler) Delete(w http.ResponseWriter, r *http.Request, id string)
 		writeInternalError(w, err)
 		return
 	}
+	_ = h.store.ClearHealState(models.HealResourceCache, id)
+	reconcileFirewalls(h.store, userID)
 	w.WriteHeader(http.StatusNoContent)
 }
-
-// CacheEnvVarName derives the env var name from a cache name.
-// e.g. "my-cache" → "MY_CACHE_URL"
-func CacheEnvVarName(name string) string {
-	return DBEnvVarName(name)
-}
-
-// CacheConnectionURL builds the Redis connection URL.
-func CacheConnectionURL(c *models.Cache) string {
-	return fmt.Sprintf("redis://:%s@%s:%d", c.Password, c.NodeHost, c.Port)
-}
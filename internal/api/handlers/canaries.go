@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+const defaultCanaryWeight = 10
+
+type CanaryHandler struct {
+	store *store.Store
+}
+
+func NewCanaryHandler(s *store.Store) *CanaryHandler {
+	return &CanaryHandler{store: s}
+}
+
+func validCanaryWeight(w http.ResponseWriter, weight int) bool {
+	if weight < 0 || weight > 100 {
+		writeError(w, http.StatusBadRequest, "weight must be between 0 and 100")
+		return false
+	}
+	return true
+}
+
+// Create starts a canary container with a new image next to a running
+// deployment and sends weight percent of the service's traffic to it.
+func (h *CanaryHandler) Create(w http.ResponseWriter, r *http.Request) {
+	userID := requireRole(w, r, models.RoleDeployer)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		DeploymentID string `json:"deployment_id"`
+		DockerImage  string `json:"docker_image"`
+		Weight       *int   `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.DeploymentID == "" || body.DockerImage == "" {
+		writeError(w, http.StatusBadRequest, "deployment_id and docker_image are required")
+		return
+	}
+	weight := defaultCanaryWeight
+	if body.Weight != nil {
+		weight = *body.Weight
+	}
+	if !validCanaryWeight(w, weight) {
+		return
+	}
+
+	dep, err := h.store.GetDeployment(body.DeploymentID, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if dep == nil {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	if dep.Status != "running" {
+		writeError(w, http.StatusConflict, "deployment must be running to start a canary")
+		return
+	}
+	svc, err := h.store.GetService(dep.ServiceID, userID)
+	if err != nil || svc == nil {
+		writeError(w, http.StatusNotFound, "service not found")
+		return
+	}
+	if len(deployer.ServiceRoutes(svc)) == 0 {
+		writeError(w, http.StatusBadRequest, "canary releases require a service with at least one route")
+		return
+	}
+	node, err := h.store.GetNodeForUser(dep.NodeID, userID, isRoot(r))
+	if err != nil || node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.IsLocal && !isRoot(r) {
+		writeError(w, http.StatusForbidden, "only the root user can deploy to the management node")
+		return
+	}
+	if rejectUnschedulable(w, node) {
+		return
+	}
+	if !node.TraefikEnabled {
+		writeError(w, http.StatusBadRequest, "Traefik is not set up on this node")
+		return
+	}
+	if active, err := h.store.GetActiveCanaryForDeployment(dep.ID, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	} else if active != nil {
+		writeError(w, http.StatusConflict, "deployment already has an active canary")
+		return
+	}
+
+	now := time.Now().UTC()
+	c := &models.Canary{
+		ID:            uuid.New().String(),
+		DeploymentID:  dep.ID,
+		ServiceID:     svc.ID,
+		NodeID:        node.ID,
+		DockerImage:   body.DockerImage,
+		ContainerName: fmt.Sprintf("%s-canary-%s", dep.ContainerName, uuid.New().String()[:8]),
+		Weight:        weight,
+		Status:        "pending",
+		UserID:        userID,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		AppName:       svc.Name,
+		StableImage:   svc.DockerImage,
+	}
+	if err := h.store.CreateCanary(c, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	containerID, err := deployer.New(h.store).StartCanary(c, svc, node)
+	if err != nil {
+		_ = h.store.UpdateCanaryStatus(c.ID, userID, "failed", "")
+		c.Status = "failed"
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"canary": c,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	runner := sshexec.NewRunner(node)
+	if err := deployer.WriteCanaryRouting(runner, svc, dep.ContainerName, c.ContainerName, weight); err != nil {
+		_, _ = runner.Run(sshexec.DockerForceRemoveCmd(c.ContainerName))
+		_ = h.store.UpdateCanaryStatus(c.ID, userID, "failed", "")
+		c.Status = "failed"
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"canary": c,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	_ = h.store.UpdateCanaryStatus(c.ID, userID, "running", containerID)
+	c.Status = "running"
+	c.ContainerID = containerID
+	writeJSON(w, http.StatusCreated, c)
+}
+
+func (h *CanaryHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	canaries, err := h.store.ListCanaries(userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if canaries == nil {
+		canaries = []*models.Canary{}
+	}
+	writeJSON(w, http.StatusOK, canaries)
+}
+
+func (h *CanaryHandler) Get(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	c, err := h.store.GetCanary(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if c == nil {
+		writeError(w, http.StatusNotFound, "canary not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// loadRunning fetches a running canary together with its stable deployment,
+// service and node. On failure it writes the error response and returns ok=false.
+func (h *CanaryHandler) loadRunning(w http.ResponseWriter, r *http.Request, id, userID string) (c *models.Canary, dep *models.Deployment, svc *models.Service, node *models.Node, ok bool) {
+	c, err := h.store.GetCanary(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if c == nil {
+		writeError(w, http.StatusNotFound, "canary not found")
+		return
+	}
+	c.UserID = userID
+	if c.Status != "running" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("canary is %s", c.Status))
+		return
+	}
+	dep, err = h.store.GetDeployment(c.DeploymentID, userID)
+	if err != nil || dep == nil {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	dep.UserID = userID
+	svc, err = h.store.GetService(c.ServiceID, userID)
+	if err != nil || svc == nil {
+		writeError(w, http.StatusNotFound, "service not found")
+		return
+	}
+	node, err = h.store.GetNodeForUser(c.NodeID, userID, isRoot(r))
+	if err != nil || node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	return c, dep, svc, node, true
+}
+
+// UpdateWeight changes the percentage of traffic sent to the canary.
+func (h *CanaryHandler) UpdateWeight(w http.ResponseWriter, r *http.Request, id string) {
+	userID := requireRole(w, r, models.RoleDeployer)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		Weight *int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.Weight == nil {
+		writeError(w, http.StatusBadRequest, "weight is required")
+		return
+	}
+	if !validCanaryWeight(w, *body.Weight) {
+		return
+	}
+	c, dep, svc, node, ok := h.loadRunning(w, r, id, userID)
+	if !ok {
+		return
+	}
+
+	runner := sshexec.NewRunner(node)
+	if err := deployer.WriteCanaryRouting(runner, svc, dep.ContainerName, c.ContainerName, *body.Weight); err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"canary": c,
+			"error":  err.Error(),
+		})
+		return
+	}
+	_ = h.store.UpdateCanaryWeight(c.ID, userID, *body.Weight)
+	c.Weight = *body.Weight
+	writeJSON(w, http.StatusOK, c)
+}
+
+// Promote makes the canary image the service's image: all traffic is shifted
+// to the canary while the stable deployment is recreated with the new image,
+// then the weighted routing and the canary container are removed. Only the
+// canary's deployment is recreated, so a service with other deployments is
+// refused rather than left running two images.
+func (h *CanaryHandler) Promote(w http.ResponseWriter, r *http.Request, id string) {
+	userID := requireRole(w, r, models.RoleDeployer)
+	if userID == "" {
+		return
+	}
+	c, dep, svc, node, ok := h.loadRunning(w, r, id, userID)
+	if !ok {
+		return
+	}
+	deps, err := h.store.GetDeploymentsByServiceID(svc.ID, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if len(deps) > 1 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("service %s has %d deployments; promoting would leave the others on the old image, so update the service's image and redeploy them instead", svc.Name, len(deps)))
+		return
+	}
+
+	runner := sshexec.NewRunner(node)
+	if err := deployer.WriteCanaryRouting(runner, svc, dep.ContainerName, c.ContainerName, 100); err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"canary": c,
+			"error":  err.Error(),
+		})
+		return
+	}
+	_ = h.store.UpdateCanaryWeight(c.ID, userID, 100)
+	c.Weight = 100
+
+	svc.DockerImage = c.DockerImage
+	if err := h.store.UpdateService(svc, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	// The canary keeps serving all traffic if the stable container can't be
+	// recreated, so a failed promotion can be retried or aborted safely.
+	containerID, err := deployer.New(h.store).RedeployDeployment(dep, node)
+	if err != nil {
+		_ = h.store.UpdateDeploymentStatus(dep.ID, userID, "failed", "")
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"canary": c,
+			"error":  err.Error(),
+		})
+		return
+	}
+	now := time.Now().UTC()
+	_ = h.store.UpdateDeploymentStatus(dep.ID, userID, "running", containerID)
+	_ = h.store.UpdateDeploymentLastDeployedAt(dep.ID, userID, now)
+	_ = h.store.UpdateServiceLastDeployedAt(svc.ID, userID, now)
+
+	if err := deployer.StopCanary(runner, c, dep.ContainerName); err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"canary": c,
+			"error":  err.Error(),
+		})
+		return
+	}
+	_ = h.store.UpdateCanaryStatus(c.ID, userID, "promoted", c.ContainerID)
+	c.Status = "promoted"
+	writeJSON(w, http.StatusOK, c)
+}
+
+// Abort sends all traffic back to the stable deployment and removes the canary.
+func (h *CanaryHandler) Abort(w http.ResponseWriter, r *http.Request, id string) {
+	userID := requireRole(w, r, models.RoleDeployer)
+	if userID == "" {
+		return
+	}
+	c, dep, _, node, ok := h.loadRunning(w, r, id, userID)
+	if !ok {
+		return
+	}
+	if err := deployer.StopCanary(sshexec.NewRunner(node), c, dep.ContainerName); err != nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"canary": c,
+			"error":  err.Error(),
+		})
+		return
+	}
+	_ = h.store.UpdateCanaryStatus(c.ID, userID, "aborted", c.ContainerID)
+	c.Status = "aborted"
+	writeJSON(w, http.StatusOK, c)
+}
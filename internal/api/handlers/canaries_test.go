@@ -0,0 +1,195 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+func TestCanaryCreate_MissingFields(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+
+	tests := []struct {
+		name string
+		body map[string]any
+	}{
+		{"no fields", map[string]any{}},
+		{"missing docker_image", map[string]any{"deployment_id": "dep"}},
+		{"missing deployment_id", map[string]any{"docker_image": "nginx:1.27"}},
+		{"weight too high", map[string]any{"deployment_id": "dep", "docker_image": "nginx:1.27", "weight": 101}},
+		{"negative weight", map[string]any{"deployment_id": "dep", "docker_image": "nginx:1.27", "weight": -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.Create(rec, postJSON(t, "/api/canaries", tt.body))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d (body: %s)", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestCanaryCreate_DeploymentNotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/canaries", map[string]any{
+		"deployment_id": "nonexistent",
+		"docker_image":  "nginx:1.27",
+	}))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestCanaryCreate_RequiresRoute(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSONAsRoot(t, "/api/canaries", map[string]any{
+		"deployment_id": d.ID,
+		"docker_image":  "nginx:1.27",
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d (body: %s)", rec.Code, rec.Body)
+	}
+}
+
+func TestCanaryCreate_RequiresTraefik(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	a.Routes = `[{"host":"app.example.com"}]`
+	_ = s.UpdateService(a, testUserID)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSONAsRoot(t, "/api/canaries", map[string]any{
+		"deployment_id": d.ID,
+		"docker_image":  "nginx:1.27",
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d (body: %s)", rec.Code, rec.Body)
+	}
+}
+
+func TestCanaryGet_NotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Get(rec, getRequest("/api/canaries/nonexistent"), "nonexistent")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestCanaryList_Empty(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.List(rec, getRequest("/api/canaries"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var list []any
+	decodeJSON(t, rec, &list)
+	if len(list) != 0 {
+		t.Errorf("expected empty list, got %v", list)
+	}
+}
+
+func TestCanaryUpdateWeight_NotRunning(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+	now := time.Now().UTC()
+	c := &models.Canary{
+		ID:            "test-canary-id",
+		DeploymentID:  d.ID,
+		ServiceID:     a.ID,
+		NodeID:        n.ID,
+		DockerImage:   "nginx:1.27",
+		ContainerName: d.ContainerName + "-canary-1234abcd",
+		Weight:        10,
+		Status:        "aborted",
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := s.CreateCanary(c, testUserID); err != nil {
+		t.Fatalf("CreateCanary: %v", err)
+	}
+
+	b, _ := json.Marshal(map[string]any{"weight": 50})
+	r := withUserID(httptest.NewRequest(http.MethodPut, "/api/canaries/"+c.ID+"/weight", bytes.NewReader(b)))
+	rec := httptest.NewRecorder()
+	h.UpdateWeight(rec, r, c.ID)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d (body: %s)", rec.Code, rec.Body)
+	}
+}
+
+func TestCanaryPromote_RefusesServiceWithOtherDeployments(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCanaryHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+	other := &models.Deployment{
+		ID:            "test-dep-id-2",
+		ServiceID:     a.ID,
+		NodeID:        n.ID,
+		ContainerName: "localisprod-test-app-efgh5678",
+		ContainerID:   "def456",
+		Status:        "running",
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := s.CreateDeployment(other, testUserID); err != nil {
+		t.Fatalf("CreateDeployment: %v", err)
+	}
+	now := time.Now().UTC()
+	c := &models.Canary{
+		ID:            "test-canary-id",
+		DeploymentID:  d.ID,
+		ServiceID:     a.ID,
+		NodeID:        n.ID,
+		DockerImage:   "nginx:1.28",
+		ContainerName: d.ContainerName + "-canary-1234abcd",
+		Weight:        10,
+		Status:        "running",
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := s.CreateCanary(c, testUserID); err != nil {
+		t.Fatalf("CreateCanary: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Promote(rec, postJSON(t, "/api/canaries/"+c.ID+"/promote", nil), c.ID)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d (body: %s)", rec.Code, rec.Body)
+	}
+	if svc, _ := s.GetService(a.ID, testUserID); svc.DockerImage == c.DockerImage {
+		t.Errorf("service image was changed to %s", svc.DockerImage)
+	}
+	if got, _ := s.GetCanary(c.ID, testUserID); got.Status != "running" || got.Weight != 10 {
+		t.Errorf("canary is %s at weight %d, want running at 10", got.Status, got.Weight)
+	}
+}
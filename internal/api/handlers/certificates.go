@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+type CertificateHandler struct {
+	store *store.Store
+}
+
+func NewCertificateHandler(s *store.Store) *CertificateHandler {
+	return &CertificateHandler{store: s}
+}
+
+// traefikNodes returns the user's nodes that have Traefik set up.
+func (h *CertificateHandler) traefikNodes(userID string) []*models.Node {
+	nodes, err := h.store.ListNodes(userID)
+	if err != nil {
+		log.Printf("certificates: list nodes: %v", err)
+		return nil
+	}
+	var out []*models.Node
+	for _, n := range nodes {
+		if n.TraefikEnabled {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// Create stores an uploaded certificate/key pair (the key encrypted) and
+// pushes it to every Traefik node of the user. Nodes that cannot be reached
+// get it the next time Traefik is set up on them.
+func (h *CertificateHandler) Create(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		CertPEM string `json:"cert_pem"`
+		KeyPEM  string `json:"key_pem"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.CertPEM == "" || body.KeyPEM == "" {
+		writeError(w, http.StatusBadRequest, "cert_pem and key_pem are required")
+		return
+	}
+	c, err := deployer.ParseCertificate(body.CertPEM, body.KeyPEM)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	if c.NotAfter.Before(now) {
+		writeError(w, http.StatusBadRequest, "certificate has expired")
+		return
+	}
+	c.ID = uuid.New().String()
+	c.CreatedAt = now
+	c.UpdatedAt = now
+	if err := h.store.CreateCertificate(c, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	for _, n := range h.traefikNodes(userID) {
+		if err := deployer.PushCertificate(sshexec.NewRunner(n), c); err != nil {
+			log.Printf("certificates: push %s to node %s: %v", c.ID, n.Name, err)
+		}
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+func (h *CertificateHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	certs, err := h.store.ListCertificates(userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if certs == nil {
+		certs = []*models.Certificate{}
+	}
+	writeJSON(w, http.StatusOK, certs)
+}
+
+func (h *CertificateHandler) Get(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	c, err := h.store.GetCertificate(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if c == nil {
+		writeError(w, http.StatusNotFound, "certificate not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// Delete removes an uploaded certificate from the user's Traefik nodes and
+// the store. ACME certificates are managed by Traefik and cannot be deleted.
+func (h *CertificateHandler) Delete(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	c, err := h.store.GetCertificate(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if c == nil {
+		writeError(w, http.StatusNotFound, "certificate not found")
+		return
+	}
+	if c.Source != models.CertificateSourceUploaded {
+		writeError(w, http.StatusBadRequest, "ACME certificates are managed by Traefik and cannot be deleted")
+		return
+	}
+	for _, n := range h.traefikNodes(userID) {
+		if err := deployer.RemoveCertificate(sshexec.NewRunner(n), c.ID); err != nil {
+			log.Printf("certificates: remove %s from node %s: %v", c.ID, n.Name, err)
+		}
+	}
+	if err := h.store.DeleteCertificate(id, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetACME returns the user's ACME settings.
+func (h *CertificateHandler) GetACME(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	resp := map[string]string{}
+	for field, key := range map[string]string{
+		"email":          deployer.SettingACMEEmail,
+		"directory_url":  deployer.SettingACMEDirectoryURL,
+		"ca_certificate": deployer.SettingACMECACertificate,
+	} {
+		val, err := h.store.GetUserSetting(userID, key)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		resp[field] = val
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// UpdateACME replaces the user's ACME settings. An empty email disables ACME;
+// an empty directory URL uses Let's Encrypt. ca_certificate is only needed for
+// ACME servers with a private CA, such as Pebble. Traefik must be set up again
+// on a node for changes to apply there.
+func (h *CertificateHandler) UpdateACME(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		Email         string `json:"email"`
+		DirectoryURL  string `json:"directory_url"`
+		CACertificate string `json:"ca_certificate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	body.Email = strings.TrimSpace(body.Email)
+	body.DirectoryURL = strings.TrimSpace(body.DirectoryURL)
+	if body.Email != "" {
+		if addr, err := mail.ParseAddress(body.Email); err != nil || addr.Address != body.Email {
+			writeError(w, http.StatusBadRequest, "invalid email")
+			return
+		}
+	}
+	if body.DirectoryURL != "" {
+		u, err := url.Parse(body.DirectoryURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			writeError(w, http.StatusBadRequest, "directory_url must be an https URL")
+			return
+		}
+	}
+	if body.CACertificate != "" {
+		if err := deployer.ParseCACertificate(body.CACertificate); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ca_certificate: "+err.Error())
+			return
+		}
+	}
+	for key, val := range map[string]string{
+		deployer.SettingACMEEmail:         body.Email,
+		deployer.SettingACMEDirectoryURL:  body.DirectoryURL,
+		deployer.SettingACMECACertificate: body.CACertificate,
+	} {
+		if err := h.store.SetUserSetting(userID, key, val); err != nil {
+			writeInternalError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"email":          body.Email,
+		"directory_url":  body.DirectoryURL,
+		"ca_certificate": body.CACertificate,
+	})
+}
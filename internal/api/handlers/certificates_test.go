@@ -0,0 +1,201 @@
+package handlers_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+// selfSignedPEM returns a PEM certificate and key for domains valid until notAfter.
+func selfSignedPEM(t *testing.T, notAfter time.Time, domains ...string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		Issuer:       pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(certPEM), string(keyPEM)
+}
+
+func putACME(t *testing.T, body any) *http.Request {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPut, "/api/acme", bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json")
+	return withUserID(r)
+}
+
+func TestCertificateCreate_Success(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCertificateHandler(s)
+	notAfter := time.Now().Add(60 * 24 * time.Hour).UTC().Truncate(time.Second)
+	certPEM, keyPEM := selfSignedPEM(t, notAfter, "example.com", "www.example.com")
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/certificates", map[string]string{"cert_pem": certPEM, "key_pem": keyPEM}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (body: %s)", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "PRIVATE KEY") {
+		t.Error("expected private key to be omitted from the response")
+	}
+	var c models.Certificate
+	decodeJSON(t, rec, &c)
+	if c.Domains != `["example.com","www.example.com"]` {
+		t.Errorf("unexpected domains: %s", c.Domains)
+	}
+	if c.Source != models.CertificateSourceUploaded {
+		t.Errorf("expected source uploaded, got %s", c.Source)
+	}
+	if !c.NotAfter.Equal(notAfter) {
+		t.Errorf("expected not_after %s, got %s", notAfter, c.NotAfter)
+	}
+
+	stored, err := s.GetCertificate(c.ID, testUserID)
+	if err != nil || stored == nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if stored.KeyPEM != keyPEM {
+		t.Error("expected stored key to round-trip")
+	}
+}
+
+func TestCertificateCreate_Invalid(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCertificateHandler(s)
+	certPEM, _ := selfSignedPEM(t, time.Now().Add(time.Hour), "example.com")
+	_, otherKey := selfSignedPEM(t, time.Now().Add(time.Hour), "example.com")
+	expiredCert, expiredKey := selfSignedPEM(t, time.Now().Add(-time.Hour), "example.com")
+
+	tests := []struct {
+		name string
+		body map[string]string
+	}{
+		{"missing fields", map[string]string{}},
+		{"not pem", map[string]string{"cert_pem": "nope", "key_pem": "nope"}},
+		{"mismatched key", map[string]string{"cert_pem": certPEM, "key_pem": otherKey}},
+		{"expired", map[string]string{"cert_pem": expiredCert, "key_pem": expiredKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.Create(rec, postJSON(t, "/api/certificates", tt.body))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d (body: %s)", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestCertificateDelete(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCertificateHandler(s)
+	certPEM, keyPEM := selfSignedPEM(t, time.Now().Add(time.Hour), "example.com")
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/certificates", map[string]string{"cert_pem": certPEM, "key_pem": keyPEM}))
+	var c models.Certificate
+	decodeJSON(t, rec, &c)
+
+	rec = httptest.NewRecorder()
+	h.Delete(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/certificates/"+c.ID, nil)), c.ID)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d (body: %s)", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Get(rec, getRequest("/api/certificates/"+c.ID), c.ID)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestCertificateList_Empty(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCertificateHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.List(rec, getRequest("/api/certificates"))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("expected 200 with [], got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestACMEUpdate(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCertificateHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.UpdateACME(rec, putACME(t, map[string]string{
+		"email":         "ops@example.com",
+		"directory_url": "https://localhost:14000/dir",
+	}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.GetACME(rec, getRequest("/api/acme"))
+	var resp map[string]string
+	decodeJSON(t, rec, &resp)
+	if resp["email"] != "ops@example.com" || resp["directory_url"] != "https://localhost:14000/dir" {
+		t.Errorf("unexpected settings: %v", resp)
+	}
+}
+
+func TestACMEUpdate_Invalid(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewCertificateHandler(s)
+
+	tests := []struct {
+		name string
+		body map[string]string
+	}{
+		{"bad email", map[string]string{"email": "not-an-email"}},
+		{"http directory", map[string]string{"email": "ops@example.com", "directory_url": "http://pebble/dir"}},
+		{"bad ca", map[string]string{"email": "ops@example.com", "ca_certificate": "nope"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.UpdateACME(rec, putACME(t, tt.body))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d (body: %s)", rec.Code, rec.Body)
+			}
+		})
+	}
+}
@@ -17,6 +17,9 @@ func NewComposeHandler(s *store.Store) *ComposeHandler {
 }
 
 // Preview parses a docker-compose.yml and returns classified service objects.
+// Override files in overrides are merged over content in order; env supplies
+// ${VAR} values, files the contents of env_file and extends files by path,
+// and profiles the active profiles.
 // POST /api/import/docker-compose
 func (h *ComposeHandler) Preview(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(w, r)
@@ -25,7 +28,9 @@ func (h *ComposeHandler) Preview(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var body struct {
-		Content string `json:"content"`
+		Content   string   `json:"content"`
+		Overrides []string `json:"overrides"`
+		compose.Options
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
@@ -36,7 +41,11 @@ func (h *ComposeHandler) Preview(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	preview, err := compose.Parse([]byte(body.Content))
+	contents := [][]byte{[]byte(body.Content)}
+	for _, o := range body.Overrides {
+		contents = append(contents, []byte(o))
+	}
+	preview, err := compose.ParseFiles(contents, body.Options)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
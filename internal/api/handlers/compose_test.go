@@ -0,0 +1,40 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/compose"
+)
+
+func TestComposePreview_MergesOverridesWithEnv(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handlers.NewComposeHandler(newTestStore(t)).Preview(rec, postJSON(t, "/api/import/docker-compose", map[string]any{
+		"content":   "services:\n  web:\n    image: nginx:${TAG:-latest}\n    stop_signal: SIGINT\n",
+		"overrides": []string{"services:\n  web:\n    ports: ['8080:80']\n"},
+		"env":       map[string]string{"TAG": "1.27"},
+	}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var p compose.Preview
+	decodeJSON(t, rec, &p)
+	if len(p.Services) != 1 || p.Services[0].DockerImage != "nginx:1.27" || len(p.Services[0].Ports) != 1 {
+		t.Errorf("services = %+v", p.Services)
+	}
+	if len(p.Warnings) != 1 {
+		t.Errorf("warnings = %v, want one for stop_signal", p.Warnings)
+	}
+}
+
+func TestComposePreview_RequiredVariable(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handlers.NewComposeHandler(newTestStore(t)).Preview(rec, postJSON(t, "/api/import/docker-compose", map[string]any{
+		"content": "services:\n  web:\n    image: nginx:${TAG:?TAG must be set}\n",
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
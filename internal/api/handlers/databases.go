@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -21,18 +21,6 @@ func NewDatabaseHandler(s *store.Store) *DatabaseHandler {
 	return &DatabaseHandler{store: s}
 }
 
-type dbConfig struct {
-	defaultVersion string
-	defaultPort    int
-	image          string
-	mountPath      string
-}
-
-var dbConfigs = map[string]dbConfig{
-	"postgres": {"16", 5432, "postgres", "/var/lib/postgresql/data"},
-	"redis":    {"7", 6379, "redis", "/data"},
-}
-
 func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(w, r)
 	if userID == "" {
@@ -47,6 +35,8 @@ func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 		DBUser   string `json:"db_user"`
 		Password string `json:"password"`
 		Port     int    `json:"port"`
+
+		HealPolicy string `json:"heal_policy"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
@@ -56,19 +46,23 @@ func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "name, type, node_id, and password are required")
 		return
 	}
-	cfg, ok := dbConfigs[body.Type]
+	cfg, ok := deployer.DatabaseTypes[body.Type]
 	if !ok {
 		writeError(w, http.StatusBadRequest, "type must be one of: postgres, redis")
 		return
 	}
+	healPolicy, ok := parseHealPolicy(w, body.HealPolicy)
+	if !ok {
+		return
+	}
 
 	version := body.Version
 	if version == "" {
-		version = cfg.defaultVersion
+		version = cfg.DefaultVersion
 	}
 	port := body.Port
 	if port == 0 {
-		port = cfg.defaultPort
+		port = cfg.DefaultPort
 	}
 	dbname := body.DBName
 	if dbname == "" {
@@ -88,6 +82,9 @@ func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusForbidden, "only the root user can create databases on the management node")
 		return
 	}
+	if rejectUnschedulable(w, node) {
+		return
+	}
 
 	// Check for port conflicts before creating the container.
 	if used, err := h.store.IsPortUsedOnNode(body.NodeID, port); err != nil {
@@ -103,10 +100,8 @@ func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	safeName := strings.ReplaceAll(body.Name, " ", "-")
 	shortID := uuid.New().String()[:8]
-	containerName := fmt.Sprintf("localisprod-db-%s-%s", safeName, shortID)
-	volumeName := fmt.Sprintf("localisprod-%s-data", safeName)
+	containerName := fmt.Sprintf("localisprod-db-%s-%s", deployer.SafeName(body.Name), shortID)
 
 	db := &models.Database{
 		ID:            uuid.New().String(),
@@ -120,6 +115,7 @@ func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Port:          port,
 		ContainerName: containerName,
 		Status:        "pending",
+		HealPolicy:    healPolicy,
 		CreatedAt:     time.Now().UTC(),
 	}
 	if err := h.store.CreateDatabase(db, userID); err != nil {
@@ -128,53 +124,19 @@ func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create named volume (idempotent)
-	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(volumeName))
-
-	// Build env vars for the database container
-	envVars := dbContainerEnvVars(body.Type, dbname, dbuser, body.Password)
-
-	image := fmt.Sprintf("%s:%s", cfg.image, version)
-
-	var envFilePath string
-	if len(envVars) > 0 {
-		envFilePath = fmt.Sprintf("/tmp/%s.env", containerName)
-		var buf strings.Builder
-		for k, v := range envVars {
-			buf.WriteString(k)
-			buf.WriteByte('=')
-			buf.WriteString(v)
-			buf.WriteByte('\n')
-		}
-		if err := runner.WriteFile(envFilePath, buf.String()); err != nil {
-			_ = h.store.UpdateDatabaseStatus(db.ID, userID, "failed")
-			writeJSON(w, http.StatusOK, map[string]interface{}{
-				"database": db,
-				"error":    "failed to write env file: " + err.Error(),
-			})
-			return
-		}
-	}
-
-	runCfg := sshexec.RunConfig{
-		ContainerName: containerName,
-		Image:         image,
-		Ports:         []string{fmt.Sprintf("%d:%d", port, cfg.defaultPort)},
-		EnvFilePath:   envFilePath,
-		Volumes:       []string{fmt.Sprintf("%s:%s", volumeName, cfg.mountPath)},
-		Restart:       "unless-stopped",
-	}
-	// Redis password is set via command, not env var
-	if body.Type == "redis" && body.Password != "" {
-		runCfg.Command = fmt.Sprintf("redis-server --requirepass %s", sshexec.ShellEscape(body.Password))
-	}
-
-	cmd := sshexec.DockerRunCmd(runCfg)
-	output, runErr := runner.Run(cmd)
+	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(deployer.DatabaseVolumeName(body.Name)))
 
-	if envFilePath != "" {
-		_, _ = runner.Run(sshexec.RemoveFileCmd(envFilePath))
+	runCfg, envVars := deployer.DatabaseRunConfig(db)
+	if netErr := deployer.AttachUserNetwork(runner, &runCfg, userID); netErr != nil {
+		_ = h.store.UpdateDatabaseStatus(db.ID, userID, "failed")
+		db.Status = "failed"
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"database": db,
+			"error":    netErr.Error(),
+		})
+		return
 	}
-
+	output, runErr := deployer.RunContainer(runner, runCfg, envVars)
 	if runErr != nil {
 		_ = h.store.UpdateDatabaseStatus(db.ID, userID, "failed")
 		db.Status = "failed"
@@ -191,6 +153,7 @@ func (h *DatabaseHandler) Create(w http.ResponseWriter, r *http.Request) {
 	_ = h.store.UpdateDatabaseLastDeployedAt(db.ID, userID, now)
 	db.Status = "running"
 	db.LastDeployedAt = &now
+	reconcileFirewalls(h.store, userID)
 	writeJSON(w, http.StatusCreated, db)
 }
 
@@ -207,6 +170,7 @@ func (h *DatabaseHandler) List(w http.ResponseWriter, r *http.Request) {
 	if dbs == nil {
 		dbs = []*models.Database{}
 	}
+	hideCredentials(r, dbs)
 	writeJSON(w, http.StatusOK, dbs)
 }
 
@@ -224,6 +188,7 @@ func (h *DatabaseHandler) Get(w http.ResponseWriter, r *http.Request, id string)
 		writeError(w, http.StatusNotFound, "database not found")
 		return
 	}
+	hideCredentials(r, db)
 	writeJSON(w, http.StatusOK, db)
 }
 
@@ -251,37 +216,7 @@ func (h *DatabaseHandler) Delete(w http.ResponseWriter, r *http.Request, id stri
 		writeInternalError(w, err)
 		return
 	}
+	_ = h.store.ClearHealState(models.HealResourceDatabase, id)
+	reconcileFirewalls(h.store, userID)
 	w.WriteHeader(http.StatusNoContent)
 }
-
-func dbContainerEnvVars(dbType, dbname, dbuser, password string) map[string]string {
-	switch dbType {
-	case "postgres":
-		return map[string]string{
-			"POSTGRES_DB":       dbname,
-			"POSTGRES_USER":     dbuser,
-			"POSTGRES_PASSWORD": password,
-		}
-	}
-	return nil // redis: password set via command
-}
-
-// DBEnvVarName derives the env var name from a database name.
-// e.g. "my-db" → "MY_DB_URL"
-func DBEnvVarName(dbName string) string {
-	upper := strings.ToUpper(dbName)
-	cleaned := strings.NewReplacer("-", "_", " ", "_", ".", "_").Replace(upper)
-	return cleaned + "_URL"
-}
-
-// DBConnectionURL builds the connection URL for an application to use.
-func DBConnectionURL(db *models.Database) string {
-	switch db.Type {
-	case "postgres":
-		return fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
-			db.DBUser, db.Password, db.NodeHost, db.Port, db.DBName)
-	case "redis":
-		return fmt.Sprintf("redis://:%s@%s:%d", db.Password, db.NodeHost, db.Port)
-	}
-	return ""
-}
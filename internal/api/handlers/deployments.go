@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -22,13 +23,14 @@ func NewDeploymentHandler(s *store.Store) *DeploymentHandler {
 }
 
 func (h *DeploymentHandler) Create(w http.ResponseWriter, r *http.Request) {
-	userID := getUserID(w, r)
+	userID := requireRole(w, r, models.RoleDeployer)
 	if userID == "" {
 		return
 	}
 	var body struct {
-		ServiceID string `json:"service_id"`
-		NodeID    string `json:"node_id"`
+		ServiceID  string `json:"service_id"`
+		NodeID     string `json:"node_id"`
+		HealPolicy string `json:"heal_policy"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
@@ -38,6 +40,10 @@ func (h *DeploymentHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "service_id and node_id are required")
 		return
 	}
+	healPolicy, ok := parseHealPolicy(w, body.HealPolicy)
+	if !ok {
+		return
+	}
 
 	app, err := h.store.GetService(body.ServiceID, userID)
 	if err != nil || app == nil {
@@ -54,6 +60,9 @@ func (h *DeploymentHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusForbidden, "only the root user can deploy to the management node")
 		return
 	}
+	if rejectUnschedulable(w, node) {
+		return
+	}
 
 	// Check for port conflicts on each host port declared by the application.
 	var appPorts []string
@@ -96,6 +105,7 @@ func (h *DeploymentHandler) Create(w http.ResponseWriter, r *http.Request) {
 		ContainerName: containerName,
 		ContainerID:   "",
 		Status:        "pending",
+		HealPolicy:    healPolicy,
 		CreatedAt:     time.Now().UTC(),
 	}
 	if err := h.store.CreateDeployment(deployment, userID); err != nil {
@@ -103,183 +113,32 @@ func (h *DeploymentHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse env vars, ports, and volumes
-	var envVars map[string]string
-	_ = json.Unmarshal([]byte(app.EnvVars), &envVars)
-	var ports []string
-	_ = json.Unmarshal([]byte(app.Ports), &ports)
-	var volumes []string
-	_ = json.Unmarshal([]byte(app.Volumes), &volumes)
-
-	// Inject database connection URLs from linked databases
-	var dbIDs []string
-	_ = json.Unmarshal([]byte(app.Databases), &dbIDs)
-	for _, dbID := range dbIDs {
-		db, err := h.store.GetDatabase(dbID, userID)
-		if err != nil || db == nil {
-			continue
-		}
-		if envVars == nil {
-			envVars = map[string]string{}
-		}
-		envVars[DBEnvVarName(db.Name)] = DBConnectionURL(db)
-	}
-	// For single-database apps, also inject DATABASE_URL as a convenience alias
-	// unless the user has already set it explicitly.
-	if len(dbIDs) == 1 {
-		if _, exists := envVars["DATABASE_URL"]; !exists {
-			db, err := h.store.GetDatabase(dbIDs[0], userID)
-			if err == nil && db != nil {
-				envVars["DATABASE_URL"] = DBConnectionURL(db)
-			}
-		}
-	}
-
-	// Inject cache connection URLs from linked caches
-	var cacheIDs []string
-	_ = json.Unmarshal([]byte(app.Caches), &cacheIDs)
-	for _, cID := range cacheIDs {
-		c, err := h.store.GetCache(cID, userID)
-		if err != nil || c == nil {
-			continue
-		}
-		if envVars == nil {
-			envVars = map[string]string{}
-		}
-		envVars[CacheEnvVarName(c.Name)] = CacheConnectionURL(c)
-	}
-	// For single-cache apps, also inject CACHE_URL as a convenience alias.
-	if len(cacheIDs) == 1 {
-		if _, exists := envVars["CACHE_URL"]; !exists {
-			c, err := h.store.GetCache(cacheIDs[0], userID)
-			if err == nil && c != nil {
-				envVars["CACHE_URL"] = CacheConnectionURL(c)
-			}
-		}
-	}
-
-	// Inject Kafka bootstrap server addresses from linked Kafka clusters
-	var kafkaIDs []string
-	_ = json.Unmarshal([]byte(app.Kafkas), &kafkaIDs)
-	for _, kID := range kafkaIDs {
-		k, err := h.store.GetKafka(kID, userID)
-		if err != nil || k == nil {
-			continue
-		}
-		if envVars == nil {
-			envVars = map[string]string{}
-		}
-		envVars[KafkaEnvVarName(k.Name)] = KafkaConnectionURL(k)
-	}
-	// For single-Kafka apps, also inject KAFKA_BROKERS as a convenience alias.
-	if len(kafkaIDs) == 1 {
-		if _, exists := envVars["KAFKA_BROKERS"]; !exists {
-			k, err := h.store.GetKafka(kafkaIDs[0], userID)
-			if err == nil && k != nil {
-				envVars["KAFKA_BROKERS"] = KafkaConnectionURL(k)
-			}
-		}
-	}
-
-	// Inject monitoring URLs from linked monitoring stacks
-	var monitoringIDs []string
-	_ = json.Unmarshal([]byte(app.Monitorings), &monitoringIDs)
-	for _, mID := range monitoringIDs {
-		mon, err := h.store.GetMonitoring(mID, userID)
-		if err != nil || mon == nil {
-			continue
-		}
-		if envVars == nil {
-			envVars = map[string]string{}
-		}
-		envVars[MonitoringPrometheusEnvVarName(mon.Name)] = MonitoringPrometheusURL(mon)
-		envVars[MonitoringGrafanaEnvVarName(mon.Name)] = MonitoringGrafanaURL(mon)
-	}
-	// For single-monitoring apps, also inject convenience aliases.
-	if len(monitoringIDs) == 1 {
-		mon, err := h.store.GetMonitoring(monitoringIDs[0], userID)
-		if err == nil && mon != nil {
-			if _, exists := envVars["PROMETHEUS_URL"]; !exists {
-				envVars["PROMETHEUS_URL"] = MonitoringPrometheusURL(mon)
-			}
-			if _, exists := envVars["GRAFANA_URL"]; !exists {
-				envVars["GRAFANA_URL"] = MonitoringGrafanaURL(mon)
-			}
-		}
-	}
+	d := deployer.New(h.store)
+	envVars := d.ServiceEnv(app, userID, node.ID)
 
 	// If image is from ghcr.io, authenticate first
-	if strings.HasPrefix(app.DockerImage, "ghcr.io/") {
-		ghToken, _ := h.store.GetSecretUserSetting(userID, "github_token")
-		ghUsername, _ := h.store.GetUserSetting(userID, "github_username")
-		if ghToken != "" && ghUsername != "" {
-			loginCmd := sshexec.DockerLoginCmd(ghUsername, ghToken)
-			loginOutput, loginErr := runner.Run(loginCmd)
-			if loginErr != nil {
-				_ = h.store.UpdateDeploymentStatus(deployment.ID, userID, "failed", "")
-				deployment.Status = "failed"
-				writeJSON(w, http.StatusOK, map[string]interface{}{
-					"deployment": deployment,
-					"error":      "docker login failed: " + loginErr.Error(),
-					"output":     loginOutput,
-				})
-				return
-			}
-		}
-	}
-
-	// Write env vars to a temporary file on the node so they are never
-	// exposed in the process list or shell history.
-	var envFilePath string
-	if len(envVars) > 0 {
-		envFilePath = fmt.Sprintf("/tmp/%s.env", containerName)
-		var buf strings.Builder
-		for k, v := range envVars {
-			buf.WriteString(k)
-			buf.WriteByte('=')
-			buf.WriteString(v)
-			buf.WriteByte('\n')
-		}
-		if err := runner.WriteFile(envFilePath, buf.String()); err != nil {
-			_ = h.store.UpdateDeploymentStatus(deployment.ID, userID, "failed", "")
-			deployment.Status = "failed"
-			writeJSON(w, http.StatusOK, map[string]interface{}{
-				"deployment": deployment,
-				"error":      "failed to write env file: " + err.Error(),
-			})
-			return
-		}
-	}
-
-	cfg := sshexec.RunConfig{
-		ContainerName: containerName,
-		Image:         app.DockerImage,
-		Ports:         ports,
-		Volumes:       volumes,
-		EnvFilePath:   envFilePath,
-		CommandArgs:   shellFields(app.Command),
-	}
-
-	if app.Domain != "" {
-		containerPort := "80"
-		if len(ports) > 0 {
-			// Parse "hostPort:containerPort" → take container side
-			if idx := strings.LastIndex(ports[0], ":"); idx >= 0 {
-				containerPort = ports[0][idx+1:]
-			}
-		}
-		cfg.Network = "traefik-net"
-		cfg.Labels = sshexec.TraefikLabels(containerName, app.Domain, containerPort)
+	if loginOutput, loginErr := d.DockerLogin(runner, app.DockerImage, userID); loginErr != nil {
+		_ = h.store.UpdateDeploymentStatus(deployment.ID, userID, "failed", "")
+		deployment.Status = "failed"
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"deployment": deployment,
+			"error":      "docker login failed: " + loginErr.Error(),
+			"output":     loginOutput,
+		})
+		return
 	}
 
-	cmd := sshexec.DockerRunCmd(cfg)
-	output, runErr := runner.Run(cmd)
-
-	// Always remove the env file — docker run -d has already loaded it.
-	if envFilePath != "" {
-		_, _ = runner.Run(sshexec.RemoveFileCmd(envFilePath))
+	cfg := deployer.ServiceRunConfig(app, containerName)
+	if netErr := d.AttachServiceNetwork(runner, &cfg, app, userID, node.ID); netErr != nil {
+		_ = h.store.UpdateDeploymentStatus(deployment.ID, userID, "failed", "")
+		deployment.Status = "failed"
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"deployment": deployment,
+			"error":      netErr.Error(),
+		})
+		return
 	}
-
+	output, runErr := deployer.RunContainer(runner, cfg, envVars)
 	if runErr != nil {
 		_ = h.store.UpdateDeploymentStatus(deployment.ID, userID, "failed", "")
 		deployment.Status = "failed"
@@ -300,6 +159,7 @@ func (h *DeploymentHandler) Create(w http.ResponseWriter, r *http.Request) {
 	deployment.ContainerID = containerID
 	deployment.LastDeployedAt = &now
 
+	reconcileFirewalls(h.store, userID)
 	writeJSON(w, http.StatusCreated, deployment)
 }
 
@@ -337,7 +197,7 @@ func (h *DeploymentHandler) Get(w http.ResponseWriter, r *http.Request, id strin
 }
 
 func (h *DeploymentHandler) Delete(w http.ResponseWriter, r *http.Request, id string) {
-	userID := getUserID(w, r)
+	userID := requireRole(w, r, models.RoleDeployer)
 	if userID == "" {
 		return
 	}
@@ -353,19 +213,28 @@ func (h *DeploymentHandler) Delete(w http.ResponseWriter, r *http.Request, id st
 
 	node, err := h.store.GetNodeForUser(d.NodeID, userID, isRoot(r))
 	if err == nil && node != nil {
+		runner := sshexec.NewRunner(node)
+		// Tear down an active canary first so Traefik stops routing to it.
+		if c, _ := h.store.GetActiveCanaryForDeployment(id, userID); c != nil {
+			_ = deployer.StopCanary(runner, c, d.ContainerName)
+			_ = h.store.UpdateCanaryStatus(c.ID, userID, "aborted", c.ContainerID)
+		}
 		cmd := sshexec.DockerStopRemoveCmd(d.ContainerName)
-		_, _ = sshexec.NewRunner(node).Run(cmd)
+		_, _ = runner.Run(cmd)
 	}
 
 	if err := h.store.DeleteDeployment(id, userID); err != nil {
 		writeInternalError(w, err)
 		return
 	}
+	_ = h.store.ClearHealState(models.HealResourceDeployment, id)
+	_ = h.store.DeleteMetricSamples(models.MetricKindDeployment, id)
+	reconcileFirewalls(h.store, userID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *DeploymentHandler) Restart(w http.ResponseWriter, r *http.Request, id string) {
-	userID := getUserID(w, r)
+	userID := requireRole(w, r, models.RoleDeployer)
 	if userID == "" {
 		return
 	}
@@ -397,12 +266,103 @@ func (h *DeploymentHandler) Restart(w http.ResponseWriter, r *http.Request, id s
 	_ = h.store.UpdateDeploymentStatus(id, userID, "running", d.ContainerID)
 	_ = h.store.UpdateDeploymentLastDeployedAt(id, userID, now)
 	_ = h.store.UpdateServiceLastDeployedAt(d.ServiceID, userID, now)
+	// A manual restart also pulls the deployment out of crash_loop.
+	_ = h.store.ClearHealState(models.HealResourceDeployment, id)
 	writeJSON(w, http.StatusOK, map[string]string{
 		"status":  "running",
 		"message": "container restarted",
 	})
 }
 
+// Rollback recreates the deployment's container from the image it ran before
+// it was last recreated, e.g. by a redeploy that pulled a newer image, and
+// pins it there until the next redeploy.
+func (h *DeploymentHandler) Rollback(w http.ResponseWriter, r *http.Request, id string) {
+	userID := requireRole(w, r, models.RoleDeployer)
+	if userID == "" {
+		return
+	}
+	d, err := h.store.GetDeployment(id, userID)
+	if err != nil || d == nil {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	if d.PreviousImage == "" {
+		writeError(w, http.StatusConflict, deployer.ErrNoPreviousImage.Error())
+		return
+	}
+	node, err := h.store.GetNodeForUser(d.NodeID, userID, isRoot(r))
+	if err != nil || node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	d.UserID = userID
+
+	from := d.PreviousImage
+	containerID, runErr := deployer.New(h.store).RollbackDeployment(d, node)
+	if runErr != nil {
+		_ = h.store.UpdateDeploymentStatus(id, userID, "failed", "")
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status":  "error",
+			"message": runErr.Error(),
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	_ = h.store.UpdateDeploymentStatus(id, userID, "running", containerID)
+	_ = h.store.UpdateDeploymentLastDeployedAt(id, userID, now)
+	_ = h.store.ClearHealState(models.HealResourceDeployment, id)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":       "running",
+		"message":      "rolled back to " + from,
+		"image":        from,
+		"container_id": containerID,
+	})
+}
+
+// Redeploy recreates the deployment's container from the service's current
+// configuration, pulling its image again. It ends a rollback's pin.
+func (h *DeploymentHandler) Redeploy(w http.ResponseWriter, r *http.Request, id string) {
+	userID := requireRole(w, r, models.RoleDeployer)
+	if userID == "" {
+		return
+	}
+	d, err := h.store.GetDeployment(id, userID)
+	if err != nil || d == nil {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	node, err := h.store.GetNodeForUser(d.NodeID, userID, isRoot(r))
+	if err != nil || node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	d.UserID = userID
+
+	containerID, runErr := deployer.New(h.store).RedeployDeployment(d, node)
+	if runErr != nil {
+		_ = h.store.UpdateDeploymentStatus(id, userID, "failed", "")
+		writeJSON(w, http.StatusOK, map[string]string{
+			"status":  "error",
+			"message": runErr.Error(),
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	_ = h.store.UpdateDeploymentStatus(id, userID, "running", containerID)
+	_ = h.store.UpdateDeploymentLastDeployedAt(id, userID, now)
+	_ = h.store.UpdateServiceLastDeployedAt(d.ServiceID, userID, now)
+	_ = h.store.ClearHealState(models.HealResourceDeployment, id)
+	reconcileFirewalls(h.store, userID)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status":       "running",
+		"message":      "container recreated",
+		"container_id": containerID,
+	})
+}
+
 func (h *DeploymentHandler) Logs(w http.ResponseWriter, r *http.Request, id string) {
 	userID := getUserID(w, r)
 	if userID == "" {
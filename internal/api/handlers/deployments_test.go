@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
 )
 
 func TestDeploymentCreate_MissingFields(t *testing.T) {
@@ -294,3 +295,25 @@ func TestDeploymentLogs_NodeMissing(t *testing.T) {
 		t.Errorf("expected 404 when node missing, got %d", rec.Code)
 	}
 }
+
+func TestDeploymentRollback_NoPreviousImage(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewDeploymentHandler(s)
+	n := mustCreateNode(t, s)
+	d := mustCreateDeployment(t, s, mustCreateApp(t, s).ID, n.ID)
+
+	rec := httptest.NewRecorder()
+	h.Rollback(rec, withUserID(httptest.NewRequest(http.MethodPost, "/api/deployments/"+d.ID+"/rollback", nil)), d.ID)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 without a previous image, got %d", rec.Code)
+	}
+
+	_ = s.SetDeploymentPreviousImage(d.ID, testUserID, "sha256:abc")
+	rec = httptest.NewRecorder()
+	h.Get(rec, withUserID(getRequest("/api/deployments/"+d.ID)), d.ID)
+	var got models.Deployment
+	decodeJSON(t, rec, &got)
+	if got.PreviousImage != "sha256:abc" {
+		t.Errorf("previous_image = %q", got.PreviousImage)
+	}
+}
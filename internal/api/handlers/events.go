@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/events"
+)
+
+// eventsKeepalive is how often an idle event stream gets a comment line, so
+// proxies do not close it.
+const eventsKeepalive = 30 * time.Second
+
+type EventsHandler struct {
+	subscribe func() (<-chan events.Event, func())
+}
+
+func NewEventsHandler() *EventsHandler {
+	return &EventsHandler{subscribe: events.Subscribe}
+}
+
+// NewEventsHandlerWithBus returns an EventsHandler reading from bus. Used in
+// tests.
+func NewEventsHandlerWithBus(bus *events.Bus) *EventsHandler {
+	return &EventsHandler{subscribe: bus.Subscribe}
+}
+
+// Stream sends the container events of the user's nodes as server-sent
+// events until the client goes away.
+func (h *EventsHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	ch, cancel := h.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventsKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if e.UserID != userID {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: container\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package handlers_test
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/events"
+)
+
+func TestEventsStream_OnlyOwnEvents(t *testing.T) {
+	bus := events.NewBus()
+	h := handlers.NewEventsHandlerWithBus(bus)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Stream(w, withUserID(r))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	// Headers are flushed after subscribing, so nothing published now is lost.
+	bus.Publish(events.Event{UserID: "someone-else", Container: "theirs", Action: "die"})
+	bus.Publish(events.Event{UserID: testUserID, Container: "web", Action: "die", ResourceType: "deployment", ResourceID: "d1"})
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if strings.Contains(line, "theirs") {
+			t.Fatalf("received another user's event: %s", line)
+		}
+		if !strings.Contains(line, `"container":"web"`) || !strings.Contains(line, `"resource_id":"d1"`) {
+			t.Errorf("unexpected event: %s", line)
+		}
+		return
+	}
+	t.Fatalf("stream ended without an event: %v", scanner.Err())
+}
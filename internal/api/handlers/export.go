@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gsarma/localisprod-v2/internal/compose"
+	"github.com/gsarma/localisprod-v2/internal/manifest"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+type ExportHandler struct {
+	store *store.Store
+}
+
+func NewExportHandler(s *store.Store) *ExportHandler {
+	return &ExportHandler{store: s}
+}
+
+// Export returns the workspace as a YAML file. format=manifest, the default,
+// is a manifest that POST /api/apply accepts; format=compose is a
+// docker-compose file that runs the services and their managed resources on
+// one machine. mask_secrets=true leaves passwords and secret env vars out;
+// they are always left out for callers below admin.
+// GET /api/export
+func (h *ExportHandler) Export(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "manifest"
+	}
+	if format != "manifest" && format != "compose" {
+		writeError(w, http.StatusBadRequest, "format must be manifest or compose")
+		return
+	}
+
+	st, err := workspaceState(h.store, r, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	m := manifest.FromState(st)
+	if q.Get("mask_secrets") == "true" || !hasRole(r, models.RoleAdmin) {
+		m.Mask()
+	}
+	var out []byte
+	filename := "localisprod.yaml"
+	if format == "compose" {
+		out, err = compose.Export(m)
+		filename = "docker-compose.yml"
+	} else {
+		out, err = m.Marshal()
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	_, _ = w.Write(out)
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+type FirewallHandler struct {
+	store *store.Store
+}
+
+func NewFirewallHandler(s *store.Store) *FirewallHandler {
+	return &FirewallHandler{store: s}
+}
+
+// reconcileFirewalls re-applies the user's firewall rulesets in the
+// background after a change to what is published or who links to it.
+// Failures are logged and recorded per node; they never fail or slow down the
+// request that triggered them.
+func reconcileFirewalls(s *store.Store, userID string) {
+	deployer.New(s).ScheduleFirewallReconcile(userID)
+}
+
+// List returns the firewalled nodes with their last apply outcome and the
+// user's extra rules.
+func (h *FirewallHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	nodes, err := h.store.ListNodeFirewalls(userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	rules, err := h.store.ListFirewallRules(userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if nodes == nil {
+		nodes = []*models.NodeFirewall{}
+	}
+	if rules == nil {
+		rules = []*models.FirewallRule{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"nodes": nodes,
+		"rules": rules,
+	})
+}
+
+func (h *FirewallHandler) CreateRule(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		NodeID      string `json:"node_id"`
+		Protocol    string `json:"protocol"`
+		Port        int    `json:"port"`
+		Source      string `json:"source"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.Protocol == "" {
+		body.Protocol = "tcp"
+	}
+	if body.Protocol != "tcp" && body.Protocol != "udp" {
+		writeError(w, http.StatusBadRequest, "protocol must be tcp or udp")
+		return
+	}
+	if body.Port < 1 || body.Port > 65535 {
+		writeError(w, http.StatusBadRequest, "port must be between 1 and 65535")
+		return
+	}
+	body.Source = strings.TrimSpace(body.Source)
+	if body.Source != "" {
+		if _, _, err := net.ParseCIDR(body.Source); err != nil && net.ParseIP(body.Source) == nil {
+			writeError(w, http.StatusBadRequest, "source must be an IP address or CIDR")
+			return
+		}
+	}
+	if body.NodeID != "" {
+		node, err := h.store.GetNode(body.NodeID, userID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if node == nil {
+			writeError(w, http.StatusBadRequest, "node not found")
+			return
+		}
+	}
+
+	rule := &models.FirewallRule{
+		ID:          uuid.New().String(),
+		NodeID:      body.NodeID,
+		Protocol:    body.Protocol,
+		Port:        body.Port,
+		Source:      body.Source,
+		Description: body.Description,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := h.store.CreateFirewallRule(rule, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	reconcileFirewalls(h.store, userID)
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+func (h *FirewallHandler) DeleteRule(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	deleted, err := h.store.DeleteFirewallRule(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "firewall rule not found")
+		return
+	}
+	reconcileFirewalls(h.store, userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Enable starts managing the firewall of a node and applies its ruleset right
+// away. The apply error, if any, is returned in "error" and recorded on the
+// node; the firewall stays enabled so the poller keeps retrying. The
+// management node is refused: its ruleset would drop the API's own port.
+func (h *FirewallHandler) Enable(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.IsLocal {
+		writeError(w, http.StatusBadRequest, "the management node's firewall cannot be managed")
+		return
+	}
+	ruleset, applyErr, err := deployer.New(h.store).EnableFirewall(node, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	resp := map[string]interface{}{"ruleset": ruleset}
+	if applyErr != nil {
+		resp["error"] = applyErr.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Disable stops managing the firewall of a node and removes its ruleset.
+func (h *FirewallHandler) Disable(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	removeErr, err := deployer.New(h.store).DisableFirewall(node, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if removeErr != nil {
+		writeJSON(w, http.StatusOK, map[string]string{"error": removeErr.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
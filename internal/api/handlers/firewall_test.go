@@ -0,0 +1,102 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+func TestFirewallRuleCreate_ListDelete(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewFirewallHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.CreateRule(rec, postJSON(t, "/api/firewall/rules", map[string]interface{}{
+		"port":   3000,
+		"source": "198.51.100.0/24",
+	}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (body: %s)", rec.Code, rec.Body)
+	}
+	var rule models.FirewallRule
+	decodeJSON(t, rec, &rule)
+	if rule.Protocol != "tcp" {
+		t.Errorf("expected protocol to default to tcp, got %q", rule.Protocol)
+	}
+
+	rec = httptest.NewRecorder()
+	h.List(rec, getRequest("/api/firewall"))
+	var list struct {
+		Nodes []models.NodeFirewall `json:"nodes"`
+		Rules []models.FirewallRule `json:"rules"`
+	}
+	decodeJSON(t, rec, &list)
+	if len(list.Rules) != 1 || list.Nodes == nil {
+		t.Errorf("unexpected list: %+v", list)
+	}
+
+	rec = httptest.NewRecorder()
+	h.DeleteRule(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/firewall/rules/"+rule.ID, nil)), rule.ID)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.DeleteRule(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/firewall/rules/"+rule.ID, nil)), rule.ID)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 on second delete, got %d", rec.Code)
+	}
+}
+
+func TestFirewallRuleCreate_Invalid(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewFirewallHandler(s)
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{"missing port", map[string]interface{}{}},
+		{"port out of range", map[string]interface{}{"port": 70000}},
+		{"bad protocol", map[string]interface{}{"port": 53, "protocol": "icmp"}},
+		{"bad source", map[string]interface{}{"port": 53, "source": "office"}},
+		{"unknown node", map[string]interface{}{"port": 53, "node_id": "missing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.CreateRule(rec, postJSON(t, "/api/firewall/rules", tt.body))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d (body: %s)", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestFirewallEnable_NodeNotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewFirewallHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Enable(rec, withUserID(httptest.NewRequest(http.MethodPost, "/api/nodes/missing/firewall", nil)), "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestFirewallEnable_RejectsManagementNode(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s) // IsLocal=true
+	h := handlers.NewFirewallHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Enable(rec, withUserID(httptest.NewRequest(http.MethodPost, "/api/nodes/"+n.ID+"/firewall", nil)), n.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", rec.Code, rec.Body)
+	}
+	if fws, _ := s.ListNodeFirewalls(testUserID); len(fws) != 0 {
+		t.Errorf("management node firewall was enabled: %+v", fws)
+	}
+}
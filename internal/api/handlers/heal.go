@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// HealHandler exposes the self-healing policy and state shared by deployments
+// and managed resources.
+type HealHandler struct {
+	store *store.Store
+}
+
+func NewHealHandler(s *store.Store) *HealHandler {
+	return &HealHandler{store: s}
+}
+
+// parseHealPolicy validates an optional heal policy from a create request body.
+// An empty value defaults to observe. On failure it writes a 400 and returns false.
+func parseHealPolicy(w http.ResponseWriter, policy string) (string, bool) {
+	switch policy {
+	case "":
+		return models.HealPolicyObserve, true
+	case models.HealPolicyObserve, models.HealPolicyRestart, models.HealPolicyRecreate:
+		return policy, true
+	}
+	writeError(w, http.StatusBadRequest, "heal_policy must be one of: observe, restart, recreate")
+	return "", false
+}
+
+// Get returns the heal policy of a resource together with its current heal state
+// (null when the resource has not needed healing).
+func (h *HealHandler) Get(w http.ResponseWriter, r *http.Request, resourceType, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	policy, err := h.store.GetHealPolicy(resourceType, id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if policy == "" {
+		writeError(w, http.StatusNotFound, resourceType+" not found")
+		return
+	}
+	state, err := h.store.GetHealState(resourceType, id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"heal_policy": policy,
+		"heal_state":  state,
+	})
+}
+
+// Update changes the heal policy of a resource. Changing the policy resets any
+// previous heal attempts so a resource in crash_loop gets a fresh budget.
+func (h *HealHandler) Update(w http.ResponseWriter, r *http.Request, resourceType, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		HealPolicy string `json:"heal_policy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.HealPolicy == "" {
+		writeError(w, http.StatusBadRequest, "heal_policy is required")
+		return
+	}
+	policy, ok := parseHealPolicy(w, body.HealPolicy)
+	if !ok {
+		return
+	}
+	found, err := h.store.UpdateHealPolicy(resourceType, id, userID, policy)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, resourceType+" not found")
+		return
+	}
+	_ = h.store.ClearHealState(resourceType, id)
+	writeJSON(w, http.StatusOK, map[string]string{"heal_policy": policy})
+}
@@ -0,0 +1,132 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+func putHealPolicy(t *testing.T, path, policy string) *http.Request {
+	t.Helper()
+	b, err := json.Marshal(map[string]string{"heal_policy": policy})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	r := httptest.NewRequest(http.MethodPut, path, bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json")
+	return withUserID(r)
+}
+
+func TestHealUpdate_Success(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewHealHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+
+	rec := httptest.NewRecorder()
+	h.Update(rec, putHealPolicy(t, "/api/deployments/"+d.ID+"/heal-policy", "restart"), models.HealResourceDeployment, d.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", rec.Code, rec.Body)
+	}
+
+	got, _ := s.GetDeployment(d.ID, testUserID)
+	if got.HealPolicy != models.HealPolicyRestart {
+		t.Errorf("expected restart, got %q", got.HealPolicy)
+	}
+}
+
+func TestHealUpdate_InvalidPolicy(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewHealHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+
+	for _, policy := range []string{"", "reboot"} {
+		rec := httptest.NewRecorder()
+		h.Update(rec, putHealPolicy(t, "/api/deployments/"+d.ID+"/heal-policy", policy), models.HealResourceDeployment, d.ID)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("policy %q: expected 400, got %d", policy, rec.Code)
+		}
+	}
+}
+
+func TestHealUpdate_NotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewHealHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Update(rec, putHealPolicy(t, "/api/databases/nonexistent/heal-policy", "recreate"), models.HealResourceDatabase, "nonexistent")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestHealUpdate_ResetsHealState(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewHealHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+	_ = s.SaveHealState(&models.HealState{ResourceType: models.HealResourceDeployment, ResourceID: d.ID, Attempts: 5})
+
+	rec := httptest.NewRecorder()
+	h.Update(rec, putHealPolicy(t, "/api/deployments/"+d.ID+"/heal-policy", "recreate"), models.HealResourceDeployment, d.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	state, _ := s.GetHealState(models.HealResourceDeployment, d.ID)
+	if state != nil {
+		t.Errorf("expected heal state to be cleared, got %+v", state)
+	}
+}
+
+func TestHealGet(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewHealHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+	d := mustCreateDeployment(t, s, a.ID, n.ID)
+	_ = s.SaveHealState(&models.HealState{ResourceType: models.HealResourceDeployment, ResourceID: d.ID, Attempts: 2, LastError: "boom"})
+
+	rec := httptest.NewRecorder()
+	h.Get(rec, getRequest("/api/deployments/"+d.ID+"/heal-policy"), models.HealResourceDeployment, d.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var resp struct {
+		HealPolicy string            `json:"heal_policy"`
+		HealState  *models.HealState `json:"heal_state"`
+	}
+	decodeJSON(t, rec, &resp)
+	if resp.HealPolicy != models.HealPolicyObserve {
+		t.Errorf("expected observe, got %q", resp.HealPolicy)
+	}
+	if resp.HealState == nil || resp.HealState.Attempts != 2 {
+		t.Errorf("unexpected heal state: %+v", resp.HealState)
+	}
+}
+
+func TestDeploymentCreate_InvalidHealPolicy(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewDeploymentHandler(s)
+	n := mustCreateNode(t, s)
+	a := mustCreateApp(t, s)
+
+	rec := httptest.NewRecorder()
+	r := postJSON(t, "/api/deployments", map[string]any{
+		"service_id":  a.ID,
+		"node_id":     n.ID,
+		"heal_policy": "sometimes",
+	})
+	h.Create(rec, r)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
@@ -4,52 +4,11 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"strings"
 
 	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
 )
 
-// shellFields splits s into tokens like strings.Fields but respects single-
-// and double-quoted strings so that e.g. `sh -c "a b c"` yields
-// ["sh", "-c", "a b c"] rather than ["sh", "-c", "\"a", "b", "c\""].
-func shellFields(s string) []string {
-	var tokens []string
-	var cur strings.Builder
-	inSingle, inDouble := false, false
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		switch {
-		case inSingle:
-			if c == '\'' {
-				inSingle = false
-			} else {
-				cur.WriteByte(c)
-			}
-		case inDouble:
-			if c == '"' {
-				inDouble = false
-			} else {
-				cur.WriteByte(c)
-			}
-		case c == '\'':
-			inSingle = true
-		case c == '"':
-			inDouble = true
-		case c == ' ' || c == '\t' || c == '\n':
-			if cur.Len() > 0 {
-				tokens = append(tokens, cur.String())
-				cur.Reset()
-			}
-		default:
-			cur.WriteByte(c)
-		}
-	}
-	if cur.Len() > 0 {
-		tokens = append(tokens, cur.String())
-	}
-	return tokens
-}
-
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -65,16 +24,91 @@ func writeInternalError(w http.ResponseWriter, err error) {
 	writeError(w, http.StatusInternalServerError, "internal server error")
 }
 
+// getUserID returns the ID of the organization the request acts in, which
+// owns every resource the request reads or changes (a personal organization
+// has its user's ID). Reading needs the viewer role and changing anything the
+// admin role; handlers that need another role call requireRole instead.
 func getUserID(w http.ResponseWriter, r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return requireRole(w, r, models.RoleViewer)
+	}
+	return requireRole(w, r, models.RoleAdmin)
+}
+
+// requireRole returns the ID of the organization the request acts in when the
+// caller has at least role in it, and otherwise writes 401 or 403 and returns
+// "". A request without a workspace acts in the caller's personal
+// organization, which the caller owns.
+func requireRole(w http.ResponseWriter, r *http.Request, role string) string {
 	claims := auth.ClaimsFromContext(r.Context())
 	if claims == nil {
 		writeError(w, http.StatusUnauthorized, "unauthorized")
 		return ""
 	}
-	return claims.UserID
+	ws := auth.WorkspaceFromContext(r.Context())
+	if ws == nil {
+		return claims.UserID
+	}
+	if !models.RoleAtLeast(ws.Role, role) {
+		writeError(w, http.StatusForbidden, "requires the "+role+" role in this organization")
+		return ""
+	}
+	return ws.OrgID
+}
+
+// hasRole reports whether the caller has at least role in the organization
+// the request acts in.
+func hasRole(r *http.Request, role string) bool {
+	ws := auth.WorkspaceFromContext(r.Context())
+	return ws == nil || models.RoleAtLeast(ws.Role, role)
+}
+
+// hideCredentials clears the passwords and secret keys of the resources in v,
+// a managed resource or a list of them, unless the caller is an admin, the
+// role it takes to change them.
+func hideCredentials(r *http.Request, v any) {
+	if hasRole(r, models.RoleAdmin) {
+		return
+	}
+	switch x := v.(type) {
+	case *models.Database:
+		x.Password = ""
+	case []*models.Database:
+		for _, db := range x {
+			db.Password = ""
+		}
+	case *models.Cache:
+		x.Password = ""
+	case []*models.Cache:
+		for _, c := range x {
+			c.Password = ""
+		}
+	case *models.Monitoring:
+		x.GrafanaPassword = ""
+	case []*models.Monitoring:
+		for _, m := range x {
+			m.GrafanaPassword = ""
+		}
+	case *models.ObjectStorage:
+		x.SecretAccessKey = ""
+	case []*models.ObjectStorage:
+		for _, o := range x {
+			o.SecretAccessKey = ""
+		}
+	}
 }
 
 func isRoot(r *http.Request) bool {
 	claims := auth.ClaimsFromContext(r.Context())
 	return claims != nil && claims.IsRoot
 }
+
+// rejectUnschedulable writes 409 and returns true when node is cordoned or
+// draining and so takes no new workloads.
+func rejectUnschedulable(w http.ResponseWriter, node *models.Node) bool {
+	if node.Schedulable() {
+		return false
+	}
+	writeError(w, http.StatusConflict, "node is "+node.Schedule+" and takes no new deployments")
+	return true
+}
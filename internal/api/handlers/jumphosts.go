@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+type JumpHostHandler struct {
+	store *store.Store
+}
+
+func NewJumpHostHandler(s *store.Store) *JumpHostHandler {
+	return &JumpHostHandler{store: s}
+}
+
+func (h *JumpHostHandler) Create(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		Name            string `json:"name"`
+		Host            string `json:"host"`
+		Port            int    `json:"port"`
+		Username        string `json:"username"`
+		PrivateKey      string `json:"private_key"`
+		KeyPassphrase   string `json:"key_passphrase"`
+		HostKey         string `json:"host_key"`
+		ProxyJumpHostID string `json:"proxy_jump_host_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.Name == "" || body.Host == "" || body.Username == "" || body.PrivateKey == "" {
+		writeError(w, http.StatusBadRequest, "name, host, username, and private_key are required")
+		return
+	}
+	if body.Port == 0 {
+		body.Port = 22
+	}
+	if err := sshexec.ValidateCredentials(body.PrivateKey, body.KeyPassphrase, ""); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hostKey := ""
+	if body.HostKey != "" {
+		k, err := sshexec.NormalizeHostKey(body.HostKey)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		hostKey = k
+	}
+	if body.ProxyJumpHostID != "" {
+		proxy, err := h.store.GetJumpHost(body.ProxyJumpHostID, userID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if proxy == nil {
+			writeError(w, http.StatusBadRequest, "proxy jump host not found")
+			return
+		}
+	}
+	j := &models.JumpHost{
+		ID:              uuid.New().String(),
+		Name:            body.Name,
+		Host:            body.Host,
+		Port:            body.Port,
+		Username:        body.Username,
+		PrivateKey:      body.PrivateKey,
+		KeyPassphrase:   body.KeyPassphrase,
+		HostKey:         hostKey,
+		ProxyJumpHostID: body.ProxyJumpHostID,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if err := h.store.CreateJumpHost(j, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	j.PrivateKey = ""
+	writeJSON(w, http.StatusCreated, j)
+}
+
+func (h *JumpHostHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	hosts, err := h.store.ListJumpHosts(userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if hosts == nil {
+		hosts = []*models.JumpHost{}
+	}
+	for _, j := range hosts {
+		j.PrivateKey = ""
+	}
+	writeJSON(w, http.StatusOK, hosts)
+}
+
+// Delete removes a jump host nothing dials through any more.
+func (h *JumpHostHandler) Delete(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	j, err := h.store.GetJumpHost(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if j == nil {
+		writeError(w, http.StatusNotFound, "jump host not found")
+		return
+	}
+	if used, err := h.store.JumpHostInUse(id); err != nil {
+		writeInternalError(w, err)
+		return
+	} else if used {
+		writeError(w, http.StatusConflict, "nodes or jump hosts are reached through this jump host; move them off it first")
+		return
+	}
+	if err := h.store.DeleteJumpHost(id, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	sshexec.EvictJumpHost(id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+func TestJumpHostCreateListDelete(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewJumpHostHandler(s)
+	nodeH := handlers.NewNodeHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/jump-hosts", map[string]any{
+		"name": "bastion", "host": "203.0.113.10", "username": "ops", "private_key": "key",
+	}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var j models.JumpHost
+	decodeJSON(t, rec, &j)
+	if j.Port != 22 || j.PrivateKey != "" {
+		t.Errorf("expected default port and no key in response, got %+v", j)
+	}
+
+	rec = httptest.NewRecorder()
+	h.List(rec, getRequest("/api/jump-hosts"))
+	var list []models.JumpHost
+	decodeJSON(t, rec, &list)
+	if len(list) != 1 || list[0].PrivateKey != "" {
+		t.Fatalf("expected one jump host without key, got %+v", list)
+	}
+
+	rec = httptest.NewRecorder()
+	nodeH.Create(rec, postJSON(t, "/api/nodes", map[string]any{
+		"name": "private", "host": "10.0.0.5", "username": "root", "private_key": "key", "proxy_jump_host_id": j.ID,
+	}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.Delete(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/jump-hosts/"+j.ID, nil)), j.ID)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 while a node uses it, got %d", rec.Code)
+	}
+}
+
+func TestJumpHostCreate_UnknownProxy(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewJumpHostHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/jump-hosts", map[string]any{
+		"name": "inner", "host": "10.0.0.2", "username": "ops", "private_key": "key", "proxy_jump_host_id": "missing",
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestNodeCreate_InvalidProxy(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	local := mustCreateNode(t, s)
+
+	for name, proxy := range map[string]map[string]any{
+		"missing node": {"proxy_node_id": "missing"},
+		"local node":   {"proxy_node_id": local.ID},
+		"missing jump": {"proxy_jump_host_id": "missing"},
+		"both":         {"proxy_node_id": local.ID, "proxy_jump_host_id": "x"},
+	} {
+		body := map[string]any{"name": "n", "host": "10.0.0.5", "username": "root", "private_key": "key"}
+		for k, v := range proxy {
+			body[k] = v
+		}
+		rec := httptest.NewRecorder()
+		h.Create(rec, postJSON(t, "/api/nodes", body))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, rec.Code)
+		}
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -31,6 +31,8 @@ func (h *KafkaHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Version string `json:"version"`
 		NodeID  string `json:"node_id"`
 		Port    int    `json:"port"`
+
+		HealPolicy string `json:"heal_policy"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
@@ -40,6 +42,10 @@ func (h *KafkaHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "name and node_id are required")
 		return
 	}
+	healPolicy, ok := parseHealPolicy(w, body.HealPolicy)
+	if !ok {
+		return
+	}
 
 	version := body.Version
 	if version == "" {
@@ -59,6 +65,9 @@ func (h *KafkaHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusForbidden, "only the root user can create Kafka clusters on the management node")
 		return
 	}
+	if rejectUnschedulable(w, node) {
+		return
+	}
 
 	// Check for port conflicts before creating the container.
 	if used, err := h.store.IsPortUsedOnNode(body.NodeID, port); err != nil {
@@ -74,10 +83,8 @@ func (h *KafkaHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	safeName := strings.ReplaceAll(body.Name, " ", "-")
 	shortID := uuid.New().String()[:8]
-	containerName := fmt.Sprintf("localisprod-kafka-%s-%s", safeName, shortID)
-	volumeName := fmt.Sprintf("localisprod-kafka-%s-data", safeName)
+	containerName := fmt.Sprintf("localisprod-kafka-%s-%s", deployer.SafeName(body.Name), shortID)
 
 	k := &models.Kafka{
 		ID:            uuid.New().String(),
@@ -87,6 +94,7 @@ func (h *KafkaHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Port:          port,
 		ContainerName: containerName,
 		Status:        "pending",
+		HealPolicy:    healPolicy,
 		CreatedAt:     time.Now().UTC(),
 	}
 	if err := h.store.CreateKafka(k, userID); err != nil {
@@ -95,49 +103,21 @@ func (h *KafkaHandler) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create named volume for Kafka data (idempotent)
-	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(volumeName))
+	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(deployer.KafkaVolumeName(body.Name)))
 
-	// Write Kafka configuration env vars to a temp file on the node.
+	// Kafka configuration env vars are written to a temp file on the node.
 	// Using apache/kafka in KRaft mode (no ZooKeeper).
-	envFilePath := fmt.Sprintf("/tmp/%s.env", containerName)
-	kafkaEnv := fmt.Sprintf(
-		"KAFKA_NODE_ID=1\n"+
-			"KAFKA_PROCESS_ROLES=broker,controller\n"+
-			"KAFKA_CONTROLLER_QUORUM_VOTERS=1@localhost:9093\n"+
-			"KAFKA_LISTENERS=PLAINTEXT://:9092,CONTROLLER://:9093\n"+
-			"KAFKA_ADVERTISED_LISTENERS=PLAINTEXT://%s:%d\n"+
-			"KAFKA_CONTROLLER_LISTENER_NAMES=CONTROLLER\n"+
-			"KAFKA_LISTENER_SECURITY_PROTOCOL_MAP=CONTROLLER:PLAINTEXT,PLAINTEXT:PLAINTEXT\n"+
-			"KAFKA_OFFSETS_TOPIC_REPLICATION_FACTOR=1\n"+
-			"KAFKA_TRANSACTION_STATE_LOG_REPLICATION_FACTOR=1\n"+
-			"KAFKA_TRANSACTION_STATE_LOG_MIN_ISR=1\n",
-		node.Host, port,
-	)
-	if err := runner.WriteFile(envFilePath, kafkaEnv); err != nil {
+	runCfg, kafkaEnv := deployer.KafkaRunConfig(k, node.Host)
+	if netErr := deployer.AttachUserNetwork(runner, &runCfg, userID); netErr != nil {
 		_ = h.store.UpdateKafkaStatus(k.ID, userID, "failed")
 		k.Status = "failed"
 		writeJSON(w, http.StatusOK, map[string]interface{}{
-			"kafka":  k,
-			"error":  "failed to write env file: " + err.Error(),
+			"kafka": k,
+			"error": netErr.Error(),
 		})
 		return
 	}
-
-	runCfg := sshexec.RunConfig{
-		ContainerName: containerName,
-		Image:         fmt.Sprintf("apache/kafka:%s", version),
-		Ports:         []string{fmt.Sprintf("%d:9092", port)},
-		Volumes:       []string{fmt.Sprintf("%s:/var/lib/kafka/data", volumeName)},
-		EnvFilePath:   envFilePath,
-		Restart:       "unless-stopped",
-	}
-
-	cmd := sshexec.DockerRunCmd(runCfg)
-	output, runErr := runner.Run(cmd)
-
-	// Remove the env file once docker run -d has loaded it
-	_, _ = runner.Run(sshexec.RemoveFileCmd(envFilePath))
-
+	output, runErr := deployer.RunContainer(runner, runCfg, kafkaEnv)
 	if runErr != nil {
 		_ = h.store.UpdateKafkaStatus(k.ID, userID, "failed")
 		k.Status = "failed"
@@ -154,6 +134,7 @@ func (h *KafkaHandler) Create(w http.ResponseWriter, r *http.Request) {
 	_ = h.store.UpdateKafkaLastDeployedAt(k.ID, userID, now)
 	k.Status = "running"
 	k.LastDeployedAt = &now
+	reconcileFirewalls(h.store, userID)
 	writeJSON(w, http.StatusCreated, k)
 }
 
@@ -214,16 +195,7 @@ func (h *KafkaHandler) Delete(w http.ResponseWriter, r *http.Request, id string)
 		writeInternalError(w, err)
 		return
 	}
+	_ = h.store.ClearHealState(models.HealResourceKafka, id)
+	reconcileFirewalls(h.store, userID)
 	w.WriteHeader(http.StatusNoContent)
 }
-
-// KafkaEnvVarName derives the env var name from a Kafka cluster name.
-// e.g. "my-kafka" → "MY_KAFKA_URL"
-func KafkaEnvVarName(name string) string {
-	return DBEnvVarName(name)
-}
-
-// KafkaConnectionURL returns the bootstrap server address for the Kafka cluster.
-func KafkaConnectionURL(k *models.Kafka) string {
-	return fmt.Sprintf("%s:%d", k.NodeHost, k.Port)
-}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// maxMetricsRange is how far back the metrics history goes; see the poller's
+// retention.
+const maxMetricsRange = 30 * 24 * time.Hour
+
+type MetricsHandler struct {
+	store *store.Store
+}
+
+func NewMetricsHandler(s *store.Store) *MetricsHandler {
+	return &MetricsHandler{store: s}
+}
+
+// Node returns a node's usage history.
+func (h *MetricsHandler) Node(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	h.list(w, r, models.MetricKindNode, id, userID)
+}
+
+// Deployment returns the usage history of a deployment's container.
+func (h *MetricsHandler) Deployment(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	dep, err := h.store.GetDeployment(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if dep == nil {
+		writeError(w, http.StatusNotFound, "deployment not found")
+		return
+	}
+	h.list(w, r, models.MetricKindDeployment, id, userID)
+}
+
+// list writes the samples of the last ?range (a Go duration, default 24h).
+// Samples older than a day come back as hourly averages.
+func (h *MetricsHandler) list(w http.ResponseWriter, r *http.Request, kind, id, userID string) {
+	rng := 24 * time.Hour
+	if v := r.URL.Query().Get("range"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "range must be a positive duration such as 6h")
+			return
+		}
+		rng = min(d, maxMetricsRange)
+	}
+	samples, err := h.store.ListMetricSamples(kind, id, userID, time.Now().Add(-rng))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if samples == nil {
+		samples = []*models.MetricSample{}
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
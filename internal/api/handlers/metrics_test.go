@@ -0,0 +1,64 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+func TestNodeMetrics_NotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewMetricsHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Node(rec, getRequest("/api/nodes/missing/metrics"), "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestNodeMetrics_Range(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewMetricsHandler(s)
+	node := mustCreateNode(t, s)
+	now := time.Now().UTC()
+	for _, age := range []time.Duration{2 * time.Hour, 10 * time.Minute} {
+		if err := s.InsertMetricSample(&models.MetricSample{
+			Kind: models.MetricKindNode, TargetID: node.ID, Timestamp: now.Add(-age), CPUPercent: 12.5, UserID: testUserID,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.Node(rec, getRequest("/api/nodes/"+node.ID+"/metrics?range=1h"), node.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", rec.Code, rec.Body)
+	}
+	var samples []models.MetricSample
+	decodeJSON(t, rec, &samples)
+	if len(samples) != 1 || samples[0].CPUPercent != 12.5 {
+		t.Errorf("expected the one sample within the last hour, got %+v", samples)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Node(rec, getRequest("/api/nodes/"+node.ID+"/metrics?range=yesterday"), node.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad range, got %d", rec.Code)
+	}
+}
+
+func TestDeploymentMetrics_NotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewMetricsHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Deployment(rec, getRequest("/api/deployments/missing/metrics"), "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
@@ -4,10 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -32,6 +32,7 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 		PrometheusPort  int    `json:"prometheus_port"`
 		GrafanaPort     int    `json:"grafana_port"`
 		GrafanaPassword string `json:"grafana_password"`
+		HealPolicy      string `json:"heal_policy"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
@@ -41,6 +42,10 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "name and node_id are required")
 		return
 	}
+	healPolicy, ok := parseHealPolicy(w, body.HealPolicy)
+	if !ok {
+		return
+	}
 
 	if body.PrometheusPort == 0 {
 		body.PrometheusPort = 9090
@@ -61,6 +66,9 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusForbidden, "only the root user can create monitoring stacks on the management node")
 		return
 	}
+	if rejectUnschedulable(w, node) {
+		return
+	}
 
 	// Check for port conflicts before creating containers.
 	runner := sshexec.NewRunner(node)
@@ -78,14 +86,10 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	safeName := strings.ReplaceAll(body.Name, " ", "-")
+	safeName := deployer.SafeName(body.Name)
 	shortID := uuid.New().String()[:8]
 	promContainer := fmt.Sprintf("localisprod-prometheus-%s-%s", safeName, shortID)
 	grafanaContainer := fmt.Sprintf("localisprod-grafana-%s-%s", safeName, shortID)
-	networkName := fmt.Sprintf("localisprod-monitoring-%s-%s-net", safeName, shortID)
-	promVolume := fmt.Sprintf("localisprod-prom-%s-%s-data", safeName, shortID)
-	grafanaVolume := fmt.Sprintf("localisprod-grafana-%s-%s-data", safeName, shortID)
-	baseDir := fmt.Sprintf("/opt/localisprod/monitoring/%s-%s", safeName, shortID)
 
 	m := &models.Monitoring{
 		ID:                      uuid.New().String(),
@@ -97,12 +101,15 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 		PrometheusContainerName: promContainer,
 		GrafanaContainerName:    grafanaContainer,
 		Status:                  "pending",
+		HealPolicy:              healPolicy,
 		CreatedAt:               time.Now().UTC(),
 	}
 	if err := h.store.CreateMonitoring(m, userID); err != nil {
 		writeInternalError(w, err)
 		return
 	}
+	paths := deployer.MonitoringPathsFor(m)
+	baseDir := paths.BaseDir
 
 	// Create config directory on the node
 	mkdirCmd := fmt.Sprintf("mkdir -p %s/grafana-provisioning/datasources", sshexec.ShellEscape(baseDir))
@@ -142,40 +149,28 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Write Grafana password env file (temporary — removed after docker run)
-	grafanaEnvPath := fmt.Sprintf("/tmp/%s.env", grafanaContainer)
-	if err := runner.WriteFile(grafanaEnvPath, fmt.Sprintf("GF_SECURITY_ADMIN_PASSWORD=%s\n", body.GrafanaPassword)); err != nil {
+	promCfg, grafanaCfg, grafanaEnv := deployer.MonitoringRunConfigs(m)
+
+	// Create Docker network (idempotent)
+	_, _ = runner.Run(sshexec.DockerNetworkCreateCmd(paths.Network))
+	if netErr := deployer.AttachUserNetwork(runner, &promCfg, userID); netErr != nil {
 		_ = h.store.UpdateMonitoringStatus(m.ID, userID, "failed")
 		m.Status = "failed"
 		writeJSON(w, http.StatusOK, map[string]interface{}{
 			"monitoring": m,
-			"error":      "failed to write grafana env file: " + err.Error(),
+			"error":      netErr.Error(),
 		})
 		return
 	}
-
-	// Create Docker network (idempotent)
-	_, _ = runner.Run(fmt.Sprintf("docker network create %s 2>/dev/null || true", sshexec.ShellEscape(networkName)))
+	grafanaCfg.Networks = append(grafanaCfg.Networks, deployer.UserNetwork(userID))
 
 	// Create named volumes
-	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(promVolume))
-	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(grafanaVolume))
+	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(paths.PromVolume))
+	_, _ = runner.Run(sshexec.DockerVolumeCreateCmd(paths.GrafanaVolume))
 
 	// Run Prometheus container
-	promCfg := sshexec.RunConfig{
-		ContainerName: promContainer,
-		Image:         "prom/prometheus:latest",
-		Ports:         []string{fmt.Sprintf("%d:9090", body.PrometheusPort)},
-		Volumes: []string{
-			fmt.Sprintf("%s:/prometheus", promVolume),
-			fmt.Sprintf("%s/prometheus.yml:/etc/prometheus/prometheus.yml:ro", baseDir),
-		},
-		Network: networkName,
-		Restart: "unless-stopped",
-	}
 	promOutput, promErr := runner.Run(sshexec.DockerRunCmd(promCfg))
 	if promErr != nil {
-		_, _ = runner.Run(sshexec.RemoveFileCmd(grafanaEnvPath))
 		_ = h.store.UpdateMonitoringStatus(m.ID, userID, "failed")
 		m.Status = "failed"
 		writeJSON(w, http.StatusOK, map[string]interface{}{
@@ -186,24 +181,8 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Run Grafana container
-	grafanaCfg := sshexec.RunConfig{
-		ContainerName: grafanaContainer,
-		Image:         "grafana/grafana:latest",
-		Ports:         []string{fmt.Sprintf("%d:3000", body.GrafanaPort)},
-		Volumes: []string{
-			fmt.Sprintf("%s:/var/lib/grafana", grafanaVolume),
-			fmt.Sprintf("%s/grafana-provisioning:/etc/grafana/provisioning:ro", baseDir),
-		},
-		Network:     networkName,
-		EnvFilePath: grafanaEnvPath,
-		Restart:     "unless-stopped",
-	}
-	grafanaOutput, grafanaErr := runner.Run(sshexec.DockerRunCmd(grafanaCfg))
-
-	// Remove temporary Grafana env file
-	_, _ = runner.Run(sshexec.RemoveFileCmd(grafanaEnvPath))
-
+	// Run Grafana container; the admin password goes through a temporary env file.
+	grafanaOutput, grafanaErr := deployer.RunContainer(runner, grafanaCfg, grafanaEnv)
 	if grafanaErr != nil {
 		_ = h.store.UpdateMonitoringStatus(m.ID, userID, "failed")
 		m.Status = "failed"
@@ -220,6 +199,7 @@ func (h *MonitoringHandler) Create(w http.ResponseWriter, r *http.Request) {
 	_ = h.store.UpdateMonitoringLastDeployedAt(m.ID, userID, now)
 	m.Status = "running"
 	m.LastDeployedAt = &now
+	reconcileFirewalls(h.store, userID)
 	writeJSON(w, http.StatusCreated, m)
 }
 
@@ -236,6 +216,7 @@ func (h *MonitoringHandler) List(w http.ResponseWriter, r *http.Request) {
 	if monitorings == nil {
 		monitorings = []*models.Monitoring{}
 	}
+	hideCredentials(r, monitorings)
 	writeJSON(w, http.StatusOK, monitorings)
 }
 
@@ -253,6 +234,7 @@ func (h *MonitoringHandler) Get(w http.ResponseWriter, r *http.Request, id strin
 		writeError(w, http.StatusNotFound, "monitoring stack not found")
 		return
 	}
+	hideCredentials(r, m)
 	writeJSON(w, http.StatusOK, m)
 }
 
@@ -277,8 +259,7 @@ func (h *MonitoringHandler) Delete(w http.ResponseWriter, r *http.Request, id st
 		_, _ = runner.Run(sshexec.DockerStopRemoveCmd(m.GrafanaContainerName))
 		_, _ = runner.Run(sshexec.DockerStopRemoveCmd(m.PrometheusContainerName))
 		// Remove persistent config directory
-		baseDirSuffix := strings.TrimPrefix(m.PrometheusContainerName, "localisprod-prometheus-")
-		baseDir := "/opt/localisprod/monitoring/" + baseDirSuffix
+		baseDir := deployer.MonitoringPathsFor(m).BaseDir
 		_, _ = runner.Run(fmt.Sprintf("rm -rf %s", sshexec.ShellEscape(baseDir)))
 	}
 
@@ -286,31 +267,7 @@ func (h *MonitoringHandler) Delete(w http.ResponseWriter, r *http.Request, id st
 		writeInternalError(w, err)
 		return
 	}
+	_ = h.store.ClearHealState(models.HealResourceMonitoring, id)
+	reconcileFirewalls(h.store, userID)
 	w.WriteHeader(http.StatusNoContent)
 }
-
-// MonitoringPrometheusEnvVarName derives the env var name for the Prometheus URL.
-// e.g. "my-monitor" → "MY_MONITOR_PROMETHEUS_URL"
-func MonitoringPrometheusEnvVarName(name string) string {
-	upper := strings.ToUpper(name)
-	cleaned := strings.NewReplacer("-", "_", " ", "_", ".", "_").Replace(upper)
-	return cleaned + "_PROMETHEUS_URL"
-}
-
-// MonitoringGrafanaEnvVarName derives the env var name for the Grafana URL.
-// e.g. "my-monitor" → "MY_MONITOR_GRAFANA_URL"
-func MonitoringGrafanaEnvVarName(name string) string {
-	upper := strings.ToUpper(name)
-	cleaned := strings.NewReplacer("-", "_", " ", "_", ".", "_").Replace(upper)
-	return cleaned + "_GRAFANA_URL"
-}
-
-// MonitoringPrometheusURL returns the HTTP URL for the Prometheus HTTP API.
-func MonitoringPrometheusURL(m *models.Monitoring) string {
-	return fmt.Sprintf("http://%s:%d", m.NodeHost, m.PrometheusPort)
-}
-
-// MonitoringGrafanaURL returns the HTTP URL for the Grafana UI.
-func MonitoringGrafanaURL(m *models.Monitoring) string {
-	return fmt.Sprintf("http://%s:%d", m.NodeHost, m.GrafanaPort)
-}
@@ -2,11 +2,13 @@ package handlers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -35,18 +37,33 @@ func (h *NodeHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var body struct {
-		Name       string `json:"name"`
-		Host       string `json:"host"`
-		Port       int    `json:"port"`
-		Username   string `json:"username"`
-		PrivateKey string `json:"private_key"`
+		Name            string `json:"name"`
+		Host            string `json:"host"`
+		Port            int    `json:"port"`
+		Username        string `json:"username"`
+		PrivateKey      string `json:"private_key"`
+		KeyPassphrase   string `json:"key_passphrase"`
+		Certificate     string `json:"certificate"`
+		Password        string `json:"password"`
+		GenerateKey     bool   `json:"generate_key"`
+		HostKey         string `json:"host_key"`
+		ProxyNodeID     string `json:"proxy_node_id"`
+		ProxyJumpHostID string `json:"proxy_jump_host_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
 		return
 	}
-	if body.Name == "" || body.Host == "" || body.Username == "" || body.PrivateKey == "" {
-		writeError(w, http.StatusBadRequest, "name, host, username, and private_key are required")
+	if body.Name == "" || body.Host == "" || body.Username == "" || (body.PrivateKey == "" && body.Password == "") {
+		writeError(w, http.StatusBadRequest, "name, host, username, and private_key or password are required")
+		return
+	}
+	if body.GenerateKey && (body.Password == "" || body.PrivateKey != "") {
+		writeError(w, http.StatusBadRequest, "generate_key needs password and no private_key")
+		return
+	}
+	if err := sshexec.ValidateCredentials(body.PrivateKey, body.KeyPassphrase, body.Certificate); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	if localHosts[strings.ToLower(body.Host)] && !isRoot(r) {
@@ -56,15 +73,52 @@ func (h *NodeHandler) Create(w http.ResponseWriter, r *http.Request) {
 	if body.Port == 0 {
 		body.Port = 22
 	}
+	hostKey := ""
+	if body.HostKey != "" {
+		k, err := sshexec.NormalizeHostKey(body.HostKey)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		hostKey = k
+	}
+	if msg, err := h.checkProxy(userID, body.ProxyNodeID, body.ProxyJumpHostID); err != nil {
+		writeInternalError(w, err)
+		return
+	} else if msg != "" {
+		writeError(w, http.StatusBadRequest, msg)
+		return
+	}
 	node := &models.Node{
-		ID:         uuid.New().String(),
-		Name:       body.Name,
-		Host:       body.Host,
-		Port:       body.Port,
-		Username:   body.Username,
-		PrivateKey: body.PrivateKey,
-		Status:     "unknown",
-		CreatedAt:  time.Now().UTC(),
+		ID:              uuid.New().String(),
+		Name:            body.Name,
+		Host:            body.Host,
+		Port:            body.Port,
+		Username:        body.Username,
+		PrivateKey:      body.PrivateKey,
+		KeyPassphrase:   body.KeyPassphrase,
+		Certificate:     body.Certificate,
+		Password:        body.Password,
+		Status:          "unknown",
+		HostKey:         hostKey,
+		ProxyNodeID:     body.ProxyNodeID,
+		ProxyJumpHostID: body.ProxyJumpHostID,
+		CreatedAt:       time.Now().UTC(),
+	}
+	if body.GenerateKey {
+		// The password is only used to install the generated key; it is not
+		// stored.
+		privateKey, publicKey, err := sshexec.GenerateKeyPair()
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		node.HostKey, err = sshexec.InstallAuthorizedKey(node, body.Password, publicKey)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, "install generated key: "+err.Error())
+			return
+		}
+		node.PrivateKey, node.Password = privateKey, ""
 	}
 	if err := h.store.CreateNode(node, userID); err != nil {
 		writeInternalError(w, err)
@@ -74,6 +128,36 @@ func (h *NodeHandler) Create(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, node)
 }
 
+// checkProxy validates the SSH proxy a node is registered behind and returns
+// why it is unusable, if it is.
+func (h *NodeHandler) checkProxy(userID, proxyNodeID, jumpHostID string) (string, error) {
+	if proxyNodeID != "" && jumpHostID != "" {
+		return "set either proxy_node_id or proxy_jump_host_id, not both", nil
+	}
+	if proxyNodeID != "" {
+		proxy, err := h.store.GetNode(proxyNodeID, userID)
+		if err != nil {
+			return "", err
+		}
+		if proxy == nil {
+			return "proxy node not found", nil
+		}
+		if proxy.IsLocal {
+			return "a local node cannot be an SSH proxy", nil
+		}
+	}
+	if jumpHostID != "" {
+		j, err := h.store.GetJumpHost(jumpHostID, userID)
+		if err != nil {
+			return "", err
+		}
+		if j == nil {
+			return "jump host not found", nil
+		}
+	}
+	return "", nil
+}
+
 func (h *NodeHandler) List(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(w, r)
 	if userID == "" {
@@ -135,10 +219,28 @@ func (h *NodeHandler) Delete(w http.ResponseWriter, r *http.Request, id string)
 		writeError(w, http.StatusNotFound, "node not found")
 		return
 	}
+	if used, err := h.store.NodeUsedAsProxy(id); err != nil {
+		writeInternalError(w, err)
+		return
+	} else if used {
+		writeError(w, http.StatusConflict, "other nodes are reached through this node; move them off it first")
+		return
+	}
+	// Drop the node from the WireGuard mesh first so the remaining nodes stop
+	// routing to it.
+	if peer, err := h.store.GetWireGuardPeer(id, userID); err == nil && peer != nil {
+		if err := deployer.New(h.store).LeaveMesh(node, userID); err != nil {
+			log.Printf("nodes: leave mesh for %s: %v", node.Name, err)
+		}
+	}
 	if err := h.store.DeleteNode(id, userID); err != nil {
 		writeInternalError(w, err)
 		return
 	}
+	sshexec.EvictNode(id)
+	_ = h.store.DisableNodeFirewall(id, userID)
+	_ = h.store.DeleteMetricSamples(models.MetricKindNode, id)
+	reconcileFirewalls(h.store, userID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -158,7 +260,7 @@ func (h *NodeHandler) SetupTraefik(w http.ResponseWriter, r *http.Request, id st
 	}
 
 	runner := sshexec.NewRunner(node)
-	output, runErr := runner.Run(sshexec.TraefikSetupCmd())
+	output, runErr := deployer.New(h.store).SetupTraefik(runner, userID)
 
 	if runErr != nil {
 		writeJSON(w, http.StatusOK, map[string]string{
@@ -207,3 +309,290 @@ func (h *NodeHandler) Ping(w http.ResponseWriter, r *http.Request, id string) {
 		"message": message,
 	})
 }
+
+// Bootstrap installs Docker and the other prerequisites on a node over SSH and
+// records the installed versions. Failures are returned in "error" and kept on
+// the node's bootstrap record.
+func (h *NodeHandler) Bootstrap(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.IsLocal {
+		writeError(w, http.StatusForbidden, "the management node cannot be bootstrapped")
+		return
+	}
+
+	output, b := deployer.Bootstrap(sshexec.NewRunner(node), node)
+	if err := h.store.RecordNodeBootstrap(b, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	resp := map[string]interface{}{"output": output}
+	if b.LastError != "" {
+		resp["error"] = b.LastError
+	} else {
+		_ = h.store.UpdateNodeStatus(id, userID, "online")
+	}
+	if rec, err := h.store.GetNodeBootstrap(id, userID); err == nil && rec != nil {
+		resp["bootstrap"] = rec
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GetBootstrap returns the bootstrap record of a node.
+func (h *NodeHandler) GetBootstrap(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	b, err := h.store.GetNodeBootstrap(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if b == nil {
+		writeError(w, http.StatusNotFound, "node has not been bootstrapped")
+		return
+	}
+	writeJSON(w, http.StatusOK, b)
+}
+
+// Cordon stops new deployments and resources from being placed on a node.
+// What already runs there is left alone.
+func (h *NodeHandler) Cordon(w http.ResponseWriter, r *http.Request, id string) {
+	h.setSchedule(w, r, id, models.NodeScheduleCordoned)
+}
+
+// Uncordon makes a cordoned or drained node take new workloads again.
+func (h *NodeHandler) Uncordon(w http.ResponseWriter, r *http.Request, id string) {
+	h.setSchedule(w, r, id, models.NodeScheduleActive)
+}
+
+func (h *NodeHandler) setSchedule(w http.ResponseWriter, r *http.Request, id, schedule string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.Schedule == models.NodeScheduleDraining {
+		writeError(w, http.StatusConflict, "node is being drained")
+		return
+	}
+	if err := h.store.UpdateNodeSchedule(id, userID, schedule); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	node.Schedule = schedule
+	node.PrivateKey = ""
+	writeJSON(w, http.StatusOK, node)
+}
+
+// Drain cordons a node and moves every deployment on it to other nodes,
+// optionally to body.target_node_id. The node stays cordoned afterwards. The
+// report lists what moved, what could not, and the managed resources on the
+// node with a plan for migrating their data.
+func (h *NodeHandler) Drain(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		TargetNodeID string `json:"target_node_id"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.Schedule == models.NodeScheduleDraining {
+		writeError(w, http.StatusConflict, "node is already being drained")
+		return
+	}
+	var target *models.Node
+	if body.TargetNodeID != "" {
+		if body.TargetNodeID == id {
+			writeError(w, http.StatusBadRequest, "target node must differ from the drained node")
+			return
+		}
+		target, err = h.store.GetNode(body.TargetNodeID, userID)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		if target == nil {
+			writeError(w, http.StatusBadRequest, "target node not found")
+			return
+		}
+	}
+
+	if err := h.store.UpdateNodeSchedule(id, userID, models.NodeScheduleDraining); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	report, drainErr := deployer.New(h.store).DrainNode(node, target, userID)
+	_ = h.store.UpdateNodeSchedule(id, userID, models.NodeScheduleCordoned)
+	if drainErr != nil {
+		writeInternalError(w, drainErr)
+		return
+	}
+	if len(report.Moved) > 0 {
+		reconcileFirewalls(h.store, userID)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// HostKey compares the node's pinned SSH host key with the one it presents
+// now, so a rotated key can be checked before it is accepted.
+func (h *NodeHandler) HostKey(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.IsLocal {
+		writeError(w, http.StatusBadRequest, "local nodes are not reached over SSH")
+		return
+	}
+	resp := map[string]interface{}{
+		"pinned":             node.HostKey,
+		"pinned_fingerprint": sshexec.HostKeyFingerprint(node.HostKey),
+	}
+	presented, err := sshexec.ScanNodeHostKey(node)
+	if err != nil {
+		resp["error"] = err.Error()
+	} else {
+		resp["presented"] = presented
+		resp["presented_fingerprint"] = sshexec.HostKeyFingerprint(presented)
+		resp["match"] = presented == node.HostKey
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AcceptHostKey pins body.host_key as the node's SSH host key, replacing the
+// previous one. The key must be given explicitly; it is never taken from the
+// connection, since that is what a man in the middle would present.
+func (h *NodeHandler) AcceptHostKey(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		HostKey string `json:"host_key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if body.HostKey == "" {
+		writeError(w, http.StatusBadRequest, "host_key is required")
+		return
+	}
+	key, err := sshexec.NormalizeHostKey(body.HostKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if err := h.store.SetNodeHostKey(id, userID, key); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	sshexec.EvictNode(id)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"host_key":    key,
+		"fingerprint": sshexec.HostKeyFingerprint(key),
+	})
+}
+
+// RotateKey generates a new ed25519 key for the node and installs it, logging
+// in once with body.password when given or with the current credentials
+// otherwise. The node then uses only the new key; the old key is left in
+// authorized_keys for the user to remove.
+func (h *NodeHandler) RotateKey(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		Password string `json:"password"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.IsLocal {
+		writeError(w, http.StatusBadRequest, "local nodes are not reached over SSH")
+		return
+	}
+	privateKey, publicKey, err := sshexec.GenerateKeyPair()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if _, err := sshexec.InstallAuthorizedKey(node, body.Password, publicKey); err != nil {
+		writeJSON(w, http.StatusOK, map[string]string{"error": err.Error()})
+		return
+	}
+	node.PrivateKey, node.KeyPassphrase, node.Certificate, node.Password = privateKey, "", "", ""
+	if err := h.store.UpdateNodeCredentials(node, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	sshexec.EvictNode(id)
+	writeJSON(w, http.StatusOK, map[string]string{"public_key": publicKey})
+}
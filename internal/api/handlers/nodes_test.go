@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
 )
 
 func TestNodeCreate_MissingFields(t *testing.T) {
@@ -278,3 +279,183 @@ func TestNodeSetupTraefik_NotFound(t *testing.T) {
 		t.Errorf("expected 404, got %d", rec.Code)
 	}
 }
+
+func TestNodeBootstrap_NotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+
+	rec := httptest.NewRecorder()
+	r := postJSON(t, "/api/nodes/badid/bootstrap", nil)
+	h.Bootstrap(rec, r, "badid")
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestNodeBootstrap_LocalNodeForbidden(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	n := mustCreateNode(t, s) // IsLocal=true
+
+	rec := httptest.NewRecorder()
+	r := postJSON(t, "/api/nodes/"+n.ID+"/bootstrap", nil)
+	h.Bootstrap(rec, r, n.ID)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d (body: %s)", rec.Code, rec.Body)
+	}
+}
+
+func TestNodeCordon_BlocksNewDeployments(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	n := mustCreateNode(t, s)
+	app := mustCreateApp(t, s)
+
+	rec := httptest.NewRecorder()
+	h.Cordon(rec, postJSON(t, "/api/nodes/"+n.ID+"/cordon", nil), n.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", rec.Code, rec.Body)
+	}
+	var node map[string]any
+	decodeJSON(t, rec, &node)
+	if node["schedule"] != "cordoned" {
+		t.Errorf("expected schedule=cordoned, got %v", node["schedule"])
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.NewDeploymentHandler(s).Create(rec, withRootUserID(postJSON(t, "/api/deployments", map[string]any{
+		"service_id": app.ID,
+		"node_id":    n.ID,
+	})))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 on a cordoned node, got %d (body: %s)", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Uncordon(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/nodes/"+n.ID+"/cordon", nil)), n.ID)
+	if got, _ := s.GetNode(n.ID, testUserID); rec.Code != http.StatusOK || got.Schedule != "active" {
+		t.Errorf("expected node active again, got %d %+v", rec.Code, got)
+	}
+}
+
+func TestNodeDrain_NoTarget(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	n := mustCreateNode(t, s)
+	app := mustCreateApp(t, s)
+	dep := mustCreateDeployment(t, s, app.ID, n.ID)
+
+	rec := httptest.NewRecorder()
+	h.Drain(rec, postJSON(t, "/api/nodes/"+n.ID+"/drain", nil), n.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", rec.Code, rec.Body)
+	}
+	var report struct {
+		Moved  []map[string]any `json:"moved"`
+		Failed []struct {
+			DeploymentID string `json:"deployment_id"`
+			Error        string `json:"error"`
+		} `json:"failed"`
+	}
+	decodeJSON(t, rec, &report)
+	if len(report.Moved) != 0 || len(report.Failed) != 1 || report.Failed[0].DeploymentID != dep.ID {
+		t.Errorf("expected the deployment to stay put for lack of a target, got %+v", report)
+	}
+	if got, _ := s.GetNode(n.ID, testUserID); got.Schedule != "cordoned" {
+		t.Errorf("expected node cordoned after drain, got %q", got.Schedule)
+	}
+}
+
+func TestNodeDrain_LeavesStoppedDeploymentsInPlace(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	n := mustCreateNode(t, s)
+	dep := mustCreateDeployment(t, s, mustCreateApp(t, s).ID, n.ID)
+	if err := s.UpdateDeploymentStatus(dep.ID, testUserID, "stopped", dep.ContainerID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Drain(rec, postJSON(t, "/api/nodes/"+n.ID+"/drain", nil), n.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body: %s)", rec.Code, rec.Body)
+	}
+	var report models.DrainReport
+	decodeJSON(t, rec, &report)
+	if len(report.Moved) != 0 || len(report.Failed) != 0 || len(report.Skipped) != 1 ||
+		report.Skipped[0].DeploymentID != dep.ID || report.Skipped[0].Status != "stopped" {
+		t.Errorf("expected the stopped deployment skipped, got %+v", report)
+	}
+	if got, _ := s.GetDeployment(dep.ID, testUserID); got.NodeID != n.ID || got.Status != "stopped" {
+		t.Errorf("stopped deployment changed: %+v", got)
+	}
+}
+
+func TestNodeDrain_TargetNotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	n := mustCreateNode(t, s)
+
+	rec := httptest.NewRecorder()
+	h.Drain(rec, postJSON(t, "/api/nodes/"+n.ID+"/drain", map[string]any{"target_node_id": "missing"}), n.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+	if got, _ := s.GetNode(n.ID, testUserID); got.Schedule != "active" {
+		t.Errorf("expected node untouched, got %q", got.Schedule)
+	}
+}
+
+func TestNodeCreate_InvalidHostKey(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/nodes", map[string]any{
+		"name": "n", "host": "10.0.0.1", "username": "root", "private_key": "key", "host_key": "garbage",
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestNodeHostKey_NotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.HostKey(rec, getRequest("/api/nodes/missing/host-key"), "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestNodeAcceptHostKey(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	n := mustCreateNode(t, s)
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+
+	rec := httptest.NewRecorder()
+	h.AcceptHostKey(rec, postJSON(t, "/api/nodes/"+n.ID+"/host-key", map[string]any{"host_key": "garbage"}), n.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid key, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.AcceptHostKey(rec, postJSON(t, "/api/nodes/missing/host-key", map[string]any{"host_key": key}), "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.AcceptHostKey(rec, postJSON(t, "/api/nodes/"+n.ID+"/host-key", map[string]any{"host_key": key + " root@node"}), n.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := s.GetNode(n.ID, testUserID); got.HostKey != key {
+		t.Errorf("expected key pinned, got %q", got.HostKey)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -62,6 +63,9 @@ func (h *ObjectStorageHandler) Create(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusForbidden, "only the root user can create object storages on the management node")
 		return
 	}
+	if rejectUnschedulable(w, node) {
+		return
+	}
 
 	if used, err := h.store.IsPortUsedOnNode(body.NodeID, s3Port); err != nil {
 		writeInternalError(w, err)
@@ -141,6 +145,15 @@ api_bind_addr = "[::]:3903"
 		},
 		Restart: "unless-stopped",
 	}
+	if netErr := deployer.AttachUserNetwork(runner, &runCfg, userID); netErr != nil {
+		_ = h.store.UpdateObjectStorageStatus(o.ID, userID, "failed")
+		o.Status = "failed"
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"object_storage": o,
+			"error":          netErr.Error(),
+		})
+		return
+	}
 	cmd := sshexec.DockerRunCmd(runCfg)
 	output, runErr := runner.Run(cmd)
 	if runErr != nil {
@@ -220,6 +233,7 @@ func (h *ObjectStorageHandler) List(w http.ResponseWriter, r *http.Request) {
 	if result == nil {
 		result = []*models.ObjectStorage{}
 	}
+	hideCredentials(r, result)
 	writeJSON(w, http.StatusOK, result)
 }
 
@@ -237,6 +251,7 @@ func (h *ObjectStorageHandler) Get(w http.ResponseWriter, r *http.Request, id st
 		writeError(w, http.StatusNotFound, "object storage not found")
 		return
 	}
+	hideCredentials(r, o)
 	writeJSON(w, http.StatusOK, o)
 }
 
@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// OrgHandler manages organizations and their members. Unlike resource
+// handlers it acts on the organization in the path rather than the one the
+// request is made in.
+type OrgHandler struct {
+	store *store.Store
+}
+
+func NewOrgHandler(s *store.Store) *OrgHandler {
+	return &OrgHandler{store: s}
+}
+
+// orgWithMembers is an organization as returned by Get.
+type orgWithMembers struct {
+	*models.Organization
+	Members []*models.OrgMember `json:"members"`
+}
+
+// member loads the organization id and the caller's role in it, capped by
+// the scope of an API token. It writes 404 and returns ok false when either
+// does not exist, so organizations of others are not revealed, and 403 when
+// the role is below min.
+func (h *OrgHandler) member(w http.ResponseWriter, r *http.Request, id, min string) (org *models.Organization, callerID, role string, ok bool) {
+	claims := auth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, "", "", false
+	}
+	org, err := h.store.GetOrganization(id)
+	if err != nil {
+		writeInternalError(w, err)
+		return nil, "", "", false
+	}
+	if org != nil {
+		role, err = h.store.GetOrgRole(id, claims.UserID)
+		if err != nil {
+			writeInternalError(w, err)
+			return nil, "", "", false
+		}
+	}
+	if org == nil || role == "" {
+		writeError(w, http.StatusNotFound, "organization not found")
+		return nil, "", "", false
+	}
+	role = models.CapRole(role, claims.Scope)
+	if !models.RoleAtLeast(role, min) {
+		writeError(w, http.StatusForbidden, "requires the "+min+" role in this organization")
+		return nil, "", "", false
+	}
+	org.Role = role
+	return org, claims.UserID, role, true
+}
+
+// List returns the organizations the caller is a member of, with the
+// caller's role in each.
+func (h *OrgHandler) List(w http.ResponseWriter, r *http.Request) {
+	claims := auth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	orgs, err := h.store.ListUserOrganizations(claims.UserID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if orgs == nil {
+		orgs = []*models.Organization{}
+	}
+	writeJSON(w, http.StatusOK, orgs)
+}
+
+// Create creates a team organization owned by the caller.
+func (h *OrgHandler) Create(w http.ResponseWriter, r *http.Request) {
+	claims := auth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	if claims.Scope != "" && claims.Scope != models.ScopeAdmin {
+		writeError(w, http.StatusForbidden, "requires an API token with the admin scope")
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	org, err := h.store.CreateOrganization(body.Name, claims.UserID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, org)
+}
+
+// Get returns an organization with its members.
+func (h *OrgHandler) Get(w http.ResponseWriter, r *http.Request, id string) {
+	org, _, _, ok := h.member(w, r, id, models.RoleViewer)
+	if !ok {
+		return
+	}
+	members, err := h.store.ListOrgMembers(id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, orgWithMembers{Organization: org, Members: members})
+}
+
+// Update renames a team organization.
+func (h *OrgHandler) Update(w http.ResponseWriter, r *http.Request, id string) {
+	org, _, _, ok := h.member(w, r, id, models.RoleAdmin)
+	if !ok {
+		return
+	}
+	if org.Personal {
+		writeError(w, http.StatusBadRequest, "a personal organization cannot be renamed")
+		return
+	}
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := h.store.RenameOrganization(id, body.Name); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	org.Name = body.Name
+	writeJSON(w, http.StatusOK, org)
+}
+
+// Delete removes a team organization. Its resources must be deleted first.
+func (h *OrgHandler) Delete(w http.ResponseWriter, r *http.Request, id string) {
+	org, _, _, ok := h.member(w, r, id, models.RoleOwner)
+	if !ok {
+		return
+	}
+	if org.Personal {
+		writeError(w, http.StatusBadRequest, "a personal organization cannot be deleted")
+		return
+	}
+	busy, err := h.store.OrganizationHasResources(id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if busy {
+		writeError(w, http.StatusConflict, "organization still has nodes, services or managed services; delete them first")
+		return
+	}
+	if err := h.store.DeleteOrganization(id); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListMembers returns the members of an organization.
+func (h *OrgHandler) ListMembers(w http.ResponseWriter, r *http.Request, id string) {
+	if _, _, _, ok := h.member(w, r, id, models.RoleViewer); !ok {
+		return
+	}
+	members, err := h.store.ListOrgMembers(id)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if members == nil {
+		members = []*models.OrgMember{}
+	}
+	writeJSON(w, http.StatusOK, members)
+}
+
+// AddMember adds a user who has signed in before to a team organization.
+// Admins add members below owner; only owners add owners.
+func (h *OrgHandler) AddMember(w http.ResponseWriter, r *http.Request, id string) {
+	org, _, role, ok := h.member(w, r, id, models.RoleAdmin)
+	if !ok {
+		return
+	}
+	if org.Personal {
+		writeError(w, http.StatusBadRequest, "a personal organization cannot have members; create a team organization")
+		return
+	}
+	var body struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if body.Email == "" {
+		writeError(w, http.StatusBadRequest, "email is required")
+		return
+	}
+	if !models.ValidRole(body.Role) {
+		writeError(w, http.StatusBadRequest, "role must be owner, admin, deployer or viewer")
+		return
+	}
+	if body.Role == models.RoleOwner && role != models.RoleOwner {
+		writeError(w, http.StatusForbidden, "only owners can add owners")
+		return
+	}
+	user, err := h.store.GetUserByEmail(strings.TrimSpace(body.Email))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "no user with that email has signed in yet")
+		return
+	}
+	existing, err := h.store.GetOrgRole(id, user.ID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if existing != "" {
+		writeError(w, http.StatusConflict, "user is already a member")
+		return
+	}
+	if err := h.store.SetOrgMember(id, user.ID, body.Role); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &models.OrgMember{OrgID: id, UserID: user.ID, Email: user.Email, Name: user.Name, Role: body.Role})
+}
+
+// UpdateMember changes a member's role. Only owners change the role of an
+// owner or make someone an owner, and the last owner cannot step down.
+func (h *OrgHandler) UpdateMember(w http.ResponseWriter, r *http.Request, id, userID string) {
+	_, _, role, ok := h.member(w, r, id, models.RoleAdmin)
+	if !ok {
+		return
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if !models.ValidRole(body.Role) {
+		writeError(w, http.StatusBadRequest, "role must be owner, admin, deployer or viewer")
+		return
+	}
+	current, ok := h.targetRole(w, id, userID, role)
+	if !ok {
+		return
+	}
+	if body.Role == models.RoleOwner && role != models.RoleOwner {
+		writeError(w, http.StatusForbidden, "only owners can add owners")
+		return
+	}
+	if current == models.RoleOwner && body.Role != models.RoleOwner && !h.keepsOwner(w, id) {
+		return
+	}
+	if err := h.store.SetOrgMember(id, userID, body.Role); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"org_id": id, "user_id": userID, "role": body.Role})
+}
+
+// RemoveMember removes a member. Admins remove members below owner, anyone
+// can leave, and the last owner cannot be removed.
+func (h *OrgHandler) RemoveMember(w http.ResponseWriter, r *http.Request, id, userID string) {
+	_, callerID, role, ok := h.member(w, r, id, models.RoleViewer)
+	if !ok {
+		return
+	}
+	if userID != callerID && !models.RoleAtLeast(role, models.RoleAdmin) {
+		writeError(w, http.StatusForbidden, "requires the admin role in this organization")
+		return
+	}
+	if userID == callerID {
+		// Leaving needs no more than membership.
+		role = models.RoleOwner
+	}
+	current, ok := h.targetRole(w, id, userID, role)
+	if !ok {
+		return
+	}
+	if current == models.RoleOwner && !h.keepsOwner(w, id) {
+		return
+	}
+	if err := h.store.RemoveOrgMember(id, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// targetRole returns the role of the member being changed, writing 404 if
+// there is no such member and 403 if it is an owner and callerRole is not.
+func (h *OrgHandler) targetRole(w http.ResponseWriter, id, userID, callerRole string) (string, bool) {
+	current, err := h.store.GetOrgRole(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return "", false
+	}
+	if current == "" {
+		writeError(w, http.StatusNotFound, "member not found")
+		return "", false
+	}
+	if current == models.RoleOwner && callerRole != models.RoleOwner {
+		writeError(w, http.StatusForbidden, "only owners can change owners")
+		return "", false
+	}
+	return current, true
+}
+
+// keepsOwner writes 409 and returns false when the organization has a single
+// owner left.
+func (h *OrgHandler) keepsOwner(w http.ResponseWriter, id string) bool {
+	n, err := h.store.CountOrgOwners(id)
+	if err != nil {
+		writeInternalError(w, err)
+		return false
+	}
+	if n <= 1 {
+		writeError(w, http.StatusConflict, "an organization needs at least one owner")
+		return false
+	}
+	return true
+}
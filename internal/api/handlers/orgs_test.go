@@ -0,0 +1,202 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+// asMember makes r come from another user acting in the test user's
+// organization with role.
+func asMember(r *http.Request, role string) *http.Request {
+	ctx := auth.InjectClaims(r.Context(), &auth.Claims{UserID: "member-user", Email: "member@example.com"})
+	ctx = auth.InjectWorkspace(ctx, &auth.Workspace{OrgID: testUserID, Role: role})
+	return r.WithContext(ctx)
+}
+
+// asUser makes r come from userID, without a workspace.
+func asUser(r *http.Request, userID string) *http.Request {
+	return r.WithContext(auth.InjectClaims(r.Context(), &auth.Claims{UserID: userID}))
+}
+
+func TestRoles_ViewerReadsLogsButCannotDeleteDatabase(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s)
+	d := mustCreateDeployment(t, s, mustCreateApp(t, s).ID, n.ID)
+	db := &models.Database{ID: "db-1", Name: "main", Type: "postgres", NodeID: n.ID, ContainerName: "localisprod-db-main", Status: "running", CreatedAt: time.Now().UTC()}
+	if err := s.CreateDatabase(db, testUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handlers.NewDeploymentHandler(s).Logs(rec, asMember(httptest.NewRequest(http.MethodGet, "/api/deployments/"+d.ID+"/logs", nil), models.RoleViewer), d.ID)
+	if rec.Code != http.StatusOK {
+		t.Errorf("viewer logs: expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.NewDatabaseHandler(s).Delete(rec, asMember(httptest.NewRequest(http.MethodDelete, "/api/databases/db-1", nil), models.RoleViewer), "db-1")
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("viewer delete database: expected 403, got %d", rec.Code)
+	}
+	if got, _ := s.GetDatabase("db-1", testUserID); got == nil {
+		t.Error("database was deleted by a viewer")
+	}
+}
+
+func TestRoles_ViewerGetsDatabaseWithoutPassword(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s)
+	db := &models.Database{ID: "db-1", Name: "main", Type: "postgres", NodeID: n.ID, Password: "s3cret", ContainerName: "localisprod-db-main", Status: "running", CreatedAt: time.Now().UTC()}
+	if err := s.CreateDatabase(db, testUserID); err != nil {
+		t.Fatal(err)
+	}
+	h := handlers.NewDatabaseHandler(s)
+
+	for role, want := range map[string]string{models.RoleViewer: "", models.RoleDeployer: "", models.RoleAdmin: "s3cret"} {
+		var got models.Database
+		rec := httptest.NewRecorder()
+		h.Get(rec, asMember(getRequest("/api/databases/db-1"), role), "db-1")
+		decodeJSON(t, rec, &got)
+		if got.Password != want {
+			t.Errorf("%s get: password = %q, want %q", role, got.Password, want)
+		}
+
+		var list []models.Database
+		rec = httptest.NewRecorder()
+		h.List(rec, asMember(getRequest("/api/databases"), role))
+		decodeJSON(t, rec, &list)
+		if len(list) != 1 || list[0].Password != want {
+			t.Errorf("%s list: %+v, want password %q", role, list, want)
+		}
+	}
+}
+
+func TestRoles_DeployerRestartsButCannotDeleteNode(t *testing.T) {
+	s := newTestStore(t)
+	n := mustCreateNode(t, s)
+	d := mustCreateDeployment(t, s, mustCreateApp(t, s).ID, n.ID)
+	h := handlers.NewDeploymentHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Restart(rec, asMember(httptest.NewRequest(http.MethodPost, "/api/deployments/"+d.ID+"/restart", nil), models.RoleViewer), d.ID)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("viewer restart: expected 403, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.Restart(rec, asMember(httptest.NewRequest(http.MethodPost, "/api/deployments/"+d.ID+"/restart", nil), models.RoleDeployer), d.ID)
+	if rec.Code == http.StatusForbidden {
+		t.Errorf("deployer restart: got 403")
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.NewNodeHandler(s).Delete(rec, asMember(httptest.NewRequest(http.MethodDelete, "/api/nodes/"+n.ID, nil), models.RoleDeployer), n.ID)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("deployer delete node: expected 403, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handlers.NewNodeHandler(s).Delete(rec, asMember(httptest.NewRequest(http.MethodDelete, "/api/nodes/"+n.ID, nil), models.RoleAdmin), n.ID)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("admin delete node: expected 204, got %d", rec.Code)
+	}
+}
+
+func TestOrgMembers(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewOrgHandler(s)
+	owner, _ := s.UpsertUser("sub-owner", "owner@example.com", "Owner", "")
+	viewer, _ := s.UpsertUser("sub-viewer", "viewer@example.com", "Viewer", "")
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, asUser(postJSON(t, "/api/orgs", map[string]string{"name": "Team"}), owner.ID))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var org models.Organization
+	decodeJSON(t, rec, &org)
+	if tok, _ := s.GetUserSetting(org.ID, "webhook_token"); tok == "" {
+		t.Error("organization has no webhook token")
+	}
+
+	rec = httptest.NewRecorder()
+	h.AddMember(rec, asUser(postJSON(t, "/api/orgs/"+org.ID+"/members", map[string]string{"email": "viewer@example.com", "role": "viewer"}), owner.ID), org.ID)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("add member: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	h.AddMember(rec, asUser(postJSON(t, "/api/orgs/"+org.ID+"/members", map[string]string{"email": "nobody@example.com", "role": "viewer"}), owner.ID), org.ID)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("add unknown user: expected 404, got %d", rec.Code)
+	}
+
+	// A viewer cannot promote itself.
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/api/orgs/"+org.ID+"/members/"+viewer.ID, nil)
+	h.UpdateMember(rec, asUser(req, viewer.ID), org.ID, viewer.ID)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("viewer update member: expected 403, got %d", rec.Code)
+	}
+
+	var orgs []models.Organization
+	rec = httptest.NewRecorder()
+	h.List(rec, asUser(getRequest("/api/orgs"), viewer.ID))
+	decodeJSON(t, rec, &orgs)
+	if len(orgs) != 2 || !orgs[0].Personal || orgs[1].ID != org.ID || orgs[1].Role != models.RoleViewer {
+		t.Errorf("viewer organizations = %+v", orgs)
+	}
+
+	// The last owner cannot leave, the viewer can.
+	rec = httptest.NewRecorder()
+	h.RemoveMember(rec, asUser(httptest.NewRequest(http.MethodDelete, "/", nil), owner.ID), org.ID, owner.ID)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("last owner leaving: expected 409, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.RemoveMember(rec, asUser(httptest.NewRequest(http.MethodDelete, "/", nil), viewer.ID), org.ID, viewer.ID)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("viewer leaving: expected 204, got %d", rec.Code)
+	}
+
+	// Outsiders do not see the organization at all.
+	rec = httptest.NewRecorder()
+	h.Get(rec, asUser(getRequest("/api/orgs/"+org.ID), viewer.ID), org.ID)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("outsider get: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestOrgDelete_RefusedWithResources(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewOrgHandler(s)
+	owner, _ := s.UpsertUser("sub-owner", "owner@example.com", "Owner", "")
+	org, err := s.CreateOrganization("Team", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateNode(&models.Node{ID: "n1", Name: "n1", Host: "10.0.0.1", Port: 22, Username: "root", CreatedAt: time.Now().UTC()}, org.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Delete(rec, asUser(httptest.NewRequest(http.MethodDelete, "/", nil), owner.ID), org.ID)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 with a node left, got %d", rec.Code)
+	}
+	_ = s.DeleteNode("n1", org.ID)
+	rec = httptest.NewRecorder()
+	h.Delete(rec, asUser(httptest.NewRequest(http.MethodDelete, "/", nil), owner.ID), org.ID)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Delete(rec, asUser(httptest.NewRequest(http.MethodDelete, "/", nil), owner.ID), owner.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("deleting the personal organization: expected 400, got %d", rec.Code)
+	}
+}
@@ -3,13 +3,16 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
 	"github.com/gsarma/localisprod-v2/internal/models"
 	awsprov "github.com/gsarma/localisprod-v2/internal/providers/aws"
 	doprov "github.com/gsarma/localisprod-v2/internal/providers/digitalocean"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
 )
 
@@ -22,6 +25,27 @@ func NewProvidersHandler(s *store.Store) *ProvidersHandler {
 	return &ProvidersHandler{store: s}
 }
 
+// bootstrapProvisioned waits for a freshly provisioned node to accept SSH and
+// bootstraps it. It runs in the background so provisioning returns as soon as
+// the node is registered; the outcome shows up on the node's bootstrap record.
+func bootstrapProvisioned(s *store.Store, node models.Node, userID string) {
+	runner := sshexec.NewRunner(&node)
+	if err := deployer.WaitForSSH(runner, 5*time.Minute); err != nil {
+		log.Printf("providers: bootstrap %s: %v", node.Name, err)
+		_ = s.RecordNodeBootstrap(&models.NodeBootstrap{NodeID: node.ID, LastError: err.Error(), UpdatedAt: time.Now().UTC()}, userID)
+		return
+	}
+	_, b := deployer.Bootstrap(runner, &node)
+	if err := s.RecordNodeBootstrap(b, userID); err != nil {
+		log.Printf("providers: record bootstrap of %s: %v", node.Name, err)
+	}
+	if b.LastError != "" {
+		log.Printf("providers: bootstrap %s: %s", node.Name, b.LastError)
+		return
+	}
+	_ = s.UpdateNodeStatus(node.ID, userID, "online")
+}
+
 // DOMetadata returns DigitalOcean regions, sizes, and images.
 func (h *ProvidersHandler) DOMetadata(w http.ResponseWriter, r *http.Request) {
 	userID := getUserID(w, r)
@@ -115,6 +139,7 @@ func (h *ProvidersHandler) DOProvision(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "register node: "+err.Error())
 		return
 	}
+	go bootstrapProvisioned(h.store, *node, userID)
 	node.PrivateKey = ""
 	writeJSON(w, http.StatusCreated, node)
 }
@@ -167,7 +192,7 @@ func (h *ProvidersHandler) AWSProvision(w http.ResponseWriter, r *http.Request)
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
 	defer cancel()
 
-	host, instanceID, privateKeyPEM, err := awsprov.ProvisionInstance(ctx, accessKey, secretKey, body.Region, body.InstanceType, body.OS, body.Name)
+	host, instanceID, privateKeyPEM, hostKey, err := awsprov.ProvisionInstance(ctx, accessKey, secretKey, body.Region, body.InstanceType, body.OS, body.Name)
 	if err != nil {
 		writeError(w, http.StatusBadGateway, "provision instance: "+err.Error())
 		return
@@ -181,6 +206,7 @@ func (h *ProvidersHandler) AWSProvision(w http.ResponseWriter, r *http.Request)
 		Port:               22,
 		Username:           username,
 		PrivateKey:         privateKeyPEM,
+		HostKey:            hostKey,
 		Status:             "unknown",
 		Provider:           "aws",
 		ProviderRegion:     body.Region,
@@ -191,6 +217,7 @@ func (h *ProvidersHandler) AWSProvision(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusInternalServerError, "register node: "+err.Error())
 		return
 	}
+	go bootstrapProvisioned(h.store, *node, userID)
 	node.PrivateKey = ""
 	writeJSON(w, http.StatusCreated, node)
 }
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	validRouteHost = regexp.MustCompile(`^[a-zA-Z0-9*]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+	validRoutePath = regexp.MustCompile(`^/[a-zA-Z0-9._~/-]*$`)
+	// Header names end up in Traefik label keys, where a dot would split the
+	// key, so it is left out of the token characters.
+	validHeaderName    = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+^_|~-]+$`)
+	validBasicAuthUser = regexp.MustCompile(`^[^:,\s]+$`)
+)
+
+// parseRoutes validates a service's routes and returns them as JSON. A
+// non-empty domain with no routes is accepted as a single route for that host.
+// It writes a 400 and returns false on invalid input.
+func parseRoutes(w http.ResponseWriter, routes []models.Route, domain string) ([]byte, bool) {
+	if len(routes) == 0 && domain != "" {
+		routes = []models.Route{{Host: domain}}
+	}
+	for i := range routes {
+		route := &routes[i]
+		route.Host = strings.ToLower(strings.TrimSpace(route.Host))
+		if !validRouteHost.MatchString(route.Host) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("route %d: invalid host %q", i+1, route.Host))
+			return nil, false
+		}
+		if route.PathPrefix != "" && !validRoutePath.MatchString(route.PathPrefix) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("route %d: path_prefix must start with / and contain only URL path characters", i+1))
+			return nil, false
+		}
+		if route.StripPrefix && route.PathPrefix == "" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("route %d: strip_prefix requires a path_prefix", i+1))
+			return nil, false
+		}
+		if route.ContainerPort < 0 || route.ContainerPort > 65535 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("route %d: container_port must be between 1 and 65535", i+1))
+			return nil, false
+		}
+		if route.Entrypoint == "" {
+			route.Entrypoint = "web"
+		}
+		// Traefik is only started with these two entrypoints.
+		if route.Entrypoint != "web" && route.Entrypoint != "websecure" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("route %d: entrypoint must be one of: web, websecure", i+1))
+			return nil, false
+		}
+		if route.Middlewares != nil {
+			if err := normalizeRouteMiddlewares(route.Middlewares); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("route %d: %v", i+1, err))
+				return nil, false
+			}
+		}
+	}
+	if routes == nil {
+		return []byte("[]"), true
+	}
+	routesJSON, _ := json.Marshal(routes)
+	return routesJSON, true
+}
+
+// normalizeRouteMiddlewares validates a route's middlewares in place. Basic
+// auth entries may be given as "user:password"; the password is replaced with
+// its bcrypt hash. Entries that already carry a bcrypt hash are kept, so a
+// service can be re-submitted unchanged.
+func normalizeRouteMiddlewares(mw *models.RouteMiddlewares) error {
+	for i, entry := range mw.IPAllowList {
+		entry = strings.TrimSpace(entry)
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return fmt.Errorf("ip_allowlist: invalid IP or CIDR %q", entry)
+		}
+		mw.IPAllowList[i] = entry
+	}
+	for i, entry := range mw.BasicAuth {
+		user, password, ok := strings.Cut(entry, ":")
+		if !ok || !validBasicAuthUser.MatchString(user) || password == "" {
+			return errors.New(`basic_auth: entries must be "user:password"`)
+		}
+		if isBcryptHash(password) {
+			continue
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("basic_auth: %w", err)
+		}
+		mw.BasicAuth[i] = user + ":" + string(hash)
+	}
+	if rl := mw.RateLimit; rl != nil {
+		if rl.Average <= 0 || rl.Burst < 0 {
+			return errors.New("rate_limit: average must be positive and burst non-negative")
+		}
+		if rl.Period != "" {
+			if d, err := time.ParseDuration(rl.Period); err != nil || d <= 0 {
+				return fmt.Errorf("rate_limit: invalid period %q", rl.Period)
+			}
+		}
+	}
+	if rr := mw.RedirectRegex; rr != nil {
+		if rr.Regex == "" || rr.Replacement == "" {
+			return errors.New("redirect_regex: regex and replacement are required")
+		}
+		if _, err := regexp.Compile(rr.Regex); err != nil {
+			return fmt.Errorf("redirect_regex: %w", err)
+		}
+	}
+	for _, headers := range []map[string]string{mw.RequestHeaders, mw.ResponseHeaders} {
+		for name := range headers {
+			if !validHeaderName.MatchString(name) {
+				return fmt.Errorf("invalid header name %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+func isBcryptHash(s string) bool {
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
@@ -35,7 +35,8 @@ func (h *ServiceHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Volumes        []string          `json:"volumes"`
 		Command        string            `json:"command"`
 		GithubRepo     string            `json:"github_repo"`
-		Domain         string            `json:"domain"`
+		Routes         []models.Route    `json:"routes"`
+		Domain         string            `json:"domain"` // shorthand for a single route
 		Databases      []string          `json:"databases"`
 		Caches         []string          `json:"caches"`
 		Kafkas         []string          `json:"kafkas"`
@@ -54,6 +55,11 @@ func (h *ServiceHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	routesJSON, ok := parseRoutes(w, body.Routes, body.Domain)
+	if !ok {
+		return
+	}
+
 	envJSON, _ := json.Marshal(body.EnvVars)
 	if body.EnvVars == nil {
 		envJSON = []byte("{}")
@@ -93,7 +99,7 @@ func (h *ServiceHandler) Create(w http.ResponseWriter, r *http.Request) {
 		Volumes:        string(volumesJSON),
 		Command:        body.Command,
 		GithubRepo:     body.GithubRepo,
-		Domain:         body.Domain,
+		Routes:         string(routesJSON),
 		Databases:      string(dbsJSON),
 		Caches:         string(cachesJSON),
 		Kafkas:         string(kafkasJSON),
@@ -158,7 +164,8 @@ func (h *ServiceHandler) Update(w http.ResponseWriter, r *http.Request, id strin
 		Ports          []string          `json:"ports"`
 		Volumes        []string          `json:"volumes"`
 		Command        string            `json:"command"`
-		Domain         string            `json:"domain"`
+		Routes         []models.Route    `json:"routes"`
+		Domain         string            `json:"domain"` // shorthand for a single route
 		Databases      []string          `json:"databases"`
 		Caches         []string          `json:"caches"`
 		Kafkas         []string          `json:"kafkas"`
@@ -176,6 +183,10 @@ func (h *ServiceHandler) Update(w http.ResponseWriter, r *http.Request, id strin
 		writeError(w, http.StatusBadRequest, "service name must contain only letters, numbers, hyphens, and underscores")
 		return
 	}
+	routesJSON, ok := parseRoutes(w, body.Routes, body.Domain)
+	if !ok {
+		return
+	}
 	envJSON, _ := json.Marshal(body.EnvVars)
 	if body.EnvVars == nil {
 		envJSON = []byte("{}")
@@ -211,7 +222,7 @@ func (h *ServiceHandler) Update(w http.ResponseWriter, r *http.Request, id strin
 	existing.Ports = string(portsJSON)
 	existing.Volumes = string(volumesJSON)
 	existing.Command = body.Command
-	existing.Domain = body.Domain
+	existing.Routes = string(routesJSON)
 	existing.Databases = string(dbsJSON)
 	existing.Caches = string(cachesJSON)
 	existing.Kafkas = string(kafkasJSON)
@@ -220,6 +231,7 @@ func (h *ServiceHandler) Update(w http.ResponseWriter, r *http.Request, id strin
 		writeInternalError(w, err)
 		return
 	}
+	reconcileFirewalls(h.store, userID)
 	writeJSON(w, http.StatusOK, existing)
 }
 
@@ -241,5 +253,6 @@ func (h *ServiceHandler) Delete(w http.ResponseWriter, r *http.Request, id strin
 		writeInternalError(w, err)
 		return
 	}
+	reconcileFirewalls(h.store, userID)
 	w.WriteHeader(http.StatusNoContent)
 }
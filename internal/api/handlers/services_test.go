@@ -1,11 +1,15 @@
 package handlers_test
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestServiceCreate_MissingFields(t *testing.T) {
@@ -107,8 +111,167 @@ func TestServiceCreate_Success_WithEnvAndPorts(t *testing.T) {
 	if resp["github_repo"] != "owner/repo" {
 		t.Errorf("expected github_repo 'owner/repo', got %v", resp["github_repo"])
 	}
-	if resp["domain"] != "example.com" {
-		t.Errorf("expected domain 'example.com', got %v", resp["domain"])
+	if resp["routes"] != `[{"host":"example.com","entrypoint":"web"}]` {
+		t.Errorf("expected domain shorthand as a single route, got %v", resp["routes"])
+	}
+}
+
+func TestServiceCreate_Routes(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewServiceHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/services", map[string]any{
+		"name":         "api",
+		"docker_image": "myimage:v1",
+		"routes": []map[string]any{
+			{"host": "api.example.com"},
+			{"host": "Example.com", "path_prefix": "/api", "strip_prefix": true},
+			{"host": "admin.example.com", "container_port": 9000, "entrypoint": "websecure"},
+		},
+	}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (body: %s)", rec.Code, rec.Body)
+	}
+
+	var resp models.Service
+	decodeJSON(t, rec, &resp)
+	var routes []models.Route
+	if err := json.Unmarshal([]byte(resp.Routes), &routes); err != nil {
+		t.Fatalf("unmarshal routes: %v", err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(routes))
+	}
+	if routes[1].Host != "example.com" || routes[1].PathPrefix != "/api" || !routes[1].StripPrefix {
+		t.Errorf("unexpected path route: %+v", routes[1])
+	}
+	if routes[2].ContainerPort != 9000 || routes[2].Entrypoint != "websecure" {
+		t.Errorf("unexpected admin route: %+v", routes[2])
+	}
+}
+
+func TestServiceCreate_RouteMiddlewares(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewServiceHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/services", map[string]any{
+		"name":         "tools",
+		"docker_image": "myimage:v1",
+		"routes": []map[string]any{{
+			"host": "tools.example.com",
+			"middlewares": map[string]any{
+				"ip_allowlist":     []string{"10.0.0.0/8", "192.168.1.10"},
+				"basic_auth":       []string{"admin:s3cret"},
+				"rate_limit":       map[string]any{"average": 100, "burst": 50, "period": "1m"},
+				"request_headers":  map[string]string{"X-Forwarded-Env": "prod"},
+				"response_headers": map[string]string{"X-Frame-Options": "DENY"},
+				"redirect_regex":   map[string]any{"regex": "^https?://tools.example.com/old/(.*)", "replacement": "https://tools.example.com/${1}"},
+				"compress":         true,
+			},
+		}},
+	}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (body: %s)", rec.Code, rec.Body)
+	}
+
+	var resp models.Service
+	decodeJSON(t, rec, &resp)
+	var routes []models.Route
+	if err := json.Unmarshal([]byte(resp.Routes), &routes); err != nil {
+		t.Fatalf("unmarshal routes: %v", err)
+	}
+	mw := routes[0].Middlewares
+	if mw == nil || len(mw.BasicAuth) != 1 {
+		t.Fatalf("expected basic auth entry, got %+v", mw)
+	}
+	user, hash, _ := strings.Cut(mw.BasicAuth[0], ":")
+	if user != "admin" || bcrypt.CompareHashAndPassword([]byte(hash), []byte("s3cret")) != nil {
+		t.Errorf("expected bcrypt-hashed password, got %q", mw.BasicAuth[0])
+	}
+
+	// Re-submitting the stored (hashed) entry keeps it unchanged.
+	rec = httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/services", map[string]any{
+		"name":         "tools2",
+		"docker_image": "myimage:v1",
+		"routes":       routes,
+	}))
+	var resp2 models.Service
+	decodeJSON(t, rec, &resp2)
+	if !strings.Contains(resp2.Routes, mw.BasicAuth[0]) {
+		t.Errorf("expected hashed entry to be kept, got %s", resp2.Routes)
+	}
+}
+
+func TestServiceCreate_InvalidRouteMiddlewares(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewServiceHandler(s)
+
+	cases := []map[string]any{
+		{"ip_allowlist": []string{"not-an-ip"}},
+		{"basic_auth": []string{"nopassword"}},
+		{"rate_limit": map[string]any{"average": 0}},
+		{"rate_limit": map[string]any{"average": 10, "period": "soon"}},
+		{"redirect_regex": map[string]any{"regex": "(", "replacement": "/"}},
+		{"request_headers": map[string]string{"Bad Header": "x"}},
+		{"response_headers": map[string]string{"X.Custom": "x"}},
+	}
+	for _, mw := range cases {
+		rec := httptest.NewRecorder()
+		h.Create(rec, postJSON(t, "/api/services", map[string]any{
+			"name":         "tools",
+			"docker_image": "myimage:v1",
+			"routes":       []map[string]any{{"host": "tools.example.com", "middlewares": mw}},
+		}))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("middlewares %v: expected 400, got %d", mw, rec.Code)
+		}
+	}
+}
+
+func TestServiceCreate_InvalidRoutes(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewServiceHandler(s)
+
+	cases := []map[string]any{
+		{"host": ""},
+		{"host": "bad host`"},
+		{"host": "example.com", "path_prefix": "api"},
+		{"host": "example.com", "strip_prefix": true},
+		{"host": "example.com", "container_port": 70000},
+		{"host": "example.com", "entrypoint": "web secure"},
+		{"host": "example.com", "entrypoint": "metrics"},
+	}
+	for _, route := range cases {
+		rec := httptest.NewRecorder()
+		h.Create(rec, postJSON(t, "/api/services", map[string]any{
+			"name":         "api",
+			"docker_image": "myimage:v1",
+			"routes":       []map[string]any{route},
+		}))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("route %v: expected 400, got %d", route, rec.Code)
+		}
+	}
+}
+
+func TestServiceCreate_UnknownEntrypoint(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewServiceHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/services", map[string]any{
+		"name":         "api",
+		"docker_image": "myimage:v1",
+		"routes":       []map[string]any{{"host": "example.com", "entrypoint": "metrics"}},
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "web, websecure") {
+		t.Errorf("expected the valid entrypoints to be listed, got %s", rec.Body)
 	}
 }
 
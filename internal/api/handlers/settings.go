@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/gsarma/localisprod-v2/internal/models"
 	awsprov "github.com/gsarma/localisprod-v2/internal/providers/aws"
 	doprov "github.com/gsarma/localisprod-v2/internal/providers/digitalocean"
 	"github.com/gsarma/localisprod-v2/internal/store"
@@ -19,7 +20,7 @@ func NewSettingsHandler(s *store.Store, appURL string) *SettingsHandler {
 }
 
 func (h *SettingsHandler) Get(w http.ResponseWriter, r *http.Request) {
-	userID := getUserID(w, r)
+	userID := requireRole(w, r, models.RoleAdmin)
 	if userID == "" {
 		return
 	}
@@ -98,12 +99,12 @@ func (h *SettingsHandler) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var body struct {
-		GithubUsername      string `json:"github_username"`
-		GithubToken         string `json:"github_token"`
-		WebhookSecret       string `json:"webhook_secret"`
-		DOAPIToken          string `json:"do_api_token"`
-		AWSAccessKeyID      string `json:"aws_access_key_id"`
-		AWSSecretAccessKey  string `json:"aws_secret_access_key"`
+		GithubUsername     string `json:"github_username"`
+		GithubToken        string `json:"github_token"`
+		WebhookSecret      string `json:"webhook_secret"`
+		DOAPIToken         string `json:"do_api_token"`
+		AWSAccessKeyID     string `json:"aws_access_key_id"`
+		AWSSecretAccessKey string `json:"aws_secret_access_key"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		writeError(w, http.StatusBadRequest, "invalid request body")
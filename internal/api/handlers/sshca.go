@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// sshCASetting holds the user's SSH certificate authority private key.
+const sshCASetting = "ssh_ca_key"
+
+// defaultCertificateValidity is how long issued node certificates are valid
+// unless the request says otherwise.
+const defaultCertificateValidity = 365 * 24 * time.Hour
+
+// userSSHCA returns the user's SSH CA private key, generating it on first use.
+func userSSHCA(s *store.Store, userID string) (string, error) {
+	key, err := s.GetSecretUserSetting(userID, sshCASetting)
+	if err != nil || key != "" {
+		return key, err
+	}
+	key, _, err = sshexec.GenerateKeyPair()
+	if err != nil {
+		return "", err
+	}
+	if err := s.SetSecretUserSetting(userID, sshCASetting, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+type SSHCAHandler struct {
+	store *store.Store
+}
+
+func NewSSHCAHandler(s *store.Store) *SSHCAHandler {
+	return &SSHCAHandler{store: s}
+}
+
+// Get returns the public key of the user's SSH CA, for TrustedUserCAKeys in
+// the sshd_config of nodes that should accept certificates it issues.
+func (h *SSHCAHandler) Get(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	ca, err := userSSHCA(h.store, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	pub, err := sshexec.PublicKey(ca, "")
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"public_key": pub})
+}
+
+// IssueCertificate signs the node's key with the user's SSH CA for the node's
+// login user and stores the certificate on the node. body.valid_for is a Go
+// duration and defaults to a year.
+func (h *NodeHandler) IssueCertificate(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		ValidFor string `json:"valid_for"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+	validFor := defaultCertificateValidity
+	if body.ValidFor != "" {
+		d, err := time.ParseDuration(body.ValidFor)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "valid_for must be a positive duration such as 720h")
+			return
+		}
+		validFor = d
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if node.PrivateKey == "" {
+		writeError(w, http.StatusBadRequest, "node has no private key to certify")
+		return
+	}
+	pub, err := sshexec.PublicKey(node.PrivateKey, node.KeyPassphrase)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ca, err := userSSHCA(h.store, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	cert, validBefore, err := sshexec.SignUserCertificate(ca, pub, node.Username, "localisprod:"+node.Name, validFor)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	node.Certificate = cert
+	if err := h.store.UpdateNodeCredentials(node, userID); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	sshexec.EvictNode(id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"certificate":  cert,
+		"valid_before": validBefore,
+	})
+}
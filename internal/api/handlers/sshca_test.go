@@ -0,0 +1,91 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+func TestSSHCA_StableAcrossCalls(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewSSHCAHandler(s)
+
+	var first, second map[string]string
+	rec := httptest.NewRecorder()
+	h.Get(rec, getRequest("/api/ssh-ca"))
+	decodeJSON(t, rec, &first)
+	rec = httptest.NewRecorder()
+	h.Get(rec, getRequest("/api/ssh-ca"))
+	decodeJSON(t, rec, &second)
+	if first["public_key"] == "" || first["public_key"] != second["public_key"] {
+		t.Errorf("expected a stable CA key, got %q and %q", first["public_key"], second["public_key"])
+	}
+}
+
+func TestNodeIssueCertificate(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	key, _, err := sshexec.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &models.Node{ID: "cert-node", Name: "cert-node", Host: "10.0.0.5", Port: 22, Username: "deploy", PrivateKey: key, Status: "unknown", CreatedAt: time.Now().UTC()}
+	if err := s.CreateNode(n, testUserID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.IssueCertificate(rec, postJSON(t, "/api/nodes/"+n.ID+"/certificate", map[string]any{"valid_for": "nope"}), n.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid valid_for, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.IssueCertificate(rec, postJSON(t, "/api/nodes/"+n.ID+"/certificate", map[string]any{"valid_for": "24h"}), n.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	got, _ := s.GetNode(n.ID, testUserID)
+	if got.Certificate == "" {
+		t.Fatal("expected certificate stored on node")
+	}
+	if err := sshexec.ValidateCredentials(got.PrivateKey, "", got.Certificate); err != nil {
+		t.Errorf("issued certificate does not fit the key: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	h.IssueCertificate(rec, postJSON(t, "/api/nodes/missing/certificate", map[string]any{}), "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestNodeCreate_GenerateKeyNeedsPassword(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, postJSON(t, "/api/nodes", map[string]any{
+		"name": "n", "host": "10.0.0.5", "username": "root", "private_key": "key", "generate_key": true,
+	}))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestNodeRotateKey_LocalNode(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewNodeHandler(s)
+	n := mustCreateNode(t, s)
+
+	rec := httptest.NewRecorder()
+	h.RotateKey(rec, postJSON(t, "/api/nodes/"+n.ID+"/key", map[string]any{}), n.ID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
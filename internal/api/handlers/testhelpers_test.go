@@ -108,7 +108,7 @@ func mustCreateApp(t *testing.T, s *store.Store) *models.Service {
 		Ports:       `[]`,
 		Command:     "",
 		GithubRepo:  "",
-		Domain:      "",
+		Routes:      "[]",
 		CreatedAt:   time.Now().UTC(),
 	}
 	if err := s.CreateService(a, testUserID); err != nil {
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// defaultTokenLifetime is how long a token lives when no expiry is given.
+const defaultTokenLifetime = 90 * 24 * time.Hour
+
+// TokenHandler manages the caller's own API tokens. Tokens belong to a user,
+// not an organization: a token acts in whichever of the user's organizations
+// a request selects.
+type TokenHandler struct {
+	store *store.Store
+}
+
+func NewTokenHandler(s *store.Store) *TokenHandler {
+	return &TokenHandler{store: s}
+}
+
+// createdToken is a new token with its secret, which is only ever shown in
+// the response to Create.
+type createdToken struct {
+	*models.APIToken
+	Token string `json:"token"`
+}
+
+// tokenOwner returns the ID of the user making the request. Changing tokens
+// with an API token needs the admin scope.
+func tokenOwner(w http.ResponseWriter, r *http.Request) string {
+	claims := auth.ClaimsFromContext(r.Context())
+	if claims == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return ""
+	}
+	if r.Method != http.MethodGet && claims.Scope != "" && claims.Scope != models.ScopeAdmin {
+		writeError(w, http.StatusForbidden, "requires an API token with the admin scope")
+		return ""
+	}
+	return claims.UserID
+}
+
+// List returns the caller's tokens without their secrets.
+func (h *TokenHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := tokenOwner(w, r)
+	if userID == "" {
+		return
+	}
+	tokens, err := h.store.ListAPITokens(userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if tokens == nil {
+		tokens = []*models.APIToken{}
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// Create issues a token with a name, a scope (read, deploy or admin) and an
+// expiry in days: 90 when omitted, none when 0. The token is returned once.
+func (h *TokenHandler) Create(w http.ResponseWriter, r *http.Request) {
+	userID := tokenOwner(w, r)
+	if userID == "" {
+		return
+	}
+	var body struct {
+		Name          string `json:"name"`
+		Scope         string `json:"scope"`
+		ExpiresInDays *int   `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if !models.ValidScope(body.Scope) {
+		writeError(w, http.StatusBadRequest, "scope must be read, deploy or admin")
+		return
+	}
+	now := time.Now().UTC()
+	t := &models.APIToken{
+		ID:        uuid.New().String(),
+		Name:      body.Name,
+		Scope:     body.Scope,
+		UserID:    userID,
+		CreatedAt: now,
+	}
+	switch {
+	case body.ExpiresInDays == nil:
+		exp := now.Add(defaultTokenLifetime)
+		t.ExpiresAt = &exp
+	case *body.ExpiresInDays < 0:
+		writeError(w, http.StatusBadRequest, "expires_in_days must not be negative")
+		return
+	case *body.ExpiresInDays > 0:
+		exp := now.Add(time.Duration(*body.ExpiresInDays) * 24 * time.Hour)
+		t.ExpiresAt = &exp
+	}
+
+	secret, prefix, hash, err := auth.GenerateAPIToken()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	t.Prefix = prefix
+	if err := h.store.CreateAPIToken(t, hash); err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, createdToken{APIToken: t, Token: secret})
+}
+
+// Delete revokes one of the caller's tokens.
+func (h *TokenHandler) Delete(w http.ResponseWriter, r *http.Request, id string) {
+	userID := tokenOwner(w, r)
+	if userID == "" {
+		return
+	}
+	ok, err := h.store.DeleteAPIToken(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
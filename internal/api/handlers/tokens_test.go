@@ -0,0 +1,84 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+func TestTokens_CreateListRevoke(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewTokenHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, withUserID(postJSON(t, "/api/tokens", map[string]any{"name": "ci", "scope": "deploy"})))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var created struct {
+		models.APIToken
+		Token string `json:"token"`
+	}
+	decodeJSON(t, rec, &created)
+	if !auth.IsAPIToken(created.Token) || created.Prefix == "" || created.Token[:len(created.Prefix)] != created.Prefix {
+		t.Errorf("token %q with prefix %q", created.Token, created.Prefix)
+	}
+	if created.ExpiresAt == nil {
+		t.Error("expected the default expiry")
+	}
+	if stored, _ := s.GetAPITokenByHash(auth.HashAPIToken(created.Token)); stored == nil || stored.ID != created.ID {
+		t.Error("token not found by its hash")
+	}
+
+	rec = httptest.NewRecorder()
+	h.Create(rec, withUserID(postJSON(t, "/api/tokens", map[string]any{"name": "forever", "scope": "read", "expires_in_days": 0})))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create without expiry: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.Create(rec, withUserID(postJSON(t, "/api/tokens", map[string]any{"name": "bad", "scope": "root"})))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad scope: expected 400, got %d", rec.Code)
+	}
+
+	var list []map[string]any
+	rec = httptest.NewRecorder()
+	h.List(rec, withUserID(getRequest("/api/tokens")))
+	decodeJSON(t, rec, &list)
+	if len(list) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(list))
+	}
+	for _, tok := range list {
+		if _, ok := tok["token"]; ok {
+			t.Error("list exposes the token secret")
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.Delete(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/tokens/"+created.ID, nil)), created.ID)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("revoke: expected 204, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.Delete(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/tokens/"+created.ID, nil)), created.ID)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("revoke twice: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestTokens_ScopedTokenCannotMintTokens(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewTokenHandler(s)
+	r := postJSON(t, "/api/tokens", map[string]any{"name": "escalate", "scope": "admin"})
+	r = r.WithContext(auth.InjectClaims(r.Context(), &auth.Claims{UserID: testUserID, Scope: models.ScopeDeploy}))
+
+	rec := httptest.NewRecorder()
+	h.Create(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
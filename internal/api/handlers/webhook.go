@@ -5,11 +5,15 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"strings"
 
+	"github.com/gsarma/localisprod-v2/internal/audit"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
 )
@@ -29,20 +33,20 @@ func (h *WebhookHandler) GithubForUser(w http.ResponseWriter, r *http.Request, t
 		return
 	}
 
-	// Look up the user by webhook token
-	user, err := h.store.GetUserByWebhookToken(token)
+	// Look up the organization by webhook token
+	ownerID, err := h.store.GetWebhookOwner(token)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "internal error")
 		return
 	}
-	if user == nil {
+	if ownerID == "" {
 		writeError(w, http.StatusNotFound, "invalid webhook token")
 		return
 	}
 
-	// Verify HMAC-SHA256 signature against this user's webhook_secret.
+	// Verify HMAC-SHA256 signature against this organization's webhook_secret.
 	// A secret must be configured — unauthenticated webhook delivery is rejected.
-	secret, _ := h.store.GetSecretUserSetting(user.ID, "webhook_secret")
+	secret, _ := h.store.GetSecretUserSetting(ownerID, "webhook_secret")
 	if secret == "" {
 		writeError(w, http.StatusUnauthorized, "webhook secret not configured")
 		return
@@ -77,35 +81,54 @@ func (h *WebhookHandler) GithubForUser(w http.ResponseWriter, r *http.Request, t
 		return
 	}
 
-	apps, err := h.store.ListServicesByUserAndRepo(user.ID, repoFullName)
+	apps, err := h.store.ListServicesByUserAndRepo(ownerID, repoFullName)
 	if err != nil {
 		writeInternalError(w, err)
 		return
 	}
 
-	ghToken, _ := h.store.GetSecretUserSetting(user.ID, "github_token")
-	ghUsername, _ := h.store.GetUserSetting(user.ID, "github_username")
+	ghToken, _ := h.store.GetSecretUserSetting(ownerID, "github_token")
+	ghUsername, _ := h.store.GetUserSetting(ownerID, "github_username")
 
+	deploy := deployer.New(h.store)
 	redeployed := 0
+	// record adds a redeploy attempt to the organization's audit log.
+	record := func(d *models.Deployment, image, containerID string, err error) {
+		e := &models.AuditEvent{
+			ActorType:    models.AuditActorWebhook,
+			ActorID:      "github",
+			ActorName:    repoFullName,
+			Action:       "deployment.redeploy",
+			ResourceType: "deployment",
+			ResourceID:   d.ID,
+			SourceIP:     audit.ClientIP(r),
+			UserID:       ownerID,
+		}
+		if err != nil {
+			e.Error = err.Error()
+		} else {
+			e.After = audit.SummaryOf(map[string]string{"image": image, "container_id": containerID, "status": "running"})
+		}
+		audit.Record(h.store, e)
+	}
 
 	for _, app := range apps {
-		deployments, err := h.store.GetDeploymentsByServiceID(app.ID, user.ID)
+		deployments, err := h.store.GetDeploymentsByServiceID(app.ID, ownerID)
 		if err != nil {
 			log.Printf("webhook: list deployments for app %s: %v", app.ID, err)
 			continue
 		}
 
-		var envVars map[string]string
-		_ = json.Unmarshal([]byte(app.EnvVars), &envVars)
-		var ports []string
-		_ = json.Unmarshal([]byte(app.Ports), &ports)
-
 		for _, d := range deployments {
 			if d.Status != "running" {
 				continue
 			}
+			if d.PinnedImage != "" {
+				log.Printf("webhook: deployment %s is pinned to %s by a rollback; redeploy it to take the new image", d.ID, d.PinnedImage)
+				continue
+			}
 
-			node, err := h.store.GetNode(d.NodeID, user.ID)
+			node, err := h.store.GetNode(d.NodeID, ownerID)
 			if err != nil || node == nil {
 				log.Printf("webhook: node %s not found for deployment %s", d.NodeID, d.ID)
 				continue
@@ -118,7 +141,8 @@ func (h *WebhookHandler) GithubForUser(w http.ResponseWriter, r *http.Request, t
 				loginCmd := sshexec.DockerLoginCmd(ghUsername, ghToken)
 				if _, loginErr := runner.Run(loginCmd); loginErr != nil {
 					log.Printf("webhook: docker login failed for deployment %s: %v", d.ID, loginErr)
-					_ = h.store.UpdateDeploymentStatus(d.ID, user.ID, "failed", "")
+					_ = h.store.UpdateDeploymentStatus(d.ID, ownerID, "failed", "")
+					record(d, app.DockerImage, "", fmt.Errorf("docker login: %w", loginErr))
 					continue
 				}
 			}
@@ -127,45 +151,24 @@ func (h *WebhookHandler) GithubForUser(w http.ResponseWriter, r *http.Request, t
 			pullCmd := sshexec.DockerPullCmd(app.DockerImage)
 			if _, pullErr := runner.Run(pullCmd); pullErr != nil {
 				log.Printf("webhook: docker pull failed for deployment %s: %v", d.ID, pullErr)
-				_ = h.store.UpdateDeploymentStatus(d.ID, user.ID, "failed", "")
+				_ = h.store.UpdateDeploymentStatus(d.ID, ownerID, "failed", "")
+				record(d, app.DockerImage, "", fmt.Errorf("docker pull: %w", pullErr))
 				continue
 			}
 
-			// Stop and remove old container
-			stopCmd := sshexec.DockerStopRemoveCmd(d.ContainerName)
-			if _, stopErr := runner.Run(stopCmd); stopErr != nil {
-				log.Printf("webhook: docker stop/rm failed for deployment %s: %v", d.ID, stopErr)
-			}
-
-			// Build RunConfig reusing the same container name
-			cfg := sshexec.RunConfig{
-				ContainerName: d.ContainerName,
-				Image:         app.DockerImage,
-				Ports:         ports,
-				CommandArgs:   strings.Fields(app.Command),
-			}
-			_ = envVars // env vars are embedded in the running container; redeploy reuses existing config
-			if app.Domain != "" {
-				containerPort := "80"
-				if len(ports) > 0 {
-					if idx := strings.LastIndex(ports[0], ":"); idx >= 0 {
-						containerPort = ports[0][idx+1:]
-					}
-				}
-				cfg.Network = "traefik-net"
-				cfg.Labels = sshexec.TraefikLabels(d.ContainerName, app.Domain, containerPort)
-			}
-
-			runCmd := sshexec.DockerRunCmd(cfg)
-			output, runErr := runner.Run(runCmd)
+			// Recreate the container under the same name with the service's
+			// env vars and networks; the freshly pulled image is picked up.
+			d.UserID = ownerID
+			newContainerID, runErr := deploy.RecreateDeployment(d, node)
 			if runErr != nil {
-				log.Printf("webhook: docker run failed for deployment %s: %v\noutput: %s", d.ID, runErr, output)
-				_ = h.store.UpdateDeploymentStatus(d.ID, user.ID, "failed", "")
+				log.Printf("webhook: redeploy failed for deployment %s: %v", d.ID, runErr)
+				_ = h.store.UpdateDeploymentStatus(d.ID, ownerID, "failed", "")
+				record(d, app.DockerImage, "", runErr)
 				continue
 			}
 
-			newContainerID := strings.TrimSpace(output)
-			_ = h.store.UpdateDeploymentStatus(d.ID, user.ID, "running", newContainerID)
+			_ = h.store.UpdateDeploymentStatus(d.ID, ownerID, "running", newContainerID)
+			record(d, app.DockerImage, newContainerID, nil)
 			log.Printf("webhook: redeployed %s (container %s) on node %s", d.ContainerName, newContainerID, node.Name)
 			redeployed++
 		}
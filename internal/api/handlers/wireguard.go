@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+type WireGuardHandler struct {
+	store *store.Store
+}
+
+func NewWireGuardHandler(s *store.Store) *WireGuardHandler {
+	return &WireGuardHandler{store: s}
+}
+
+// List returns the nodes in the user's WireGuard mesh.
+func (h *WireGuardHandler) List(w http.ResponseWriter, r *http.Request) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	peers, err := h.store.ListWireGuardPeers(userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if peers == nil {
+		peers = []*models.WireGuardPeer{}
+	}
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// Join adds a node to the user's mesh and pushes peer configs to every mesh
+// node. Nodes that could not be configured are reported in "error"; the
+// membership is kept so a later join or leave retries them.
+func (h *WireGuardHandler) Join(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	peer, err := deployer.New(h.store).JoinMesh(node, userID)
+	if peer == nil {
+		writeInternalError(w, err)
+		return
+	}
+	// The node's overlay IP is now a valid source for linked resource ports.
+	reconcileFirewalls(h.store, userID)
+	resp := map[string]interface{}{"peer": peer}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Leave removes a node from the user's mesh and pushes updated peer configs to
+// the remaining nodes.
+func (h *WireGuardHandler) Leave(w http.ResponseWriter, r *http.Request, id string) {
+	userID := getUserID(w, r)
+	if userID == "" {
+		return
+	}
+	node, err := h.store.GetNode(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if node == nil {
+		writeError(w, http.StatusNotFound, "node not found")
+		return
+	}
+	peer, err := h.store.GetWireGuardPeer(id, userID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if peer == nil {
+		writeError(w, http.StatusNotFound, "node is not in the mesh")
+		return
+	}
+
+	err = deployer.New(h.store).LeaveMesh(node, userID)
+	reconcileFirewalls(h.store, userID)
+	if err != nil {
+		writeJSON(w, http.StatusOK, map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
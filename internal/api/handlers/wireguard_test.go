@@ -0,0 +1,44 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/api/handlers"
+)
+
+func TestWireGuardList_Empty(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewWireGuardHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.List(rec, getRequest("/api/wireguard"))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("expected 200 with [], got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWireGuardJoin_NodeNotFound(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewWireGuardHandler(s)
+
+	rec := httptest.NewRecorder()
+	h.Join(rec, withUserID(httptest.NewRequest(http.MethodPost, "/api/nodes/missing/wireguard", nil)), "missing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestWireGuardLeave_NotInMesh(t *testing.T) {
+	s := newTestStore(t)
+	h := handlers.NewWireGuardHandler(s)
+	node := mustCreateNode(t, s)
+
+	rec := httptest.NewRecorder()
+	h.Leave(rec, withUserID(httptest.NewRequest(http.MethodDelete, "/api/nodes/"+node.ID+"/wireguard", nil)), node.ID)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d (body: %s)", rec.Code, rec.Body)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/gsarma/localisprod-v2/internal/api/handlers"
 	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/store"
 )
 
@@ -26,6 +27,19 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 	providersH := handlers.NewProvidersHandler(s)
 	composeH := handlers.NewComposeHandler(s)
 	volH := handlers.NewVolumeHandler(s)
+	healH := handlers.NewHealHandler(s)
+	canaryH := handlers.NewCanaryHandler(s)
+	certH := handlers.NewCertificateHandler(s)
+	wgH := handlers.NewWireGuardHandler(s)
+	fwH := handlers.NewFirewallHandler(s)
+	metricsH := handlers.NewMetricsHandler(s)
+	jumpH := handlers.NewJumpHostHandler(s)
+	sshCAH := handlers.NewSSHCAHandler(s)
+	eventsH := handlers.NewEventsHandler()
+	auditH := handlers.NewAuditHandler(s)
+	orgH := handlers.NewOrgHandler(s)
+	tokenH := handlers.NewTokenHandler(s)
+	exportH := handlers.NewExportHandler(s)
 
 	// Unprotected mux (auth + webhooks)
 	publicMux := http.NewServeMux()
@@ -76,6 +90,86 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 		}
 	})
 
+	// API tokens
+	protectedMux.HandleFunc("/api/tokens", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			tokenH.List(w, r)
+		case http.MethodPost:
+			tokenH.Create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	protectedMux.HandleFunc("/api/tokens/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/tokens/"), "/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			tokenH.Delete(w, r, id)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Organizations
+	protectedMux.HandleFunc("/api/orgs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			orgH.List(w, r)
+		case http.MethodPost:
+			orgH.Create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	protectedMux.HandleFunc("/api/orgs/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/orgs/"), "/")
+		parts := strings.Split(path, "/")
+		id := parts[0]
+		if id == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case len(parts) == 1:
+			switch r.Method {
+			case http.MethodGet:
+				orgH.Get(w, r, id)
+			case http.MethodPut:
+				orgH.Update(w, r, id)
+			case http.MethodDelete:
+				orgH.Delete(w, r, id)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		case len(parts) == 2 && parts[1] == "members":
+			switch r.Method {
+			case http.MethodGet:
+				orgH.ListMembers(w, r, id)
+			case http.MethodPost:
+				orgH.AddMember(w, r, id)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		case len(parts) == 3 && parts[1] == "members" && parts[2] != "":
+			switch r.Method {
+			case http.MethodPut:
+				orgH.UpdateMember(w, r, id, parts[2])
+			case http.MethodDelete:
+				orgH.RemoveMember(w, r, id, parts[2])
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
 	protectedMux.HandleFunc("/api/stats", dashH.Stats)
 
 	// Settings
@@ -129,6 +223,84 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 				}
 				return
+			case "host-key":
+				switch r.Method {
+				case http.MethodGet:
+					nodeH.HostKey(w, r, id)
+				case http.MethodPut:
+					nodeH.AcceptHostKey(w, r, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "key":
+				if r.Method == http.MethodPost {
+					nodeH.RotateKey(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "certificate":
+				if r.Method == http.MethodPost {
+					nodeH.IssueCertificate(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "cordon":
+				switch r.Method {
+				case http.MethodPost:
+					nodeH.Cordon(w, r, id)
+				case http.MethodDelete:
+					nodeH.Uncordon(w, r, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "drain":
+				if r.Method == http.MethodPost {
+					nodeH.Drain(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "metrics":
+				if r.Method == http.MethodGet {
+					metricsH.Node(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "bootstrap":
+				switch r.Method {
+				case http.MethodGet:
+					nodeH.GetBootstrap(w, r, id)
+				case http.MethodPost:
+					nodeH.Bootstrap(w, r, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "firewall":
+				switch r.Method {
+				case http.MethodPost:
+					fwH.Enable(w, r, id)
+				case http.MethodDelete:
+					fwH.Disable(w, r, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "wireguard":
+				switch r.Method {
+				case http.MethodPost:
+					wgH.Join(w, r, id)
+				case http.MethodDelete:
+					wgH.Leave(w, r, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
 			case "setup-traefik":
 				if r.Method == http.MethodPost {
 					nodeH.SetupTraefik(w, r, id)
@@ -222,11 +394,31 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 
 	protectedMux.HandleFunc("/api/databases/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/api/databases/")
-		id := strings.TrimSuffix(path, "/")
+		parts := strings.SplitN(strings.TrimSuffix(path, "/"), "/", 2)
+		id := parts[0]
 		if id == "" {
 			http.NotFound(w, r)
 			return
 		}
+
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "heal-policy":
+				switch r.Method {
+				case http.MethodGet:
+					healH.Get(w, r, models.HealResourceDatabase, id)
+				case http.MethodPut:
+					healH.Update(w, r, models.HealResourceDatabase, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			dbH.Get(w, r, id)
@@ -251,11 +443,31 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 
 	protectedMux.HandleFunc("/api/caches/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/api/caches/")
-		id := strings.TrimSuffix(path, "/")
+		parts := strings.SplitN(strings.TrimSuffix(path, "/"), "/", 2)
+		id := parts[0]
 		if id == "" {
 			http.NotFound(w, r)
 			return
 		}
+
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "heal-policy":
+				switch r.Method {
+				case http.MethodGet:
+					healH.Get(w, r, models.HealResourceCache, id)
+				case http.MethodPut:
+					healH.Update(w, r, models.HealResourceCache, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			cacheH.Get(w, r, id)
@@ -280,11 +492,31 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 
 	protectedMux.HandleFunc("/api/kafkas/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/api/kafkas/")
-		id := strings.TrimSuffix(path, "/")
+		parts := strings.SplitN(strings.TrimSuffix(path, "/"), "/", 2)
+		id := parts[0]
 		if id == "" {
 			http.NotFound(w, r)
 			return
 		}
+
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "heal-policy":
+				switch r.Method {
+				case http.MethodGet:
+					healH.Get(w, r, models.HealResourceKafka, id)
+				case http.MethodPut:
+					healH.Update(w, r, models.HealResourceKafka, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			kafkaH.Get(w, r, id)
@@ -309,11 +541,31 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 
 	protectedMux.HandleFunc("/api/monitorings/", func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimPrefix(r.URL.Path, "/api/monitorings/")
-		id := strings.TrimSuffix(path, "/")
+		parts := strings.SplitN(strings.TrimSuffix(path, "/"), "/", 2)
+		id := parts[0]
 		if id == "" {
 			http.NotFound(w, r)
 			return
 		}
+
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "heal-policy":
+				switch r.Method {
+				case http.MethodGet:
+					healH.Get(w, r, models.HealResourceMonitoring, id)
+				case http.MethodPut:
+					healH.Update(w, r, models.HealResourceMonitoring, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			monitoringH.Get(w, r, id)
@@ -392,6 +644,31 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 		}
 	})
 
+	// Declarative manifests and compose imports. Changes are replayed through
+	// the audited API.
+	applyH := handlers.NewApplyHandler(s, auditMiddleware(s, protectedMux))
+	protectedMux.HandleFunc("/api/apply", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			applyH.Apply(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	protectedMux.HandleFunc("/api/import/docker-compose/apply", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			applyH.ImportCompose(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	protectedMux.HandleFunc("/api/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			exportH.Export(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
 	// Deployments
 	protectedMux.HandleFunc("/api/deployments", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
@@ -422,6 +699,20 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 				}
 				return
+			case "rollback":
+				if r.Method == http.MethodPost {
+					depH.Rollback(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "redeploy":
+				if r.Method == http.MethodPost {
+					depH.Redeploy(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
 			case "logs":
 				if r.Method == http.MethodGet {
 					depH.Logs(w, r, id)
@@ -429,6 +720,23 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 				}
 				return
+			case "metrics":
+				if r.Method == http.MethodGet {
+					metricsH.Deployment(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "heal-policy":
+				switch r.Method {
+				case http.MethodGet:
+					healH.Get(w, r, models.HealResourceDeployment, id)
+				case http.MethodPut:
+					healH.Update(w, r, models.HealResourceDeployment, id)
+				default:
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
 			}
 		}
 
@@ -442,8 +750,190 @@ func NewRouter(s *store.Store, oauthSvc *auth.OAuthService, jwtSvc *auth.JWTServ
 		}
 	})
 
-	// Wrap protected routes with JWT middleware
-	protectedHandler := jwtSvc.Middleware(protectedMux)
+	// Canaries
+	protectedMux.HandleFunc("/api/canaries", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			canaryH.List(w, r)
+		case http.MethodPost:
+			canaryH.Create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	protectedMux.HandleFunc("/api/canaries/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/canaries/")
+		parts := strings.SplitN(path, "/", 2)
+		id := parts[0]
+		if id == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if len(parts) == 2 {
+			switch parts[1] {
+			case "weight":
+				if r.Method == http.MethodPut {
+					canaryH.UpdateWeight(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "promote":
+				if r.Method == http.MethodPost {
+					canaryH.Promote(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			case "abort":
+				if r.Method == http.MethodPost {
+					canaryH.Abort(w, r, id)
+				} else {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				}
+				return
+			}
+		}
+
+		if r.Method == http.MethodGet {
+			canaryH.Get(w, r, id)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// TLS certificates
+	protectedMux.HandleFunc("/api/certificates", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			certH.List(w, r)
+		case http.MethodPost:
+			certH.Create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	protectedMux.HandleFunc("/api/certificates/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/certificates/")
+		if id == "" {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			certH.Get(w, r, id)
+		case http.MethodDelete:
+			certH.Delete(w, r, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	protectedMux.HandleFunc("/api/acme", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			certH.GetACME(w, r)
+		case http.MethodPut:
+			certH.UpdateACME(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Firewall
+	protectedMux.HandleFunc("/api/firewall", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			fwH.List(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	protectedMux.HandleFunc("/api/firewall/rules", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			fwH.CreateRule(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	protectedMux.HandleFunc("/api/firewall/rules/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/firewall/rules/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			fwH.DeleteRule(w, r, id)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// SSH certificate authority
+	protectedMux.HandleFunc("/api/ssh-ca", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			sshCAH.Get(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Jump hosts
+	protectedMux.HandleFunc("/api/jump-hosts", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			jumpH.List(w, r)
+		case http.MethodPost:
+			jumpH.Create(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	protectedMux.HandleFunc("/api/jump-hosts/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/jump-hosts/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			jumpH.Delete(w, r, id)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// WireGuard mesh
+	protectedMux.HandleFunc("/api/wireguard", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			wgH.List(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Container events, as a server-sent event stream
+	protectedMux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			eventsH.Stream(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Audit log
+	protectedMux.HandleFunc("/api/audit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			auditH.List(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Wrap protected routes with JWT middleware; mutating requests are
+	// recorded in the audit log
+	protectedHandler := jwtSvc.MiddlewareWithTokens(apiTokenAuth(s, rootEmail), workspaceMiddleware(s, auditMiddleware(s, protectedMux)))
 
 	// Main mux: public routes first, then protected
 	mainMux := http.NewServeMux()
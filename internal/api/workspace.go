@@ -0,0 +1,49 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// orgHeader selects the organization a request acts in. The org_id query
+// parameter does the same for requests that cannot set headers, such as an
+// EventSource or a download link.
+const orgHeader = "X-Org-ID"
+
+// workspaceMiddleware resolves the organization each request to next acts in
+// and the caller's role in it. Without a selection a request acts in the
+// caller's personal organization; selecting one the caller is not a member
+// of is refused. An API token's scope caps the role.
+func workspaceMiddleware(s *store.Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := auth.ClaimsFromContext(r.Context())
+		if claims == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		orgID := r.Header.Get(orgHeader)
+		if orgID == "" {
+			orgID = r.URL.Query().Get("org_id")
+		}
+		ws := &auth.Workspace{OrgID: claims.UserID, Role: models.RoleOwner}
+		if orgID != "" && orgID != claims.UserID {
+			role, err := s.GetOrgRole(orgID, claims.UserID)
+			if err != nil {
+				log.Printf("internal error: resolve organization %s: %v", orgID, err)
+				http.Error(w, `{"error":"internal server error"}`, http.StatusInternalServerError)
+				return
+			}
+			if role == "" {
+				http.Error(w, `{"error":"not a member of this organization"}`, http.StatusForbidden)
+				return
+			}
+			ws = &auth.Workspace{OrgID: orgID, Role: role}
+		}
+		ws.Role = models.CapRole(ws.Role, claims.Scope)
+		next.ServeHTTP(w, r.WithContext(auth.InjectWorkspace(r.Context(), ws)))
+	})
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/auth"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+func TestWorkspaceMiddleware(t *testing.T) {
+	s, err := store.New(":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, _ := s.UpsertUser("sub-owner", "owner@example.com", "Owner", "")
+	member, _ := s.UpsertUser("sub-member", "member@example.com", "Member", "")
+	org, err := s.CreateOrganization("Team", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetOrgMember(org.ID, member.ID, models.RoleDeployer); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *auth.Workspace
+	h := workspaceMiddleware(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.WorkspaceFromContext(r.Context())
+	}))
+	do := func(userID, header, query string) int {
+		got = nil
+		r := httptest.NewRequest(http.MethodGet, "/api/nodes"+query, nil)
+		if header != "" {
+			r.Header.Set(orgHeader, header)
+		}
+		r = r.WithContext(auth.InjectClaims(r.Context(), &auth.Claims{UserID: userID}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := do(member.ID, "", ""); code != http.StatusOK || got.OrgID != member.ID || got.Role != models.RoleOwner {
+		t.Errorf("default: %d %+v", code, got)
+	}
+	if code := do(member.ID, org.ID, ""); code != http.StatusOK || got.OrgID != org.ID || got.Role != models.RoleDeployer {
+		t.Errorf("header: %d %+v", code, got)
+	}
+	if code := do(member.ID, "", "?org_id="+org.ID); code != http.StatusOK || got.OrgID != org.ID {
+		t.Errorf("query: %d %+v", code, got)
+	}
+	if code := do(member.ID, owner.ID, ""); code != http.StatusForbidden || got != nil {
+		t.Errorf("another user's personal organization: %d %+v", code, got)
+	}
+}
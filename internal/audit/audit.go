@@ -0,0 +1,130 @@
+// Package audit records mutating actions in the store's audit log, with
+// secrets redacted from the before/after summaries.
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// maxSummary caps the size of a before/after summary.
+const maxSummary = 8 << 10
+
+// Redacted replaces the value of every secret field in a summary.
+const Redacted = "[redacted]"
+
+// secretKeys are substrings of JSON field names whose values are never
+// recorded.
+var secretKeys = []string{
+	"password", "passphrase", "secret", "token", "private_key", "key_pem",
+	"access_key", "credential", "env_vars", "basic_auth",
+}
+
+// Record stores e, filling in its ID and time. Failures are only logged so
+// that auditing never fails the action itself.
+func Record(s *store.Store, e *models.AuditEvent) {
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	if e.Result == "" {
+		e.Result = models.AuditResultSuccess
+		if e.Error != "" {
+			e.Result = models.AuditResultFailure
+		}
+	}
+	if err := s.InsertAuditEvent(e); err != nil {
+		log.Printf("audit: record %s %s: %v", e.Action, e.ResourceID, err)
+	}
+}
+
+// Summary returns the JSON document data with secret fields redacted, or ""
+// when data is not a JSON object or array.
+func Summary(data []byte) string {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return ""
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+	default:
+		return ""
+	}
+	out, err := json.Marshal(redact(v))
+	if err != nil {
+		return ""
+	}
+	if len(out) > maxSummary {
+		// Cut on a rune boundary so the summary stays valid UTF-8.
+		n := maxSummary
+		for n > 0 && !utf8.RuneStart(out[n]) {
+			n--
+		}
+		return string(out[:n]) + "…"
+	}
+	return string(out)
+}
+
+// SummaryOf is Summary of v marshalled to JSON.
+func SummaryOf(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return Summary(data)
+}
+
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			if isSecret(k) && val != nil && val != "" {
+				v[k] = Redacted
+			} else {
+				v[k] = redact(val)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return v
+}
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address the request came from. X-Forwarded-For is only
+// trusted when the direct peer is a local reverse proxy.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsPrivate()) {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	return host
+}
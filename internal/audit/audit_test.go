@@ -0,0 +1,48 @@
+package audit_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gsarma/localisprod-v2/internal/audit"
+)
+
+func TestSummary_RedactsSecrets(t *testing.T) {
+	got := audit.Summary([]byte(`{"name":"db","password":"hunter2","nested":{"github_token":"ghp_x","private_key":""},
+		"env_vars":{"API_KEY":"abc"},"list":[{"key_passphrase":"p"}],"host_key":"ssh-ed25519 AAAA"}`))
+	for _, secret := range []string{"hunter2", "ghp_x", "abc", `"p"`} {
+		if strings.Contains(got, secret) {
+			t.Errorf("summary leaks %s: %s", secret, got)
+		}
+	}
+	for _, kept := range []string{`"name":"db"`, `"host_key":"ssh-ed25519 AAAA"`, `"private_key":""`} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("summary lost %s: %s", kept, got)
+		}
+	}
+}
+
+func TestSummary_NotJSON(t *testing.T) {
+	for _, in := range []string{"", "plain text", `"a string"`, "42"} {
+		if got := audit.Summary([]byte(in)); got != "" {
+			t.Errorf("Summary(%q) = %q, want empty", in, got)
+		}
+	}
+}
+
+func TestSummary_Truncated(t *testing.T) {
+	got := audit.Summary([]byte(`{"content":"` + strings.Repeat("x", 20000) + `"}`))
+	if len(got) > 9000 || !strings.HasSuffix(got, "…") {
+		t.Errorf("expected a truncated summary, got %d bytes", len(got))
+	}
+}
+
+func TestSummary_TruncatedOnRuneBoundary(t *testing.T) {
+	for pad := 0; pad < 4; pad++ {
+		got := audit.Summary([]byte(`{"content":"` + strings.Repeat("x", pad) + strings.Repeat("é", 10000) + `"}`))
+		if !utf8.ValidString(got) {
+			t.Errorf("pad %d: truncated summary is not valid UTF-8", pad)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// apiTokenPrefix marks API tokens so they are recognisable in configs and
+// secret scanners.
+const apiTokenPrefix = "lp_"
+
+// apiTokenDisplayLen is how much of a token is kept in clear to tell tokens
+// apart.
+const apiTokenDisplayLen = len(apiTokenPrefix) + 6
+
+// GenerateAPIToken returns a new random API token, the prefix shown for it
+// in listings and the hash it is stored as. The token itself is not stored.
+func GenerateAPIToken() (token, prefix, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", fmt.Errorf("generate api token: %w", err)
+	}
+	token = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, token[:apiTokenDisplayLen], HashAPIToken(token), nil
+}
+
+// HashAPIToken returns the hash an API token is stored and looked up by.
+// Tokens are random, so an unsalted SHA-256 is enough.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIToken reports whether s looks like an API token.
+func IsAPIToken(s string) bool {
+	return strings.HasPrefix(s, apiTokenPrefix) && len(s) > apiTokenDisplayLen
+}
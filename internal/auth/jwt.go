@@ -14,6 +14,10 @@ type Claims struct {
 	Name      string `json:"name"`
 	AvatarURL string `json:"avatar_url"`
 	IsRoot    bool   `json:"is_root"`
+	// Scope and TokenName are set when the request authenticated with an
+	// API token rather than a session; they are never part of a JWT.
+	Scope     string `json:"-"`
+	TokenName string `json:"-"`
 	jwt.RegisteredClaims
 }
 
@@ -2,13 +2,38 @@ package auth
 
 import (
 	"context"
+	"log"
 	"net/http"
+	"strings"
 )
 
 type contextKey struct{}
 
 func (j *JWTService) Middleware(next http.Handler) http.Handler {
+	return j.MiddlewareWithTokens(nil, next)
+}
+
+// APITokenFunc resolves an API token sent as a bearer token to the claims of
+// its user, or returns nil claims if it is unknown or expired.
+type APITokenFunc func(r *http.Request, token string) (*Claims, error)
+
+// MiddlewareWithTokens is Middleware that also accepts API tokens in an
+// "Authorization: Bearer" header, resolved by tokens. A bearer token takes
+// precedence over the session cookie.
+func (j *JWTService) MiddlewareWithTokens(tokens APITokenFunc, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && tokens != nil {
+			claims, err := tokens(r, strings.TrimSpace(bearer))
+			if err != nil {
+				log.Printf("api token: %v", err)
+			}
+			if claims == nil {
+				http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, claims)))
+			return
+		}
 		cookie, err := r.Cookie(j.CookieName())
 		if err != nil {
 			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
@@ -33,3 +58,24 @@ func ClaimsFromContext(ctx context.Context) *Claims {
 func InjectClaims(ctx context.Context, c *Claims) context.Context {
 	return context.WithValue(ctx, contextKey{}, c)
 }
+
+type workspaceKey struct{}
+
+// Workspace is the organization a request acts in and the caller's role in
+// it.
+type Workspace struct {
+	OrgID string
+	Role  string
+}
+
+// WorkspaceFromContext returns the workspace of a request, or nil if none was
+// resolved.
+func WorkspaceFromContext(ctx context.Context) *Workspace {
+	ws, _ := ctx.Value(workspaceKey{}).(*Workspace)
+	return ws
+}
+
+// InjectWorkspace injects the workspace of a request into a context.
+func InjectWorkspace(ctx context.Context, ws *Workspace) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, ws)
+}
@@ -0,0 +1,239 @@
+package compose
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/manifest"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+// Manifest returns the manifest that creates the previewed resources on the
+// node named node. Services are linked to the databases, caches and Kafka
+// clusters they depend on, and deployed on node when deploy is set.
+// Postgres keeps the POSTGRES_PASSWORD of its compose service; other
+// passwords are generated. Image tags that do not carry over to the managed
+// images, such as "latest" or MinIO's, are left to the API's defaults, and
+// so are the healthchecks, resources, replicas, restart policies, labels,
+// networks and secrets of services, which services do not have.
+func (p *Preview) Manifest(node string, deploy bool) (*manifest.Manifest, error) {
+	m := &manifest.Manifest{Nodes: []manifest.Node{{Name: node}}}
+	kinds := map[string]string{} // compose service name -> manifest link field
+	for _, db := range p.Databases {
+		m.Databases = append(m.Databases, manifest.Database{
+			Name: db.Name, Type: db.Type, Version: pinned(db.Version), Node: node, DBName: db.DBName, DBUser: db.DBUser,
+			Password: db.EnvVars["POSTGRES_PASSWORD"], Port: db.Port,
+		})
+		kinds[db.Name] = manifest.KindDatabase
+	}
+	for _, c := range p.Caches {
+		m.Caches = append(m.Caches, manifest.Cache{Name: c.Name, Version: pinned(c.Version), Node: node, Port: c.Port, Volumes: c.Volumes})
+		kinds[c.Name] = manifest.KindCache
+	}
+	for _, k := range p.Kafkas {
+		m.Kafkas = append(m.Kafkas, manifest.Kafka{Name: k.Name, Version: pinned(k.Version), Node: node, Port: k.Port})
+		kinds[k.Name] = manifest.KindKafka
+	}
+	for _, o := range p.ObjectStorages {
+		m.ObjectStorages = append(m.ObjectStorages, manifest.ObjectStorage{Name: o.Name, Node: node, S3Port: o.Port})
+	}
+	for _, s := range p.Services {
+		if s.DockerImage == "" {
+			return nil, fmt.Errorf("service %s is built from %s; set docker_image to the image to run", s.Name, s.BuildPath)
+		}
+		ms := manifest.Service{Name: s.Name, DockerImage: s.DockerImage, EnvVars: s.EnvVars, Ports: s.Ports, Volumes: s.Volumes, Command: s.Command}
+		for _, dep := range s.DependsOn {
+			switch kinds[dep] {
+			case manifest.KindDatabase:
+				ms.Databases = append(ms.Databases, dep)
+			case manifest.KindCache:
+				ms.Caches = append(ms.Caches, dep)
+			case manifest.KindKafka:
+				ms.Kafkas = append(ms.Kafkas, dep)
+			}
+		}
+		if deploy {
+			ms.Nodes = []string{node}
+		}
+		m.Services = append(m.Services, ms)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// pinned returns a compose image tag, or "" for latest.
+func pinned(tag string) string {
+	if tag == "latest" {
+		return ""
+	}
+	return tag
+}
+
+// Endpoint is where services on the same node reach a managed resource.
+type Endpoint struct {
+	Host string // container name
+	Port int    // inside the container network
+	URL  string // connection URL
+}
+
+// Endpoints returns the endpoints of the managed resources of m as they
+// exist in st, by name.
+func Endpoints(m *manifest.Manifest, st *manifest.State) map[string]Endpoint {
+	out := map[string]Endpoint{}
+	for _, want := range m.Databases {
+		for _, db := range st.Databases {
+			if db.Name == want.Name {
+				out[db.Name] = Endpoint{db.ContainerName, deployer.DatabaseTypes[db.Type].DefaultPort, deployer.DBInternalURL(db)}
+				break
+			}
+		}
+	}
+	for _, want := range m.Caches {
+		for _, c := range st.Caches {
+			if c.Name == want.Name {
+				out[c.Name] = Endpoint{c.ContainerName, 6379, deployer.CacheInternalURL(c)}
+				break
+			}
+		}
+	}
+	for _, want := range m.Kafkas {
+		for _, k := range st.Kafkas {
+			if k.Name == want.Name {
+				out[k.Name] = Endpoint{k.ContainerName, deployer.KafkaInternalPort, deployer.KafkaInternalURL(k)}
+				break
+			}
+		}
+	}
+	for _, want := range m.ObjectStorages {
+		for _, o := range st.ObjectStorages {
+			if o.Name == want.Name {
+				out[o.Name] = Endpoint{o.ContainerName, 3900, fmt.Sprintf("http://%s:3900", o.ContainerName)}
+				break
+			}
+		}
+	}
+	return out
+}
+
+// RewriteEnv points the env vars of m's services that refer to a compose
+// hostname in endpoints at the managed resource instead: a URL whose host is
+// the compose service, e.g. postgres://app:pw@db:5432/app, becomes the
+// resource's connection URL, and a bare host or host:port, e.g. db:5432,
+// becomes its container name and port.
+func RewriteEnv(m *manifest.Manifest, endpoints map[string]Endpoint) {
+	for i := range m.Services {
+		for k, v := range m.Services[i].EnvVars {
+			if nv, ok := rewriteValue(v, endpoints); ok {
+				m.Services[i].EnvVars[k] = nv
+			}
+		}
+	}
+}
+
+func rewriteValue(v string, endpoints map[string]Endpoint) (string, bool) {
+	if strings.Contains(v, "://") {
+		u, err := url.Parse(v)
+		if err != nil {
+			return "", false
+		}
+		e, ok := endpoints[u.Hostname()]
+		return e.URL, ok
+	}
+	host, port, err := net.SplitHostPort(v)
+	if err != nil {
+		e, ok := endpoints[v]
+		return e.Host, ok
+	}
+	e, ok := endpoints[host]
+	if _, err := strconv.Atoi(port); !ok || err != nil {
+		return "", false
+	}
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port)), true
+}
+
+// Conflicts returns an error for each resource of m whose name is already
+// used by one of the same kind in st; an import only creates.
+func Conflicts(m *manifest.Manifest, st *manifest.State) []string {
+	var out []string
+	check := func(kind, name string, exists bool) {
+		if exists {
+			out = append(out, fmt.Sprintf("%s %s already exists", kind, name))
+		}
+	}
+	for _, x := range m.Services {
+		check(manifest.KindService, x.Name, hasName(st.Services, x.Name, func(s *models.Service) string { return s.Name }))
+	}
+	for _, x := range m.Databases {
+		check(manifest.KindDatabase, x.Name, hasName(st.Databases, x.Name, func(d *models.Database) string { return d.Name }))
+	}
+	for _, x := range m.Caches {
+		check(manifest.KindCache, x.Name, hasName(st.Caches, x.Name, func(c *models.Cache) string { return c.Name }))
+	}
+	for _, x := range m.Kafkas {
+		check(manifest.KindKafka, x.Name, hasName(st.Kafkas, x.Name, func(k *models.Kafka) string { return k.Name }))
+	}
+	for _, x := range m.ObjectStorages {
+		check(manifest.KindObjectStorage, x.Name, hasName(st.ObjectStorages, x.Name, func(o *models.ObjectStorage) string { return o.Name }))
+	}
+	return out
+}
+
+// Imported returns the part of st that m names: its services with their
+// deployments, and its managed resources. Since Conflicts refuses an import
+// that reuses a name, right after an import this is what it created.
+func Imported(m *manifest.Manifest, st *manifest.State) *manifest.State {
+	out := &manifest.State{Nodes: st.Nodes}
+	services := map[string]bool{}
+	for _, x := range m.Services {
+		services[x.Name] = true
+	}
+	serviceIDs := map[string]bool{}
+	for _, x := range st.Services {
+		if services[x.Name] {
+			out.Services = append(out.Services, x)
+			serviceIDs[x.ID] = true
+		}
+	}
+	for _, x := range st.Deployments {
+		if serviceIDs[x.ServiceID] {
+			out.Deployments = append(out.Deployments, x)
+		}
+	}
+	for _, x := range m.Databases {
+		out.Databases = appendNamed(out.Databases, st.Databases, x.Name, func(d *models.Database) string { return d.Name })
+	}
+	for _, x := range m.Caches {
+		out.Caches = appendNamed(out.Caches, st.Caches, x.Name, func(c *models.Cache) string { return c.Name })
+	}
+	for _, x := range m.Kafkas {
+		out.Kafkas = appendNamed(out.Kafkas, st.Kafkas, x.Name, func(k *models.Kafka) string { return k.Name })
+	}
+	for _, x := range m.ObjectStorages {
+		out.ObjectStorages = appendNamed(out.ObjectStorages, st.ObjectStorages, x.Name, func(o *models.ObjectStorage) string { return o.Name })
+	}
+	return out
+}
+
+func appendNamed[T any](out, items []T, name string, nameOf func(T) string) []T {
+	for _, it := range items {
+		if nameOf(it) == name {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+func hasName[T any](items []T, name string, nameOf func(T) string) bool {
+	for _, it := range items {
+		if nameOf(it) == name {
+			return true
+		}
+	}
+	return false
+}
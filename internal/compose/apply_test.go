@@ -0,0 +1,92 @@
+package compose
+
+import (
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/manifest"
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+const testCompose = `
+services:
+  web:
+    image: ghcr.io/acme/web:3
+    depends_on: [db, cache]
+    environment:
+      DATABASE_URL: postgresql://app:pw@db:5432/app
+      REDIS_ADDR: cache:6379
+      DB_HOST: db
+      MODE: prod
+  db:
+    image: postgres:16
+    environment:
+      POSTGRES_USER: app
+      POSTGRES_PASSWORD: pw
+  cache:
+    image: redis:latest
+`
+
+func TestPreviewManifest(t *testing.T) {
+	p, err := Parse([]byte(testCompose))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := p.Manifest("worker-1", true)
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	web := m.Services[0]
+	if len(web.Databases) != 1 || web.Databases[0] != "db" || len(web.Caches) != 1 || web.Caches[0] != "cache" || web.Nodes[0] != "worker-1" {
+		t.Errorf("web = %+v", web)
+	}
+	if m.Databases[0].Password != "pw" || m.Databases[0].Version != "16" || m.Caches[0].Version != "" {
+		t.Errorf("resources = %+v %+v", m.Databases, m.Caches)
+	}
+
+	st := &manifest.State{
+		Databases: []*models.Database{{Name: "db", Type: "postgres", DBName: "app", DBUser: "app", Password: "pw", ContainerName: "localisprod-db-1"}},
+		Caches:    []*models.Cache{{Name: "cache", Password: "gen", ContainerName: "localisprod-cache-1"}},
+	}
+	RewriteEnv(m, Endpoints(m, st))
+	want := map[string]string{
+		"DATABASE_URL": "postgres://app:pw@localisprod-db-1:5432/app",
+		"REDIS_ADDR":   "localisprod-cache-1:6379",
+		"DB_HOST":      "localisprod-db-1",
+		"MODE":         "prod",
+	}
+	for k, v := range want {
+		if got := m.Services[0].EnvVars[k]; got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestPreviewManifest_NeedsImage(t *testing.T) {
+	p := &Preview{Services: []ParsedService{{Name: "web", BuildPath: "./web"}}}
+	if _, err := p.Manifest("worker-1", false); err == nil {
+		t.Error("expected an error for a service without an image")
+	}
+}
+
+func TestImported(t *testing.T) {
+	p, err := Parse([]byte(testCompose))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := p.Manifest("worker-1", true)
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	st := &manifest.State{
+		Services:    []*models.Service{{ID: "s1", Name: "web"}, {ID: "s2", Name: "other"}},
+		Deployments: []*models.Deployment{{ID: "d1", ServiceID: "s1"}, {ID: "d2", ServiceID: "s2"}},
+		Databases:   []*models.Database{{ID: "db1", Name: "db"}, {ID: "db2", Name: "main"}},
+	}
+	got := Imported(m, st)
+	if len(got.Services) != 1 || got.Services[0].ID != "s1" || len(got.Deployments) != 1 || got.Deployments[0].ID != "d1" {
+		t.Errorf("services %+v, deployments %+v", got.Services, got.Deployments)
+	}
+	if len(got.Databases) != 1 || got.Databases[0].ID != "db1" || len(got.Caches) != 0 {
+		t.Errorf("databases %+v, caches %+v", got.Databases, got.Caches)
+	}
+}
@@ -0,0 +1,342 @@
+package compose
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/manifest"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// exportHeader starts every exported file.
+const exportHeader = `# Exported from localisprod. Run the stack locally with "docker compose up".
+# Values written as ${VAR} are secrets left out of the export: set them in
+# the environment or in a .env file next to this one.
+`
+
+// ---- docker-compose structures written by Export ----
+
+type exportFile struct {
+	Services map[string]*exportService `yaml:"services"`
+	Volumes  map[string]struct{}       `yaml:"volumes,omitempty"`
+	Configs  map[string]exportConfig   `yaml:"configs,omitempty"`
+}
+
+type exportService struct {
+	Image       string            `yaml:"image"`
+	Command     interface{}       `yaml:"command,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	Volumes     []string          `yaml:"volumes,omitempty"`
+	Configs     []exportMount     `yaml:"configs,omitempty"`
+	DependsOn   []string          `yaml:"depends_on,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Restart     string            `yaml:"restart,omitempty"`
+}
+
+type exportConfig struct {
+	Content string `yaml:"content"`
+}
+
+type exportMount struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+// exporter builds a compose file from a manifest.
+type exporter struct {
+	file  exportFile
+	names map[string]string // manifest kind+name -> compose service name
+}
+
+// Export renders m as a docker-compose file. Every managed resource becomes
+// a service running the image it runs on a node (postgres, redis,
+// apache/kafka, prom/prometheus and grafana/grafana, dxflrs/garage), and
+// services get the connection env vars of the resources they are linked to,
+// pointing at those services, so "docker compose up" reproduces the stack on
+// one machine. Empty passwords and env vars masked by manifest.Mask become
+// ${VAR} references to be set when the stack is started.
+func Export(m *manifest.Manifest) ([]byte, error) {
+	x := &exporter{
+		file:  exportFile{Services: map[string]*exportService{}, Volumes: map[string]struct{}{}, Configs: map[string]exportConfig{}},
+		names: map[string]string{},
+	}
+	for _, db := range m.Databases {
+		x.database(db)
+	}
+	for _, c := range m.Caches {
+		x.cache(c)
+	}
+	for _, k := range m.Kafkas {
+		x.kafka(k)
+	}
+	for _, mon := range m.Monitorings {
+		x.monitoring(mon)
+	}
+	for _, o := range m.ObjectStorages {
+		x.objectStorage(o)
+	}
+	for i := range m.Services {
+		x.service(m, &m.Services[i])
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(exportHeader)
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(x.file); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// serviceName returns a compose service name for a resource that no other
+// exported resource uses.
+func (x *exporter) serviceName(kind, name string) string {
+	base := strings.ToLower(deployer.SafeName(name))
+	svc := base
+	for i := 2; x.file.Services[svc] != nil; i++ {
+		svc = fmt.Sprintf("%s-%d", base, i)
+	}
+	x.names[kind+"/"+name] = svc
+	x.file.Services[svc] = &exportService{}
+	return svc
+}
+
+// addVolumes declares the named volumes among mounts.
+func (x *exporter) addVolumes(mounts []string) {
+	for _, v := range mounts {
+		src, _, ok := strings.Cut(v, ":")
+		if ok && src != "" && !strings.ContainsAny(src[:1], "/.~$") {
+			x.file.Volumes[src] = struct{}{}
+		}
+	}
+}
+
+func (x *exporter) database(db manifest.Database) {
+	svc := x.serviceName(manifest.KindDatabase, db.Name)
+	t := deployer.DatabaseTypes[db.Type]
+	password := secret(envPrefix(db.Name)+"_PASSWORD", db.Password)
+	cfg, env := deployer.DatabaseRunConfig(&models.Database{
+		Name: db.Name, Type: db.Type, Version: or(db.Version, t.DefaultVersion), DBName: db.DBName, DBUser: db.DBUser,
+		Password: password, Port: orPort(db.Port, t.DefaultPort), ContainerName: svc,
+	})
+	s := x.runService(svc, cfg.Image, cfg.Ports, cfg.Volumes, env)
+	if db.Type == "redis" {
+		s.Command = []string{"redis-server", "--requirepass", password}
+	}
+}
+
+func (x *exporter) cache(c manifest.Cache) {
+	svc := x.serviceName(manifest.KindCache, c.Name)
+	password := secret(envPrefix(c.Name)+"_PASSWORD", c.Password)
+	cfg := deployer.CacheRunConfig(&models.Cache{
+		Name: c.Name, Version: or(c.Version, "7"), Password: password, Port: orPort(c.Port, 6379),
+		Volumes: `[]`, ContainerName: svc,
+	})
+	s := x.runService(svc, cfg.Image, cfg.Ports, c.Volumes, nil)
+	s.Command = []string{"redis-server", "--requirepass", password}
+}
+
+func (x *exporter) kafka(k manifest.Kafka) {
+	svc := x.serviceName(manifest.KindKafka, k.Name)
+	// Clients outside compose reach the broker on the published port of
+	// localhost; services use the internal listener.
+	cfg, env := deployer.KafkaRunConfig(&models.Kafka{
+		Name: k.Name, Version: or(k.Version, "latest"), Port: orPort(k.Port, 9092), ContainerName: svc,
+	}, "localhost")
+	x.runService(svc, cfg.Image, cfg.Ports, cfg.Volumes, env)
+}
+
+func (x *exporter) monitoring(mon manifest.Monitoring) {
+	prom := x.serviceName(manifest.KindMonitoring, mon.Name+"-prometheus")
+	grafana := x.serviceName(manifest.KindMonitoring, mon.Name+"-grafana")
+	x.runService(prom, "prom/prometheus:latest",
+		[]string{fmt.Sprintf("%d:9090", orPort(mon.PrometheusPort, 9090))},
+		[]string{fmt.Sprintf("localisprod-prom-%s-data:/prometheus", deployer.SafeName(mon.Name))}, nil)
+	s := x.runService(grafana, "grafana/grafana:latest",
+		[]string{fmt.Sprintf("%d:3000", orPort(mon.GrafanaPort, 3000))},
+		[]string{fmt.Sprintf("localisprod-grafana-%s-data:/var/lib/grafana", deployer.SafeName(mon.Name))},
+		map[string]string{"GF_SECURITY_ADMIN_PASSWORD": secret(envPrefix(mon.Name)+"_GRAFANA_PASSWORD", mon.GrafanaPassword)})
+	s.DependsOn = []string{prom}
+}
+
+func (x *exporter) objectStorage(o manifest.ObjectStorage) {
+	svc := x.serviceName(manifest.KindObjectStorage, o.Name)
+	rpcSecret := make([]byte, 32)
+	_, _ = rand.Read(rpcSecret)
+	// Buckets and access keys are not exported; create them with
+	// "docker compose exec <service> /garage ..." as on a node.
+	x.file.Configs[svc+"-config"] = exportConfig{Content: fmt.Sprintf(`metadata_dir = "/var/lib/garage/meta"
+data_dir = "/var/lib/garage/data"
+db_engine = "sqlite"
+replication_factor = 1
+
+rpc_bind_addr = "[::]:3901"
+rpc_public_addr = "%s:3901"
+rpc_secret = "%s"
+
+[s3_api]
+s3_region = "garage"
+api_bind_addr = "[::]:3900"
+
+[admin]
+api_bind_addr = "[::]:3903"
+`, svc, hex.EncodeToString(rpcSecret))}
+	name := deployer.SafeName(o.Name)
+	s := x.runService(svc, "dxflrs/garage:"+or(o.Version, "v1.0.1"),
+		[]string{fmt.Sprintf("%d:3900", orPort(o.S3Port, 3900))},
+		[]string{
+			fmt.Sprintf("localisprod-garage-%s-meta:/var/lib/garage/meta", name),
+			fmt.Sprintf("localisprod-garage-%s-data:/var/lib/garage/data", name),
+		}, nil)
+	s.Configs = []exportMount{{Source: svc + "-config", Target: "/etc/garage.toml"}}
+}
+
+// runService fills in the compose service of a managed resource.
+func (x *exporter) runService(svc, image string, ports, volumes []string, env map[string]string) *exportService {
+	s := x.file.Services[svc]
+	s.Image = image
+	s.Ports = ports
+	s.Volumes = volumes
+	s.Environment = env
+	s.Restart = "unless-stopped"
+	x.addVolumes(volumes)
+	return s
+}
+
+// service adds an application service with the env vars a deployment gets
+// from its links, as the deployer sets them, pointing at the linked
+// resources' compose services.
+func (x *exporter) service(m *manifest.Manifest, ms *manifest.Service) {
+	svc := x.serviceName(manifest.KindService, ms.Name)
+	s := x.file.Services[svc]
+	s.Image = ms.DockerImage
+	if ms.Command != "" {
+		s.Command = escape(ms.Command)
+	}
+	s.Ports = ms.Ports
+	s.Volumes = ms.Volumes
+	s.Restart = "unless-stopped"
+	x.addVolumes(ms.Volumes)
+
+	env := map[string]string{}
+	for k, v := range ms.EnvVars {
+		if v == manifest.Masked {
+			env[k] = "${" + k + "}"
+		} else {
+			env[k] = escape(v)
+		}
+	}
+	var deps []string
+	alias := func(key, value string, n int) {
+		if _, set := env[key]; !set && n == 1 {
+			env[key] = value
+		}
+	}
+	for _, name := range ms.Databases {
+		for _, db := range m.Databases {
+			if db.Name != name {
+				continue
+			}
+			host := x.names[manifest.KindDatabase+"/"+name]
+			deps = append(deps, host)
+			url := deployer.DBInternalURL(&models.Database{Type: db.Type, DBName: db.DBName, DBUser: db.DBUser,
+				Password: secret(envPrefix(db.Name)+"_PASSWORD", db.Password), ContainerName: host})
+			env[deployer.DBEnvVarName(name)] = url
+			alias("DATABASE_URL", url, len(ms.Databases))
+		}
+	}
+	for _, name := range ms.Caches {
+		for _, c := range m.Caches {
+			if c.Name != name {
+				continue
+			}
+			host := x.names[manifest.KindCache+"/"+name]
+			deps = append(deps, host)
+			url := deployer.CacheInternalURL(&models.Cache{Password: secret(envPrefix(c.Name)+"_PASSWORD", c.Password), ContainerName: host})
+			env[deployer.CacheEnvVarName(name)] = url
+			alias("CACHE_URL", url, len(ms.Caches))
+		}
+	}
+	for _, name := range ms.Kafkas {
+		host := x.names[manifest.KindKafka+"/"+name]
+		if host == "" {
+			continue
+		}
+		deps = append(deps, host)
+		url := deployer.KafkaInternalURL(&models.Kafka{ContainerName: host})
+		env[deployer.KafkaEnvVarName(name)] = url
+		alias("KAFKA_BROKERS", url, len(ms.Kafkas))
+	}
+	for _, name := range ms.Monitorings {
+		prom := x.names[manifest.KindMonitoring+"/"+name+"-prometheus"]
+		grafana := x.names[manifest.KindMonitoring+"/"+name+"-grafana"]
+		if prom == "" {
+			continue
+		}
+		deps = append(deps, prom, grafana)
+		mon := &models.Monitoring{PrometheusContainerName: prom, GrafanaContainerName: grafana}
+		env[deployer.MonitoringPrometheusEnvVarName(name)] = deployer.MonitoringPrometheusInternalURL(mon)
+		env[deployer.MonitoringGrafanaEnvVarName(name)] = deployer.MonitoringGrafanaInternalURL(mon)
+		alias("PROMETHEUS_URL", deployer.MonitoringPrometheusInternalURL(mon), len(ms.Monitorings))
+		alias("GRAFANA_URL", deployer.MonitoringGrafanaInternalURL(mon), len(ms.Monitorings))
+	}
+	if len(env) > 0 {
+		s.Environment = env
+	}
+	sort.Strings(deps)
+	s.DependsOn = deps
+
+	var hosts []string
+	for _, r := range ms.Routes {
+		hosts = append(hosts, r.Host)
+	}
+	if ms.Domain != "" {
+		hosts = append(hosts, ms.Domain)
+	}
+	if len(hosts) > 0 {
+		// Domains are served by the node's proxy; recorded for reference.
+		s.Labels = map[string]string{"localisprod.domains": strings.Join(hosts, ",")}
+	}
+}
+
+// envPrefix derives the env var prefix of a resource name, e.g.
+// "my-db" → "MY_DB".
+func envPrefix(name string) string {
+	return strings.TrimSuffix(deployer.DBEnvVarName(name), "_URL")
+}
+
+// secret returns value escaped for compose, or a reference to the variable
+// named name when value is empty.
+func secret(name, value string) string {
+	if value == "" {
+		return "${" + name + "}"
+	}
+	return escape(value)
+}
+
+// escape keeps compose from interpolating the $ of a literal value.
+func escape(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+func or(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func orPort(p, def int) int {
+	if p == 0 {
+		return def
+	}
+	return p
+}
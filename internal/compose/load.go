@@ -0,0 +1,456 @@
+package compose
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Options control how compose files are read.
+type Options struct {
+	// Env holds the values of ${VAR} references, as the shell and the .env
+	// file supply them to docker compose.
+	Env map[string]string `json:"env,omitempty"`
+	// DotEnv is the content of a .env file, read for the variables Env does
+	// not set.
+	DotEnv string `json:"dotenv,omitempty"`
+	// Files holds the contents of the env_file and extends files that the
+	// compose files refer to, by the path written in them.
+	Files map[string]string `json:"files,omitempty"`
+	// Profiles are the active profiles. Services assigned to other profiles
+	// are left out.
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+// withDotEnv returns opts with the variables of DotEnv added to Env.
+func (opts Options) withDotEnv() Options {
+	if opts.DotEnv == "" {
+		return opts
+	}
+	env := parseEnvFile(opts.DotEnv)
+	for k, v := range opts.Env {
+		env[k] = v
+	}
+	opts.Env = env
+	return opts
+}
+
+// warnings collects what was read but could not be carried over.
+type warnings []string
+
+func (w *warnings) add(format string, args ...any) {
+	*w = append(*w, fmt.Sprintf(format, args...))
+}
+
+// appendedKeys are the service keys whose lists an override file extends
+// rather than replaces, as docker compose merges them.
+var appendedKeys = map[string]bool{
+	"ports": true, "volumes": true, "env_file": true, "expose": true, "secrets": true,
+	"configs": true, "profiles": true, "dns": true, "extra_hosts": true, "cap_add": true,
+	"cap_drop": true, "devices": true,
+}
+
+// load reads compose files in order: each is interpolated with opts.Env and
+// merged over the ones before it, then extends are resolved and services
+// outside the active profiles are dropped.
+func load(contents [][]byte, opts Options, w *warnings) (map[string]any, error) {
+	var doc map[string]any
+	for i, content := range contents {
+		file, err := decodeFile(content, opts, w)
+		if err != nil {
+			if len(contents) > 1 {
+				return nil, fmt.Errorf("file %d: %w", i+1, err)
+			}
+			return nil, err
+		}
+		doc = merge(doc, file)
+	}
+	services, _ := doc["services"].(map[string]any)
+	if services == nil {
+		return nil, fmt.Errorf("no services found in docker-compose file")
+	}
+
+	resolved := map[string]any{}
+	for _, name := range sortedNames(services) {
+		svc, err := extend(name, services, opts, w, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		resolved[name] = svc
+	}
+	for _, name := range sortedNames(resolved) {
+		if !activeProfile(resolved[name].(map[string]any), opts.Profiles) {
+			delete(resolved, name)
+		}
+	}
+	doc["services"] = resolved
+	return doc, nil
+}
+
+// decodeFile parses and interpolates one compose file and normalises the
+// short forms of its services so that files merge key by key.
+func decodeFile(content []byte, opts Options, w *warnings) (map[string]any, error) {
+	var file map[string]any
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("invalid docker-compose YAML: %w", err)
+	}
+	if file == nil {
+		file = map[string]any{}
+	}
+	v, err := interpolateValue(file, opts.Env, w)
+	if err != nil {
+		return nil, err
+	}
+	file = v.(map[string]any)
+	if services, ok := file["services"].(map[string]any); ok {
+		for name, svc := range services {
+			m, _ := svc.(map[string]any)
+			if m == nil {
+				m = map[string]any{}
+			}
+			services[name] = normalize(m, opts.Env)
+		}
+	}
+	return file, nil
+}
+
+// normalize rewrites environment and labels lists as maps, depends_on lists
+// as maps and a single env_file as a list.
+func normalize(svc map[string]any, env map[string]string) map[string]any {
+	if list, ok := svc["environment"].([]any); ok {
+		m := map[string]any{}
+		for _, item := range list {
+			s := fmt.Sprint(item)
+			if k, v, ok := strings.Cut(s, "="); ok {
+				m[k] = v
+			} else if v, set := env[s]; set {
+				// A bare name takes its value from the environment.
+				m[s] = v
+			}
+		}
+		svc["environment"] = m
+	}
+	if list, ok := svc["labels"].([]any); ok {
+		m := map[string]any{}
+		for _, item := range list {
+			k, v, _ := strings.Cut(fmt.Sprint(item), "=")
+			m[k] = v
+		}
+		svc["labels"] = m
+	}
+	if list, ok := svc["depends_on"].([]any); ok {
+		m := map[string]any{}
+		for _, item := range list {
+			m[fmt.Sprint(item)] = map[string]any{"condition": "service_started"}
+		}
+		svc["depends_on"] = m
+	}
+	if s, ok := svc["env_file"].(string); ok {
+		svc["env_file"] = []any{s}
+	}
+	return svc
+}
+
+// merge returns over merged into base without modifying either: maps merge
+// key by key, the lists of appendedKeys are concatenated without duplicates,
+// and other values are replaced.
+func merge(base, over map[string]any) map[string]any {
+	out := make(map[string]any, len(base)+len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		bm, bok := out[k].(map[string]any)
+		om, ook := v.(map[string]any)
+		bl, blok := out[k].([]any)
+		ol, olok := v.([]any)
+		switch {
+		case bok && ook:
+			out[k] = merge(bm, om)
+		case blok && olok && appendedKeys[k]:
+			list := append([]any(nil), bl...)
+			for _, item := range ol {
+				if !containsValue(list, item) {
+					list = append(list, item)
+				}
+			}
+			out[k] = list
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func containsValue(list []any, v any) bool {
+	s := fmt.Sprint(v)
+	for _, item := range list {
+		if fmt.Sprint(item) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// extend returns the service name of services with its extends resolved:
+// the service it extends, from the same services or from a file in
+// opts.Files, with the service's own keys merged over it.
+func extend(name string, services map[string]any, opts Options, w *warnings, seen map[string]bool) (map[string]any, error) {
+	svc, _ := services[name].(map[string]any)
+	ext, ok := svc["extends"]
+	if !ok {
+		return svc, nil
+	}
+	if seen[name] {
+		return nil, fmt.Errorf("service %s: extends loops back to itself", name)
+	}
+	seen[name] = true
+
+	var base, file string
+	switch v := ext.(type) {
+	case string:
+		base = v
+	case map[string]any:
+		base, _ = v["service"].(string)
+		file, _ = v["file"].(string)
+	}
+	if base == "" {
+		return nil, fmt.Errorf("service %s: extends needs a service", name)
+	}
+	from := services
+	if file != "" {
+		content, ok := opts.Files[file]
+		if !ok {
+			return nil, fmt.Errorf("service %s: extends file %s was not supplied", name, file)
+		}
+		doc, err := decodeFile([]byte(content), opts, w)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		from, _ = doc["services"].(map[string]any)
+		// Names in another file are resolved within it.
+		seen = map[string]bool{}
+	}
+	if _, ok := from[base]; !ok {
+		return nil, fmt.Errorf("service %s: extends unknown service %s", name, base)
+	}
+	parent, err := extend(base, from, opts, w, seen)
+	if err != nil {
+		return nil, err
+	}
+	own := make(map[string]any, len(svc))
+	for k, v := range svc {
+		if k != "extends" {
+			own[k] = v
+		}
+	}
+	return merge(parent, own), nil
+}
+
+// activeProfile reports whether a service with the profiles of svc runs
+// when profiles are active. Services without profiles always run.
+func activeProfile(svc map[string]any, profiles []string) bool {
+	list, _ := svc["profiles"].([]any)
+	if len(list) == 0 {
+		return true
+	}
+	for _, p := range list {
+		for _, active := range profiles {
+			if fmt.Sprint(p) == active || active == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// interpolateValue replaces ${VAR} references in every string of v.
+func interpolateValue(v any, env map[string]string, w *warnings) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return interpolate(v, env, w)
+	case map[string]any:
+		for k, val := range v {
+			nv, err := interpolateValue(val, env, w)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = nv
+		}
+	case []any:
+		for i := range v {
+			nv, err := interpolateValue(v[i], env, w)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = nv
+		}
+	}
+	return v, nil
+}
+
+// interpolate expands $VAR and ${VAR} in s with the compose modifiers:
+// ${VAR:-default} and ${VAR-default} fall back when VAR is unset or empty
+// (:-) or unset (-), ${VAR:?message} and ${VAR?message} fail, ${VAR:+alt}
+// and ${VAR+alt} substitute alt when VAR is set, and $$ is a literal $.
+func interpolate(s string, env map[string]string, w *warnings) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		switch next := s[i+1]; {
+		case next == '$':
+			sb.WriteByte('$')
+			i++
+		case next == '{':
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return "", fmt.Errorf("invalid interpolation format in %q: missing }", s)
+			}
+			v, err := expand(s[i+2:end], env, w)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(v)
+			i = end
+		case isNameByte(next, true):
+			j := i + 1
+			for j < len(s) && isNameByte(s[j], false) {
+				j++
+			}
+			v, err := expand(s[i+1:j], env, w)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(v)
+			i = j - 1
+		default:
+			sb.WriteByte('$')
+		}
+	}
+	return sb.String(), nil
+}
+
+// closingBrace returns the index of the } closing a ${ whose name starts at
+// start, skipping nested ${...} in defaults, or -1.
+func closingBrace(s string, start int) int {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// expand returns the value of the braced expression expr, e.g. "VAR:-x".
+func expand(expr string, env map[string]string, w *warnings) (string, error) {
+	n := 0
+	for n < len(expr) && isNameByte(expr[n], n == 0) {
+		n++
+	}
+	name, rest := expr[:n], expr[n:]
+	if name == "" {
+		return "", fmt.Errorf("invalid interpolation format: ${%s}", expr)
+	}
+	value, set := env[name]
+	op, arg := "", ""
+	for _, o := range []string{":-", ":?", ":+", "-", "?", "+"} {
+		if strings.HasPrefix(rest, o) {
+			op, arg = o, rest[len(o):]
+			break
+		}
+	}
+	if op == "" && rest != "" {
+		return "", fmt.Errorf("invalid interpolation format: ${%s}", expr)
+	}
+	// Only the branch taken is expanded, so an unused default's variables
+	// are not reported.
+	sub := func() (string, error) { return interpolate(arg, env, w) }
+	switch op {
+	case ":-":
+		if value == "" {
+			return sub()
+		}
+	case "-":
+		if !set {
+			return sub()
+		}
+	case ":?", "?":
+		if !set || (op == ":?" && value == "") {
+			msg, err := sub()
+			if err != nil {
+				return "", err
+			}
+			if msg == "" {
+				msg = "is not set"
+			}
+			return "", fmt.Errorf("required variable %s is missing a value: %s", name, msg)
+		}
+	case ":+":
+		if value != "" {
+			return sub()
+		}
+		return "", nil
+	case "+":
+		if set {
+			return sub()
+		}
+		return "", nil
+	default:
+		if !set {
+			w.add("variable %s is not set; substituting an empty string", name)
+		}
+	}
+	return value, nil
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// parseEnvFile reads KEY=VALUE lines, skipping blank lines and comments and
+// removing an export prefix and matching quotes around the value.
+func parseEnvFile(content string) map[string]string {
+	out := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		out[strings.TrimSpace(k)] = v
+	}
+	return out
+}
+
+func sortedNames(m map[string]any) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
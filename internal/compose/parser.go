@@ -2,6 +2,7 @@ package compose
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -11,35 +12,117 @@ import (
 // ---- raw docker-compose structures ----
 
 type composeFile struct {
-	Services map[string]composeService `yaml:"services"`
+	Services map[string]composeService  `yaml:"services"`
+	Volumes  map[string]composeTopLevel `yaml:"volumes"`
+	Networks map[string]composeTopLevel `yaml:"networks"`
+	Secrets  map[string]composeTopLevel `yaml:"secrets"`
 }
 
 type composeService struct {
-	Image       string        `yaml:"image"`
-	Build       interface{}   `yaml:"build"`       // string or map{context:...}
-	Ports       []interface{} `yaml:"ports"`       // "host:container" or map
-	Environment interface{}   `yaml:"environment"` // map or []"KEY=VAL"
-	Command     interface{}   `yaml:"command"`     // string or []string
-	Volumes     []string      `yaml:"volumes"`
-	DependsOn   interface{}   `yaml:"depends_on"`  // []string or map
+	Image       string         `yaml:"image"`
+	Build       interface{}    `yaml:"build"`       // string or map{context:...}
+	Ports       []interface{}  `yaml:"ports"`       // "host:container" or map
+	Environment map[string]any `yaml:"environment"` // lists are normalised to maps
+	EnvFile     []interface{}  `yaml:"env_file"`    // paths or maps{path, required}
+	Command     interface{}    `yaml:"command"`     // string or []string
+	Volumes     []interface{}  `yaml:"volumes"`     // "source:target[:mode]" or map
+	DependsOn   interface{}    `yaml:"depends_on"`  // []string or map
+	Healthcheck *composeHealth `yaml:"healthcheck"`
+	Deploy      *composeDeploy `yaml:"deploy"`
+	Restart     string         `yaml:"restart"`
+	Labels      map[string]any `yaml:"labels"`
+	Profiles    []string       `yaml:"profiles"`
+	Networks    interface{}    `yaml:"networks"` // []string or map
+	Secrets     []interface{}  `yaml:"secrets"`  // names or maps{source, target}
+	Extends     interface{}    `yaml:"extends"`  // resolved by load
+	Extensions  map[string]any `yaml:",inline"`  // every other key
+}
+
+type composeHealth struct {
+	Test        interface{} `yaml:"test"` // string or []string
+	Interval    string      `yaml:"interval"`
+	Timeout     string      `yaml:"timeout"`
+	StartPeriod string      `yaml:"start_period"`
+	Retries     int         `yaml:"retries"`
+	Disable     bool        `yaml:"disable"`
+}
+
+type composeDeploy struct {
+	Replicas  *int `yaml:"replicas"`
+	Resources struct {
+		Limits       map[string]any `yaml:"limits"`
+		Reservations map[string]any `yaml:"reservations"`
+	} `yaml:"resources"`
+	Other map[string]any `yaml:",inline"`
+}
+
+type composeTopLevel struct {
+	External    interface{} `yaml:"external"` // bool, or map{name} in old files
+	Driver      string      `yaml:"driver"`
+	File        string      `yaml:"file"`
+	Environment string      `yaml:"environment"`
+}
+
+// serviceKeys are the service keys Parse reads; others come back as
+// warnings.
+var serviceKeys = map[string]bool{
+	"image": true, "build": true, "ports": true, "environment": true, "env_file": true, "command": true,
+	"volumes": true, "depends_on": true, "healthcheck": true, "deploy": true, "restart": true,
+	"labels": true, "profiles": true, "networks": true, "secrets": true, "extends": true,
+}
+
+// topLevelKeys are the top-level keys Parse reads or that carry nothing to
+// import.
+var topLevelKeys = map[string]bool{
+	"services": true, "volumes": true, "networks": true, "secrets": true, "version": true, "name": true,
 }
 
 // ---- preview types returned to the client ----
 
 type ParsedService struct {
-	Name        string            `json:"name"`
-	DockerImage string            `json:"docker_image"`
-	BuildPath   string            `json:"build_path,omitempty"`
-	Ports       []string          `json:"ports"`
-	Volumes     []string          `json:"volumes"`
-	EnvVars     map[string]string `json:"env_vars"`
-	Command     string            `json:"command,omitempty"`
-	DependsOn   []string          `json:"depends_on,omitempty"`
+	Name        string             `json:"name"`
+	DockerImage string             `json:"docker_image"`
+	BuildPath   string             `json:"build_path,omitempty"`
+	Ports       []string           `json:"ports"`
+	Volumes     []string           `json:"volumes"`
+	EnvVars     map[string]string  `json:"env_vars"`
+	Command     string             `json:"command,omitempty"`
+	DependsOn   []string           `json:"depends_on,omitempty"`
+	Healthcheck *ParsedHealthcheck `json:"healthcheck,omitempty"`
+	Resources   *ParsedResources   `json:"resources,omitempty"`
+	Replicas    int                `json:"replicas,omitempty"`
+	Restart     string             `json:"restart,omitempty"`
+	Labels      map[string]string  `json:"labels,omitempty"`
+	Profiles    []string           `json:"profiles,omitempty"`
+	Networks    []string           `json:"networks,omitempty"`
+	Secrets     []string           `json:"secrets,omitempty"`
+}
+
+// ParsedHealthcheck is a service's healthcheck; Test is in exec form, e.g.
+// ["CMD-SHELL", "curl -f http://localhost/"].
+type ParsedHealthcheck struct {
+	Test        []string `json:"test,omitempty"`
+	Interval    string   `json:"interval,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	StartPeriod string   `json:"start_period,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+	Disable     bool     `json:"disable,omitempty"`
+}
+
+// ParsedResources are the deploy.resources of a service.
+type ParsedResources struct {
+	Limits       ResourceSpec `json:"limits"`
+	Reservations ResourceSpec `json:"reservations"`
+}
+
+type ResourceSpec struct {
+	CPUs   string `json:"cpus,omitempty"`
+	Memory string `json:"memory,omitempty"`
 }
 
 type ParsedDatabase struct {
 	Name    string            `json:"name"`
-	Type    string            `json:"type"`    // postgres, redis
+	Type    string            `json:"type"` // postgres, redis
 	Version string            `json:"version"`
 	Port    int               `json:"port"`
 	DBName  string            `json:"dbname,omitempty"`
@@ -67,29 +150,86 @@ type ParsedObjectStorage struct {
 	Port    int    `json:"port"`
 }
 
+// ParsedVolume is a top-level volume or network.
+type ParsedVolume struct {
+	Name     string `json:"name"`
+	External bool   `json:"external,omitempty"`
+	Driver   string `json:"driver,omitempty"`
+}
+
+// ParsedSecret is a top-level secret, read from a file or an env var.
+type ParsedSecret struct {
+	Name        string `json:"name"`
+	File        string `json:"file,omitempty"`
+	Environment string `json:"environment,omitempty"`
+	External    bool   `json:"external,omitempty"`
+}
+
 type Preview struct {
 	Services       []ParsedService       `json:"services"`
 	Databases      []ParsedDatabase      `json:"databases"`
 	Caches         []ParsedCache         `json:"caches"`
 	Kafkas         []ParsedKafka         `json:"kafkas"`
-	ObjectStorages []ParsedObjectStorage  `json:"object_storages"`
+	ObjectStorages []ParsedObjectStorage `json:"object_storages"`
+	Volumes        []ParsedVolume        `json:"volumes,omitempty"`
+	Networks       []ParsedVolume        `json:"networks,omitempty"`
+	Secrets        []ParsedSecret        `json:"secrets,omitempty"`
+	// Warnings lists what the files hold that the preview leaves out, such
+	// as unsupported keys and unset variables.
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 // Parse parses the given docker-compose YAML content and returns a Preview.
 func Parse(content []byte) (*Preview, error) {
-	var cf composeFile
-	if err := yaml.Unmarshal(content, &cf); err != nil {
-		return nil, fmt.Errorf("invalid docker-compose YAML: %w", err)
+	return ParseFiles([][]byte{content}, Options{})
+}
+
+// ParseFiles parses docker-compose files, each merged over the ones before it
+// as with several -f flags, and returns a Preview.
+func ParseFiles(contents [][]byte, opts Options) (*Preview, error) {
+	var w warnings
+	opts = opts.withDotEnv()
+	doc, err := load(contents, opts, &w)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range sortedNames(doc) {
+		if !topLevelKeys[k] && !strings.HasPrefix(k, "x-") {
+			w.add("%s: not supported; ignored", k)
+		}
 	}
-	if cf.Services == nil {
-		return nil, fmt.Errorf("no services found in docker-compose file")
+	b, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var cf composeFile
+	if err := yaml.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("invalid docker-compose file: %w", err)
 	}
 
 	preview := &Preview{}
+	preview.Volumes = topLevel(cf.Volumes)
+	preview.Networks = topLevel(cf.Networks)
+	for _, name := range sortedKeys(cf.Secrets) {
+		s := cf.Secrets[name]
+		preview.Secrets = append(preview.Secrets, ParsedSecret{Name: name, File: s.File, Environment: s.Environment, External: isExternal(s.External)})
+	}
 
-	for name, svc := range cf.Services {
-		env := parseEnv(svc.Environment)
+	names := make([]string, 0, len(cf.Services))
+	for name := range cf.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		svc := cf.Services[name]
+		for _, k := range sortedNames(svc.Extensions) {
+			if !strings.HasPrefix(k, "x-") {
+				w.add("service %s: %s is not supported; ignored", name, k)
+			}
+		}
+		env := serviceEnv(name, svc, opts, &w)
 		ports := parsePorts(svc.Ports)
+		volumes := parseVolumes(name, svc.Volumes, &w)
 		deps := parseDependsOn(svc.DependsOn)
 		image, version := splitImageTag(svc.Image)
 		buildPath := parseBuild(svc.Build)
@@ -103,7 +243,7 @@ func Parse(content []byte) (*Preview, error) {
 				Type:    "postgres",
 				Version: version,
 				Port:    firstHostPort(ports, 5432),
-				Volumes: svc.Volumes,
+				Volumes: volumes,
 				EnvVars: env,
 			}
 			if v, ok := env["POSTGRES_DB"]; ok {
@@ -125,7 +265,7 @@ func Parse(content []byte) (*Preview, error) {
 				Type:    "redis",
 				Version: version,
 				Port:    firstHostPort(ports, 6379),
-				Volumes: svc.Volumes,
+				Volumes: volumes,
 				EnvVars: env,
 			}
 			preview.Databases = append(preview.Databases, db)
@@ -135,7 +275,7 @@ func Parse(content []byte) (*Preview, error) {
 				Name:    name,
 				Version: version,
 				Port:    firstHostPort(ports, 6379),
-				Volumes: svc.Volumes,
+				Volumes: volumes,
 			})
 
 		case "kafka":
@@ -154,12 +294,27 @@ func Parse(content []byte) (*Preview, error) {
 
 		default: // service
 			app := ParsedService{
-				Name:      name,
-				DependsOn: deps,
-				Ports:     ports,
-				Volumes:   svc.Volumes,
-				EnvVars:   env,
-				Command:   parseCommand(svc.Command),
+				Name:        name,
+				DependsOn:   deps,
+				Ports:       ports,
+				Volumes:     volumes,
+				EnvVars:     env,
+				Command:     parseCommand(svc.Command),
+				Healthcheck: parseHealthcheck(svc.Healthcheck),
+				Restart:     svc.Restart,
+				Labels:      stringMap(svc.Labels),
+				Profiles:    svc.Profiles,
+				Networks:    parseNetworks(svc.Networks),
+				Secrets:     parseSecrets(svc.Secrets),
+			}
+			if d := svc.Deploy; d != nil {
+				if d.Replicas != nil {
+					app.Replicas = *d.Replicas
+				}
+				app.Resources = parseResources(d.Resources.Limits, d.Resources.Reservations)
+				for _, k := range sortedNames(d.Other) {
+					w.add("service %s: deploy.%s is not supported; ignored", name, k)
+				}
 			}
 			if buildPath != "" {
 				app.DockerImage = ""
@@ -171,6 +326,7 @@ func Parse(content []byte) (*Preview, error) {
 		}
 	}
 
+	preview.Warnings = w
 	return preview, nil
 }
 
@@ -253,39 +409,49 @@ func parseBuild(build interface{}) string {
 	return "."
 }
 
-// parseEnv handles both map and list forms of docker-compose environment.
-func parseEnv(env interface{}) map[string]string {
+// serviceEnv returns the env vars of a service: those of its env_file
+// entries in order, overridden by its environment. A variable listed without
+// a value takes it from opts.Env.
+func serviceEnv(name string, svc composeService, opts Options, w *warnings) map[string]string {
 	result := map[string]string{}
-	if env == nil {
-		return result
-	}
-	switch v := env.(type) {
-	case map[string]interface{}:
-		for k, val := range v {
-			if val == nil {
-				result[k] = ""
-			} else {
-				result[k] = fmt.Sprintf("%v", val)
+	for _, f := range svc.EnvFile {
+		path, required := "", true
+		switch v := f.(type) {
+		case string:
+			path = v
+		case map[string]interface{}:
+			path, _ = v["path"].(string)
+			if r, ok := v["required"].(bool); ok {
+				required = r
 			}
 		}
-	case []interface{}:
-		for _, item := range v {
-			s, ok := item.(string)
-			if !ok {
-				continue
+		content, ok := opts.Files[path]
+		if !ok {
+			if required {
+				w.add("service %s: env_file %s was not supplied; its variables are missing", name, path)
 			}
-			idx := strings.IndexByte(s, '=')
-			if idx < 0 {
-				result[s] = ""
+			continue
+		}
+		for k, v := range parseEnvFile(content) {
+			result[k] = v
+		}
+	}
+	for k, val := range svc.Environment {
+		if val == nil {
+			if v, ok := opts.Env[k]; ok {
+				result[k] = v
 			} else {
-				result[s[:idx]] = s[idx+1:]
+				result[k] = ""
 			}
+		} else {
+			result[k] = fmt.Sprintf("%v", val)
 		}
 	}
 	return result
 }
 
-// parsePorts normalises port specs to "hostPort:containerPort" strings.
+// parsePorts normalises port specs to "hostPort:containerPort" strings. The
+// long form keeps its host IP and protocol: "127.0.0.1:8080:80/udp".
 func parsePorts(ports []interface{}) []string {
 	var result []string
 	for _, p := range ports {
@@ -296,16 +462,172 @@ func parsePorts(ports []interface{}) []string {
 			s := strconv.Itoa(v)
 			result = append(result, s+":"+s)
 		case map[string]interface{}:
-			published, _ := v["published"].(int)
-			target, _ := v["target"].(int)
-			if published != 0 && target != 0 {
-				result = append(result, fmt.Sprintf("%d:%d", published, target))
+			published := fmt.Sprint(v["published"])
+			target := fmt.Sprint(v["target"])
+			if v["published"] == nil || v["target"] == nil {
+				continue
+			}
+			spec := published + ":" + target
+			if ip, _ := v["host_ip"].(string); ip != "" {
+				spec = ip + ":" + spec
+			}
+			if proto, _ := v["protocol"].(string); proto != "" && proto != "tcp" {
+				spec += "/" + proto
+			}
+			result = append(result, spec)
+		}
+	}
+	return result
+}
+
+// parseVolumes normalises volume specs to "source:target[:ro]" strings.
+// Anonymous volumes and tmpfs mounts hold nothing to keep and are dropped
+// with a warning.
+func parseVolumes(name string, volumes []interface{}, w *warnings) []string {
+	var result []string
+	for _, vol := range volumes {
+		switch v := vol.(type) {
+		case string:
+			if !strings.Contains(v, ":") {
+				w.add("service %s: anonymous volume %s is not supported; ignored", name, v)
+				continue
+			}
+			result = append(result, v)
+		case map[string]interface{}:
+			source, _ := v["source"].(string)
+			target, _ := v["target"].(string)
+			if t, _ := v["type"].(string); t == "tmpfs" || source == "" || target == "" {
+				w.add("service %s: volume for %s is not supported; ignored", name, target)
+				continue
+			}
+			spec := source + ":" + target
+			if ro, _ := v["read_only"].(bool); ro {
+				spec += ":ro"
+			}
+			result = append(result, spec)
+		}
+	}
+	return result
+}
+
+// parseHealthcheck returns the healthcheck in exec form. A string test runs
+// in a shell.
+func parseHealthcheck(h *composeHealth) *ParsedHealthcheck {
+	if h == nil {
+		return nil
+	}
+	out := &ParsedHealthcheck{Interval: h.Interval, Timeout: h.Timeout, StartPeriod: h.StartPeriod, Retries: h.Retries, Disable: h.Disable}
+	switch t := h.Test.(type) {
+	case string:
+		out.Test = []string{"CMD-SHELL", t}
+	case []interface{}:
+		for _, part := range t {
+			out.Test = append(out.Test, fmt.Sprintf("%v", part))
+		}
+	}
+	if len(out.Test) == 1 && out.Test[0] == "NONE" {
+		out.Test, out.Disable = nil, true
+	}
+	return out
+}
+
+// parseResources returns the CPU and memory limits and reservations, or nil
+// when none are set.
+func parseResources(limits, reservations map[string]any) *ParsedResources {
+	spec := func(m map[string]any) ResourceSpec {
+		var s ResourceSpec
+		if v, ok := m["cpus"]; ok {
+			s.CPUs = fmt.Sprintf("%v", v)
+		}
+		if v, ok := m["memory"]; ok {
+			s.Memory = fmt.Sprintf("%v", v)
+		}
+		return s
+	}
+	r := &ParsedResources{Limits: spec(limits), Reservations: spec(reservations)}
+	if r.Limits == (ResourceSpec{}) && r.Reservations == (ResourceSpec{}) {
+		return nil
+	}
+	return r
+}
+
+// parseNetworks returns the names of the networks a service joins.
+func parseNetworks(networks interface{}) []string {
+	var result []string
+	switch v := networks.(type) {
+	case []interface{}:
+		for _, n := range v {
+			result = append(result, fmt.Sprintf("%v", n))
+		}
+	case map[string]interface{}:
+		for n := range v {
+			result = append(result, n)
+		}
+		sort.Strings(result)
+	}
+	return result
+}
+
+// parseSecrets returns the names of the secrets a service uses.
+func parseSecrets(secrets []interface{}) []string {
+	var result []string
+	for _, s := range secrets {
+		switch v := s.(type) {
+		case string:
+			result = append(result, v)
+		case map[string]interface{}:
+			if src, _ := v["source"].(string); src != "" {
+				result = append(result, src)
 			}
 		}
 	}
 	return result
 }
 
+// topLevel lists top-level volumes or networks by name.
+func topLevel(m map[string]composeTopLevel) []ParsedVolume {
+	var result []ParsedVolume
+	for _, name := range sortedKeys(m) {
+		result = append(result, ParsedVolume{Name: name, External: isExternal(m[name].External), Driver: m[name].Driver})
+	}
+	return result
+}
+
+// isExternal reads external, which older files set to a map with the name.
+func isExternal(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case map[string]interface{}:
+		return true
+	}
+	return false
+}
+
+func stringMap(m map[string]any) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		if v == nil {
+			result[k] = ""
+		} else {
+			result[k] = fmt.Sprintf("%v", v)
+		}
+	}
+	return result
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // parseCommand converts string or []string command to a single string.
 func parseCommand(cmd interface{}) string {
 	if cmd == nil {
@@ -346,15 +668,17 @@ func parseDependsOn(dep interface{}) []string {
 }
 
 // firstHostPort extracts the first host port from port mappings, returning fallback if none found.
+// Mappings may carry a host IP and a protocol, e.g. "127.0.0.1:5432:5432/tcp".
 func firstHostPort(ports []string, fallback int) int {
 	for _, p := range ports {
-		host := p
-		if idx := strings.LastIndex(p, ":"); idx >= 0 {
-			host = p[:idx]
+		p, _, _ = strings.Cut(p, "/")
+		parts := strings.Split(p, ":")
+		host := parts[0]
+		if len(parts) >= 2 {
+			// The host port precedes the container port; an IPv6 host IP
+			// contains colons of its own.
+			host = parts[len(parts)-2]
 		}
-		// Strip IPv6 bracket prefix if any
-		host = strings.TrimPrefix(host, "[::1]:")
-		host = strings.TrimPrefix(host, "0.0.0.0:")
 		if n, err := strconv.Atoi(host); err == nil && n > 0 {
 			return n
 		}
@@ -0,0 +1,169 @@
+package compose
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	env := map[string]string{"TAG": "1.27", "EMPTY": "", "HOST": "db"}
+	tests := []struct{ in, want string }{
+		{"nginx:${TAG}", "nginx:1.27"},
+		{"nginx:$TAG", "nginx:1.27"},
+		{"${MISSING:-latest}", "latest"},
+		{"${EMPTY:-x}", "x"},
+		{"${EMPTY-x}", ""},
+		{"${MISSING-x}", "x"},
+		{"${TAG:+pinned}", "pinned"},
+		{"${MISSING:+pinned}", ""},
+		{"${MISSING:-${HOST}:5432}", "db:5432"},
+		{"price: $$5", "price: $5"},
+	}
+	for _, tt := range tests {
+		var w warnings
+		got, err := interpolate(tt.in, env, &w)
+		if err != nil || got != tt.want {
+			t.Errorf("interpolate(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+		if len(w) > 0 {
+			t.Errorf("interpolate(%q) warned: %v", tt.in, w)
+		}
+	}
+
+	var w warnings
+	if got, _ := interpolate("${MISSING}", env, &w); got != "" || len(w) != 1 {
+		t.Errorf("unset variable: got %q, warnings %v", got, w)
+	}
+	if _, err := interpolate("${DB_PASSWORD:?set it in .env}", env, &w); err == nil || !strings.Contains(err.Error(), "set it in .env") {
+		t.Errorf("required variable: err = %v", err)
+	}
+	if _, err := interpolate("${TAG", env, &w); err == nil {
+		t.Error("expected an error for an unclosed ${")
+	}
+}
+
+const baseCompose = `
+x-common: &common
+  restart: unless-stopped
+services:
+  base:
+    image: ghcr.io/acme/base:1
+    environment:
+      - LOG_LEVEL=info
+    labels: [team=core]
+  web:
+    <<: *common
+    extends: base
+    image: ghcr.io/acme/web:${TAG:-latest}
+    env_file: web.env
+    environment:
+      MODE: prod
+    ports:
+      - target: 80
+        published: "8080"
+        host_ip: 127.0.0.1
+        protocol: udp
+    volumes:
+      - type: bind
+        source: ./static
+        target: /srv
+        read_only: true
+      - /tmp/scratch
+    healthcheck:
+      test: curl -f http://localhost/
+      interval: 10s
+      retries: 3
+    deploy:
+      replicas: 2
+      resources:
+        limits: {cpus: 0.5, memory: 512M}
+      placement: {constraints: [node.role==manager]}
+    secrets: [api_key]
+    networks: [front]
+    container_name: web
+  debug:
+    image: busybox
+    profiles: [debug]
+volumes:
+  data: {}
+networks:
+  front: {external: true}
+secrets:
+  api_key: {file: ./api_key.txt}
+`
+
+const overrideCompose = `
+services:
+  web:
+    environment:
+      MODE: staging
+    ports: ["9090:90"]
+`
+
+func TestParseFiles(t *testing.T) {
+	p, err := ParseFiles([][]byte{[]byte(baseCompose), []byte(overrideCompose)}, Options{
+		Env:    map[string]string{"TAG": "3"},
+		DotEnv: "TAG=2\n",
+		Files:  map[string]string{"web.env": "# comment\nexport API_URL=\"https://api\"\nMODE=dev\n"},
+	})
+	if err != nil {
+		t.Fatalf("ParseFiles: %v", err)
+	}
+	if len(p.Services) != 2 || p.Services[1].Name != "web" {
+		t.Fatalf("services = %+v, want base and web without the debug profile", p.Services)
+	}
+	web := p.Services[1]
+	want := ParsedService{
+		Name:        "web",
+		DockerImage: "ghcr.io/acme/web:3",
+		Ports:       []string{"127.0.0.1:8080:80/udp", "9090:90"},
+		Volumes:     []string{"./static:/srv:ro"},
+		EnvVars:     map[string]string{"LOG_LEVEL": "info", "API_URL": "https://api", "MODE": "staging"},
+		Healthcheck: &ParsedHealthcheck{Test: []string{"CMD-SHELL", "curl -f http://localhost/"}, Interval: "10s", Retries: 3},
+		Resources:   &ParsedResources{Limits: ResourceSpec{CPUs: "0.5", Memory: "512M"}},
+		Replicas:    2,
+		Restart:     "unless-stopped",
+		Labels:      map[string]string{"team": "core"},
+		Networks:    []string{"front"},
+		Secrets:     []string{"api_key"},
+	}
+	if !reflect.DeepEqual(web, want) {
+		t.Errorf("web =\n%+v\nwant\n%+v", web, want)
+	}
+	if len(p.Volumes) != 1 || !p.Networks[0].External || p.Secrets[0].File != "./api_key.txt" {
+		t.Errorf("top-level: volumes %+v networks %+v secrets %+v", p.Volumes, p.Networks, p.Secrets)
+	}
+	joined := strings.Join(p.Warnings, "\n")
+	for _, w := range []string{"container_name", "deploy.placement", "anonymous volume /tmp/scratch"} {
+		if !strings.Contains(joined, w) {
+			t.Errorf("warnings %q lack %q", joined, w)
+		}
+	}
+
+	p, err = ParseFiles([][]byte{[]byte(baseCompose)}, Options{Profiles: []string{"debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Services) != 3 || !strings.Contains(strings.Join(p.Warnings, "\n"), "env_file web.env was not supplied") {
+		t.Errorf("with the debug profile: %d services, warnings %v", len(p.Services), p.Warnings)
+	}
+}
+
+func TestParseFiles_ExtendsErrors(t *testing.T) {
+	for doc, want := range map[string]string{
+		"services:\n  a: {extends: b}\n  b: {extends: a}\n":         "loops",
+		"services:\n  a: {extends: missing}\n":                      "unknown service",
+		"services:\n  a: {extends: {service: b, file: base.yml}}\n": "base.yml was not supplied",
+	} {
+		if _, err := Parse([]byte(doc)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %v, want %q", doc, err, want)
+		}
+	}
+
+	p, err := ParseFiles([][]byte{[]byte("services:\n  a: {extends: {service: b, file: base.yml}, ports: ['80:80']}\n")},
+		Options{Files: map[string]string{"base.yml": "services:\n  b: {image: nginx:1}\n"}})
+	if err != nil || p.Services[0].DockerImage != "nginx:1" {
+		t.Errorf("extends from a file: %+v, %v", p, err)
+	}
+}
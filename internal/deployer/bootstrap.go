@@ -0,0 +1,50 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// Bootstrap installs Docker and the tools the deployer relies on (rsync, ss,
+// mkfs.ext4) on a node and returns the script output with the record of
+// installed versions. On failure the record carries the error in LastError.
+func Bootstrap(runner sshexec.Runner, node *models.Node) (string, *models.NodeBootstrap) {
+	now := time.Now().UTC()
+	b := &models.NodeBootstrap{NodeID: node.ID, Versions: "{}", UpdatedAt: now}
+	if err := runner.WriteFile(sshexec.BootstrapScriptPath, sshexec.BootstrapScript(node.Username)); err != nil {
+		b.LastError = fmt.Sprintf("write bootstrap script: %v", err)
+		return "", b
+	}
+	output, err := runner.Run(sshexec.BootstrapRunCmd())
+	if err != nil {
+		b.LastError = fmt.Sprintf("bootstrap: %v", err)
+		return output, b
+	}
+	versions := sshexec.ParseBootstrapVersions(output)
+	b.OS = versions["os"]
+	delete(versions, "os")
+	raw, _ := json.Marshal(versions)
+	b.Versions = string(raw)
+	b.BootstrappedAt = &now
+	return output, b
+}
+
+// WaitForSSH pings the node until it answers or timeout elapses. Freshly
+// provisioned instances report an address before sshd is up.
+func WaitForSSH(runner sshexec.Runner, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := runner.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ssh not reachable after %s: %w", timeout, err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
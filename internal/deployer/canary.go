@@ -0,0 +1,79 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// CanaryRouterName returns the prefix of the Traefik routers and weighted
+// services used to split a deployment's traffic with its canary; it also names
+// the file-provider config.
+func CanaryRouterName(stableContainer string) string {
+	return stableContainer + "-split"
+}
+
+// CanaryRunConfig builds the run configuration for a canary container: the
+// service's configuration with image swapped in. Host ports are not published
+// (they are taken by the stable container); Traefik reaches the canary over
+// traefik-net.
+func CanaryRunConfig(svc *models.Service, containerName, image string) sshexec.RunConfig {
+	cfg := ServiceRunConfig(svc, containerName)
+	cfg.Image = image
+	cfg.Ports = nil
+	cfg.Network = "traefik-net"
+	cfg.Labels = sshexec.TraefikCanaryLabels(containerName, ServiceRoutes(svc), ServiceContainerPort(svc))
+	return cfg
+}
+
+// WriteCanaryRouting writes the weighted Traefik config sending weight percent
+// of each of the service's routes to the canary container.
+func WriteCanaryRouting(runner sshexec.Runner, svc *models.Service, stableContainer, canaryContainer string, weight int) error {
+	if _, err := runner.Run("mkdir -p " + sshexec.TraefikDynamicDir); err != nil {
+		return fmt.Errorf("create traefik config dir: %w", err)
+	}
+	name := CanaryRouterName(stableContainer)
+	config := sshexec.TraefikWeightedConfig(name, ServiceRoutes(svc), ServiceContainerPort(svc), stableContainer, canaryContainer, weight)
+	if err := runner.WriteFile(sshexec.TraefikDynamicConfigPath(name), config); err != nil {
+		return fmt.Errorf("write traefik config: %w", err)
+	}
+	return nil
+}
+
+// RemoveCanaryRouting deletes the weighted Traefik config so the stable
+// container's own routers serve all traffic again.
+func RemoveCanaryRouting(runner sshexec.Runner, stableContainer string) error {
+	_, err := runner.Run(sshexec.RemoveFileCmd(sshexec.TraefikDynamicConfigPath(CanaryRouterName(stableContainer))))
+	return err
+}
+
+// StartCanary runs the canary container for c next to its stable deployment.
+// It returns the new container ID.
+func (d *Deployer) StartCanary(c *models.Canary, svc *models.Service, node *models.Node) (string, error) {
+	runner := sshexec.NewRunner(node)
+	if output, err := d.DockerLogin(runner, c.DockerImage, c.UserID); err != nil {
+		return "", fmt.Errorf("docker login failed: %w: %s", err, output)
+	}
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(c.ContainerName))
+	cfg := CanaryRunConfig(svc, c.ContainerName, c.DockerImage)
+	if err := d.AttachServiceNetwork(runner, &cfg, svc, c.UserID, node.ID); err != nil {
+		return "", err
+	}
+	output, err := RunContainer(runner, cfg, d.ServiceEnv(svc, c.UserID, node.ID))
+	if err != nil {
+		return "", fmt.Errorf("docker run: %w: %s", err, output)
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// StopCanary removes the weighted routing first, so no request is sent to a
+// container that is going away, and then removes the canary container.
+func StopCanary(runner sshexec.Runner, c *models.Canary, stableContainer string) error {
+	if err := RemoveCanaryRouting(runner, stableContainer); err != nil {
+		return fmt.Errorf("remove traefik config: %w", err)
+	}
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(c.ContainerName))
+	return nil
+}
@@ -0,0 +1,173 @@
+package deployer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// ACME settings are stored per user.
+const (
+	SettingACMEEmail         = "acme_email"
+	SettingACMEDirectoryURL  = "acme_directory_url"
+	SettingACMECACertificate = "acme_ca_certificate"
+)
+
+// ParseCertificate validates a PEM certificate chain and private key and
+// returns an uploaded Certificate with domains, issuer and validity taken from
+// the leaf certificate. ID and timestamps are left for the caller.
+func ParseCertificate(certPEM, keyPEM string) (*models.Certificate, error) {
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate/key pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	c := certificateFromLeaf(leaf)
+	c.Source = models.CertificateSourceUploaded
+	c.CertPEM = certPEM
+	c.KeyPEM = keyPEM
+	return c, nil
+}
+
+// ParseCACertificate checks that data starts with a PEM-encoded certificate.
+func ParseCACertificate(data string) error {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("no PEM certificate found")
+	}
+	_, err := x509.ParseCertificate(block.Bytes)
+	return err
+}
+
+func certificateFromLeaf(leaf *x509.Certificate) *models.Certificate {
+	domains := leaf.DNSNames
+	if len(domains) == 0 && leaf.Subject.CommonName != "" {
+		domains = []string{leaf.Subject.CommonName}
+	}
+	domainsJSON, _ := json.Marshal(domains)
+	if domains == nil {
+		domainsJSON = []byte("[]")
+	}
+	issuer := leaf.Issuer.CommonName
+	if issuer == "" {
+		issuer = leaf.Issuer.String()
+	}
+	return &models.Certificate{
+		Domains:   string(domainsJSON),
+		Issuer:    issuer,
+		NotBefore: leaf.NotBefore.UTC(),
+		NotAfter:  leaf.NotAfter.UTC(),
+	}
+}
+
+// ParseACMEStorage returns the certificates in a Traefik acme.json file. Keys
+// are not returned; Traefik keeps managing them on the node.
+func ParseACMEStorage(data []byte) ([]*models.Certificate, error) {
+	var storage map[string]struct {
+		Certificates []struct {
+			Certificate string `json:"certificate"`
+		} `json:"Certificates"`
+	}
+	if err := json.Unmarshal(data, &storage); err != nil {
+		return nil, fmt.Errorf("parse acme storage: %w", err)
+	}
+	var certs []*models.Certificate
+	for _, resolver := range storage {
+		for _, entry := range resolver.Certificates {
+			raw, err := base64.StdEncoding.DecodeString(entry.Certificate)
+			if err != nil {
+				continue
+			}
+			block, _ := pem.Decode(raw)
+			if block == nil {
+				continue
+			}
+			leaf, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				continue
+			}
+			c := certificateFromLeaf(leaf)
+			c.Source = models.CertificateSourceACME
+			c.CertPEM = strings.TrimSpace(string(raw)) + "\n"
+			certs = append(certs, c)
+		}
+	}
+	return certs, nil
+}
+
+// PushCertificate writes an uploaded certificate and its key to a node and
+// registers them with Traefik's file provider.
+func PushCertificate(runner sshexec.Runner, c *models.Certificate) error {
+	if _, err := runner.Run("mkdir -p " + sshexec.TraefikCertsDir + " " + sshexec.TraefikDynamicDir); err != nil {
+		return fmt.Errorf("create traefik dirs: %w", err)
+	}
+	certPath, keyPath := sshexec.TraefikCertificatePaths(c.ID)
+	if err := runner.WriteFile(certPath, c.CertPEM); err != nil {
+		return fmt.Errorf("write certificate: %w", err)
+	}
+	if err := runner.WriteFile(keyPath, c.KeyPEM); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	name := sshexec.TraefikCertificateConfigName(c.ID)
+	if err := runner.WriteFile(sshexec.TraefikDynamicConfigPath(name), sshexec.TraefikCertificateConfig(c.ID)); err != nil {
+		return fmt.Errorf("write traefik config: %w", err)
+	}
+	return nil
+}
+
+// RemoveCertificate unregisters an uploaded certificate from Traefik on a node
+// and deletes its files.
+func RemoveCertificate(runner sshexec.Runner, id string) error {
+	certPath, keyPath := sshexec.TraefikCertificatePaths(id)
+	configPath := sshexec.TraefikDynamicConfigPath(sshexec.TraefikCertificateConfigName(id))
+	// Remove the config first so Traefik never references missing files.
+	if _, err := runner.Run(sshexec.RemoveFileCmd(configPath)); err != nil {
+		return err
+	}
+	_, err := runner.Run(sshexec.RemoveFileCmd(certPath) + " && " + sshexec.RemoveFileCmd(keyPath))
+	return err
+}
+
+// SetupTraefik installs Traefik on a node using the user's ACME settings and
+// pushes the user's uploaded certificates to it. It returns the setup output.
+func (d *Deployer) SetupTraefik(runner sshexec.Runner, userID string) (string, error) {
+	opts := sshexec.TraefikOptions{}
+	opts.ACMEEmail, _ = d.store.GetUserSetting(userID, SettingACMEEmail)
+	opts.ACMEDirectoryURL, _ = d.store.GetUserSetting(userID, SettingACMEDirectoryURL)
+	if ca, _ := d.store.GetUserSetting(userID, SettingACMECACertificate); ca != "" {
+		if _, err := runner.Run("mkdir -p " + sshexec.TraefikACMEDir); err != nil {
+			return "", fmt.Errorf("create acme dir: %w", err)
+		}
+		if err := runner.WriteFile(sshexec.TraefikACMECAPath, ca); err != nil {
+			return "", fmt.Errorf("write acme CA certificate: %w", err)
+		}
+		opts.ACMETrustCA = true
+	}
+
+	output, err := runner.Run(sshexec.TraefikSetupCmd(opts))
+	if err != nil {
+		return output, err
+	}
+
+	certs, err := d.store.ListUploadedCertificates(userID)
+	if err != nil {
+		return output, fmt.Errorf("list certificates: %w", err)
+	}
+	for _, c := range certs {
+		if err := PushCertificate(runner, c); err != nil {
+			return output, fmt.Errorf("push certificate %s: %w", c.ID, err)
+		}
+	}
+	return output, nil
+}
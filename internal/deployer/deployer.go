@@ -0,0 +1,428 @@
+// Package deployer builds and starts containers for services and managed
+// resources from the configuration stored in the database. HTTP handlers use it
+// when a resource is first created, and the background poller uses it to
+// recreate containers that disappeared from a node.
+package deployer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+// Deployer starts containers on nodes using stored configuration.
+type Deployer struct {
+	store *store.Store
+}
+
+// New creates a new Deployer.
+func New(s *store.Store) *Deployer {
+	return &Deployer{store: s}
+}
+
+// WriteEnvFile writes env to a temporary file on the node so values are never
+// exposed in the process list or shell history. It returns the file path, or ""
+// when env is empty. Callers remove the file once docker run has returned.
+func WriteEnvFile(runner sshexec.Runner, containerName string, env map[string]string) (string, error) {
+	if len(env) == 0 {
+		return "", nil
+	}
+	path := fmt.Sprintf("/tmp/%s.env", containerName)
+	var buf strings.Builder
+	for k, v := range env {
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(v)
+		buf.WriteByte('\n')
+	}
+	if err := runner.WriteFile(path, buf.String()); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// RunContainer writes env to a temporary env file, runs cfg and removes the env
+// file again. It returns the docker run output (the container ID on success).
+func RunContainer(runner sshexec.Runner, cfg sshexec.RunConfig, env map[string]string) (string, error) {
+	envFilePath, err := WriteEnvFile(runner, cfg.ContainerName, env)
+	if err != nil {
+		return "", fmt.Errorf("failed to write env file: %w", err)
+	}
+	if envFilePath != "" {
+		cfg.EnvFilePath = envFilePath
+	}
+	output, runErr := runner.Run(sshexec.DockerRunCmd(cfg))
+	// Always remove the env file — docker run -d has already loaded it.
+	if envFilePath != "" {
+		_, _ = runner.Run(sshexec.RemoveFileCmd(envFilePath))
+	}
+	return output, runErr
+}
+
+// ServiceRunConfig builds the docker run configuration for a service container.
+// The env file is added by RunContainer.
+func ServiceRunConfig(svc *models.Service, containerName string) sshexec.RunConfig {
+	var ports []string
+	_ = json.Unmarshal([]byte(svc.Ports), &ports)
+	var volumes []string
+	_ = json.Unmarshal([]byte(svc.Volumes), &volumes)
+
+	cfg := sshexec.RunConfig{
+		ContainerName: containerName,
+		Image:         svc.DockerImage,
+		Ports:         ports,
+		Volumes:       volumes,
+		CommandArgs:   shellFields(svc.Command),
+	}
+
+	if routes := ServiceRoutes(svc); len(routes) > 0 {
+		cfg.Network = "traefik-net"
+		cfg.Labels = sshexec.TraefikLabels(containerName, routes, ServiceContainerPort(svc))
+	}
+	return cfg
+}
+
+// ServiceRoutes returns the service's Traefik routes.
+func ServiceRoutes(svc *models.Service) []models.Route {
+	var routes []models.Route
+	_ = json.Unmarshal([]byte(svc.Routes), &routes)
+	return routes
+}
+
+// ServiceContainerPort returns the container side of the service's first port
+// mapping, which routes without a container port are sent to. Defaults to "80".
+func ServiceContainerPort(svc *models.Service) string {
+	var ports []string
+	_ = json.Unmarshal([]byte(svc.Ports), &ports)
+	if len(ports) > 0 {
+		// Parse "hostPort:containerPort" → take container side
+		if idx := strings.LastIndex(ports[0], ":"); idx >= 0 {
+			return ports[0][idx+1:]
+		}
+	}
+	return "80"
+}
+
+// ServiceEnv returns the env vars for a service container on nodeID: the
+// service's own env vars plus connection URLs for every linked database, cache,
+// Kafka cluster and monitoring stack. Resources on the same node are addressed
+// by container name over the user network; others by node host and host port.
+func (d *Deployer) ServiceEnv(svc *models.Service, userID, nodeID string) map[string]string {
+	envVars := map[string]string{}
+	_ = json.Unmarshal([]byte(svc.EnvVars), &envVars)
+
+	// Across nodes, prefer the WireGuard overlay when both ends are in the
+	// user's mesh; published ports are reachable on the overlay IP too.
+	mesh := d.meshAddrs(userID)
+	_, meshed := mesh[nodeID]
+	overlayHost := func(resourceNodeID, host string) string {
+		if ip, ok := mesh[resourceNodeID]; ok && meshed {
+			return ip
+		}
+		return host
+	}
+
+	dbURL := func(db *models.Database) string {
+		if db.NodeID == nodeID {
+			return DBInternalURL(db)
+		}
+		db.NodeHost = overlayHost(db.NodeID, db.NodeHost)
+		return DBConnectionURL(db)
+	}
+	cacheURL := func(c *models.Cache) string {
+		if c.NodeID == nodeID {
+			return CacheInternalURL(c)
+		}
+		c.NodeHost = overlayHost(c.NodeID, c.NodeHost)
+		return CacheConnectionURL(c)
+	}
+	// Kafka keeps the node host across nodes: the broker advertises its
+	// public listener, so clients would leave the overlay after bootstrap.
+	kafkaURL := func(k *models.Kafka) string {
+		if k.NodeID == nodeID {
+			return KafkaInternalURL(k)
+		}
+		return KafkaConnectionURL(k)
+	}
+	prometheusURL := func(m *models.Monitoring) string {
+		if m.NodeID == nodeID {
+			return MonitoringPrometheusInternalURL(m)
+		}
+		m.NodeHost = overlayHost(m.NodeID, m.NodeHost)
+		return MonitoringPrometheusURL(m)
+	}
+	grafanaURL := func(m *models.Monitoring) string {
+		if m.NodeID == nodeID {
+			return MonitoringGrafanaInternalURL(m)
+		}
+		m.NodeHost = overlayHost(m.NodeID, m.NodeHost)
+		return MonitoringGrafanaURL(m)
+	}
+
+	// Inject database connection URLs from linked databases
+	var dbIDs []string
+	_ = json.Unmarshal([]byte(svc.Databases), &dbIDs)
+	for _, dbID := range dbIDs {
+		db, err := d.store.GetDatabase(dbID, userID)
+		if err != nil || db == nil {
+			continue
+		}
+		envVars[DBEnvVarName(db.Name)] = dbURL(db)
+	}
+	// For single-database apps, also inject DATABASE_URL as a convenience alias
+	// unless the user has already set it explicitly.
+	if len(dbIDs) == 1 {
+		if _, exists := envVars["DATABASE_URL"]; !exists {
+			db, err := d.store.GetDatabase(dbIDs[0], userID)
+			if err == nil && db != nil {
+				envVars["DATABASE_URL"] = dbURL(db)
+			}
+		}
+	}
+
+	// Inject cache connection URLs from linked caches
+	var cacheIDs []string
+	_ = json.Unmarshal([]byte(svc.Caches), &cacheIDs)
+	for _, cID := range cacheIDs {
+		c, err := d.store.GetCache(cID, userID)
+		if err != nil || c == nil {
+			continue
+		}
+		envVars[CacheEnvVarName(c.Name)] = cacheURL(c)
+	}
+	// For single-cache apps, also inject CACHE_URL as a convenience alias.
+	if len(cacheIDs) == 1 {
+		if _, exists := envVars["CACHE_URL"]; !exists {
+			c, err := d.store.GetCache(cacheIDs[0], userID)
+			if err == nil && c != nil {
+				envVars["CACHE_URL"] = cacheURL(c)
+			}
+		}
+	}
+
+	// Inject Kafka bootstrap server addresses from linked Kafka clusters
+	var kafkaIDs []string
+	_ = json.Unmarshal([]byte(svc.Kafkas), &kafkaIDs)
+	for _, kID := range kafkaIDs {
+		k, err := d.store.GetKafka(kID, userID)
+		if err != nil || k == nil {
+			continue
+		}
+		envVars[KafkaEnvVarName(k.Name)] = kafkaURL(k)
+	}
+	// For single-Kafka apps, also inject KAFKA_BROKERS as a convenience alias.
+	if len(kafkaIDs) == 1 {
+		if _, exists := envVars["KAFKA_BROKERS"]; !exists {
+			k, err := d.store.GetKafka(kafkaIDs[0], userID)
+			if err == nil && k != nil {
+				envVars["KAFKA_BROKERS"] = kafkaURL(k)
+			}
+		}
+	}
+
+	// Inject monitoring URLs from linked monitoring stacks
+	var monitoringIDs []string
+	_ = json.Unmarshal([]byte(svc.Monitorings), &monitoringIDs)
+	for _, mID := range monitoringIDs {
+		mon, err := d.store.GetMonitoring(mID, userID)
+		if err != nil || mon == nil {
+			continue
+		}
+		envVars[MonitoringPrometheusEnvVarName(mon.Name)] = prometheusURL(mon)
+		envVars[MonitoringGrafanaEnvVarName(mon.Name)] = grafanaURL(mon)
+	}
+	// For single-monitoring apps, also inject convenience aliases.
+	if len(monitoringIDs) == 1 {
+		mon, err := d.store.GetMonitoring(monitoringIDs[0], userID)
+		if err == nil && mon != nil {
+			if _, exists := envVars["PROMETHEUS_URL"]; !exists {
+				envVars["PROMETHEUS_URL"] = prometheusURL(mon)
+			}
+			if _, exists := envVars["GRAFANA_URL"]; !exists {
+				envVars["GRAFANA_URL"] = grafanaURL(mon)
+			}
+		}
+	}
+
+	return envVars
+}
+
+// DockerLogin authenticates the node against GHCR when image is hosted there and
+// the user has GitHub credentials configured. It is a no-op otherwise.
+func (d *Deployer) DockerLogin(runner sshexec.Runner, image, userID string) (string, error) {
+	if !strings.HasPrefix(image, "ghcr.io/") {
+		return "", nil
+	}
+	ghToken, _ := d.store.GetSecretUserSetting(userID, "github_token")
+	ghUsername, _ := d.store.GetUserSetting(userID, "github_username")
+	if ghToken == "" || ghUsername == "" {
+		return "", nil
+	}
+	return runner.Run(sshexec.DockerLoginCmd(ghUsername, ghToken))
+}
+
+// ErrNoPreviousImage is returned by RollbackDeployment when the deployment
+// has not been recreated with a different image yet.
+var ErrNoPreviousImage = errors.New("deployment has no previous image to roll back to")
+
+// RecreateDeployment removes the deployment's container (if any) and starts a
+// fresh one from the service's current configuration under the same name, or
+// from the deployment's pinned image after a rollback. It returns the new
+// container ID. When the new container runs a different image than the old
+// one, the old image is kept as the deployment's previous image.
+func (d *Deployer) RecreateDeployment(dep *models.Deployment, node *models.Node) (string, error) {
+	return d.recreateDeployment(dep, node, dep.PinnedImage)
+}
+
+// RedeployDeployment is an explicit deploy of the service's current image: it
+// drops the deployment's pinned image, if any, and recreates it.
+func (d *Deployer) RedeployDeployment(dep *models.Deployment, node *models.Node) (string, error) {
+	if dep.PinnedImage != "" {
+		if err := d.store.SetDeploymentPinnedImage(dep.ID, dep.UserID, ""); err != nil {
+			return "", fmt.Errorf("unpin image: %w", err)
+		}
+		dep.PinnedImage = ""
+	}
+	return d.recreateDeployment(dep, node, "")
+}
+
+// RollbackDeployment recreates the deployment from its previous image, which
+// in turn becomes the image it is rolled back from, so a second rollback
+// undoes the first. The deployment stays pinned to the image it was rolled
+// back to, so heals and webhook or image-check redeploys do not bring the
+// service's image back; the next RedeployDeployment does.
+func (d *Deployer) RollbackDeployment(dep *models.Deployment, node *models.Node) (string, error) {
+	if dep.PreviousImage == "" {
+		return "", ErrNoPreviousImage
+	}
+	image := dep.PreviousImage
+	containerID, err := d.recreateDeployment(dep, node, image)
+	if err != nil {
+		return "", err
+	}
+	if err := d.store.SetDeploymentPinnedImage(dep.ID, dep.UserID, image); err != nil {
+		return "", fmt.Errorf("pin image: %w", err)
+	}
+	dep.PinnedImage = image
+	return containerID, nil
+}
+
+// recreateDeployment recreates the deployment's container, from image
+// instead of the service's image when image is set.
+func (d *Deployer) recreateDeployment(dep *models.Deployment, node *models.Node, image string) (string, error) {
+	svc, err := d.store.GetService(dep.ServiceID, dep.UserID)
+	if err != nil {
+		return "", fmt.Errorf("get service: %w", err)
+	}
+	if svc == nil {
+		return "", fmt.Errorf("service %s not found", dep.ServiceID)
+	}
+
+	runner := sshexec.NewRunner(node)
+	if _, err := d.DockerLogin(runner, svc.DockerImage, dep.UserID); err != nil {
+		return "", fmt.Errorf("docker login: %w", err)
+	}
+	oldImage := containerImageID(runner, dep.ContainerName)
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(dep.ContainerName))
+
+	cfg := ServiceRunConfig(svc, dep.ContainerName)
+	if image != "" {
+		cfg.Image = image
+	}
+	if err := d.AttachServiceNetwork(runner, &cfg, svc, dep.UserID, node.ID); err != nil {
+		return "", err
+	}
+	output, err := RunContainer(runner, cfg, d.ServiceEnv(svc, dep.UserID, node.ID))
+	if err != nil {
+		return "", fmt.Errorf("docker run: %w: %s", err, output)
+	}
+	if newImage := containerImageID(runner, dep.ContainerName); oldImage != "" && newImage != oldImage {
+		if err := d.store.SetDeploymentPreviousImage(dep.ID, dep.UserID, oldImage); err == nil {
+			dep.PreviousImage = oldImage
+		}
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// containerImageID returns the ID of the image a container runs, or "" if
+// the container does not exist.
+func containerImageID(runner sshexec.Runner, containerName string) string {
+	out, err := runner.Run(sshexec.DockerImageIDCmd(containerName))
+	if out = strings.Trim(strings.TrimSpace(out), "'"); err != nil || !strings.HasPrefix(out, "sha256:") {
+		return ""
+	}
+	return out
+}
+
+// RecreateDatabase removes the database container (if any) and starts a fresh
+// one with the stored credentials. Data survives in the named volume.
+func (d *Deployer) RecreateDatabase(db *models.Database, node *models.Node) error {
+	runner := sshexec.NewRunner(node)
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(db.ContainerName))
+	cfg, env := DatabaseRunConfig(db)
+	if err := AttachUserNetwork(runner, &cfg, db.UserID); err != nil {
+		return err
+	}
+	if output, err := RunContainer(runner, cfg, env); err != nil {
+		return fmt.Errorf("docker run: %w: %s", err, output)
+	}
+	return nil
+}
+
+// RecreateCache removes the cache container (if any) and starts a fresh one.
+func (d *Deployer) RecreateCache(c *models.Cache, node *models.Node) error {
+	runner := sshexec.NewRunner(node)
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(c.ContainerName))
+	cfg := CacheRunConfig(c)
+	if err := AttachUserNetwork(runner, &cfg, c.UserID); err != nil {
+		return err
+	}
+	if output, err := RunContainer(runner, cfg, nil); err != nil {
+		return fmt.Errorf("docker run: %w: %s", err, output)
+	}
+	return nil
+}
+
+// RecreateKafka removes the Kafka container (if any) and starts a fresh one.
+func (d *Deployer) RecreateKafka(k *models.Kafka, node *models.Node) error {
+	runner := sshexec.NewRunner(node)
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(k.ContainerName))
+	cfg, env := KafkaRunConfig(k, node.Host)
+	if err := AttachUserNetwork(runner, &cfg, k.UserID); err != nil {
+		return err
+	}
+	if output, err := RunContainer(runner, cfg, env); err != nil {
+		return fmt.Errorf("docker run: %w: %s", err, output)
+	}
+	return nil
+}
+
+// RecreateMonitoring removes both monitoring containers (if any) and starts
+// fresh ones. The Prometheus and Grafana config files written at creation time
+// are reused from the node.
+func (d *Deployer) RecreateMonitoring(m *models.Monitoring, node *models.Node) error {
+	runner := sshexec.NewRunner(node)
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(m.GrafanaContainerName))
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(m.PrometheusContainerName))
+
+	promCfg, grafanaCfg, grafanaEnv := MonitoringRunConfigs(m)
+	_, _ = runner.Run(sshexec.DockerNetworkCreateCmd(promCfg.Network))
+	if err := AttachUserNetwork(runner, &promCfg, m.UserID); err != nil {
+		return err
+	}
+	if err := AttachUserNetwork(runner, &grafanaCfg, m.UserID); err != nil {
+		return err
+	}
+	if output, err := RunContainer(runner, promCfg, nil); err != nil {
+		return fmt.Errorf("docker run prometheus: %w: %s", err, output)
+	}
+	if output, err := RunContainer(runner, grafanaCfg, grafanaEnv); err != nil {
+		return fmt.Errorf("docker run grafana: %w: %s", err, output)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package deployer_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+const testUserID = "test-user-id"
+
+// fakeDocker puts a docker on PATH that keeps the image of the one container
+// it runs in a file, mapping the service image acme/api:new to sha256:new,
+// and returns that file.
+func fakeDocker(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	state := filepath.Join(dir, "image")
+	script := `#!/bin/sh
+case "$1" in
+inspect) cat "` + state + `" 2>/dev/null || exit 1 ;;
+run)
+	for a in "$@"; do
+		case "$a" in
+		sha256:*) img=$a ;;
+		acme/api:new) img=sha256:new ;;
+		esac
+	done
+	echo "$img" > "` + state + `"
+	echo container-id ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return state
+}
+
+func runningImage(t *testing.T, state string) string {
+	t.Helper()
+	b, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func TestRollback_SurvivesHealRecreate(t *testing.T) {
+	state := fakeDocker(t)
+	s, err := store.New(":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &models.Node{ID: "node-1", Name: "local", Host: "127.0.0.1", Username: "root", IsLocal: true, CreatedAt: time.Now().UTC()}
+	svc := &models.Service{ID: "svc-1", Name: "api", DockerImage: "acme/api:new", Ports: "[]", Volumes: "[]", EnvVars: "{}", CreatedAt: time.Now().UTC()}
+	dep := &models.Deployment{ID: "dep-1", ServiceID: svc.ID, NodeID: node.ID, ContainerName: "localisprod-api-1", Status: "running", CreatedAt: time.Now().UTC()}
+	for _, err := range []error{s.CreateNode(node, testUserID), s.CreateService(svc, testUserID), s.CreateDeployment(dep, testUserID)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The deployment was redeployed from sha256:old onto the new image.
+	if err := os.WriteFile(state, []byte("sha256:new\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDeploymentPreviousImage(dep.ID, testUserID, "sha256:old"); err != nil {
+		t.Fatal(err)
+	}
+	d := deployer.New(s)
+
+	dep, _ = s.GetDeployment(dep.ID, testUserID)
+	dep.UserID = testUserID
+	if _, err := d.RollbackDeployment(dep, node); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if got := runningImage(t, state); got != "sha256:old" {
+		t.Fatalf("after rollback the container runs %s", got)
+	}
+
+	// A heal recreates the deployment as the health check loaded it.
+	healthy, err := s.ListDeploymentsForHealthCheck()
+	if err != nil || len(healthy) != 1 {
+		t.Fatalf("ListDeploymentsForHealthCheck = %v, %v", healthy, err)
+	}
+	if _, err := d.RecreateDeployment(healthy[0], node); err != nil {
+		t.Fatalf("heal recreate: %v", err)
+	}
+	if got := runningImage(t, state); got != "sha256:old" {
+		t.Errorf("heal recreate after rollback runs %s, want sha256:old", got)
+	}
+	if got, _ := s.GetDeployment(dep.ID, testUserID); got.PinnedImage != "sha256:old" || got.PreviousImage != "sha256:new" {
+		t.Errorf("after heal: pinned %q, previous %q", got.PinnedImage, got.PreviousImage)
+	}
+
+	// An explicit redeploy goes back to the service's image and unpins.
+	if _, err := d.RedeployDeployment(dep, node); err != nil {
+		t.Fatalf("redeploy: %v", err)
+	}
+	if got := runningImage(t, state); got != "sha256:new" {
+		t.Errorf("redeploy runs %s, want sha256:new", got)
+	}
+	if got, _ := s.GetDeployment(dep.ID, testUserID); got.PinnedImage != "" {
+		t.Errorf("redeploy left the deployment pinned to %q", got.PinnedImage)
+	}
+}
@@ -0,0 +1,268 @@
+package deployer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// DrainNode moves every running deployment off node, which the caller has
+// marked as draining. Each deployment is recreated on target, or on the schedulable
+// online node running the fewest deployments when target is nil; once the new
+// container is running the deployment is switched over, so Traefik on the new
+// node serves its routes, and the old container is removed. Deployments that
+// cannot be moved stay where they are and are listed in Failed; stopped and
+// failed ones are left in place too, so a drain never starts them, and are
+// listed in Skipped. Managed
+// resources are never moved; they are listed with a data-migration plan.
+func (d *Deployer) DrainNode(node *models.Node, target *models.Node, userID string) (*models.DrainReport, error) {
+	report := &models.DrainReport{
+		NodeID:    node.ID,
+		Moved:     []*models.DrainMove{},
+		Failed:    []*models.DrainFailure{},
+		Skipped:   []*models.DrainSkip{},
+		Resources: []*models.DrainResource{},
+	}
+	deps, err := d.store.ListDeployments(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list deployments: %w", err)
+	}
+	nodes, err := d.store.ListNodes(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	load := map[string]int{}
+	for _, dep := range deps {
+		load[dep.NodeID]++
+	}
+
+	source := sshexec.NewRunner(node)
+	for _, dep := range deps {
+		if dep.NodeID != node.ID {
+			continue
+		}
+		if dep.Status != "running" {
+			report.Skipped = append(report.Skipped, &models.DrainSkip{DeploymentID: dep.ID, ServiceName: dep.AppName, Status: dep.Status})
+			continue
+		}
+		dep.UserID = userID
+		svc, err := d.store.GetService(dep.ServiceID, userID)
+		if err != nil || svc == nil {
+			report.Failed = append(report.Failed, &models.DrainFailure{DeploymentID: dep.ID, ServiceName: dep.AppName, Error: "service not found"})
+			continue
+		}
+		move, err := d.moveDeployment(dep, svc, source, node, target, nodes, load)
+		if err != nil {
+			report.Failed = append(report.Failed, &models.DrainFailure{DeploymentID: dep.ID, ServiceName: svc.Name, Error: err.Error()})
+			continue
+		}
+		load[node.ID]--
+		load[move.ToNodeID]++
+		report.Moved = append(report.Moved, move)
+	}
+
+	resources, err := d.drainResources(node.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+	report.Resources = resources
+	return report, nil
+}
+
+// moveDeployment recreates dep on a node other than from and removes the old
+// container once the new one runs.
+func (d *Deployer) moveDeployment(dep *models.Deployment, svc *models.Service, source sshexec.Runner, from, target *models.Node, nodes []*models.Node, load map[string]int) (*models.DrainMove, error) {
+	if c, _ := d.store.GetActiveCanaryForDeployment(dep.ID, dep.UserID); c != nil {
+		return nil, errors.New("a canary is in progress; promote or abort it first")
+	}
+	if dep.PinnedImage != "" {
+		// The pinned image ID exists only on this node and cannot be pulled.
+		return nil, errors.New("it is pinned to a rolled-back image; redeploy it first")
+	}
+	routes := ServiceRoutes(svc)
+	to := target
+	if to == nil {
+		to = d.pickDrainTarget(svc, from, nodes, load)
+		if to == nil {
+			return nil, errors.New("no schedulable online node has room for it")
+		}
+	} else if err := d.checkDrainTarget(svc, to); err != nil {
+		return nil, err
+	}
+
+	runner := sshexec.NewRunner(to)
+	if output, err := d.DockerLogin(runner, svc.DockerImage, dep.UserID); err != nil {
+		return nil, fmt.Errorf("docker login on %s: %w: %s", to.Name, err, output)
+	}
+	_, _ = runner.Run(sshexec.DockerForceRemoveCmd(dep.ContainerName))
+	cfg := ServiceRunConfig(svc, dep.ContainerName)
+	if err := d.AttachServiceNetwork(runner, &cfg, svc, dep.UserID, to.ID); err != nil {
+		return nil, err
+	}
+	output, err := RunContainer(runner, cfg, d.ServiceEnv(svc, dep.UserID, to.ID))
+	if err != nil {
+		_, _ = runner.Run(sshexec.DockerForceRemoveCmd(dep.ContainerName))
+		return nil, fmt.Errorf("docker run on %s: %w: %s", to.Name, err, output)
+	}
+	containerID := strings.TrimSpace(output)
+	if state, err := runner.Run(sshexec.CheckContainersHealthCmd([]string{dep.ContainerName})); err != nil || strings.TrimSpace(state) != "true" {
+		_, _ = runner.Run(sshexec.DockerForceRemoveCmd(dep.ContainerName))
+		return nil, fmt.Errorf("container did not keep running on %s", to.Name)
+	}
+
+	// Switch over before removing the old container so the deployment always
+	// points at a running one.
+	if err := d.store.UpdateDeploymentNode(dep.ID, dep.UserID, to.ID, containerID); err != nil {
+		_, _ = runner.Run(sshexec.DockerForceRemoveCmd(dep.ContainerName))
+		return nil, err
+	}
+	_, _ = source.Run(sshexec.DockerStopRemoveCmd(dep.ContainerName))
+
+	move := &models.DrainMove{
+		DeploymentID: dep.ID,
+		ServiceName:  svc.Name,
+		ToNodeID:     to.ID,
+		ToNodeName:   to.Name,
+		ContainerID:  containerID,
+	}
+	var hosts []string
+	for _, r := range routes {
+		if r.Host != "" {
+			hosts = append(hosts, r.Host)
+		}
+	}
+	if len(hosts) > 0 {
+		move.Warnings = append(move.Warnings, fmt.Sprintf("point DNS for %s at %s", strings.Join(dedupe(hosts), ", "), to.Host))
+	}
+	var volumes []string
+	_ = json.Unmarshal([]byte(svc.Volumes), &volumes)
+	if len(volumes) > 0 {
+		move.Warnings = append(move.Warnings, fmt.Sprintf("volume data was not copied from %s: %s", from.Name, strings.Join(volumes, ", ")))
+	}
+	return move, nil
+}
+
+// pickDrainTarget returns the schedulable online node other than from that
+// runs the fewest deployments and can take svc, or nil if there is none.
+func (d *Deployer) pickDrainTarget(svc *models.Service, from *models.Node, nodes []*models.Node, load map[string]int) *models.Node {
+	var best *models.Node
+	for _, n := range nodes {
+		if n.ID == from.ID || n.Status == "offline" {
+			continue
+		}
+		if d.checkDrainTarget(svc, n) != nil {
+			continue
+		}
+		if best == nil || load[n.ID] < load[best.ID] {
+			best = n
+		}
+	}
+	return best
+}
+
+// checkDrainTarget reports why svc cannot be placed on n, if it cannot.
+func (d *Deployer) checkDrainTarget(svc *models.Service, n *models.Node) error {
+	if !n.Schedulable() {
+		return fmt.Errorf("node %s is %s", n.Name, n.Schedule)
+	}
+	if len(ServiceRoutes(svc)) > 0 && !n.TraefikEnabled {
+		return fmt.Errorf("node %s has no Traefik to serve the service's routes", n.Name)
+	}
+	var ports []string
+	_ = json.Unmarshal([]byte(svc.Ports), &ports)
+	for _, mapping := range ports {
+		hostPort := mapping
+		if idx := strings.LastIndex(mapping, ":"); idx >= 0 {
+			hostPort = mapping[:idx]
+		}
+		var port int
+		if _, err := fmt.Sscanf(hostPort, "%d", &port); err != nil || port == 0 {
+			continue
+		}
+		if used, err := d.store.IsPortUsedOnNode(n.ID, port); err != nil || used {
+			return fmt.Errorf("port %d is already in use on node %s", port, n.Name)
+		}
+	}
+	return nil
+}
+
+// drainResources lists the managed resources on a node with a plan for moving
+// their data.
+func (d *Deployer) drainResources(nodeID, userID string) ([]*models.DrainResource, error) {
+	out := []*models.DrainResource{}
+	dbs, err := d.store.ListDatabases(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list databases: %w", err)
+	}
+	for _, db := range dbs {
+		if db.NodeID != nodeID {
+			continue
+		}
+		vol := DatabaseVolumeName(db.Name)
+		plan := fmt.Sprintf("Copy the Redis snapshot from volume %s (run BGSAVE first) into a new database on the target node, then relink services.", vol)
+		if db.Type == "postgres" {
+			plan = fmt.Sprintf("Create a database on the target node, stop writers, pipe `docker exec %s pg_dump -U %s %s` into psql on the new one, then relink services. Data is in volume %s.",
+				db.ContainerName, db.DBUser, db.DBName, vol)
+		}
+		out = append(out, &models.DrainResource{Kind: "database", ID: db.ID, Name: db.Name, Plan: plan})
+	}
+
+	caches, err := d.store.ListCaches(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list caches: %w", err)
+	}
+	for _, c := range caches {
+		if c.NodeID != nodeID {
+			continue
+		}
+		var volumes []string
+		_ = json.Unmarshal([]byte(c.Volumes), &volumes)
+		plan := "No volumes: the cache holds no persistent data. Create a new cache on the target node and relink services."
+		if len(volumes) > 0 {
+			plan = fmt.Sprintf("Run BGSAVE, copy the snapshot from %s into a new cache on the target node, then relink services.", strings.Join(volumes, ", "))
+		}
+		out = append(out, &models.DrainResource{Kind: "cache", ID: c.ID, Name: c.Name, Plan: plan})
+	}
+
+	kafkas, err := d.store.ListKafkas(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list kafkas: %w", err)
+	}
+	for _, k := range kafkas {
+		if k.NodeID != nodeID {
+			continue
+		}
+		out = append(out, &models.DrainResource{Kind: "kafka", ID: k.ID, Name: k.Name,
+			Plan: fmt.Sprintf("Create a cluster on the target node and mirror topics with MirrorMaker 2 (or let consumers finish and start fresh), then relink services. Data is in volume %s.", KafkaVolumeName(k.Name))})
+	}
+
+	mons, err := d.store.ListMonitorings(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list monitorings: %w", err)
+	}
+	for _, m := range mons {
+		if m.NodeID != nodeID {
+			continue
+		}
+		p := MonitoringPathsFor(m)
+		out = append(out, &models.DrainResource{Kind: "monitoring", ID: m.ID, Name: m.Name,
+			Plan: fmt.Sprintf("Create a stack on the target node; metric history and dashboards stay in volumes %s and %s unless copied over.", p.PromVolume, p.GrafanaVolume)})
+	}
+
+	stores, err := d.store.ListObjectStorages(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list object storages: %w", err)
+	}
+	for _, o := range stores {
+		if o.NodeID != nodeID {
+			continue
+		}
+		out = append(out, &models.DrainResource{Kind: "object_storage", ID: o.ID, Name: o.Name,
+			Plan: "Create a storage on the target node and copy buckets across with an S3 client such as `rclone sync`, then update credentials in services."})
+	}
+	return out, nil
+}
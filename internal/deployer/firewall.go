@@ -0,0 +1,352 @@
+package deployer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// firewallResource is a published resource port that only linked services may
+// reach.
+type firewallResource struct {
+	id     string
+	nodeID string
+	port   int
+}
+
+// FirewallConfigs computes the ruleset of every node of the user. Each node
+// allows SSH, HTTP(S) for Traefik, WireGuard when it is in the mesh and the
+// user's rules for it. Published database, cache, Kafka and Prometheus ports
+// are only reachable from the other nodes running services linked to them;
+// same-node services use the user network instead. A user rule for such a port
+// adds its source, or opens the port completely when it has none.
+func (d *Deployer) FirewallConfigs(userID string) (map[string]sshexec.FirewallConfig, error) {
+	nodes, err := d.store.ListNodes(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	mesh := d.meshAddrs(userID)
+	addrs := map[string][]string{}
+	for _, n := range nodes {
+		addrs[n.ID] = resolveHost(n.Host)
+		if ip, ok := mesh[n.ID]; ok {
+			addrs[n.ID] = append(addrs[n.ID], ip)
+		}
+	}
+
+	resources, err := d.firewallResources(userID)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := d.linkedClientNodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := d.store.ListFirewallRules(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list firewall rules: %w", err)
+	}
+
+	configs := map[string]sshexec.FirewallConfig{}
+	for _, n := range nodes {
+		cfg := sshexec.FirewallConfig{
+			Host: []sshexec.FirewallAllow{
+				{Protocol: "tcp", Port: n.Port},
+				{Protocol: "tcp", Port: 80},
+				{Protocol: "tcp", Port: 443},
+			},
+		}
+		if _, ok := mesh[n.ID]; ok {
+			cfg.Host = append(cfg.Host, sshexec.FirewallAllow{Protocol: "udp", Port: sshexec.WireGuardPort})
+		}
+
+		published := map[int]*sshexec.FirewallAllow{}
+		var ports []int
+		for _, r := range resources {
+			if r.nodeID != n.ID {
+				continue
+			}
+			allow, ok := published[r.port]
+			if !ok {
+				allow = &sshexec.FirewallAllow{Protocol: "tcp", Port: r.port}
+				published[r.port] = allow
+				ports = append(ports, r.port)
+			}
+			for clientNode := range clients[r.id] {
+				if clientNode != n.ID {
+					allow.Sources = append(allow.Sources, addrs[clientNode]...)
+				}
+			}
+		}
+
+		for _, rule := range rules {
+			if rule.NodeID != "" && rule.NodeID != n.ID {
+				continue
+			}
+			var sources []string
+			if rule.Source != "" {
+				sources = []string{rule.Source}
+			}
+			cfg.Host = append(cfg.Host, sshexec.FirewallAllow{Protocol: rule.Protocol, Port: rule.Port, Sources: sources})
+			if allow, ok := published[rule.Port]; ok && allow.Protocol == rule.Protocol {
+				if rule.Source == "" {
+					delete(published, rule.Port)
+				} else {
+					allow.Sources = append(allow.Sources, rule.Source)
+				}
+			}
+		}
+
+		sort.Ints(ports)
+		for _, p := range ports {
+			if allow, ok := published[p]; ok {
+				allow.Sources = dedupe(allow.Sources)
+				cfg.Published = append(cfg.Published, *allow)
+			}
+		}
+		configs[n.ID] = cfg
+	}
+	return configs, nil
+}
+
+// firewallResources returns the user's published resource ports that are
+// restricted to linked services. Grafana is left out: it is meant to be
+// opened in a browser and has its own login.
+func (d *Deployer) firewallResources(userID string) ([]firewallResource, error) {
+	var out []firewallResource
+	dbs, err := d.store.ListDatabases(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list databases: %w", err)
+	}
+	for _, db := range dbs {
+		out = append(out, firewallResource{db.ID, db.NodeID, db.Port})
+	}
+	caches, err := d.store.ListCaches(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list caches: %w", err)
+	}
+	for _, c := range caches {
+		out = append(out, firewallResource{c.ID, c.NodeID, c.Port})
+	}
+	kafkas, err := d.store.ListKafkas(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list kafkas: %w", err)
+	}
+	for _, k := range kafkas {
+		out = append(out, firewallResource{k.ID, k.NodeID, k.Port})
+	}
+	mons, err := d.store.ListMonitorings(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list monitorings: %w", err)
+	}
+	for _, m := range mons {
+		out = append(out, firewallResource{m.ID, m.NodeID, m.PrometheusPort})
+	}
+	return out, nil
+}
+
+// linkedClientNodes maps each resource ID to the set of nodes running a
+// deployment of a service linked to it.
+func (d *Deployer) linkedClientNodes(userID string) (map[string]map[string]bool, error) {
+	deps, err := d.store.ListDeployments(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list deployments: %w", err)
+	}
+	serviceNodes := map[string][]string{}
+	for _, dep := range deps {
+		serviceNodes[dep.ServiceID] = append(serviceNodes[dep.ServiceID], dep.NodeID)
+	}
+	svcs, err := d.store.ListServices(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list services: %w", err)
+	}
+	clients := map[string]map[string]bool{}
+	for _, svc := range svcs {
+		for _, links := range []string{svc.Databases, svc.Caches, svc.Kafkas, svc.Monitorings} {
+			var ids []string
+			_ = json.Unmarshal([]byte(links), &ids)
+			for _, id := range ids {
+				if clients[id] == nil {
+					clients[id] = map[string]bool{}
+				}
+				for _, nodeID := range serviceNodes[svc.ID] {
+					clients[id][nodeID] = true
+				}
+			}
+		}
+	}
+	return clients, nil
+}
+
+// resolveHost returns the addresses of a node host: the host itself when it is
+// an IP, otherwise what it resolves to from here.
+func resolveHost(host string) []string {
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
+
+func dedupe(values []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ApplyFirewall writes cfg to the node and loads it.
+func ApplyFirewall(runner sshexec.Runner, cfg sshexec.FirewallConfig) error {
+	if _, err := runner.Run("mkdir -p " + sshexec.ShellEscape(path.Dir(sshexec.FirewallConfigPath))); err != nil {
+		return fmt.Errorf("create firewall dir: %w", err)
+	}
+	if err := runner.WriteFile(sshexec.FirewallConfigPath, sshexec.FirewallRuleset(cfg)); err != nil {
+		return fmt.Errorf("write ruleset: %w", err)
+	}
+	if output, err := runner.Run(sshexec.FirewallApplyCmd()); err != nil {
+		return fmt.Errorf("apply ruleset: %w: %s", err, output)
+	}
+	return nil
+}
+
+// ReconcileFirewalls applies the current ruleset to every node of the user
+// whose firewall is managed, except the management node, and records the
+// outcome per node. Reconciles of a user run one at a time, so a later one
+// always applies the later state. It SSHes to each firewalled node in turn,
+// so handlers go through ScheduleFirewallReconcile instead.
+func (d *Deployer) ReconcileFirewalls(userID string) error {
+	defer firewallReconciles.lock(userID)()
+	fws, err := d.store.ListNodeFirewalls(userID)
+	if err != nil || len(fws) == 0 {
+		return err
+	}
+	configs, err := d.FirewallConfigs(userID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, fw := range fws {
+		node, err := d.store.GetNode(fw.NodeID, userID)
+		if err != nil || node == nil || node.IsLocal {
+			continue
+		}
+		applyErr := ApplyFirewall(sshexec.NewRunner(node), configs[node.ID])
+		msg := ""
+		if applyErr != nil {
+			msg = applyErr.Error()
+			errs = append(errs, fmt.Errorf("node %s: %w", node.Name, applyErr))
+		}
+		_ = d.store.RecordFirewallApply(node.ID, time.Now().UTC(), msg)
+	}
+	return errors.Join(errs...)
+}
+
+// EnableFirewall starts managing the firewall of a node, applies its ruleset
+// and records the outcome, under the user's reconcile lock so a reconcile
+// already running cannot overwrite it with an older state. It returns the
+// ruleset and the error applying it; err is set when the store fails.
+func (d *Deployer) EnableFirewall(node *models.Node, userID string) (ruleset string, applyErr, err error) {
+	defer firewallReconciles.lock(userID)()
+	if err := d.store.EnableNodeFirewall(node.ID, userID, time.Now().UTC()); err != nil {
+		return "", nil, err
+	}
+	configs, err := d.FirewallConfigs(userID)
+	if err != nil {
+		return "", nil, err
+	}
+	cfg := configs[node.ID]
+	applyErr = ApplyFirewall(sshexec.NewRunner(node), cfg)
+	msg := ""
+	if applyErr != nil {
+		msg = applyErr.Error()
+	}
+	_ = d.store.RecordFirewallApply(node.ID, time.Now().UTC(), msg)
+	return sshexec.FirewallRuleset(cfg), applyErr, nil
+}
+
+// DisableFirewall stops managing the firewall of a node and removes its
+// ruleset, under the user's reconcile lock. The node is dropped from the
+// managed ones first, so no later reconcile applies the ruleset again. It
+// returns the error removing the ruleset; err is set when the store fails.
+func (d *Deployer) DisableFirewall(node *models.Node, userID string) (removeErr, err error) {
+	defer firewallReconciles.lock(userID)()
+	if err := d.store.DisableNodeFirewall(node.ID, userID); err != nil {
+		return nil, err
+	}
+	return RemoveFirewall(sshexec.NewRunner(node)), nil
+}
+
+// firewallDebounce folds the changes a user makes in quick succession, such
+// as an apply creating several resources, into one reconcile.
+const firewallDebounce = 2 * time.Second
+
+// firewallReconciles tracks the users with a reconcile scheduled and holds a
+// lock per user.
+var firewallReconciles = &reconcileQueue{pending: map[string]bool{}, locks: map[string]*sync.Mutex{}}
+
+type reconcileQueue struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	locks   map[string]*sync.Mutex
+}
+
+// lock locks the user's reconciles and returns the unlock.
+func (q *reconcileQueue) lock(userID string) func() {
+	q.mu.Lock()
+	l := q.locks[userID]
+	if l == nil {
+		l = &sync.Mutex{}
+		q.locks[userID] = l
+	}
+	q.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// ScheduleFirewallReconcile runs ReconcileFirewalls for the user in the
+// background, firewallDebounce from now unless one is already scheduled, and
+// logs its error. Handlers call it after every change to deployments,
+// resources, links or rules.
+func (d *Deployer) ScheduleFirewallReconcile(userID string) {
+	q := firewallReconciles
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[userID] {
+		return
+	}
+	q.pending[userID] = true
+	time.AfterFunc(firewallDebounce, func() {
+		// Changes made from here on schedule another reconcile, which
+		// waits for this one.
+		q.mu.Lock()
+		delete(q.pending, userID)
+		q.mu.Unlock()
+		if err := d.ReconcileFirewalls(userID); err != nil {
+			log.Printf("firewall: reconcile for user %s: %v", userID, err)
+		}
+	})
+}
+
+// RemoveFirewall deletes the managed ruleset from a node.
+func RemoveFirewall(runner sshexec.Runner) error {
+	_, err := runner.Run(sshexec.FirewallRemoveCmd())
+	return err
+}
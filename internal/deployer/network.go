@@ -0,0 +1,86 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// UserNetwork returns the private Docker network that a user's services and
+// managed resources share on every node. Containers on it reach each other by
+// container name, so same-node links need no published host ports.
+func UserNetwork(userID string) string {
+	id := userID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "localisprod-u-" + id
+}
+
+// AttachUserNetwork creates the user's network on the node if needed and adds
+// it to cfg: as the primary network when cfg has none, otherwise as an extra
+// network connected after the container starts.
+func AttachUserNetwork(runner sshexec.Runner, cfg *sshexec.RunConfig, userID string) error {
+	network := UserNetwork(userID)
+	if output, err := runner.Run(sshexec.DockerNetworkCreateCmd(network)); err != nil {
+		return fmt.Errorf("create network %s: %w: %s", network, err, output)
+	}
+	if cfg.Network == "" {
+		cfg.Network = network
+	} else {
+		cfg.Networks = append(cfg.Networks, network)
+	}
+	return nil
+}
+
+// AttachServiceNetwork attaches a service container to the user network like
+// AttachUserNetwork and also connects the containers of the service's linked
+// resources on the same node, so container-name URLs from ServiceEnv resolve
+// even for resources started before they were put on the network.
+func (d *Deployer) AttachServiceNetwork(runner sshexec.Runner, cfg *sshexec.RunConfig, svc *models.Service, userID, nodeID string) error {
+	if err := AttachUserNetwork(runner, cfg, userID); err != nil {
+		return err
+	}
+	network := UserNetwork(userID)
+	for _, name := range d.sameNodeContainers(svc, userID, nodeID) {
+		_, _ = runner.Run(sshexec.DockerNetworkConnectCmd(network, name))
+	}
+	return nil
+}
+
+// sameNodeContainers returns the container names of the service's linked
+// resources that run on nodeID.
+func (d *Deployer) sameNodeContainers(svc *models.Service, userID, nodeID string) []string {
+	var names []string
+	var ids []string
+	_ = json.Unmarshal([]byte(svc.Databases), &ids)
+	for _, id := range ids {
+		if db, err := d.store.GetDatabase(id, userID); err == nil && db != nil && db.NodeID == nodeID {
+			names = append(names, db.ContainerName)
+		}
+	}
+	ids = nil
+	_ = json.Unmarshal([]byte(svc.Caches), &ids)
+	for _, id := range ids {
+		if c, err := d.store.GetCache(id, userID); err == nil && c != nil && c.NodeID == nodeID {
+			names = append(names, c.ContainerName)
+		}
+	}
+	ids = nil
+	_ = json.Unmarshal([]byte(svc.Kafkas), &ids)
+	for _, id := range ids {
+		if k, err := d.store.GetKafka(id, userID); err == nil && k != nil && k.NodeID == nodeID {
+			names = append(names, k.ContainerName)
+		}
+	}
+	ids = nil
+	_ = json.Unmarshal([]byte(svc.Monitorings), &ids)
+	for _, id := range ids {
+		if m, err := d.store.GetMonitoring(id, userID); err == nil && m != nil && m.NodeID == nodeID {
+			names = append(names, m.PrometheusContainerName, m.GrafanaContainerName)
+		}
+	}
+	return names
+}
@@ -0,0 +1,164 @@
+package deployer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// DatabaseType describes how a managed database type is run.
+type DatabaseType struct {
+	DefaultVersion string
+	DefaultPort    int
+	Image          string
+	MountPath      string
+}
+
+// DatabaseTypes lists the supported managed database types.
+var DatabaseTypes = map[string]DatabaseType{
+	"postgres": {"16", 5432, "postgres", "/var/lib/postgresql/data"},
+	"redis":    {"7", 6379, "redis", "/data"},
+}
+
+// SafeName replaces spaces so a resource name can be used in container and
+// volume names.
+func SafeName(name string) string {
+	return strings.ReplaceAll(name, " ", "-")
+}
+
+// DatabaseVolumeName returns the named volume holding a database's data.
+func DatabaseVolumeName(name string) string {
+	return fmt.Sprintf("localisprod-%s-data", SafeName(name))
+}
+
+// DatabaseRunConfig returns the run configuration and container env vars for a
+// managed database.
+func DatabaseRunConfig(db *models.Database) (sshexec.RunConfig, map[string]string) {
+	t := DatabaseTypes[db.Type]
+	cfg := sshexec.RunConfig{
+		ContainerName: db.ContainerName,
+		Image:         fmt.Sprintf("%s:%s", t.Image, db.Version),
+		Ports:         []string{fmt.Sprintf("%d:%d", db.Port, t.DefaultPort)},
+		Volumes:       []string{fmt.Sprintf("%s:%s", DatabaseVolumeName(db.Name), t.MountPath)},
+		Restart:       "unless-stopped",
+	}
+	// Redis password is set via command, not env var
+	if db.Type == "redis" && db.Password != "" {
+		cfg.Command = fmt.Sprintf("redis-server --requirepass %s", sshexec.ShellEscape(db.Password))
+	}
+	return cfg, databaseContainerEnv(db.Type, db.DBName, db.DBUser, db.Password)
+}
+
+func databaseContainerEnv(dbType, dbname, dbuser, password string) map[string]string {
+	switch dbType {
+	case "postgres":
+		return map[string]string{
+			"POSTGRES_DB":       dbname,
+			"POSTGRES_USER":     dbuser,
+			"POSTGRES_PASSWORD": password,
+		}
+	}
+	return nil // redis: password set via command
+}
+
+// CacheRunConfig returns the run configuration for a managed Redis cache.
+func CacheRunConfig(c *models.Cache) sshexec.RunConfig {
+	var volumes []string
+	_ = json.Unmarshal([]byte(c.Volumes), &volumes)
+	return sshexec.RunConfig{
+		ContainerName: c.ContainerName,
+		Image:         fmt.Sprintf("redis:%s", c.Version),
+		Ports:         []string{fmt.Sprintf("%d:6379", c.Port)},
+		Volumes:       volumes,
+		Restart:       "unless-stopped",
+		Command:       fmt.Sprintf("redis-server --requirepass %s", sshexec.ShellEscape(c.Password)),
+	}
+}
+
+// KafkaVolumeName returns the named volume holding a Kafka cluster's data.
+func KafkaVolumeName(name string) string {
+	return fmt.Sprintf("localisprod-kafka-%s-data", SafeName(name))
+}
+
+// KafkaInternalPort is the broker's INTERNAL listener, advertised under the
+// container name for clients on the same Docker network. It is not published.
+const KafkaInternalPort = 19092
+
+// KafkaRunConfig returns the run configuration and env vars for a single-node
+// Kafka cluster using apache/kafka in KRaft mode (no ZooKeeper). advertisedHost
+// is the address clients on other nodes use to reach the broker.
+func KafkaRunConfig(k *models.Kafka, advertisedHost string) (sshexec.RunConfig, map[string]string) {
+	cfg := sshexec.RunConfig{
+		ContainerName: k.ContainerName,
+		Image:         fmt.Sprintf("apache/kafka:%s", k.Version),
+		Ports:         []string{fmt.Sprintf("%d:9092", k.Port)},
+		Volumes:       []string{fmt.Sprintf("%s:/var/lib/kafka/data", KafkaVolumeName(k.Name))},
+		Restart:       "unless-stopped",
+	}
+	env := map[string]string{
+		"KAFKA_NODE_ID":                                  "1",
+		"KAFKA_PROCESS_ROLES":                            "broker,controller",
+		"KAFKA_CONTROLLER_QUORUM_VOTERS":                 "1@localhost:9093",
+		"KAFKA_LISTENERS":                                fmt.Sprintf("PLAINTEXT://:9092,INTERNAL://:%d,CONTROLLER://:9093", KafkaInternalPort),
+		"KAFKA_ADVERTISED_LISTENERS":                     fmt.Sprintf("PLAINTEXT://%s:%d,INTERNAL://%s:%d", advertisedHost, k.Port, k.ContainerName, KafkaInternalPort),
+		"KAFKA_CONTROLLER_LISTENER_NAMES":                "CONTROLLER",
+		"KAFKA_LISTENER_SECURITY_PROTOCOL_MAP":           "CONTROLLER:PLAINTEXT,PLAINTEXT:PLAINTEXT,INTERNAL:PLAINTEXT",
+		"KAFKA_OFFSETS_TOPIC_REPLICATION_FACTOR":         "1",
+		"KAFKA_TRANSACTION_STATE_LOG_REPLICATION_FACTOR": "1",
+		"KAFKA_TRANSACTION_STATE_LOG_MIN_ISR":            "1",
+	}
+	return cfg, env
+}
+
+// MonitoringPaths holds the node-side names derived for a monitoring stack.
+type MonitoringPaths struct {
+	Network       string
+	PromVolume    string
+	GrafanaVolume string
+	BaseDir       string
+}
+
+// MonitoringPathsFor derives the network, volume and config directory names of
+// a monitoring stack from its Prometheus container name.
+func MonitoringPathsFor(m *models.Monitoring) MonitoringPaths {
+	suffix := strings.TrimPrefix(m.PrometheusContainerName, "localisprod-prometheus-")
+	return MonitoringPaths{
+		Network:       fmt.Sprintf("localisprod-monitoring-%s-net", suffix),
+		PromVolume:    fmt.Sprintf("localisprod-prom-%s-data", suffix),
+		GrafanaVolume: fmt.Sprintf("localisprod-grafana-%s-data", suffix),
+		BaseDir:       "/opt/localisprod/monitoring/" + suffix,
+	}
+}
+
+// MonitoringRunConfigs returns the Prometheus and Grafana run configurations
+// and the Grafana env vars for a monitoring stack.
+func MonitoringRunConfigs(m *models.Monitoring) (prom, grafana sshexec.RunConfig, grafanaEnv map[string]string) {
+	p := MonitoringPathsFor(m)
+	prom = sshexec.RunConfig{
+		ContainerName: m.PrometheusContainerName,
+		Image:         "prom/prometheus:latest",
+		Ports:         []string{fmt.Sprintf("%d:9090", m.PrometheusPort)},
+		Volumes: []string{
+			fmt.Sprintf("%s:/prometheus", p.PromVolume),
+			fmt.Sprintf("%s/prometheus.yml:/etc/prometheus/prometheus.yml:ro", p.BaseDir),
+		},
+		Network: p.Network,
+		Restart: "unless-stopped",
+	}
+	grafana = sshexec.RunConfig{
+		ContainerName: m.GrafanaContainerName,
+		Image:         "grafana/grafana:latest",
+		Ports:         []string{fmt.Sprintf("%d:3000", m.GrafanaPort)},
+		Volumes: []string{
+			fmt.Sprintf("%s:/var/lib/grafana", p.GrafanaVolume),
+			fmt.Sprintf("%s/grafana-provisioning:/etc/grafana/provisioning:ro", p.BaseDir),
+		},
+		Network: p.Network,
+		Restart: "unless-stopped",
+	}
+	grafanaEnv = map[string]string{"GF_SECURITY_ADMIN_PASSWORD": m.GrafanaPassword}
+	return prom, grafana, grafanaEnv
+}
@@ -0,0 +1,113 @@
+package deployer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+// DBEnvVarName derives the env var name from a database name.
+// e.g. "my-db" → "MY_DB_URL"
+func DBEnvVarName(dbName string) string {
+	upper := strings.ToUpper(dbName)
+	cleaned := strings.NewReplacer("-", "_", " ", "_", ".", "_").Replace(upper)
+	return cleaned + "_URL"
+}
+
+// DBConnectionURL builds the connection URL for an application to use.
+func DBConnectionURL(db *models.Database) string {
+	switch db.Type {
+	case "postgres":
+		return fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
+			db.DBUser, db.Password, db.NodeHost, db.Port, db.DBName)
+	case "redis":
+		return fmt.Sprintf("redis://:%s@%s:%d", db.Password, db.NodeHost, db.Port)
+	}
+	return ""
+}
+
+// CacheEnvVarName derives the env var name from a cache name.
+// e.g. "my-cache" → "MY_CACHE_URL"
+func CacheEnvVarName(name string) string {
+	return DBEnvVarName(name)
+}
+
+// CacheConnectionURL builds the Redis connection URL.
+func CacheConnectionURL(c *models.Cache) string {
+	return fmt.Sprintf("redis://:%s@%s:%d", c.Password, c.NodeHost, c.Port)
+}
+
+// KafkaEnvVarName derives the env var name from a Kafka cluster name.
+// e.g. "my-kafka" → "MY_KAFKA_URL"
+func KafkaEnvVarName(name string) string {
+	return DBEnvVarName(name)
+}
+
+// KafkaConnectionURL returns the bootstrap server address for the Kafka cluster.
+func KafkaConnectionURL(k *models.Kafka) string {
+	return fmt.Sprintf("%s:%d", k.NodeHost, k.Port)
+}
+
+// MonitoringPrometheusEnvVarName derives the env var name for the Prometheus URL.
+// e.g. "my-monitor" → "MY_MONITOR_PROMETHEUS_URL"
+func MonitoringPrometheusEnvVarName(name string) string {
+	upper := strings.ToUpper(name)
+	cleaned := strings.NewReplacer("-", "_", " ", "_", ".", "_").Replace(upper)
+	return cleaned + "_PROMETHEUS_URL"
+}
+
+// MonitoringGrafanaEnvVarName derives the env var name for the Grafana URL.
+// e.g. "my-monitor" → "MY_MONITOR_GRAFANA_URL"
+func MonitoringGrafanaEnvVarName(name string) string {
+	upper := strings.ToUpper(name)
+	cleaned := strings.NewReplacer("-", "_", " ", "_", ".", "_").Replace(upper)
+	return cleaned + "_GRAFANA_URL"
+}
+
+// MonitoringPrometheusURL returns the HTTP URL for the Prometheus HTTP API.
+func MonitoringPrometheusURL(m *models.Monitoring) string {
+	return fmt.Sprintf("http://%s:%d", m.NodeHost, m.PrometheusPort)
+}
+
+// MonitoringGrafanaURL returns the HTTP URL for the Grafana UI.
+func MonitoringGrafanaURL(m *models.Monitoring) string {
+	return fmt.Sprintf("http://%s:%d", m.NodeHost, m.GrafanaPort)
+}
+
+// DBInternalURL builds the connection URL for a service on the same node,
+// which reaches the database by container name over the user network.
+func DBInternalURL(db *models.Database) string {
+	port := DatabaseTypes[db.Type].DefaultPort
+	switch db.Type {
+	case "postgres":
+		return fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
+			db.DBUser, db.Password, db.ContainerName, port, db.DBName)
+	case "redis":
+		return fmt.Sprintf("redis://:%s@%s:%d", db.Password, db.ContainerName, port)
+	}
+	return ""
+}
+
+// CacheInternalURL builds the Redis URL for a service on the same node.
+func CacheInternalURL(c *models.Cache) string {
+	return fmt.Sprintf("redis://:%s@%s:6379", c.Password, c.ContainerName)
+}
+
+// KafkaInternalURL returns the bootstrap address of the broker's INTERNAL
+// listener for a service on the same node.
+func KafkaInternalURL(k *models.Kafka) string {
+	return fmt.Sprintf("%s:%d", k.ContainerName, KafkaInternalPort)
+}
+
+// MonitoringPrometheusInternalURL returns the Prometheus URL for a service on
+// the same node.
+func MonitoringPrometheusInternalURL(m *models.Monitoring) string {
+	return fmt.Sprintf("http://%s:9090", m.PrometheusContainerName)
+}
+
+// MonitoringGrafanaInternalURL returns the Grafana URL for a service on the
+// same node.
+func MonitoringGrafanaInternalURL(m *models.Monitoring) string {
+	return fmt.Sprintf("http://%s:3000", m.GrafanaContainerName)
+}
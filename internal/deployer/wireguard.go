@@ -0,0 +1,161 @@
+package deployer
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// WireGuardSubnet is the overlay network of a user's node mesh. Each user has
+// their own mesh, so the same addresses are reused across users.
+const WireGuardSubnet = "10.77.0.0/16"
+
+// GenerateWireGuardKey returns a new base64-encoded Curve25519 key pair.
+func GenerateWireGuardKey() (privateKey, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()),
+		base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// NextOverlayIP returns the lowest address in WireGuardSubnet not used by
+// peers, skipping .0 and .255 addresses. It returns "" when the subnet is full.
+func NextOverlayIP(peers []*models.WireGuardPeer) string {
+	used := map[string]bool{}
+	for _, p := range peers {
+		used[p.OverlayIP] = true
+	}
+	_, subnet, _ := net.ParseCIDR(WireGuardSubnet)
+	base := subnet.IP.To4()
+	for i := 1; i < 1<<16; i++ {
+		ip := net.IPv4(base[0], base[1], byte(i>>8), byte(i))
+		if byte(i) == 0 || byte(i) == 255 {
+			continue
+		}
+		if !used[ip.String()] {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// ConfigureWireGuard installs WireGuard on self's node if needed and applies a
+// config with every other peer in peers.
+func ConfigureWireGuard(runner sshexec.Runner, self *models.WireGuardPeer, peers []*models.WireGuardPeer) error {
+	if output, err := runner.Run(sshexec.WireGuardInstallCmd()); err != nil {
+		return fmt.Errorf("install wireguard: %w: %s", err, output)
+	}
+	var others []sshexec.WireGuardPeerConfig
+	for _, p := range peers {
+		if p.NodeID == self.NodeID {
+			continue
+		}
+		others = append(others, sshexec.WireGuardPeerConfig{
+			PublicKey: p.PublicKey,
+			Endpoint:  net.JoinHostPort(p.NodeHost, fmt.Sprint(sshexec.WireGuardPort)),
+			OverlayIP: p.OverlayIP,
+		})
+	}
+	_, subnet, _ := net.ParseCIDR(WireGuardSubnet)
+	ones, _ := subnet.Mask.Size()
+	address := fmt.Sprintf("%s/%d", self.OverlayIP, ones)
+	if err := runner.WriteFile(sshexec.WireGuardConfigPath, sshexec.WireGuardConfig(address, self.PrivateKey, others)); err != nil {
+		return fmt.Errorf("write wireguard config: %w", err)
+	}
+	if output, err := runner.Run(sshexec.WireGuardApplyCmd()); err != nil {
+		return fmt.Errorf("apply wireguard config: %w: %s", err, output)
+	}
+	return nil
+}
+
+// JoinMesh adds node to the user's WireGuard mesh, generating its key pair and
+// overlay IP on first join, and pushes updated peer configs to every node in
+// the mesh. Joining again only re-pushes the configs.
+func (d *Deployer) JoinMesh(node *models.Node, userID string) (*models.WireGuardPeer, error) {
+	p, err := d.store.GetWireGuardPeer(node.ID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		peers, err := d.store.ListWireGuardPeers(userID)
+		if err != nil {
+			return nil, err
+		}
+		ip := NextOverlayIP(peers)
+		if ip == "" {
+			return nil, errors.New("no overlay addresses left")
+		}
+		privateKey, publicKey, err := GenerateWireGuardKey()
+		if err != nil {
+			return nil, fmt.Errorf("generate key: %w", err)
+		}
+		p = &models.WireGuardPeer{
+			NodeID:     node.ID,
+			OverlayIP:  ip,
+			PublicKey:  publicKey,
+			PrivateKey: privateKey,
+			CreatedAt:  time.Now().UTC(),
+			NodeName:   node.Name,
+			NodeHost:   node.Host,
+		}
+		if err := d.store.CreateWireGuardPeer(p, userID); err != nil {
+			return nil, err
+		}
+	}
+	return p, d.SyncMesh(userID)
+}
+
+// LeaveMesh takes the mesh interface down on node (best effort, the node may
+// already be gone), forgets its membership and pushes updated peer configs to
+// the remaining nodes.
+func (d *Deployer) LeaveMesh(node *models.Node, userID string) error {
+	_, _ = sshexec.NewRunner(node).Run(sshexec.WireGuardRemoveCmd())
+	if err := d.store.DeleteWireGuardPeer(node.ID, userID); err != nil {
+		return err
+	}
+	return d.SyncMesh(userID)
+}
+
+// SyncMesh pushes the current peer list to every node in the user's mesh. A
+// node that cannot be configured does not stop the others; all failures are
+// returned together.
+func (d *Deployer) SyncMesh(userID string) error {
+	peers, err := d.store.ListWireGuardPeers(userID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, p := range peers {
+		node, err := d.store.GetNode(p.NodeID, userID)
+		if err != nil || node == nil {
+			errs = append(errs, fmt.Errorf("node %s: not found", p.NodeName))
+			continue
+		}
+		if err := ConfigureWireGuard(sshexec.NewRunner(node), p, peers); err != nil {
+			errs = append(errs, fmt.Errorf("node %s: %w", p.NodeName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// meshAddrs maps the IDs of the user's mesh nodes to their overlay IPs.
+func (d *Deployer) meshAddrs(userID string) map[string]string {
+	addrs := map[string]string{}
+	peers, err := d.store.ListWireGuardPeers(userID)
+	if err != nil {
+		return addrs
+	}
+	for _, p := range peers {
+		addrs[p.NodeID] = p.OverlayIP
+	}
+	return addrs
+}
@@ -0,0 +1,75 @@
+// Package events is an in-process bus for container events. The poller
+// publishes what the docker events streams of nodes report; API clients
+// subscribe to follow status changes as they happen.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a container event on a node, with the resource the container
+// belongs to when it is a known one.
+type Event struct {
+	UserID       string    `json:"-"`
+	NodeID       string    `json:"node_id"`
+	Container    string    `json:"container"`
+	Action       string    `json:"action"` // start, die, oom or health_status
+	Health       string    `json:"health,omitempty"`
+	ExitCode     string    `json:"exit_code,omitempty"`
+	ResourceType string    `json:"resource_type,omitempty"` // models.HealResource*
+	ResourceID   string    `json:"resource_id,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it.
+const subscriberBuffer = 64
+
+// Bus fans events out to subscribers. Publish never blocks.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: map[chan Event]struct{}{}}
+}
+
+// Publish sends e to every subscriber that has room for it.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of published events and a function that ends
+// the subscription and closes the channel.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+var defaultBus = NewBus()
+
+// Publish publishes e on the process-wide bus.
+func Publish(e Event) { defaultBus.Publish(e) }
+
+// Subscribe subscribes to the process-wide bus.
+func Subscribe() (<-chan Event, func()) { return defaultBus.Subscribe() }
@@ -0,0 +1,41 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/events"
+)
+
+func TestBus_FanOut(t *testing.T) {
+	b := events.NewBus()
+	a, cancelA := b.Subscribe()
+	c, cancelC := b.Subscribe()
+	defer cancelC()
+
+	b.Publish(events.Event{Container: "web", Action: "die"})
+	if e := <-a; e.Container != "web" || e.Action != "die" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if e := <-c; e.Container != "web" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	cancelA()
+	cancelA()
+	if _, ok := <-a; ok {
+		t.Error("expected channel closed after cancel")
+	}
+	b.Publish(events.Event{Container: "db"}) // must not panic on the closed subscriber
+	if e := <-c; e.Container != "db" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestBus_SlowSubscriberDoesNotBlock(t *testing.T) {
+	b := events.NewBus()
+	_, cancel := b.Subscribe()
+	defer cancel()
+	for i := 0; i < 1000; i++ {
+		b.Publish(events.Event{Action: "start"})
+	}
+}
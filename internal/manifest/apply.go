@@ -0,0 +1,232 @@
+package manifest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// Caller sends one API request, e.g. ("POST", "/databases", body), and
+// returns the decoded response. It returns an error for error responses and
+// for successful ones that report a failure, such as a container that did
+// not start.
+type Caller func(method, path string, body any) (map[string]any, error)
+
+// Apply carries out the changes of p, which Diff computed from m and st, in
+// order through call, setting the status of each. Changes already marked
+// skipped, such as deletes without prune, are left out. It stops at the first
+// change that fails, since later ones may depend on it, and marks the rest
+// skipped. Apply is not transactional: the changes before the failed one stay
+// applied and are not rolled back, so the statuses are the record of what was
+// done, and applying the manifest again plans only what is left.
+func Apply(m *Manifest, st *State, p *Plan, call Caller) error {
+	if len(p.Errors) > 0 {
+		return fmt.Errorf("plan has errors")
+	}
+	a := &applier{m: m, call: call, ids: map[string]map[string]string{}}
+	a.index(st)
+	var failed error
+	for _, c := range p.Changes {
+		if c.Status == StatusSkipped {
+			continue
+		}
+		if failed != nil {
+			c.Status = StatusSkipped
+			continue
+		}
+		if err := a.apply(c); err != nil {
+			c.Status = StatusFailed
+			c.Error = err.Error()
+			failed = fmt.Errorf("%s %s %s: %w", c.Action, c.Kind, c.Name, err)
+			continue
+		}
+		c.Status = StatusApplied
+	}
+	return failed
+}
+
+type applier struct {
+	m    *Manifest
+	call Caller
+	ids  map[string]map[string]string // kind -> name -> ID
+}
+
+func (a *applier) index(st *State) {
+	add := func(kind, name, id string) {
+		if a.ids[kind] == nil {
+			a.ids[kind] = map[string]string{}
+		}
+		if _, ok := a.ids[kind][name]; !ok {
+			a.ids[kind][name] = id
+		}
+	}
+	for _, x := range st.Nodes {
+		add(KindNode, x.Name, x.ID)
+	}
+	for _, x := range st.Services {
+		add(KindService, x.Name, x.ID)
+	}
+	for _, x := range st.Databases {
+		add(KindDatabase, x.Name, x.ID)
+	}
+	for _, x := range st.Caches {
+		add(KindCache, x.Name, x.ID)
+	}
+	for _, x := range st.Kafkas {
+		add(KindKafka, x.Name, x.ID)
+	}
+	for _, x := range st.Monitorings {
+		add(KindMonitoring, x.Name, x.ID)
+	}
+	for _, x := range st.ObjectStorages {
+		add(KindObjectStorage, x.Name, x.ID)
+	}
+}
+
+func (a *applier) apply(c *Change) error {
+	path := apiPaths[c.Kind]
+	switch {
+	case c.Action == ActionDelete:
+		_, err := a.call(http.MethodDelete, path+"/"+c.ID, nil)
+		return err
+	case c.Kind == KindDeployment && c.Action == ActionCreate:
+		return a.create(c, map[string]any{
+			"service_id": a.ids[KindService][c.service],
+			"node_id":    a.ids[KindNode][c.node],
+		})
+	case c.Kind == KindDeployment:
+		_, err := a.call(http.MethodPost, path+"/"+c.ID+"/redeploy", nil)
+		return err
+	case c.Kind == KindService:
+		body, err := a.serviceBody(c.Name)
+		if err != nil {
+			return err
+		}
+		if c.Action == ActionUpdate {
+			_, err = a.call(http.MethodPut, path+"/"+c.ID, body)
+			return err
+		}
+		return a.create(c, body)
+	case c.Action == ActionUpdate:
+		// Heal policies are the only managed-resource fields Diff updates.
+		_, err := a.call(http.MethodPut, path+"/"+c.ID+"/heal-policy", map[string]string{"heal_policy": c.healPolicy})
+		return err
+	}
+	body, err := a.resourceBody(c)
+	if err != nil {
+		return err
+	}
+	return a.create(c, body)
+}
+
+// create posts body to the collection of c and records the new ID, so later
+// changes can refer to the resource by name.
+func (a *applier) create(c *Change, body map[string]any) error {
+	resp, err := a.call(http.MethodPost, apiPaths[c.Kind], body)
+	if err != nil {
+		return err
+	}
+	id, _ := resp["id"].(string)
+	if id == "" {
+		return fmt.Errorf("response has no id")
+	}
+	if a.ids[c.Kind] == nil {
+		a.ids[c.Kind] = map[string]string{}
+	}
+	a.ids[c.Kind][c.Name] = id
+	return nil
+}
+
+func (a *applier) serviceBody(name string) (map[string]any, error) {
+	for i := range a.m.Services {
+		s := &a.m.Services[i]
+		if s.Name != name {
+			continue
+		}
+		body := map[string]any{
+			"name":            s.Name,
+			"docker_image":    s.DockerImage,
+			"dockerfile_path": s.DockerfilePath,
+			"env_vars":        s.EnvVars,
+			"ports":           s.Ports,
+			"volumes":         s.Volumes,
+			"command":         s.Command,
+			"routes":          s.routes(),
+		}
+		for _, l := range s.links() {
+			ids := []string{}
+			for _, ref := range l.names {
+				id, ok := a.ids[l.kind][ref]
+				if !ok {
+					return nil, fmt.Errorf("%s %s does not exist", l.kind, ref)
+				}
+				ids = append(ids, id)
+			}
+			body[l.field] = ids
+		}
+		return body, nil
+	}
+	return nil, fmt.Errorf("not in the manifest")
+}
+
+// resourceBody returns the create request of a managed resource.
+func (a *applier) resourceBody(c *Change) (map[string]any, error) {
+	var body map[string]any
+	var node string
+	switch c.Kind {
+	case KindDatabase:
+		for _, x := range a.m.Databases {
+			if x.Name == c.Name {
+				node = x.Node
+				body = map[string]any{"name": x.Name, "type": x.Type, "version": x.Version, "dbname": x.DBName, "db_user": x.DBUser,
+					"password": orGenerated(x.Password), "port": x.Port, "heal_policy": x.HealPolicy}
+			}
+		}
+	case KindCache:
+		for _, x := range a.m.Caches {
+			if x.Name == c.Name {
+				node = x.Node
+				body = map[string]any{"name": x.Name, "version": x.Version, "password": orGenerated(x.Password), "port": x.Port,
+					"volumes": x.Volumes, "heal_policy": x.HealPolicy}
+			}
+		}
+	case KindKafka:
+		for _, x := range a.m.Kafkas {
+			if x.Name == c.Name {
+				node = x.Node
+				body = map[string]any{"name": x.Name, "version": x.Version, "port": x.Port, "heal_policy": x.HealPolicy}
+			}
+		}
+	case KindMonitoring:
+		for _, x := range a.m.Monitorings {
+			if x.Name == c.Name {
+				node = x.Node
+				body = map[string]any{"name": x.Name, "prometheus_port": x.PrometheusPort, "grafana_port": x.GrafanaPort,
+					"grafana_password": orGenerated(x.GrafanaPassword), "heal_policy": x.HealPolicy}
+			}
+		}
+	case KindObjectStorage:
+		for _, x := range a.m.ObjectStorages {
+			if x.Name == c.Name {
+				node = x.Node
+				body = map[string]any{"name": x.Name, "s3_port": x.S3Port, "version": x.Version}
+			}
+		}
+	}
+	if body == nil {
+		return nil, fmt.Errorf("not in the manifest")
+	}
+	body["node_id"] = a.ids[KindNode][node]
+	return body, nil
+}
+
+// orGenerated returns password, or a random one when it is empty.
+func orGenerated(password string) string {
+	if password != "" {
+		return password
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
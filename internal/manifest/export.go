@@ -0,0 +1,176 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Masked replaces the value of a secret env var in a masked export. It has to
+// be filled in before the manifest is applied.
+const Masked = "[masked]"
+
+// secretEnvKeys are substrings of env var names whose values Mask replaces.
+var secretEnvKeys = []string{"PASSWORD", "PASSPHRASE", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "AUTH"}
+
+// IsSecretEnv reports whether the env var named key holds a secret.
+func IsSecretEnv(key string) bool {
+	key = strings.ToUpper(key)
+	for _, s := range secretEnvKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// FromState returns the manifest that describes st, so applying it to the
+// same workspace plans no changes. Passwords of managed resources are
+// included as stored.
+func FromState(st *State) *Manifest {
+	m := &Manifest{}
+	nodeName := map[string]string{}
+	for _, n := range st.Nodes {
+		nodeName[n.ID] = n.Name
+	}
+	used := map[string]bool{} // node names
+	node := func(id string) string {
+		name := nodeName[id]
+		used[name] = true
+		return name
+	}
+
+	linkNames := map[string]map[string]string{
+		KindDatabase: {}, KindCache: {}, KindKafka: {}, KindMonitoring: {},
+	}
+	for _, x := range st.Databases {
+		linkNames[KindDatabase][x.ID] = x.Name
+		m.Databases = append(m.Databases, Database{Name: x.Name, Type: x.Type, Version: x.Version, Node: node(x.NodeID),
+			DBName: x.DBName, DBUser: x.DBUser, Password: x.Password, Port: x.Port, HealPolicy: x.HealPolicy})
+	}
+	for _, x := range st.Caches {
+		linkNames[KindCache][x.ID] = x.Name
+		m.Caches = append(m.Caches, Cache{Name: x.Name, Version: x.Version, Node: node(x.NodeID), Password: x.Password,
+			Port: x.Port, Volumes: decodeList(x.Volumes), HealPolicy: x.HealPolicy})
+	}
+	for _, x := range st.Kafkas {
+		linkNames[KindKafka][x.ID] = x.Name
+		m.Kafkas = append(m.Kafkas, Kafka{Name: x.Name, Version: x.Version, Node: node(x.NodeID), Port: x.Port, HealPolicy: x.HealPolicy})
+	}
+	for _, x := range st.Monitorings {
+		linkNames[KindMonitoring][x.ID] = x.Name
+		m.Monitorings = append(m.Monitorings, Monitoring{Name: x.Name, Node: node(x.NodeID), PrometheusPort: x.PrometheusPort,
+			GrafanaPort: x.GrafanaPort, GrafanaPassword: x.GrafanaPassword, HealPolicy: x.HealPolicy})
+	}
+	for _, x := range st.ObjectStorages {
+		m.ObjectStorages = append(m.ObjectStorages, ObjectStorage{Name: x.Name, Node: node(x.NodeID), S3Port: x.S3Port, Version: x.Version})
+	}
+
+	deployedOn := map[string][]string{} // service ID -> node names
+	for _, d := range st.Deployments {
+		name := node(d.NodeID)
+		if !contains(deployedOn[d.ServiceID], name) {
+			deployedOn[d.ServiceID] = append(deployedOn[d.ServiceID], name)
+		}
+	}
+	for _, x := range st.Services {
+		s := Service{Name: x.Name, DockerImage: x.DockerImage, DockerfilePath: x.DockerfilePath, Command: x.Command,
+			Ports: decodeList(x.Ports), Volumes: decodeList(x.Volumes), Nodes: deployedOn[x.ID]}
+		sort.Strings(s.Nodes)
+		_ = json.Unmarshal([]byte(x.EnvVars), &s.EnvVars)
+		_ = json.Unmarshal([]byte(x.Routes), &s.Routes)
+		if len(s.Routes) == 1 && s.Routes[0] == (models.Route{Host: s.Routes[0].Host, Entrypoint: "web"}) {
+			s.Domain, s.Routes = s.Routes[0].Host, nil
+		}
+		s.Databases = linkedNames(x.Databases, linkNames[KindDatabase])
+		s.Caches = linkedNames(x.Caches, linkNames[KindCache])
+		s.Kafkas = linkedNames(x.Kafkas, linkNames[KindKafka])
+		s.Monitorings = linkedNames(x.Monitorings, linkNames[KindMonitoring])
+		m.Services = append(m.Services, s)
+	}
+
+	for _, n := range st.Nodes {
+		if used[n.Name] {
+			m.Nodes = append(m.Nodes, Node{Name: n.Name})
+			delete(used, n.Name)
+		}
+	}
+	return m
+}
+
+// Mask removes the secrets from m: passwords are cleared, so applying the
+// manifest generates new ones, and the values of secret env vars are
+// replaced with Masked.
+func (m *Manifest) Mask() {
+	for i := range m.Databases {
+		m.Databases[i].Password = ""
+	}
+	for i := range m.Caches {
+		m.Caches[i].Password = ""
+	}
+	for i := range m.Monitorings {
+		m.Monitorings[i].GrafanaPassword = ""
+	}
+	for i := range m.Services {
+		for k := range m.Services[i].EnvVars {
+			if IsSecretEnv(k) {
+				m.Services[i].EnvVars[k] = Masked
+			}
+		}
+	}
+}
+
+// Marshal encodes m as YAML with the field names and order of the API, as
+// Parse reads it.
+func (m *Manifest) Marshal() ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML; decoding it into a node keeps the field order, and
+	// resetting the styles turns it into block YAML.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	resetStyle(&doc)
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+func resetStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		resetStyle(c)
+	}
+}
+
+// linkedNames returns the names of the resources whose IDs the JSON list ids
+// holds, skipping resources that no longer exist.
+func linkedNames(ids string, names map[string]string) []string {
+	var out []string
+	for _, id := range decodeList(ids) {
+		if name, ok := names[id]; ok {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func contains(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+// Package manifest describes the resources of a workspace declaratively so
+// they can be kept in git: Diff compares a manifest with what exists and
+// returns a Plan of creates, updates and deletes, and Apply carries the plan
+// out through the API in dependency order.
+//
+// Resources are identified by name and refer to each other by name: a
+// service lists the databases, caches, Kafka clusters and monitoring stacks it
+// is linked to and the nodes it is deployed on, and every managed resource
+// names the node it runs on.
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest is the desired state of a workspace. Resources of the workspace
+// that it does not list are deleted when it is applied.
+type Manifest struct {
+	Nodes          []Node          `json:"nodes,omitempty"`
+	Services       []Service       `json:"services,omitempty"`
+	Databases      []Database      `json:"databases,omitempty"`
+	Caches         []Cache         `json:"caches,omitempty"`
+	Kafkas         []Kafka         `json:"kafkas,omitempty"`
+	Monitorings    []Monitoring    `json:"monitorings,omitempty"`
+	ObjectStorages []ObjectStorage `json:"object_storages,omitempty"`
+}
+
+// Node names a node resources are placed on. Nodes are registered with their
+// SSH credentials through the API; a manifest only requires that they exist.
+type Node struct {
+	Name string `json:"name"`
+}
+
+// Service is described in full: applying a manifest replaces the service's
+// configuration with it, and its deployments with one per listed node.
+type Service struct {
+	Name           string            `json:"name"`
+	DockerImage    string            `json:"docker_image"`
+	DockerfilePath string            `json:"dockerfile_path,omitempty"`
+	EnvVars        map[string]string `json:"env_vars,omitempty"`
+	Ports          []string          `json:"ports,omitempty"`
+	Volumes        []string          `json:"volumes,omitempty"`
+	Command        string            `json:"command,omitempty"`
+	Routes         []models.Route    `json:"routes,omitempty"`
+	Domain         string            `json:"domain,omitempty"` // shorthand for a single route
+	Databases      []string          `json:"databases,omitempty"`
+	Caches         []string          `json:"caches,omitempty"`
+	Kafkas         []string          `json:"kafkas,omitempty"`
+	Monitorings    []string          `json:"monitorings,omitempty"`
+	Nodes          []string          `json:"nodes,omitempty"` // deployed on
+}
+
+// Managed resources take the API's defaults for fields left empty, and empty
+// fields are not compared with what runs. Passwords are only used when the
+// resource is created; empty ones are generated.
+
+type Database struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Version    string `json:"version,omitempty"`
+	Node       string `json:"node"`
+	DBName     string `json:"dbname,omitempty"`
+	DBUser     string `json:"db_user,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	HealPolicy string `json:"heal_policy,omitempty"`
+}
+
+type Cache struct {
+	Name       string   `json:"name"`
+	Version    string   `json:"version,omitempty"`
+	Node       string   `json:"node"`
+	Password   string   `json:"password,omitempty"`
+	Port       int      `json:"port,omitempty"`
+	Volumes    []string `json:"volumes,omitempty"`
+	HealPolicy string   `json:"heal_policy,omitempty"`
+}
+
+type Kafka struct {
+	Name       string `json:"name"`
+	Version    string `json:"version,omitempty"`
+	Node       string `json:"node"`
+	Port       int    `json:"port,omitempty"`
+	HealPolicy string `json:"heal_policy,omitempty"`
+}
+
+type Monitoring struct {
+	Name            string `json:"name"`
+	Node            string `json:"node"`
+	PrometheusPort  int    `json:"prometheus_port,omitempty"`
+	GrafanaPort     int    `json:"grafana_port,omitempty"`
+	GrafanaPassword string `json:"grafana_password,omitempty"`
+	HealPolicy      string `json:"heal_policy,omitempty"`
+}
+
+type ObjectStorage struct {
+	Name    string `json:"name"`
+	Node    string `json:"node"`
+	S3Port  int    `json:"s3_port,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Parse reads a YAML or JSON manifest. Field names are those of the API,
+// e.g. docker_image or heal_policy; unknown fields are rejected so a typo
+// does not silently drop a setting.
+func Parse(data []byte) (*Manifest, error) {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	// Decode through JSON so the json tags, shared with models.Route, are the
+	// only field names.
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	m := &Manifest{}
+	if err := dec.Decode(m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Validate checks that names are set and unique per kind and that services
+// only link to resources the manifest describes.
+func (m *Manifest) Validate() error {
+	if len(m.Services)+len(m.Databases)+len(m.Caches)+len(m.Kafkas)+len(m.Monitorings)+len(m.ObjectStorages) == 0 {
+		// Applying an empty manifest would delete everything; that is never
+		// what a truncated file or a wrong path meant.
+		return fmt.Errorf("manifest describes no resources")
+	}
+	var errs []string
+	names := map[string]map[string]bool{}
+	check := func(kind, name, node string, needsNode bool) {
+		if names[kind] == nil {
+			names[kind] = map[string]bool{}
+		}
+		switch {
+		case strings.TrimSpace(name) == "":
+			errs = append(errs, kind+": name is required")
+		case names[kind][name]:
+			errs = append(errs, fmt.Sprintf("%s %s: listed twice", kind, name))
+		}
+		names[kind][name] = true
+		if needsNode && node == "" {
+			errs = append(errs, fmt.Sprintf("%s %s: node is required", kind, name))
+		}
+	}
+	for _, n := range m.Nodes {
+		check(KindNode, n.Name, "", false)
+	}
+	for _, d := range m.Databases {
+		check(KindDatabase, d.Name, d.Node, true)
+		if d.Type == "" {
+			errs = append(errs, fmt.Sprintf("database %s: type is required", d.Name))
+		}
+	}
+	for _, c := range m.Caches {
+		check(KindCache, c.Name, c.Node, true)
+	}
+	for _, k := range m.Kafkas {
+		check(KindKafka, k.Name, k.Node, true)
+	}
+	for _, mon := range m.Monitorings {
+		check(KindMonitoring, mon.Name, mon.Node, true)
+	}
+	for _, o := range m.ObjectStorages {
+		check(KindObjectStorage, o.Name, o.Node, true)
+	}
+	for _, s := range m.Services {
+		check(KindService, s.Name, "", false)
+		if s.DockerImage == "" {
+			errs = append(errs, fmt.Sprintf("service %s: docker_image is required", s.Name))
+		}
+		for _, l := range s.links() {
+			for _, ref := range l.names {
+				if !names[l.kind][ref] {
+					errs = append(errs, fmt.Sprintf("service %s: links to %s %q, which the manifest does not describe", s.Name, l.kind, ref))
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid manifest: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// link is one kind of resource a service is linked to.
+type link struct {
+	kind  string
+	field string // of the service in the API
+	names []string
+}
+
+func (s *Service) links() []link {
+	return []link{
+		{KindDatabase, "databases", s.Databases},
+		{KindCache, "caches", s.Caches},
+		{KindKafka, "kafkas", s.Kafkas},
+		{KindMonitoring, "monitorings", s.Monitorings},
+	}
+}
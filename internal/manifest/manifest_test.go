@@ -0,0 +1,273 @@
+package manifest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+const testManifest = `
+nodes:
+  - name: worker-1
+databases:
+  - name: main
+    type: postgres
+    version: "16"
+    node: worker-1
+caches:
+  - name: sessions
+    node: worker-1
+    heal_policy: restart
+services:
+  - name: web
+    docker_image: nginx:1.27
+    ports: ["80:80"]
+    env_vars:
+      MODE: prod
+    domain: Example.com
+    databases: [main]
+    caches: [sessions]
+    nodes: [worker-1]
+`
+
+func testState() *State {
+	return &State{
+		Nodes: []*models.Node{{ID: "n1", Name: "worker-1"}},
+	}
+}
+
+func mustParse(t *testing.T, doc string) *Manifest {
+	t.Helper()
+	m, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return m
+}
+
+// summary renders a plan as "action kind name" lines.
+func summary(p *Plan) string {
+	var lines []string
+	for _, c := range p.Changes {
+		line := c.Action + " " + c.Kind + " " + c.Name
+		if len(c.Fields) > 0 {
+			line += " " + strings.Join(c.Fields, ",")
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestParse(t *testing.T) {
+	m := mustParse(t, testManifest)
+	if len(m.Services) != 1 || m.Services[0].EnvVars["MODE"] != "prod" || m.Databases[0].Version != "16" {
+		t.Errorf("unexpected manifest: %+v", m)
+	}
+
+	json := `{"services":[{"name":"api","docker_image":"api:1","routes":[{"host":"a.example.com","path_prefix":"/api"}]}]}`
+	m = mustParse(t, json)
+	if m.Services[0].Routes[0].PathPrefix != "/api" {
+		t.Errorf("routes not parsed from JSON: %+v", m.Services[0].Routes)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name, doc, want string
+	}{
+		{"empty", ``, "no resources"},
+		{"unknown field", "services:\n  - name: web\n    image: nginx\n", "unknown field"},
+		{"duplicate", "caches:\n  - {name: c, node: n}\n  - {name: c, node: n}\n", "listed twice"},
+		{"no node", "kafkas:\n  - name: k\n", "node is required"},
+		{"dangling link", "services:\n  - {name: web, docker_image: nginx, databases: [main]}\n", `database "main"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.doc))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiff_CreatesInDependencyOrder(t *testing.T) {
+	p := Diff(mustParse(t, testManifest), testState())
+	if len(p.Errors) > 0 {
+		t.Fatalf("errors: %v", p.Errors)
+	}
+	want := "create database main\ncreate cache sessions\ncreate service web\ncreate deployment web@worker-1"
+	if got := summary(p); got != want {
+		t.Errorf("plan:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDiff_NoChanges(t *testing.T) {
+	st := testState()
+	st.Databases = []*models.Database{{ID: "db1", Name: "main", Type: "postgres", Version: "16", NodeID: "n1", DBName: "main", Port: 5432, HealPolicy: "observe"}}
+	st.Caches = []*models.Cache{{ID: "c1", Name: "sessions", Version: "7", NodeID: "n1", Port: 6379, Volumes: "[]", HealPolicy: "restart"}}
+	st.Services = []*models.Service{{ID: "s1", Name: "web", DockerImage: "nginx:1.27", EnvVars: `{"MODE":"prod"}`, Ports: `["80:80"]`, Volumes: `[]`,
+		Routes: `[{"host":"example.com","entrypoint":"web"}]`, Databases: `["db1"]`, Caches: `["c1"]`, Kafkas: `[]`, Monitorings: `[]`}}
+	st.Deployments = []*models.Deployment{{ID: "d1", ServiceID: "s1", NodeID: "n1"}}
+
+	p := Diff(mustParse(t, testManifest), st)
+	if len(p.Errors) > 0 || len(p.Changes) > 0 {
+		t.Errorf("expected an empty plan, got errors %v and\n%s", p.Errors, summary(p))
+	}
+
+	// A new image updates the service and redeploys it; a dropped resource is
+	// deleted after everything else.
+	st.Services[0].DockerImage = "nginx:1.26"
+	st.Kafkas = []*models.Kafka{{ID: "k1", Name: "events", NodeID: "n1"}}
+	p = Diff(mustParse(t, testManifest), st)
+	want := "update service web docker_image\nupdate deployment web@worker-1 docker_image\ndelete kafka events"
+	if got := summary(p); got != want {
+		t.Errorf("plan:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDiff_DeletesDeploymentsBeforeServices(t *testing.T) {
+	st := testState()
+	st.Nodes = append(st.Nodes, &models.Node{ID: "n2", Name: "worker-2"})
+	st.Services = []*models.Service{
+		{ID: "s1", Name: "web", DockerImage: "nginx:1.27", EnvVars: `{"MODE":"prod"}`, Ports: `["80:80"]`, Routes: `[{"host":"example.com","entrypoint":"web"}]`, Databases: `["db1"]`, Caches: `["c1"]`},
+		{ID: "s2", Name: "old", DockerImage: "old:1"},
+	}
+	st.Databases = []*models.Database{{ID: "db1", Name: "main", Type: "postgres", Version: "16", NodeID: "n1"}}
+	st.Caches = []*models.Cache{{ID: "c1", Name: "sessions", NodeID: "n1", HealPolicy: "observe"}}
+	st.Deployments = []*models.Deployment{
+		{ID: "d1", ServiceID: "s1", NodeID: "n1"},
+		{ID: "d2", ServiceID: "s1", NodeID: "n2"},
+		{ID: "d3", ServiceID: "s2", NodeID: "n1"},
+	}
+	p := Diff(mustParse(t, testManifest), st)
+	want := "update cache sessions heal_policy\ndelete deployment web@worker-2\ndelete deployment old@worker-1\ndelete service old"
+	if got := summary(p); got != want {
+		t.Errorf("plan:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDiff_Errors(t *testing.T) {
+	st := testState()
+	st.Databases = []*models.Database{{ID: "db1", Name: "main", Type: "postgres", Version: "15", NodeID: "n1"}}
+	m := mustParse(t, testManifest)
+	m.Services[0].Nodes = []string{"worker-9"}
+
+	p := Diff(m, st)
+	joined := strings.Join(p.Errors, "\n")
+	for _, want := range []string{"version (15 -> 16) cannot be changed in place", `node "worker-9" does not exist`} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("errors %q do not mention %q", joined, want)
+		}
+	}
+	if err := Apply(m, st, p, nil); err == nil {
+		t.Error("Apply of a plan with errors should fail")
+	}
+}
+
+// fakeAPI records calls and hands out IDs for creates.
+type fakeAPI struct {
+	calls  []string
+	bodies map[string]map[string]any
+	fail   string // path whose calls fail
+}
+
+func (f *fakeAPI) call(method, path string, body any) (map[string]any, error) {
+	f.calls = append(f.calls, method+" "+path)
+	if path == f.fail {
+		return nil, fmt.Errorf("port 5432 is already in use on this node")
+	}
+	if b, ok := body.(map[string]any); ok {
+		f.bodies[path] = b
+	}
+	return map[string]any{"id": fmt.Sprintf("new-%d", len(f.calls))}, nil
+}
+
+func TestApply(t *testing.T) {
+	m := mustParse(t, testManifest)
+	st := testState()
+	p := Diff(m, st)
+	f := &fakeAPI{bodies: map[string]map[string]any{}}
+	if err := Apply(m, st, p, f.call); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	want := "POST /databases,POST /caches,POST /services,POST /deployments"
+	if got := strings.Join(f.calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+	db := f.bodies["/databases"]
+	if db["node_id"] != "n1" || db["password"] == "" {
+		t.Errorf("database body = %v, want node n1 and a generated password", db)
+	}
+	svc := f.bodies["/services"]
+	if ids, _ := svc["databases"].([]string); len(ids) != 1 || ids[0] != "new-1" {
+		t.Errorf("service databases = %v, want the new database's ID", svc["databases"])
+	}
+	dep := f.bodies["/deployments"]
+	if dep["service_id"] != "new-3" || dep["node_id"] != "n1" {
+		t.Errorf("deployment body = %v", dep)
+	}
+	for _, c := range p.Changes {
+		if c.Status != StatusApplied {
+			t.Errorf("%s %s: status %q", c.Kind, c.Name, c.Status)
+		}
+	}
+}
+
+func TestApply_StopsAtFailure(t *testing.T) {
+	m := mustParse(t, testManifest)
+	st := testState()
+	p := Diff(m, st)
+	f := &fakeAPI{bodies: map[string]map[string]any{}, fail: "/databases"}
+	err := Apply(m, st, p, f.call)
+	if err == nil || !strings.Contains(err.Error(), "create database main") {
+		t.Fatalf("err = %v", err)
+	}
+	if len(f.calls) != 1 {
+		t.Errorf("calls after the failure: %v", f.calls)
+	}
+	if p.Changes[0].Status != StatusFailed || p.Changes[0].Error == "" || p.Changes[1].Status != StatusSkipped {
+		t.Errorf("statuses: %+v %+v", p.Changes[0], p.Changes[1])
+	}
+}
+
+func exportState() *State {
+	st := testState()
+	st.Databases = []*models.Database{{ID: "db1", Name: "main", Type: "postgres", Version: "16", NodeID: "n1", DBName: "main", DBUser: "app", Password: "pw", Port: 5432, HealPolicy: "observe"}}
+	st.Caches = []*models.Cache{{ID: "c1", Name: "sessions", Version: "7", NodeID: "n1", Password: "cpw", Port: 6379, Volumes: "[]", HealPolicy: "restart"}}
+	st.Services = []*models.Service{{ID: "s1", Name: "web", DockerImage: "nginx:1.27", EnvVars: `{"MODE":"prod","API_TOKEN":"t0k"}`, Ports: `["80:80"]`, Volumes: `[]`,
+		Routes: `[{"host":"example.com","entrypoint":"web"}]`, Databases: `["db1"]`, Caches: `["c1"]`, Kafkas: `[]`, Monitorings: `[]`}}
+	st.Deployments = []*models.Deployment{{ID: "d1", ServiceID: "s1", NodeID: "n1"}}
+	return st
+}
+
+func TestFromState_RoundTrips(t *testing.T) {
+	st := exportState()
+	out, err := FromState(st).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	m := mustParse(t, string(out))
+	if m.Services[0].Domain != "example.com" || m.Services[0].Nodes[0] != "worker-1" || m.Databases[0].Password != "pw" {
+		t.Errorf("unexpected export:\n%s", out)
+	}
+	if p := Diff(m, st); len(p.Errors) > 0 || len(p.Changes) > 0 {
+		t.Errorf("exported manifest plans changes: errors %v and\n%s", p.Errors, summary(p))
+	}
+}
+
+func TestMask(t *testing.T) {
+	m := FromState(exportState())
+	m.Mask()
+	out, _ := m.Marshal()
+	for _, secret := range []string{"pw", "t0k"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("masked export leaks %q:\n%s", secret, out)
+		}
+	}
+	if env := m.Services[0].EnvVars; env["API_TOKEN"] != Masked || env["MODE"] != "prod" {
+		t.Errorf("env_vars = %v", env)
+	}
+}
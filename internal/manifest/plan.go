@@ -0,0 +1,469 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+)
+
+// Kinds of resources in a plan.
+const (
+	KindNode          = "node"
+	KindService       = "service"
+	KindDeployment    = "deployment"
+	KindDatabase      = "database"
+	KindCache         = "cache"
+	KindKafka         = "kafka"
+	KindMonitoring    = "monitoring"
+	KindObjectStorage = "object_storage"
+)
+
+// Plan actions.
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Change statuses set by Apply.
+const (
+	StatusApplied = "applied"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// managedKinds are the managed resource kinds in the order they are created;
+// they are deleted in reverse.
+var managedKinds = []string{KindDatabase, KindCache, KindKafka, KindMonitoring, KindObjectStorage}
+
+// apiPaths are the API collections of each kind, without the /api prefix.
+var apiPaths = map[string]string{
+	KindService:       "/services",
+	KindDeployment:    "/deployments",
+	KindDatabase:      "/databases",
+	KindCache:         "/caches",
+	KindKafka:         "/kafkas",
+	KindMonitoring:    "/monitorings",
+	KindObjectStorage: "/object-storages",
+}
+
+// State is what a workspace currently holds.
+type State struct {
+	Nodes          []*models.Node
+	Services       []*models.Service
+	Deployments    []*models.Deployment
+	Databases      []*models.Database
+	Caches         []*models.Cache
+	Kafkas         []*models.Kafka
+	Monitorings    []*models.Monitoring
+	ObjectStorages []*models.ObjectStorage
+}
+
+// Change is one step of a plan. A deployment is named service@node; updating
+// it recreates its container from the service's new configuration.
+type Change struct {
+	Action string   `json:"action"`
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	ID     string   `json:"id,omitempty"`     // of the existing resource
+	Fields []string `json:"fields,omitempty"` // changed by an update
+	Status string   `json:"status,omitempty"` // set by Apply
+	Error  string   `json:"error,omitempty"`
+
+	service, node string // of a deployment
+	healPolicy    string // of a managed resource update
+}
+
+// Plan is the ordered list of changes that turns a workspace into what a
+// manifest describes. Errors are differences that cannot be applied, such as
+// a missing node or a database moved to another node; a plan with errors is
+// not applied.
+type Plan struct {
+	Changes []*Change `json:"changes"`
+	Errors  []string  `json:"errors,omitempty"`
+}
+
+// resource is a managed resource reduced to what Diff compares.
+type resource struct {
+	id, name   string
+	node       string            // name
+	fixed      map[string]string // fields that cannot change in place
+	healPolicy string
+}
+
+type differ struct {
+	m        *Manifest
+	st       *State
+	plan     *Plan
+	nodeName map[string]string // ID -> name
+	nodes    map[string]bool   // names
+}
+
+// Diff compares m with st and returns the plan that applies m: managed
+// resources are created first, then services and their deployments, and
+// deletes come last, deployments before the services and resources they use.
+func Diff(m *Manifest, st *State) *Plan {
+	d := &differ{m: m, st: st, plan: &Plan{Changes: []*Change{}}, nodeName: map[string]string{}, nodes: map[string]bool{}}
+	for _, n := range st.Nodes {
+		d.nodeName[n.ID] = n.Name
+		d.nodes[n.Name] = true
+	}
+	for _, n := range m.Nodes {
+		if !d.nodes[n.Name] {
+			d.errorf("node %s: not registered", n.Name)
+		}
+	}
+
+	var deletes []*Change
+	for _, kind := range managedKinds {
+		want, have := d.managed(kind)
+		deletes = append(d.diffManaged(kind, want, have), deletes...)
+	}
+	serviceDeletes, deploymentDeletes := d.services()
+	d.plan.Changes = append(d.plan.Changes, deploymentDeletes...)
+	d.plan.Changes = append(d.plan.Changes, serviceDeletes...)
+	d.plan.Changes = append(d.plan.Changes, deletes...)
+	return d.plan
+}
+
+// SkipDeletes marks the deletes of p skipped, so applying it leaves alone
+// whatever the manifest does not list, as when it describes only part of a
+// workspace. The deletes stay in the plan to show what pruning would remove.
+func (p *Plan) SkipDeletes() {
+	for _, c := range p.Changes {
+		if c.Action == ActionDelete {
+			c.Status = StatusSkipped
+			c.Error = "not in the manifest; kept without prune"
+		}
+	}
+}
+
+func (d *differ) errorf(format string, args ...any) {
+	d.plan.Errors = append(d.plan.Errors, fmt.Sprintf(format, args...))
+}
+
+func (d *differ) checkNode(kind, name, node string) {
+	if !d.nodes[node] {
+		d.errorf("%s %s: node %q does not exist", kind, name, node)
+	}
+}
+
+// byName indexes resources by name, reporting names used more than once,
+// which a manifest cannot tell apart.
+func (d *differ) byName(kind string, have []resource) map[string]resource {
+	out := map[string]resource{}
+	for _, r := range have {
+		if _, dup := out[r.name]; dup {
+			d.errorf("%s %s: more than one exists with this name; rename or delete one first", kind, r.name)
+		}
+		out[r.name] = r
+	}
+	return out
+}
+
+// diffManaged adds the creates and updates of one managed kind to the plan
+// and returns its deletes.
+func (d *differ) diffManaged(kind string, want, have []resource) []*Change {
+	existing := d.byName(kind, have)
+	wanted := map[string]bool{}
+	for _, w := range want {
+		wanted[w.name] = true
+		d.checkNode(kind, w.name, w.node)
+		h, ok := existing[w.name]
+		if !ok {
+			d.plan.Changes = append(d.plan.Changes, &Change{Action: ActionCreate, Kind: kind, Name: w.name})
+			continue
+		}
+		var fixed []string
+		if h.node != w.node {
+			fixed = append(fixed, fmt.Sprintf("node (%s -> %s)", h.node, w.node))
+		}
+		for _, f := range sortedKeys(w.fixed) {
+			if v := w.fixed[f]; v != "" && v != h.fixed[f] {
+				fixed = append(fixed, fmt.Sprintf("%s (%s -> %s)", f, h.fixed[f], v))
+			}
+		}
+		if len(fixed) > 0 {
+			d.errorf("%s %s: %s cannot be changed in place; remove it from the manifest, apply, then add it back", kind, w.name, strings.Join(fixed, ", "))
+			continue
+		}
+		if w.healPolicy != "" && w.healPolicy != h.healPolicy {
+			d.plan.Changes = append(d.plan.Changes, &Change{Action: ActionUpdate, Kind: kind, Name: w.name, ID: h.id, Fields: []string{"heal_policy"}, healPolicy: w.healPolicy})
+		}
+	}
+	var deletes []*Change
+	for _, h := range have {
+		if !wanted[h.name] {
+			deletes = append(deletes, &Change{Action: ActionDelete, Kind: kind, Name: h.name, ID: h.id})
+		}
+	}
+	return deletes
+}
+
+// managed returns the wanted and existing resources of a managed kind.
+func (d *differ) managed(kind string) (want, have []resource) {
+	port := func(p int) string {
+		if p == 0 {
+			return ""
+		}
+		return strconv.Itoa(p)
+	}
+	switch kind {
+	case KindDatabase:
+		for _, x := range d.m.Databases {
+			want = append(want, resource{name: x.Name, node: x.Node, healPolicy: x.HealPolicy, fixed: map[string]string{
+				"type": x.Type, "version": x.Version, "dbname": x.DBName, "db_user": x.DBUser, "port": port(x.Port)}})
+		}
+		for _, x := range d.st.Databases {
+			have = append(have, resource{id: x.ID, name: x.Name, node: d.nodeName[x.NodeID], healPolicy: x.HealPolicy, fixed: map[string]string{
+				"type": x.Type, "version": x.Version, "dbname": x.DBName, "db_user": x.DBUser, "port": port(x.Port)}})
+		}
+	case KindCache:
+		for _, x := range d.m.Caches {
+			vols := ""
+			if len(x.Volumes) > 0 {
+				vols = jsonList(x.Volumes)
+			}
+			want = append(want, resource{name: x.Name, node: x.Node, healPolicy: x.HealPolicy, fixed: map[string]string{
+				"version": x.Version, "port": port(x.Port), "volumes": vols}})
+		}
+		for _, x := range d.st.Caches {
+			have = append(have, resource{id: x.ID, name: x.Name, node: d.nodeName[x.NodeID], healPolicy: x.HealPolicy, fixed: map[string]string{
+				"version": x.Version, "port": port(x.Port), "volumes": jsonList(decodeList(x.Volumes))}})
+		}
+	case KindKafka:
+		for _, x := range d.m.Kafkas {
+			want = append(want, resource{name: x.Name, node: x.Node, healPolicy: x.HealPolicy, fixed: map[string]string{
+				"version": x.Version, "port": port(x.Port)}})
+		}
+		for _, x := range d.st.Kafkas {
+			have = append(have, resource{id: x.ID, name: x.Name, node: d.nodeName[x.NodeID], healPolicy: x.HealPolicy, fixed: map[string]string{
+				"version": x.Version, "port": port(x.Port)}})
+		}
+	case KindMonitoring:
+		for _, x := range d.m.Monitorings {
+			want = append(want, resource{name: x.Name, node: x.Node, healPolicy: x.HealPolicy, fixed: map[string]string{
+				"prometheus_port": port(x.PrometheusPort), "grafana_port": port(x.GrafanaPort)}})
+		}
+		for _, x := range d.st.Monitorings {
+			have = append(have, resource{id: x.ID, name: x.Name, node: d.nodeName[x.NodeID], healPolicy: x.HealPolicy, fixed: map[string]string{
+				"prometheus_port": port(x.PrometheusPort), "grafana_port": port(x.GrafanaPort)}})
+		}
+	case KindObjectStorage:
+		for _, x := range d.m.ObjectStorages {
+			want = append(want, resource{name: x.Name, node: x.Node, fixed: map[string]string{
+				"version": x.Version, "s3_port": port(x.S3Port)}})
+		}
+		for _, x := range d.st.ObjectStorages {
+			have = append(have, resource{id: x.ID, name: x.Name, node: d.nodeName[x.NodeID], fixed: map[string]string{
+				"version": x.Version, "s3_port": port(x.S3Port)}})
+		}
+	}
+	return want, have
+}
+
+// services adds service creates and updates and deployment creates and
+// updates to the plan, and returns the service and deployment deletes.
+func (d *differ) services() (serviceDeletes, deploymentDeletes []*Change) {
+	linkNames := map[string]map[string]string{} // kind -> ID -> name
+	for _, kind := range managedKinds {
+		_, have := d.managed(kind)
+		linkNames[kind] = map[string]string{}
+		for _, h := range have {
+			linkNames[kind][h.id] = h.name
+		}
+	}
+	deps := map[string][]*models.Deployment{} // by service ID
+	for _, dep := range d.st.Deployments {
+		deps[dep.ServiceID] = append(deps[dep.ServiceID], dep)
+	}
+
+	existing := map[string]*models.Service{}
+	for _, s := range d.st.Services {
+		if _, dup := existing[s.Name]; dup {
+			d.errorf("service %s: more than one exists with this name; rename or delete one first", s.Name)
+		}
+		existing[s.Name] = s
+	}
+	wanted := map[string]bool{}
+	for i := range d.m.Services {
+		w := &d.m.Services[i]
+		wanted[w.Name] = true
+		var fields []string
+		h := existing[w.Name]
+		if h == nil {
+			d.plan.Changes = append(d.plan.Changes, &Change{Action: ActionCreate, Kind: KindService, Name: w.Name})
+		} else {
+			want, have := w.compared(), storedService(h, linkNames)
+			for _, f := range sortedKeys(want) {
+				if want[f] != have[f] {
+					fields = append(fields, f)
+				}
+			}
+			if len(fields) > 0 {
+				d.plan.Changes = append(d.plan.Changes, &Change{Action: ActionUpdate, Kind: KindService, Name: w.Name, ID: h.ID, Fields: fields})
+			}
+		}
+
+		byNode := map[string][]*models.Deployment{}
+		if h != nil {
+			for _, dep := range deps[h.ID] {
+				byNode[d.nodeName[dep.NodeID]] = append(byNode[d.nodeName[dep.NodeID]], dep)
+			}
+		}
+		onNode := map[string]bool{}
+		for _, node := range w.Nodes {
+			onNode[node] = true
+			d.checkNode(KindService, w.Name, node)
+			name := w.Name + "@" + node
+			if len(byNode[node]) == 0 {
+				d.plan.Changes = append(d.plan.Changes, &Change{Action: ActionCreate, Kind: KindDeployment, Name: name, service: w.Name, node: node})
+				continue
+			}
+			if len(fields) > 0 {
+				for _, dep := range byNode[node] {
+					d.plan.Changes = append(d.plan.Changes, &Change{Action: ActionUpdate, Kind: KindDeployment, Name: name, ID: dep.ID, Fields: fields})
+				}
+			}
+		}
+		if h != nil {
+			for _, dep := range deps[h.ID] {
+				if node := d.nodeName[dep.NodeID]; !onNode[node] {
+					deploymentDeletes = append(deploymentDeletes, &Change{Action: ActionDelete, Kind: KindDeployment, Name: w.Name + "@" + node, ID: dep.ID})
+				}
+			}
+		}
+	}
+	for _, s := range d.st.Services {
+		if wanted[s.Name] {
+			continue
+		}
+		for _, dep := range deps[s.ID] {
+			deploymentDeletes = append(deploymentDeletes, &Change{Action: ActionDelete, Kind: KindDeployment, Name: s.Name + "@" + d.nodeName[dep.NodeID], ID: dep.ID})
+		}
+		serviceDeletes = append(serviceDeletes, &Change{Action: ActionDelete, Kind: KindService, Name: s.Name, ID: s.ID})
+	}
+	return serviceDeletes, deploymentDeletes
+}
+
+// compared returns the fields of s that are compared with a stored service,
+// each encoded canonically.
+func (s *Service) compared() map[string]string {
+	out := map[string]string{
+		"docker_image":    s.DockerImage,
+		"dockerfile_path": s.DockerfilePath,
+		"command":         s.Command,
+		"env_vars":        jsonMap(s.EnvVars),
+		"ports":           jsonList(s.Ports),
+		"volumes":         jsonList(s.Volumes),
+		"routes":          jsonRoutes(s.routes()),
+	}
+	for _, l := range s.links() {
+		out[l.field] = jsonSet(l.names)
+	}
+	return out
+}
+
+// routes returns the service's routes as the API stores them: the domain
+// shorthand expanded, hosts lowercased and the entrypoint defaulted.
+func (s *Service) routes() []models.Route {
+	routes := append([]models.Route(nil), s.Routes...)
+	if len(routes) == 0 && s.Domain != "" {
+		routes = []models.Route{{Host: s.Domain}}
+	}
+	for i := range routes {
+		routes[i].Host = strings.ToLower(strings.TrimSpace(routes[i].Host))
+		if routes[i].Entrypoint == "" {
+			routes[i].Entrypoint = "web"
+		}
+	}
+	return routes
+}
+
+// storedService returns the compared fields of a stored service, with the
+// IDs of linked resources replaced by their names.
+func storedService(s *models.Service, linkNames map[string]map[string]string) map[string]string {
+	var env map[string]string
+	_ = json.Unmarshal([]byte(s.EnvVars), &env)
+	var routes []models.Route
+	_ = json.Unmarshal([]byte(s.Routes), &routes)
+	out := map[string]string{
+		"docker_image":    s.DockerImage,
+		"dockerfile_path": s.DockerfilePath,
+		"command":         s.Command,
+		"env_vars":        jsonMap(env),
+		"ports":           jsonList(decodeList(s.Ports)),
+		"volumes":         jsonList(decodeList(s.Volumes)),
+		"routes":          jsonRoutes(routes),
+	}
+	for field, ids := range map[string]struct {
+		kind string
+		json string
+	}{
+		"databases":   {KindDatabase, s.Databases},
+		"caches":      {KindCache, s.Caches},
+		"kafkas":      {KindKafka, s.Kafkas},
+		"monitorings": {KindMonitoring, s.Monitorings},
+	} {
+		var names []string
+		for _, id := range decodeList(ids.json) {
+			if name, ok := linkNames[ids.kind][id]; ok {
+				names = append(names, name)
+			} else {
+				names = append(names, id)
+			}
+		}
+		out[field] = jsonSet(names)
+	}
+	return out
+}
+
+func decodeList(s string) []string {
+	var out []string
+	_ = json.Unmarshal([]byte(s), &out)
+	return out
+}
+
+func jsonList(l []string) string {
+	if len(l) == 0 {
+		return "[]"
+	}
+	b, _ := json.Marshal(l)
+	return string(b)
+}
+
+// jsonSet encodes l ignoring order.
+func jsonSet(l []string) string {
+	sorted := append([]string(nil), l...)
+	sort.Strings(sorted)
+	return jsonList(sorted)
+}
+
+func jsonMap(m map[string]string) string {
+	if len(m) == 0 {
+		return "{}"
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func jsonRoutes(r []models.Route) string {
+	if len(r) == 0 {
+		return "[]"
+	}
+	b, _ := json.Marshal(r)
+	return string(b)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -24,21 +24,43 @@ type Node struct {
 	Provider           string    `json:"provider,omitempty"`
 	ProviderRegion     string    `json:"provider_region,omitempty"`
 	ProviderInstanceID string    `json:"provider_instance_id,omitempty"`
+	Schedule           string    `json:"schedule"`
+	KeyPassphrase      string    `json:"-"`                            // stored encrypted
+	Certificate        string    `json:"certificate,omitempty"`        // OpenSSH user certificate for PrivateKey
+	Password           string    `json:"-"`                            // stored encrypted; tried after the key
+	HostKey            string    `json:"host_key"`                     // pinned SSH host key, "<type> <base64>"
+	ProxyNodeID        string    `json:"proxy_node_id,omitempty"`      // node to dial through
+	ProxyJumpHostID    string    `json:"proxy_jump_host_id,omitempty"` // jump host to dial through
 	UserID             string    `json:"user_id,omitempty"`
 	CreatedAt          time.Time `json:"created_at"`
 }
 
+// Node schedule states. Status tracks whether a node is reachable; Schedule
+// whether it takes new workloads. A cordoned node keeps what it runs but takes
+// nothing new; a draining node is having its deployments moved elsewhere and
+// becomes cordoned once the drain finishes.
+const (
+	NodeScheduleActive   = "active"
+	NodeScheduleCordoned = "cordoned"
+	NodeScheduleDraining = "draining"
+)
+
+// Schedulable reports whether new deployments and resources may be placed on n.
+func (n *Node) Schedulable() bool {
+	return n.Schedule != NodeScheduleCordoned && n.Schedule != NodeScheduleDraining
+}
+
 type Service struct {
 	ID             string     `json:"id"`
 	Name           string     `json:"name"`
 	DockerImage    string     `json:"docker_image"`
 	DockerfilePath string     `json:"dockerfile_path"`
-	EnvVars        string     `json:"env_vars"`    // JSON {"KEY":"VAL"}
-	Ports          string     `json:"ports"`       // JSON ["8080:80"]
-	Volumes        string     `json:"volumes"`     // JSON ["vol-name:/path"]
+	EnvVars        string     `json:"env_vars"` // JSON {"KEY":"VAL"}
+	Ports          string     `json:"ports"`    // JSON ["8080:80"]
+	Volumes        string     `json:"volumes"`  // JSON ["vol-name:/path"]
 	Command        string     `json:"command"`
 	GithubRepo     string     `json:"github_repo"`
-	Domain         string     `json:"domain"`
+	Routes         string     `json:"routes"`      // JSON [{"host":"example.com"}]
 	Databases      string     `json:"databases"`   // JSON ["db-id-1"]
 	Caches         string     `json:"caches"`      // JSON ["cache-id-1"]
 	Kafkas         string     `json:"kafkas"`      // JSON ["kafka-id-1"]
@@ -47,6 +69,48 @@ type Service struct {
 	LastDeployedAt *time.Time `json:"last_deployed_at,omitempty"`
 }
 
+// Route exposes one container port of a service through Traefik. An empty
+// PathPrefix matches every path on Host. ContainerPort 0 means the container
+// side of the service's first port mapping (or 80), and Entrypoint defaults
+// to "web".
+type Route struct {
+	Host          string            `json:"host"`
+	PathPrefix    string            `json:"path_prefix,omitempty"`
+	StripPrefix   bool              `json:"strip_prefix,omitempty"`
+	ContainerPort int               `json:"container_port,omitempty"`
+	Entrypoint    string            `json:"entrypoint,omitempty"`
+	Middlewares   *RouteMiddlewares `json:"middlewares,omitempty"`
+}
+
+// RouteMiddlewares are optional Traefik middlewares applied to a route.
+// Requests pass them in this order: IP allowlist, basic auth, rate limit,
+// redirect regex, headers, strip prefix, compression.
+type RouteMiddlewares struct {
+	IPAllowList     []string          `json:"ip_allowlist,omitempty"` // IPs or CIDRs
+	BasicAuth       []string          `json:"basic_auth,omitempty"`   // htpasswd "user:bcrypt-hash" entries
+	RateLimit       *RateLimit        `json:"rate_limit,omitempty"`
+	RedirectRegex   *RedirectRegex    `json:"redirect_regex,omitempty"`
+	RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	Compress        bool              `json:"compress,omitempty"`
+}
+
+// RateLimit allows Average requests per Period (default "1s") per client IP,
+// with bursts of up to Burst requests.
+type RateLimit struct {
+	Average int    `json:"average"`
+	Burst   int    `json:"burst,omitempty"`
+	Period  string `json:"period,omitempty"`
+}
+
+// RedirectRegex redirects requests whose URL matches Regex to Replacement,
+// which may reference capture groups as ${1}.
+type RedirectRegex struct {
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+	Permanent   bool   `json:"permanent,omitempty"`
+}
+
 type Monitoring struct {
 	ID                      string     `json:"id"`
 	Name                    string     `json:"name"`
@@ -57,6 +121,8 @@ type Monitoring struct {
 	PrometheusContainerName string     `json:"prometheus_container_name"`
 	GrafanaContainerName    string     `json:"grafana_container_name"`
 	Status                  string     `json:"status"`
+	HealPolicy              string     `json:"heal_policy"`
+	Health                  string     `json:"health,omitempty"` // healthy or unhealthy, from docker events
 	UserID                  string     `json:"user_id,omitempty"`
 	CreatedAt               time.Time  `json:"created_at"`
 	LastDeployedAt          *time.Time `json:"last_deployed_at,omitempty"`
@@ -75,6 +141,8 @@ type Cache struct {
 	Volumes        string     `json:"volumes"` // JSON ["vol-name:/path"]
 	ContainerName  string     `json:"container_name"`
 	Status         string     `json:"status"`
+	HealPolicy     string     `json:"heal_policy"`
+	Health         string     `json:"health,omitempty"` // healthy or unhealthy, from docker events
 	UserID         string     `json:"user_id,omitempty"`
 	CreatedAt      time.Time  `json:"created_at"`
 	LastDeployedAt *time.Time `json:"last_deployed_at,omitempty"`
@@ -91,6 +159,8 @@ type Kafka struct {
 	Port           int        `json:"port"`
 	ContainerName  string     `json:"container_name"`
 	Status         string     `json:"status"`
+	HealPolicy     string     `json:"heal_policy"`
+	Health         string     `json:"health,omitempty"` // healthy or unhealthy, from docker events
 	UserID         string     `json:"user_id,omitempty"`
 	CreatedAt      time.Time  `json:"created_at"`
 	LastDeployedAt *time.Time `json:"last_deployed_at,omitempty"`
@@ -102,7 +172,7 @@ type Kafka struct {
 type Database struct {
 	ID             string     `json:"id"`
 	Name           string     `json:"name"`
-	Type           string     `json:"type"`    // postgres, mysql, redis, mongodb
+	Type           string     `json:"type"` // postgres, mysql, redis, mongodb
 	Version        string     `json:"version"`
 	NodeID         string     `json:"node_id"`
 	DBName         string     `json:"dbname"`
@@ -111,6 +181,8 @@ type Database struct {
 	Port           int        `json:"port"`
 	ContainerName  string     `json:"container_name"`
 	Status         string     `json:"status"`
+	HealPolicy     string     `json:"heal_policy"`
+	Health         string     `json:"health,omitempty"` // healthy or unhealthy, from docker events
 	UserID         string     `json:"user_id,omitempty"`
 	CreatedAt      time.Time  `json:"created_at"`
 	LastDeployedAt *time.Time `json:"last_deployed_at,omitempty"`
@@ -149,18 +221,55 @@ type NodeVolumeMigration struct {
 	UpdatedAt        time.Time `json:"updated_at"`
 }
 
+// Heal policies (deployments, databases, caches, Kafka clusters, monitoring stacks):
+//
+//	observe  — mark the resource stopped when its container is not running (default)
+//	restart  — docker start the existing container
+//	recreate — remove the container and run a fresh one from stored config
+//
+// While the poller is healing a resource its status is "restarting"; after too
+// many consecutive failed attempts it becomes "crash_loop" and is left alone.
+const (
+	HealPolicyObserve  = "observe"
+	HealPolicyRestart  = "restart"
+	HealPolicyRecreate = "recreate"
+)
+
+// Heal resource types, used as HealState.ResourceType.
+const (
+	HealResourceDeployment = "deployment"
+	HealResourceDatabase   = "database"
+	HealResourceCache      = "cache"
+	HealResourceKafka      = "kafka"
+	HealResourceMonitoring = "monitoring"
+)
+
+// HealState tracks consecutive self-healing attempts for one resource.
+type HealState struct {
+	ResourceType  string     `json:"resource_type"`
+	ResourceID    string     `json:"resource_id"`
+	Attempts      int        `json:"attempts"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastError     string     `json:"last_error"`
+}
+
 // Volume migration statuses:
 // pending, provisioning, provisioned, mounted, synced,
 // stopping, renamed, symlinked, restarting, verified,
 // completed, rolling_back, rolled_back, failed
 
 type Deployment struct {
-	ID        string     `json:"id"`
-	ServiceID string     `json:"service_id"`
-	NodeID    string     `json:"node_id"`
+	ID             string     `json:"id"`
+	ServiceID      string     `json:"service_id"`
+	NodeID         string     `json:"node_id"`
 	ContainerName  string     `json:"container_name"`
 	ContainerID    string     `json:"container_id"`
 	Status         string     `json:"status"`
+	HealPolicy     string     `json:"heal_policy"`
+	Health         string     `json:"health,omitempty"`         // healthy or unhealthy, from docker events
+	PreviousImage  string     `json:"previous_image,omitempty"` // image ID before the last recreate
+	PinnedImage    string     `json:"pinned_image,omitempty"`   // image ID a rollback pinned until the next redeploy
 	UserID         string     `json:"user_id,omitempty"`
 	CreatedAt      time.Time  `json:"created_at"`
 	LastDeployedAt *time.Time `json:"last_deployed_at,omitempty"`
@@ -169,3 +278,344 @@ type Deployment struct {
 	NodeName    string `json:"node_name,omitempty"`
 	DockerImage string `json:"docker_image,omitempty"`
 }
+
+// Canary statuses: pending, running, failed, promoted, aborted.
+// Only one pending or running canary may exist per deployment.
+
+// Canary is a second container running a candidate image next to a stable
+// deployment. Traefik splits traffic for the service's routes between the two
+// by Weight (percentage sent to the canary).
+type Canary struct {
+	ID            string    `json:"id"`
+	DeploymentID  string    `json:"deployment_id"`
+	ServiceID     string    `json:"service_id"`
+	NodeID        string    `json:"node_id"`
+	DockerImage   string    `json:"docker_image"`
+	ContainerName string    `json:"container_name"`
+	ContainerID   string    `json:"container_id"`
+	Weight        int       `json:"weight"`
+	Status        string    `json:"status"`
+	UserID        string    `json:"user_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	// Joined fields
+	AppName     string `json:"app_name,omitempty"`
+	StableImage string `json:"stable_image,omitempty"`
+}
+
+// Certificate sources.
+const (
+	CertificateSourceUploaded = "uploaded"
+	CertificateSourceACME     = "acme"
+)
+
+// Certificate is a TLS certificate served by Traefik. Uploaded certificates are
+// pushed to every Traefik node of their owner; ACME certificates are issued by
+// Traefik on a node and recorded by the poller so their expiry can be tracked.
+type Certificate struct {
+	ID        string    `json:"id"`
+	Domains   string    `json:"domains"` // JSON ["example.com","*.example.com"]
+	Source    string    `json:"source"`
+	NodeID    string    `json:"node_id,omitempty"` // ACME certificates only
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	CertPEM   string    `json:"cert_pem,omitempty"`
+	KeyPEM    string    `json:"-"`
+	UserID    string    `json:"user_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Joined fields
+	NodeName string `json:"node_name,omitempty"`
+}
+
+// JumpHost is an SSH bastion that is not itself a node. Nodes in private
+// subnets are reached by dialing through it; a jump host can in turn sit
+// behind another one.
+type JumpHost struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Host            string    `json:"host"`
+	Port            int       `json:"port"`
+	Username        string    `json:"username"`
+	PrivateKey      string    `json:"private_key,omitempty"`
+	KeyPassphrase   string    `json:"-"` // stored encrypted
+	HostKey         string    `json:"host_key"`
+	ProxyJumpHostID string    `json:"proxy_jump_host_id,omitempty"`
+	UserID          string    `json:"user_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// SSHHop is a host on the way to a node: a proxy node or a jump host, with
+// what is needed to log into it. Exactly one of NodeID and JumpHostID is set.
+type SSHHop struct {
+	NodeID        string
+	JumpHostID    string
+	Host          string
+	Port          int
+	Username      string
+	PrivateKey    string
+	KeyPassphrase string
+	Certificate   string
+	Password      string
+	HostKey       string
+}
+
+// WireGuardPeer is a node's membership in its owner's WireGuard mesh. Every
+// peer gets an overlay IP and a key pair; the private key is stored encrypted
+// and only ever written to the node's WireGuard config.
+type WireGuardPeer struct {
+	NodeID     string    `json:"node_id"`
+	OverlayIP  string    `json:"overlay_ip"`
+	PublicKey  string    `json:"public_key"`
+	PrivateKey string    `json:"-"`
+	UserID     string    `json:"user_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// Joined fields
+	NodeName string `json:"node_name,omitempty"`
+	NodeHost string `json:"node_host,omitempty"`
+}
+
+// FirewallRule opens a port on the user's firewalled nodes beyond the defaults
+// (SSH, Traefik, WireGuard and linked resource ports).
+type FirewallRule struct {
+	ID          string    `json:"id"`
+	NodeID      string    `json:"node_id"`  // "" = every firewalled node
+	Protocol    string    `json:"protocol"` // tcp, udp
+	Port        int       `json:"port"`
+	Source      string    `json:"source"` // IP or CIDR; "" = anywhere
+	Description string    `json:"description"`
+	UserID      string    `json:"user_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// NodeFirewall records that the firewall is managed on a node, and the outcome
+// of the last time its ruleset was applied.
+type NodeFirewall struct {
+	NodeID    string     `json:"node_id"`
+	AppliedAt *time.Time `json:"applied_at"`
+	LastError string     `json:"last_error"`
+	UserID    string     `json:"user_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// Joined fields
+	NodeName string `json:"node_name,omitempty"`
+}
+
+// NodeBootstrap records the last time a node was bootstrapped and the software
+// versions found on it.
+type NodeBootstrap struct {
+	NodeID         string     `json:"node_id"`
+	OS             string     `json:"os"`
+	Versions       string     `json:"versions"` // JSON object, e.g. {"docker":"27.3.1"}
+	BootstrappedAt *time.Time `json:"bootstrapped_at"`
+	LastError      string     `json:"last_error"`
+	UserID         string     `json:"user_id,omitempty"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Metric sample kinds.
+const (
+	MetricKindNode       = "node"
+	MetricKindDeployment = "deployment"
+)
+
+// MetricSample is one point of the usage time series of a node or of a
+// deployment's container. Resolution is the bucket size in seconds: 0 for raw
+// samples and larger for averages of older samples. NetRx and NetTx are
+// cumulative byte counters; disk and load are only set for nodes.
+type MetricSample struct {
+	Kind       string    `json:"-"`
+	TargetID   string    `json:"-"`
+	Resolution int       `json:"resolution"`
+	Timestamp  time.Time `json:"ts"`
+	CPUPercent float64   `json:"cpu_percent"`
+	MemUsed    int64     `json:"mem_used"`
+	MemTotal   int64     `json:"mem_total"`
+	DiskUsed   int64     `json:"disk_used,omitempty"`
+	DiskTotal  int64     `json:"disk_total,omitempty"`
+	NetRx      int64     `json:"net_rx"`
+	NetTx      int64     `json:"net_tx"`
+	Load1      float64   `json:"load1,omitempty"`
+	Load5      float64   `json:"load5,omitempty"`
+	Load15     float64   `json:"load15,omitempty"`
+	UserID     string    `json:"-"`
+}
+
+// DrainReport is the outcome of draining a node: the deployments moved to
+// other nodes, those that could not be moved, those left in place because
+// they were not running, and the managed resources left behind because their
+// data needs migrating by hand.
+type DrainReport struct {
+	NodeID    string           `json:"node_id"`
+	Moved     []*DrainMove     `json:"moved"`
+	Failed    []*DrainFailure  `json:"failed"`
+	Skipped   []*DrainSkip     `json:"skipped"`
+	Resources []*DrainResource `json:"resources"`
+}
+
+// DrainMove is a deployment recreated on another node.
+type DrainMove struct {
+	DeploymentID string   `json:"deployment_id"`
+	ServiceName  string   `json:"service_name"`
+	ToNodeID     string   `json:"to_node_id"`
+	ToNodeName   string   `json:"to_node_name"`
+	ContainerID  string   `json:"container_id"`
+	Warnings     []string `json:"warnings,omitempty"`
+}
+
+// DrainFailure is a deployment that is still on the drained node.
+type DrainFailure struct {
+	DeploymentID string `json:"deployment_id"`
+	ServiceName  string `json:"service_name"`
+	Error        string `json:"error"`
+}
+
+// DrainSkip is a deployment that was not running and so was left on the
+// drained node rather than started elsewhere.
+type DrainSkip struct {
+	DeploymentID string `json:"deployment_id"`
+	ServiceName  string `json:"service_name"`
+	Status       string `json:"status"`
+}
+
+// DrainResource is a managed resource on a drained node with a suggested
+// data-migration plan.
+type DrainResource struct {
+	Kind string `json:"kind"` // database, cache, kafka, monitoring, object_storage
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Plan string `json:"plan"`
+}
+
+// Audit actor types.
+const (
+	AuditActorUser    = "user"
+	AuditActorWebhook = "webhook"
+	AuditActorPoller  = "poller"
+)
+
+// Audit results.
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+)
+
+// AuditEvent records one mutating action on a user's resources. Before and
+// After are JSON summaries of the resource with secrets redacted; either is
+// empty when there was nothing to record, e.g. Before of a create.
+type AuditEvent struct {
+	ID           string    `json:"id"`
+	ActorType    string    `json:"actor_type"` // AuditActor*
+	ActorID      string    `json:"actor_id"`
+	ActorName    string    `json:"actor_name"`
+	Action       string    `json:"action"` // e.g. "database.delete", "deployment.redeploy"
+	ResourceType string    `json:"resource_type"`
+	ResourceID   string    `json:"resource_id"`
+	Before       string    `json:"before,omitempty"`
+	After        string    `json:"after,omitempty"`
+	SourceIP     string    `json:"source_ip,omitempty"`
+	Result       string    `json:"result"` // AuditResult*
+	Error        string    `json:"error,omitempty"`
+	UserID       string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AuditFilter narrows ListAuditEvents. Empty fields match everything.
+type AuditFilter struct {
+	ActorType    string
+	Action       string // exact action, or a prefix ending in "." such as "node."
+	ResourceType string
+	ResourceID   string
+	Result       string
+	Since        time.Time
+	Until        time.Time
+	Limit        int
+}
+
+// Organization roles, from most to least privileged.
+const (
+	RoleOwner    = "owner"    // everything, including managing owners and deleting the organization
+	RoleAdmin    = "admin"    // manages all resources, settings and non-owner members
+	RoleDeployer = "deployer" // reads everything and deploys, restarts and removes deployments
+	RoleViewer   = "viewer"   // reads everything, including logs
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleDeployer: 2, RoleAdmin: 3, RoleOwner: 4}
+
+// ValidRole reports whether role is one of the organization roles.
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// RoleAtLeast reports whether role grants everything min does.
+func RoleAtLeast(role, min string) bool {
+	return roleRank[role] > 0 && roleRank[role] >= roleRank[min]
+}
+
+// Organization owns nodes, services and every other resource; the user_id
+// column of a resource holds its organization's ID. Every user has a
+// personal organization with the user's own ID, which has no other members.
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Personal  bool      `json:"personal"`
+	Role      string    `json:"role,omitempty"` // the caller's role, when listed for a user
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrgMember is a user's membership in an organization.
+type OrgMember struct {
+	OrgID     string    `json:"org_id"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// API token scopes. A token acts with the lower of its scope's role and the
+// user's role in the organization it is used in.
+const (
+	ScopeRead   = "read"   // viewer
+	ScopeDeploy = "deploy" // deployer
+	ScopeAdmin  = "admin"  // admin
+)
+
+var scopeRoles = map[string]string{ScopeRead: RoleViewer, ScopeDeploy: RoleDeployer, ScopeAdmin: RoleAdmin}
+
+// ValidScope reports whether scope is one of the API token scopes.
+func ValidScope(scope string) bool {
+	return scopeRoles[scope] != ""
+}
+
+// CapRole returns role limited to what an API token with scope may do. An
+// empty scope, as for a session, leaves role as it is.
+func CapRole(role, scope string) string {
+	if scope == "" {
+		return role
+	}
+	if max := scopeRoles[scope]; !RoleAtLeast(max, role) {
+		return max
+	}
+	return role
+}
+
+// APIToken is a user's token for calling the API from scripts and CI. Only
+// a hash of the token is stored; Prefix is its first characters, kept to
+// tell tokens apart.
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"` // Scope*
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	UserID     string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the token has expired at now.
+func (t *APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
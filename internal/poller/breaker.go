@@ -0,0 +1,82 @@
+package poller
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// breakerThreshold consecutive failed health checks open a node's breaker.
+	breakerThreshold = 3
+	// breakerMaxOpen caps how long an open breaker skips its node.
+	breakerMaxOpen = 10 * time.Minute
+)
+
+// nodeBreaker is a per-node circuit breaker for the health check. Once a node
+// failed breakerThreshold checks in a row it is skipped for a while, so an
+// unreachable node does not cost a dial timeout on every tick. After the wait
+// one check is let through; if it fails too, the wait doubles up to
+// breakerMaxOpen.
+type nodeBreaker struct {
+	base time.Duration
+
+	mu    sync.Mutex
+	nodes map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newNodeBreaker(base time.Duration) *nodeBreaker {
+	return &nodeBreaker{base: base, nodes: map[string]*breakerState{}}
+}
+
+// allow reports whether nodeID should be checked at now.
+func (b *nodeBreaker) allow(nodeID string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.nodes[nodeID]
+	return st == nil || !now.Before(st.openUntil)
+}
+
+// record stores the outcome of a check of nodeID at now. When the failure
+// opens (or re-opens) the breaker it returns how long the node is skipped.
+func (b *nodeBreaker) record(nodeID string, err error, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.nodes, nodeID)
+		return 0
+	}
+	st := b.nodes[nodeID]
+	if st == nil {
+		st = &breakerState{}
+		b.nodes[nodeID] = st
+	}
+	st.failures++
+	if st.failures < breakerThreshold {
+		return 0
+	}
+	wait := b.base
+	for i := breakerThreshold; i < st.failures && wait < breakerMaxOpen; i++ {
+		wait *= 2
+	}
+	if wait > breakerMaxOpen {
+		wait = breakerMaxOpen
+	}
+	st.openUntil = now.Add(wait)
+	return wait
+}
+
+// retain forgets the breakers of nodes not in keep, e.g. deleted nodes.
+func (b *nodeBreaker) retain(keep map[string]bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id := range b.nodes {
+		if !keep[id] {
+			delete(b.nodes, id)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package poller
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNodeBreaker(t *testing.T) {
+	b := newNodeBreaker(time.Minute)
+	now := time.Now()
+	fail := errors.New("dial timeout")
+
+	for i := 1; i < breakerThreshold; i++ {
+		if wait := b.record("n1", fail, now); wait != 0 {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+	}
+	if wait := b.record("n1", fail, now); wait != time.Minute {
+		t.Fatalf("expected breaker to open for 1m, got %s", wait)
+	}
+	if b.allow("n1", now.Add(30*time.Second)) {
+		t.Error("expected node to be skipped while the breaker is open")
+	}
+	if !b.allow("n2", now) {
+		t.Error("expected other nodes to be checked")
+	}
+
+	// The probe after the wait fails: the wait doubles.
+	now = now.Add(time.Minute)
+	if !b.allow("n1", now) {
+		t.Fatal("expected a probe once the wait is over")
+	}
+	if wait := b.record("n1", fail, now); wait != 2*time.Minute {
+		t.Errorf("expected the wait to double, got %s", wait)
+	}
+	for i := 0; i < 10; i++ {
+		b.record("n1", fail, now)
+	}
+	if wait := b.record("n1", fail, now); wait != breakerMaxOpen {
+		t.Errorf("expected the wait capped at %s, got %s", breakerMaxOpen, wait)
+	}
+
+	// A success closes it.
+	b.record("n1", nil, now)
+	if !b.allow("n1", now) {
+		t.Error("expected node to be checked after a success")
+	}
+
+	b.record("gone", fail, now)
+	b.retain(map[string]bool{"n1": true})
+	if _, ok := b.nodes["gone"]; ok {
+		t.Error("expected breaker of a deleted node to be forgotten")
+	}
+}
@@ -0,0 +1,57 @@
+package poller
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// certificateExpiryWarning is how far ahead of expiry a certificate is logged
+// as expiring.
+const certificateExpiryWarning = 14 * 24 * time.Hour
+
+// checkCertificates reads Traefik's ACME storage on every Traefik node and
+// records the issued certificates, so their expiry is tracked alongside
+// uploaded ones.
+func (p *Poller) checkCertificates() {
+	nodes, err := p.store.ListAllNodes()
+	if err != nil {
+		log.Printf("poller: list nodes: %v", err)
+		return
+	}
+	for _, n := range nodes {
+		if !n.TraefikEnabled || n.Status != "online" {
+			continue
+		}
+		output, err := sshexec.NewRunner(n).Run("cat " + sshexec.TraefikACMEStoragePath + " 2>/dev/null || true")
+		if err != nil || output == "" {
+			continue
+		}
+		certs, err := deployer.ParseACMEStorage([]byte(output))
+		if err != nil {
+			log.Printf("poller: node %s: %v", n.Name, err)
+			continue
+		}
+		seen := time.Now().UTC()
+		for _, c := range certs {
+			c.ID = uuid.New().String()
+			c.NodeID = n.ID
+			c.UserID = n.UserID
+			c.CreatedAt = seen
+			c.UpdatedAt = seen
+			if err := p.store.UpsertACMECertificate(c); err != nil {
+				log.Printf("poller: record certificate %s on node %s: %v", c.Domains, n.Name, err)
+				continue
+			}
+			if time.Until(c.NotAfter) < certificateExpiryWarning {
+				log.Printf("poller: certificate %s on node %s expires %s", c.Domains, n.Name, c.NotAfter.Format(time.RFC3339))
+			}
+		}
+		if err := p.store.PruneACMECertificates(n.ID, seen); err != nil {
+			log.Printf("poller: prune certificates on node %s: %v", n.Name, err)
+		}
+	}
+}
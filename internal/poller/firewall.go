@@ -0,0 +1,19 @@
+package poller
+
+import "log"
+
+// reconcileFirewalls re-applies the firewall of every firewalled node, so
+// rules lost on a node reboot or changed by hand are restored and nodes that
+// were unreachable when a change was made catch up.
+func (p *Poller) reconcileFirewalls() {
+	userIDs, err := p.store.ListFirewallUserIDs()
+	if err != nil {
+		log.Printf("poller: list firewall users: %v", err)
+		return
+	}
+	for _, userID := range userIDs {
+		if err := p.deployer.ReconcileFirewalls(userID); err != nil {
+			log.Printf("poller: firewall for user %s: %v", userID, err)
+		}
+	}
+}
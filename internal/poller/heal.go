@@ -0,0 +1,168 @@
+package poller
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/audit"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+const (
+	// healBaseBackoff is the wait after the first heal attempt; it doubles with
+	// every consecutive attempt up to healMaxBackoff.
+	healBaseBackoff = 30 * time.Second
+	healMaxBackoff  = 10 * time.Minute
+	// healMaxAttempts consecutive attempts without the container staying up put
+	// the resource into crash_loop, after which the poller stops touching it.
+	healMaxAttempts = 5
+	// healStableWindow is how long a container has to keep running after the
+	// last heal attempt before the attempt counter is reset.
+	healStableWindow = 10 * time.Minute
+)
+
+// healTarget is one deployment or managed resource checked by the reconcile loop.
+type healTarget struct {
+	kind       string // models.HealResource*
+	id         string
+	userID     string
+	label      string // for log lines, e.g. "deployment abc (container)"
+	status     string // status currently stored in the database
+	policy     string
+	containers []string
+	// setStatus persists a new status for the resource.
+	setStatus func(status string)
+	// recreate removes and re-runs the resource's containers from stored config.
+	recreate func() error
+}
+
+// healBackoff returns the wait before the next attempt after attempts tries.
+func healBackoff(attempts int) time.Duration {
+	d := healBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= healMaxBackoff {
+			return healMaxBackoff
+		}
+	}
+	return d
+}
+
+// check applies t's heal policy when any of its containers is not running in
+// states, the containers found on its node.
+func (p *Poller) check(t healTarget, runner sshexec.Runner, states map[string]string) {
+	for _, name := range t.containers {
+		state, ok := states[name]
+		if !ok {
+			state = sshexec.ContainerMissing
+		}
+		if state != "running" {
+			p.heal(t, runner, name, state)
+			return
+		}
+	}
+	p.healthy(t)
+}
+
+// healthy records that every container of t is running.
+func (p *Poller) healthy(t healTarget) {
+	if t.status == "restarting" {
+		t.setStatus("running")
+		log.Printf("poller: %s recovered", t.label)
+	}
+	state, err := p.store.GetHealState(t.kind, t.id)
+	if err != nil || state == nil || state.LastAttemptAt == nil {
+		return
+	}
+	if time.Since(*state.LastAttemptAt) >= healStableWindow {
+		_ = p.store.ClearHealState(t.kind, t.id)
+	}
+}
+
+// heal applies t's heal policy after container (in state) was found not running.
+func (p *Poller) heal(t healTarget, runner sshexec.Runner, container, state string) {
+	if t.policy != models.HealPolicyRestart && t.policy != models.HealPolicyRecreate {
+		t.setStatus("stopped")
+		_ = p.store.ClearHealState(t.kind, t.id)
+		log.Printf("poller: %s container %s is %q, marked stopped", t.label, container, state)
+		p.audit(t, "status.update", t.status, "stopped", nil)
+		return
+	}
+
+	hs, err := p.store.GetHealState(t.kind, t.id)
+	if err != nil {
+		log.Printf("poller: get heal state for %s: %v", t.label, err)
+		return
+	}
+	if hs == nil {
+		hs = &models.HealState{ResourceType: t.kind, ResourceID: t.id}
+	}
+	now := time.Now().UTC()
+	if hs.NextAttemptAt != nil && now.Before(*hs.NextAttemptAt) {
+		if t.status != "restarting" {
+			t.setStatus("restarting")
+		}
+		return // still backing off
+	}
+	if hs.Attempts >= healMaxAttempts {
+		if t.status != "crash_loop" {
+			t.setStatus("crash_loop")
+			log.Printf("poller: %s container %s is %q after %d heal attempts, marked crash_loop", t.label, container, state, hs.Attempts)
+			p.audit(t, "status.update", t.status, "crash_loop", nil)
+		}
+		return
+	}
+
+	t.setStatus("restarting")
+	log.Printf("poller: %s container %s is %q, %s attempt %d", t.label, container, state, t.policy, hs.Attempts+1)
+
+	var healErr error
+	if t.policy == models.HealPolicyRestart {
+		for _, name := range t.containers {
+			if output, err := runner.Run(sshexec.DockerStartCmd(name)); err != nil {
+				healErr = fmt.Errorf("docker start %s: %w: %s", name, err, strings.TrimSpace(output))
+				break
+			}
+		}
+	} else {
+		healErr = t.recreate()
+	}
+
+	next := now.Add(healBackoff(hs.Attempts + 1))
+	hs.Attempts++
+	hs.LastAttemptAt = &now
+	hs.NextAttemptAt = &next
+	hs.LastError = ""
+	if healErr != nil {
+		hs.LastError = healErr.Error()
+		log.Printf("poller: %s %s failed: %v", t.label, t.policy, healErr)
+		p.audit(t, t.policy, t.status, "restarting", healErr)
+	} else {
+		t.setStatus("running")
+		p.audit(t, t.policy, t.status, "running", nil)
+	}
+	if err := p.store.SaveHealState(hs); err != nil {
+		log.Printf("poller: save heal state for %s: %v", t.label, err)
+	}
+}
+
+// audit records an action the poller took on t in its owner's audit log.
+func (p *Poller) audit(t healTarget, action, before, after string, err error) {
+	e := &models.AuditEvent{
+		ActorType:    models.AuditActorPoller,
+		ActorID:      "heal",
+		Action:       t.kind + "." + action,
+		ResourceType: t.kind,
+		ResourceID:   t.id,
+		Before:       audit.SummaryOf(map[string]string{"status": before}),
+		After:        audit.SummaryOf(map[string]string{"status": after}),
+		UserID:       t.userID,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	audit.Record(p.store, e)
+}
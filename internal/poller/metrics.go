@@ -0,0 +1,113 @@
+package poller
+
+import (
+	"log"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// Metrics retention: raw samples are kept for a day, then averaged into
+// hourly samples that are kept for 30 days.
+const (
+	metricsRawRetention    = 24 * time.Hour
+	metricsHourly          = 3600
+	metricsHourlyRetention = 30 * 24 * time.Hour
+)
+
+// collectMetrics samples usage of every online node and of the containers of
+// the deployments running on it, then downsamples and prunes old samples.
+func (p *Poller) collectMetrics() {
+	nodes, err := p.store.ListAllNodes()
+	if err != nil {
+		log.Printf("poller: list nodes for metrics: %v", err)
+		return
+	}
+	deployments, err := p.store.ListAllRunningDeployments()
+	if err != nil {
+		log.Printf("poller: list running deployments for metrics: %v", err)
+		return
+	}
+	byNode := map[string]map[string]*models.Deployment{}
+	for _, d := range deployments {
+		if byNode[d.NodeID] == nil {
+			byNode[d.NodeID] = map[string]*models.Deployment{}
+		}
+		byNode[d.NodeID][d.ContainerName] = d
+	}
+
+	now := time.Now().UTC()
+	for _, n := range nodes {
+		if n.Status == "offline" {
+			continue
+		}
+		runner := sshexec.NewRunner(n)
+		p.collectNodeMetrics(runner, n, now)
+		if containers := byNode[n.ID]; len(containers) > 0 {
+			p.collectContainerMetrics(runner, n, containers, now)
+		}
+	}
+
+	cutoff := now.Add(-metricsRawRetention).Truncate(time.Hour)
+	if err := p.store.DownsampleMetrics(0, metricsHourly, cutoff); err != nil {
+		log.Printf("poller: downsample metrics: %v", err)
+	}
+	if err := p.store.PruneMetrics(metricsHourly, now.Add(-metricsHourlyRetention)); err != nil {
+		log.Printf("poller: prune metrics: %v", err)
+	}
+}
+
+func (p *Poller) collectNodeMetrics(runner sshexec.Runner, n *models.Node, now time.Time) {
+	output, err := runner.Run(sshexec.NodeStatsCmd())
+	if err != nil {
+		log.Printf("poller: node stats for %s: %v", n.Name, err)
+		return
+	}
+	st, err := sshexec.ParseNodeStats(output)
+	if err != nil {
+		log.Printf("poller: node stats for %s: %v", n.Name, err)
+		return
+	}
+	_ = p.store.InsertMetricSample(&models.MetricSample{
+		Kind:       models.MetricKindNode,
+		TargetID:   n.ID,
+		Timestamp:  now,
+		CPUPercent: st.CPUPercent,
+		MemUsed:    st.MemUsed,
+		MemTotal:   st.MemTotal,
+		DiskUsed:   st.DiskUsed,
+		DiskTotal:  st.DiskTotal,
+		NetRx:      st.NetRx,
+		NetTx:      st.NetTx,
+		Load1:      st.Load1,
+		Load5:      st.Load5,
+		Load15:     st.Load15,
+		UserID:     n.UserID,
+	})
+}
+
+func (p *Poller) collectContainerMetrics(runner sshexec.Runner, n *models.Node, containers map[string]*models.Deployment, now time.Time) {
+	output, err := runner.Run(sshexec.DockerStatsCmd())
+	if err != nil {
+		log.Printf("poller: docker stats on %s: %v", n.Name, err)
+		return
+	}
+	for name, st := range sshexec.ParseDockerStats(output) {
+		d, ok := containers[name]
+		if !ok {
+			continue
+		}
+		_ = p.store.InsertMetricSample(&models.MetricSample{
+			Kind:       models.MetricKindDeployment,
+			TargetID:   d.ID,
+			Timestamp:  now,
+			CPUPercent: st.CPUPercent,
+			MemUsed:    st.MemUsed,
+			MemTotal:   st.MemTotal,
+			NetRx:      st.NetRx,
+			NetTx:      st.NetTx,
+			UserID:     d.UserID,
+		})
+	}
+}
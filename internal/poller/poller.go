@@ -2,27 +2,53 @@ package poller
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/gsarma/localisprod-v2/internal/audit"
+	"github.com/gsarma/localisprod-v2/internal/deployer"
+	"github.com/gsarma/localisprod-v2/internal/models"
 	"github.com/gsarma/localisprod-v2/internal/sshexec"
 	"github.com/gsarma/localisprod-v2/internal/store"
 )
 
-// Poller runs two background loops:
-//   - image check (interval): pulls each running deployment's image; redeploys if newer
-//   - health check (statusInterval): pings nodes and docker-inspects containers to keep
-//     status fields accurate in the database
+// Poller runs two background loops, next to a docker events stream per node
+// that reports container status changes as they happen:
+//   - image check (interval): pulls each running deployment's image; redeploys if newer,
+//     records certificates Traefik obtained via ACME and re-applies node firewalls
+//   - health check (statusInterval): lists the containers of each node with one
+//     docker ps, several nodes at a time, to keep status fields accurate in the
+//     database, restarting or recreating containers according to each resource's
+//     heal policy, then samples node and container usage into the metrics history
 type Poller struct {
 	store          *store.Store
+	deployer       *deployer.Deployer
 	interval       time.Duration
 	statusInterval time.Duration
+	breaker        *nodeBreaker
+
+	// nodeLocks serializes checks of a node between the health check and
+	// its events stream.
+	nodeLocks sync.Map
+	watchMu   sync.Mutex
+	watches   map[string]*nodeWatch
 }
 
+// reconcileWorkers is how many nodes the health check works on at once.
+const reconcileWorkers = 8
+
 func New(s *store.Store, interval, statusInterval time.Duration) *Poller {
-	return &Poller{store: s, interval: interval, statusInterval: statusInterval}
+	return &Poller{
+		store:          s,
+		deployer:       deployer.New(s),
+		interval:       interval,
+		statusInterval: statusInterval,
+		breaker:        newNodeBreaker(statusInterval),
+		watches:        map[string]*nodeWatch{},
+	}
 }
 
 // Start runs both loops until ctx is cancelled.
@@ -34,20 +60,26 @@ func (p *Poller) Start(ctx context.Context) {
 	defer imageTicker.Stop()
 	defer statusTicker.Stop()
 
+	go p.watchEvents(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-imageTicker.C:
 			p.checkImages()
+			p.checkCertificates()
+			p.reconcileFirewalls()
 		case <-statusTicker.C:
 			p.reconcileStatus()
+			p.collectMetrics()
 		}
 	}
 }
 
 // checkImages pulls the image for every running deployment and redeploys when a
-// newer image has been downloaded.
+// newer image has been downloaded. Deployments pinned by a rollback are left
+// alone.
 func (p *Poller) checkImages() {
 	deployments, err := p.store.ListAllRunningDeployments()
 	if err != nil {
@@ -56,6 +88,9 @@ func (p *Poller) checkImages() {
 	}
 
 	for _, d := range deployments {
+		if d.PinnedImage != "" {
+			continue // rolled back; only an explicit redeploy moves it on
+		}
 		app, err := p.store.GetService(d.ServiceID, d.UserID)
 		if err != nil || app == nil {
 			log.Printf("poller: get service %s: %v", d.ServiceID, err)
@@ -92,190 +127,330 @@ func (p *Poller) checkImages() {
 
 		log.Printf("poller: new image for %s (%s), redeploying deployment %s", app.Name, app.DockerImage, d.ID)
 
-		if _, stopErr := runner.Run(sshexec.DockerStopRemoveCmd(d.ContainerName)); stopErr != nil {
-			log.Printf("poller: stop/rm failed for deployment %s: %v", d.ID, stopErr)
+		newContainerID, runErr := p.deployer.RecreateDeployment(d, node)
+		e := &models.AuditEvent{
+			ActorType:    models.AuditActorPoller,
+			ActorID:      "image-check",
+			Action:       "deployment.redeploy",
+			ResourceType: models.HealResourceDeployment,
+			ResourceID:   d.ID,
+			UserID:       d.UserID,
 		}
-
-		var ports []string
-		_ = json.Unmarshal([]byte(app.Ports), &ports)
-
-		cfg := sshexec.RunConfig{
-			ContainerName: d.ContainerName,
-			Image:         app.DockerImage,
-			Ports:         ports,
-			Command:       app.Command,
-		}
-		if app.Domain != "" {
-			containerPort := "80"
-			if len(ports) > 0 {
-				if idx := strings.LastIndex(ports[0], ":"); idx >= 0 {
-					containerPort = ports[0][idx+1:]
-				}
-			}
-			cfg.Network = "traefik-net"
-			cfg.Labels = sshexec.TraefikLabels(d.ContainerName, app.Domain, containerPort)
-		}
-
-		runOutput, runErr := runner.Run(sshexec.DockerRunCmd(cfg))
 		if runErr != nil {
-			log.Printf("poller: docker run failed for deployment %s: %v\noutput: %s", d.ID, runErr, runOutput)
+			log.Printf("poller: redeploy failed for deployment %s: %v", d.ID, runErr)
 			_ = p.store.UpdateDeploymentStatus(d.ID, d.UserID, "failed", "")
+			e.Error = runErr.Error()
+			audit.Record(p.store, e)
 			continue
 		}
 
-		newContainerID := strings.TrimSpace(runOutput)
 		_ = p.store.UpdateDeploymentStatus(d.ID, d.UserID, "running", newContainerID)
+		e.After = audit.SummaryOf(map[string]string{"image": app.DockerImage, "container_id": newContainerID, "status": "running"})
+		audit.Record(p.store, e)
 		log.Printf("poller: redeployed %s → container %s", d.ContainerName, newContainerID)
 	}
 }
 
-// reconcileStatus pings every node and docker-inspects every running container,
-// updating status in the database when reality differs from what's stored.
+// reconcileStatus lists the containers of every node with a single docker ps,
+// on up to reconcileWorkers nodes at a time, and maps the result back to the
+// node and every deployment and managed resource on it: statuses are updated
+// when reality differs from what's stored, and resources whose policy allows
+// it are healed. Nodes whose breaker is open are skipped, and so are nodes
+// whose events stream keeps them up to date (see watch.go).
 func (p *Poller) reconcileStatus() {
-	p.reconcileNodes()
-	p.reconcileDeployments()
-	p.reconcileDatabases()
-	p.reconcileCaches()
-	p.reconcileKafkas()
-	p.reconcileMonitorings()
+	batches, err := p.nodeBatches("")
+	if err != nil {
+		log.Printf("poller: list nodes: %v", err)
+		return
+	}
+	ids := map[string]bool{}
+	for _, b := range batches {
+		ids[b.node.ID] = true
+	}
+	p.breaker.retain(ids)
+
+	jobs := make(chan *nodeBatch)
+	var wg sync.WaitGroup
+	for i := 0; i < reconcileWorkers && i < len(batches); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				p.reconcileNode(b)
+			}
+		}()
+	}
+	for _, b := range batches {
+		if !p.streaming(b.node.ID) {
+			jobs <- b
+		}
+	}
+	close(jobs)
+	wg.Wait()
 }
 
-func (p *Poller) reconcileNodes() {
+// nodeBatches returns a batch per node, in store order, holding the heal
+// targets of every resource on it. When nodeID is set only that node's batch
+// is built.
+func (p *Poller) nodeBatches(nodeID string) ([]*nodeBatch, error) {
 	nodes, err := p.store.ListAllNodes()
 	if err != nil {
-		log.Printf("poller: list nodes: %v", err)
-		return
+		return nil, err
 	}
+	var batches []*nodeBatch
+	byID := map[string]*nodeBatch{}
 	for _, n := range nodes {
-		runner := sshexec.NewRunner(n)
-		want := "online"
-		if err := runner.Ping(); err != nil {
-			want = "offline"
+		if nodeID != "" && n.ID != nodeID {
+			continue
 		}
-		if n.Status != want {
-			_ = p.store.UpdateNodeStatus(n.ID, n.UserID, want)
-			log.Printf("poller: node %s status %s → %s", n.Name, n.Status, want)
+		b := &nodeBatch{node: n}
+		batches = append(batches, b)
+		byID[n.ID] = b
+	}
+	if len(batches) == 0 {
+		return nil, nil
+	}
+
+	add := func(nodeID, userID string, t func(node *models.Node) healTarget) {
+		b := byID[nodeID]
+		if b == nil || b.node.UserID != userID {
+			return
 		}
+		b.targets = append(b.targets, t(b.node))
 	}
+	p.deploymentTargets(add)
+	p.databaseTargets(add)
+	p.cacheTargets(add)
+	p.kafkaTargets(add)
+	p.monitoringTargets(add)
+	return batches, nil
 }
 
-func (p *Poller) reconcileDeployments() {
-	deployments, err := p.store.ListAllRunningDeployments()
+// nodeBatch is a node and the heal targets whose containers run on it.
+type nodeBatch struct {
+	node    *models.Node
+	targets []healTarget
+}
+
+// addTarget queues the heal target built by t on the resource's node. It is
+// dropped when the node does not exist or belongs to another user.
+type addTarget func(nodeID, userID string, t func(node *models.Node) healTarget)
+
+// reconcileNode checks one node and its targets. A node that cannot be reached
+// is marked offline and its targets are left alone, so transient SSH failures
+// never flip resource status.
+func (p *Poller) reconcileNode(b *nodeBatch) {
+	n := b.node
+	if !p.breaker.allow(n.ID, time.Now()) {
+		return
+	}
+	defer p.lockNode(n.ID)()
+	runner := sshexec.NewRunner(n)
+	output, err := runner.Run(sshexec.ContainerStatesCmd())
+	if wait := p.breaker.record(n.ID, err, time.Now()); wait > 0 {
+		log.Printf("poller: node %s unreachable (%v), skipping health checks for %s", n.Name, err, wait)
+	}
+	want := "online"
+	if err != nil {
+		want = "offline"
+	}
+	if n.Status != want {
+		_ = p.store.UpdateNodeStatus(n.ID, n.UserID, want)
+		log.Printf("poller: node %s status %s → %s", n.Name, n.Status, want)
+	}
+	if err != nil {
+		return
+	}
+	states, err := sshexec.ParseContainerStates(output)
+	if err != nil {
+		if len(b.targets) > 0 {
+			log.Printf("poller: list containers on %s: %v", n.Name, err)
+		}
+		return
+	}
+	for _, t := range b.targets {
+		p.check(t, runner, states)
+	}
+	p.markChecked(n.ID)
+}
+
+func (p *Poller) deploymentTargets(add addTarget) {
+	deployments, err := p.store.ListDeploymentsForHealthCheck()
 	if err != nil {
 		log.Printf("poller: list running deployments for health check: %v", err)
 		return
 	}
 	for _, d := range deployments {
-		node, err := p.store.GetNode(d.NodeID, d.UserID)
-		if err != nil || node == nil {
-			continue
-		}
-		runner := sshexec.NewRunner(node)
-		output, err := runner.Run(sshexec.DockerInspectStatusCmd(d.ContainerName))
-		if err != nil {
-			// SSH failure or container not found — don't flip status on transient errors
-			log.Printf("poller: inspect deployment %s (%s): %v", d.ID, d.ContainerName, err)
-			continue
-		}
-		if strings.TrimSpace(output) != "running" {
-			_ = p.store.UpdateDeploymentStatus(d.ID, d.UserID, "stopped", "")
-			log.Printf("poller: deployment %s container %s is %q, marked stopped", d.ID, d.ContainerName, strings.TrimSpace(output))
-		}
+		add(d.NodeID, d.UserID, func(node *models.Node) healTarget {
+			containerID := d.ContainerID
+			return healTarget{
+				kind:       models.HealResourceDeployment,
+				id:         d.ID,
+				userID:     d.UserID,
+				label:      "deployment " + d.ID,
+				status:     d.Status,
+				policy:     d.HealPolicy,
+				containers: []string{d.ContainerName},
+				setStatus: func(status string) {
+					if status == "stopped" {
+						containerID = ""
+					}
+					_ = p.store.UpdateDeploymentStatus(d.ID, d.UserID, status, containerID)
+				},
+				recreate: func() error {
+					id, err := p.deployer.RecreateDeployment(d, node)
+					if err != nil {
+						return err
+					}
+					containerID = id
+					_ = p.store.UpdateDeploymentLastDeployedAt(d.ID, d.UserID, time.Now().UTC())
+					return nil
+				},
+			}
+		})
 	}
 }
 
-func (p *Poller) reconcileDatabases() {
+func (p *Poller) databaseTargets(add addTarget) {
 	dbs, err := p.store.ListAllRunningDatabases()
 	if err != nil {
 		log.Printf("poller: list running databases for health check: %v", err)
 		return
 	}
 	for _, db := range dbs {
-		node, err := p.store.GetNode(db.NodeID, db.UserID)
-		if err != nil || node == nil {
-			continue
-		}
-		runner := sshexec.NewRunner(node)
-		output, err := runner.Run(sshexec.DockerInspectStatusCmd(db.ContainerName))
-		if err != nil {
-			log.Printf("poller: inspect database %s (%s): %v", db.ID, db.ContainerName, err)
-			continue
-		}
-		if strings.TrimSpace(output) != "running" {
-			_ = p.store.UpdateDatabaseStatus(db.ID, db.UserID, "stopped")
-			log.Printf("poller: database %s container %s is %q, marked stopped", db.ID, db.ContainerName, strings.TrimSpace(output))
-		}
+		add(db.NodeID, db.UserID, func(node *models.Node) healTarget {
+			return healTarget{
+				kind:       models.HealResourceDatabase,
+				id:         db.ID,
+				userID:     db.UserID,
+				label:      "database " + db.ID,
+				status:     db.Status,
+				policy:     db.HealPolicy,
+				containers: []string{db.ContainerName},
+				setStatus: func(status string) {
+					_ = p.store.UpdateDatabaseStatus(db.ID, db.UserID, status)
+				},
+				recreate: func() error {
+					full, err := p.store.GetDatabase(db.ID, db.UserID)
+					if err != nil {
+						return err
+					}
+					if full == nil {
+						return fmt.Errorf("database not found")
+					}
+					full.UserID = db.UserID
+					return p.deployer.RecreateDatabase(full, node)
+				},
+			}
+		})
 	}
 }
 
-func (p *Poller) reconcileCaches() {
+func (p *Poller) cacheTargets(add addTarget) {
 	caches, err := p.store.ListAllRunningCaches()
 	if err != nil {
 		log.Printf("poller: list running caches for health check: %v", err)
 		return
 	}
 	for _, c := range caches {
-		node, err := p.store.GetNode(c.NodeID, c.UserID)
-		if err != nil || node == nil {
-			continue
-		}
-		runner := sshexec.NewRunner(node)
-		output, err := runner.Run(sshexec.DockerInspectStatusCmd(c.ContainerName))
-		if err != nil {
-			log.Printf("poller: inspect cache %s (%s): %v", c.ID, c.ContainerName, err)
-			continue
-		}
-		if strings.TrimSpace(output) != "running" {
-			_ = p.store.UpdateCacheStatus(c.ID, c.UserID, "stopped")
-			log.Printf("poller: cache %s container %s is %q, marked stopped", c.ID, c.ContainerName, strings.TrimSpace(output))
-		}
+		add(c.NodeID, c.UserID, func(node *models.Node) healTarget {
+			return healTarget{
+				kind:       models.HealResourceCache,
+				id:         c.ID,
+				userID:     c.UserID,
+				label:      "cache " + c.ID,
+				status:     c.Status,
+				policy:     c.HealPolicy,
+				containers: []string{c.ContainerName},
+				setStatus: func(status string) {
+					_ = p.store.UpdateCacheStatus(c.ID, c.UserID, status)
+				},
+				recreate: func() error {
+					full, err := p.store.GetCache(c.ID, c.UserID)
+					if err != nil {
+						return err
+					}
+					if full == nil {
+						return fmt.Errorf("cache not found")
+					}
+					full.UserID = c.UserID
+					return p.deployer.RecreateCache(full, node)
+				},
+			}
+		})
 	}
 }
 
-func (p *Poller) reconcileKafkas() {
+func (p *Poller) kafkaTargets(add addTarget) {
 	kafkas, err := p.store.ListAllRunningKafkas()
 	if err != nil {
 		log.Printf("poller: list running kafka clusters for health check: %v", err)
 		return
 	}
 	for _, k := range kafkas {
-		node, err := p.store.GetNode(k.NodeID, k.UserID)
-		if err != nil || node == nil {
-			continue
-		}
-		runner := sshexec.NewRunner(node)
-		output, err := runner.Run(sshexec.DockerInspectStatusCmd(k.ContainerName))
-		if err != nil {
-			log.Printf("poller: inspect kafka %s (%s): %v", k.ID, k.ContainerName, err)
-			continue
-		}
-		if strings.TrimSpace(output) != "running" {
-			_ = p.store.UpdateKafkaStatus(k.ID, k.UserID, "stopped")
-			log.Printf("poller: kafka %s container %s is %q, marked stopped", k.ID, k.ContainerName, strings.TrimSpace(output))
-		}
+		add(k.NodeID, k.UserID, func(node *models.Node) healTarget {
+			return healTarget{
+				kind:       models.HealResourceKafka,
+				id:         k.ID,
+				userID:     k.UserID,
+				label:      "kafka " + k.ID,
+				status:     k.Status,
+				policy:     k.HealPolicy,
+				containers: []string{k.ContainerName},
+				setStatus: func(status string) {
+					_ = p.store.UpdateKafkaStatus(k.ID, k.UserID, status)
+				},
+				recreate: func() error {
+					full, err := p.store.GetKafka(k.ID, k.UserID)
+					if err != nil {
+						return err
+					}
+					if full == nil {
+						return fmt.Errorf("kafka cluster not found")
+					}
+					full.UserID = k.UserID
+					return p.deployer.RecreateKafka(full, node)
+				},
+			}
+		})
 	}
 }
 
-func (p *Poller) reconcileMonitorings() {
+func (p *Poller) monitoringTargets(add addTarget) {
 	monitorings, err := p.store.ListAllRunningMonitorings()
 	if err != nil {
 		log.Printf("poller: list running monitoring stacks for health check: %v", err)
 		return
 	}
 	for _, m := range monitorings {
-		node, err := p.store.GetNode(m.NodeID, m.UserID)
-		if err != nil || node == nil {
-			continue
-		}
-		runner := sshexec.NewRunner(node)
-		output, err := runner.Run(sshexec.DockerInspectStatusCmd(m.PrometheusContainerName))
-		if err != nil {
-			log.Printf("poller: inspect monitoring %s (%s): %v", m.ID, m.PrometheusContainerName, err)
-			continue
-		}
-		if strings.TrimSpace(output) != "running" {
-			_ = p.store.UpdateMonitoringStatus(m.ID, m.UserID, "stopped")
-			log.Printf("poller: monitoring %s prometheus container %s is %q, marked stopped", m.ID, m.PrometheusContainerName, strings.TrimSpace(output))
+		containers := []string{m.PrometheusContainerName}
+		if m.GrafanaContainerName != "" {
+			containers = append(containers, m.GrafanaContainerName)
 		}
+		add(m.NodeID, m.UserID, func(node *models.Node) healTarget {
+			return healTarget{
+				kind:       models.HealResourceMonitoring,
+				id:         m.ID,
+				userID:     m.UserID,
+				label:      "monitoring " + m.ID,
+				status:     m.Status,
+				policy:     m.HealPolicy,
+				containers: containers,
+				setStatus: func(status string) {
+					_ = p.store.UpdateMonitoringStatus(m.ID, m.UserID, status)
+				},
+				recreate: func() error {
+					full, err := p.store.GetMonitoring(m.ID, m.UserID)
+					if err != nil {
+						return err
+					}
+					if full == nil {
+						return fmt.Errorf("monitoring stack not found")
+					}
+					full.UserID = m.UserID
+					return p.deployer.RecreateMonitoring(full, node)
+				},
+			}
+		})
 	}
 }
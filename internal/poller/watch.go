@@ -0,0 +1,300 @@
+package poller
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/events"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+const (
+	// eventsSyncInterval is how often streams are opened for new nodes and
+	// closed for deleted ones.
+	eventsSyncInterval = 30 * time.Second
+	// eventsRetryBase is the wait before reopening a dropped stream; it
+	// doubles while reconnects keep failing, up to eventsRetryMax.
+	eventsRetryBase = 2 * time.Second
+	eventsRetryMax  = time.Minute
+	// eventsDebounce folds the events of a node into one check, e.g. the die
+	// and start of a container being recreated.
+	eventsDebounce = 2 * time.Second
+	// eventsFallbackTicks is how many health-check ticks a node with a live
+	// stream goes without a full check, in case an event was missed.
+	eventsFallbackTicks = 5
+)
+
+// nodeWatch is the events stream of one node. live is set while the stream
+// is connected; checked is when the node was last fully checked.
+type nodeWatch struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	live    bool
+	checked time.Time
+	pending *time.Timer // debounced check
+	// resources maps the node's container names to the deployment or
+	// resource they belong to, as of the stream's start or the last debounced
+	// check, so events are applied without reading every resource table.
+	resources map[string]healTarget
+}
+
+// setResources replaces the container to resource map with the one of b.
+func (w *nodeWatch) setResources(b *nodeBatch) {
+	resources := map[string]healTarget{}
+	for _, t := range b.targets {
+		for _, name := range t.containers {
+			resources[name] = t
+		}
+	}
+	w.mu.Lock()
+	w.resources = resources
+	w.mu.Unlock()
+}
+
+func (w *nodeWatch) resource(container string) (healTarget, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	t, ok := w.resources[container]
+	return t, ok
+}
+
+func (w *nodeWatch) setLive(live bool) {
+	w.mu.Lock()
+	w.live = live
+	w.mu.Unlock()
+}
+
+func (w *nodeWatch) isLive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.live
+}
+
+// watchEvents keeps a docker events stream open to every node until ctx is
+// cancelled.
+func (p *Poller) watchEvents(ctx context.Context) {
+	ticker := time.NewTicker(eventsSyncInterval)
+	defer ticker.Stop()
+	for {
+		p.syncWatches(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncWatches starts a stream for every node without one and stops the
+// streams of nodes that no longer exist.
+func (p *Poller) syncWatches(ctx context.Context) {
+	nodes, err := p.store.ListAllNodes()
+	if err != nil {
+		log.Printf("poller: list nodes for events: %v", err)
+		return
+	}
+	keep := map[string]bool{}
+	p.watchMu.Lock()
+	defer p.watchMu.Unlock()
+	for _, n := range nodes {
+		keep[n.ID] = true
+		if p.watches[n.ID] != nil {
+			continue
+		}
+		wctx, cancel := context.WithCancel(ctx)
+		w := &nodeWatch{cancel: cancel}
+		p.watches[n.ID] = w
+		go p.watchNode(wctx, n.ID, w)
+	}
+	for id, w := range p.watches {
+		if !keep[id] {
+			w.cancel()
+			delete(p.watches, id)
+		}
+	}
+}
+
+// watchNode follows the docker events of a node until ctx is cancelled,
+// reopening the stream whenever it drops.
+func (p *Poller) watchNode(ctx context.Context, nodeID string, w *nodeWatch) {
+	wait := eventsRetryBase
+	for {
+		started := time.Now()
+		p.streamNode(ctx, nodeID, w)
+		w.setLive(false)
+		if time.Since(started) > eventsRetryMax {
+			wait = eventsRetryBase
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > eventsRetryMax {
+			wait = eventsRetryMax
+		}
+	}
+}
+
+// streamNode runs one docker events stream of the node. Every event is
+// published on the event bus and schedules a check of the node; so does
+// connecting, to catch up on what happened while the stream was down.
+func (p *Poller) streamNode(ctx context.Context, nodeID string, w *nodeWatch) {
+	// A node the health check found unreachable is left to it to probe.
+	if !p.breaker.allow(nodeID, time.Now()) {
+		return
+	}
+	batches, err := p.nodeBatches(nodeID)
+	if err != nil || len(batches) == 0 {
+		return
+	}
+	node := batches[0].node
+	w.setResources(batches[0])
+	err = sshexec.NewRunner(node).Stream(ctx, sshexec.DockerEventsCmd(), func(line string) {
+		if line == sshexec.EventsReady {
+			w.setLive(true)
+			p.scheduleCheck(nodeID, w)
+			return
+		}
+		e, err := sshexec.ParseDockerEvent(line)
+		if err != nil {
+			log.Printf("poller: events of node %s: %v", node.Name, err)
+			return
+		}
+		t, ok := w.resource(e.Container)
+		p.publishEvent(node, t, e)
+		if ok {
+			p.applyEvent(t, e)
+		}
+		p.scheduleCheck(nodeID, w)
+	})
+	if w.isLive() && ctx.Err() == nil {
+		log.Printf("poller: events stream of node %s dropped: %v", node.Name, err)
+	}
+}
+
+// publishEvent publishes e on the event bus with t, the resource its
+// container belongs to, if any.
+func (p *Poller) publishEvent(node *models.Node, t healTarget, e *sshexec.ContainerEvent) {
+	events.Publish(events.Event{
+		UserID:       node.UserID,
+		NodeID:       node.ID,
+		Container:    e.Container,
+		Action:       e.Action,
+		Health:       e.Health,
+		ExitCode:     e.ExitCode,
+		ResourceType: t.kind,
+		ResourceID:   t.id,
+		Time:         e.Time,
+	})
+}
+
+// applyEvent writes the status or health that e reports for the container of
+// t right away. A running resource whose container died or ran out of memory
+// is marked failed, or stopped after a clean exit; with a restart or recreate
+// heal policy it is marked restarting instead, so the debounced check heals
+// it. A stopped or failed resource whose container started again is marked
+// running. Statuses the heal loop owns, such as restarting and crash_loop,
+// are left to it.
+func (p *Poller) applyEvent(t healTarget, e *sshexec.ContainerEvent) {
+	if e.Action == "health_status" {
+		if err := p.store.UpdateResourceHealth(t.kind, t.id, e.Health); err != nil {
+			log.Printf("poller: record health of %s: %v", t.label, err)
+		}
+		return
+	}
+	status, err := p.store.GetResourceStatus(t.kind, t.id)
+	if err != nil || status == "" {
+		return
+	}
+	next := status
+	switch e.Action {
+	case "start":
+		if status == "stopped" || status == "failed" {
+			next = "running"
+		}
+	case "die", "oom":
+		if status != "running" {
+			break
+		}
+		switch {
+		case t.policy == models.HealPolicyRestart || t.policy == models.HealPolicyRecreate:
+			next = "restarting"
+		case e.Action == "oom" || e.ExitCode != "0":
+			next = "failed"
+		default:
+			next = "stopped"
+		}
+	}
+	// A new or dead container has no health yet.
+	_ = p.store.UpdateResourceHealth(t.kind, t.id, "")
+	if next == status {
+		return
+	}
+	t.setStatus(next)
+	log.Printf("poller: %s container %s %s, marked %s", t.label, e.Container, e.Action, next)
+	p.audit(t, "status.update", status, next, nil)
+}
+
+// scheduleCheck checks the node eventsDebounce from now, unless a check is
+// already scheduled. The check also refreshes the watch's container map.
+func (p *Poller) scheduleCheck(nodeID string, w *nodeWatch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending != nil {
+		return
+	}
+	w.pending = time.AfterFunc(eventsDebounce, func() {
+		w.mu.Lock()
+		w.pending = nil
+		w.mu.Unlock()
+		batches, err := p.nodeBatches(nodeID)
+		if err != nil {
+			log.Printf("poller: list node %s for events: %v", nodeID, err)
+			return
+		}
+		if len(batches) == 1 {
+			w.setResources(batches[0])
+			p.reconcileNode(batches[0])
+		}
+	})
+}
+
+// streaming reports whether the node's events stream is live and the node
+// had a full check recently enough for the health check to skip it.
+func (p *Poller) streaming(nodeID string) bool {
+	p.watchMu.Lock()
+	w := p.watches[nodeID]
+	p.watchMu.Unlock()
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.live && time.Since(w.checked) < eventsFallbackTicks*p.statusInterval
+}
+
+// markChecked records a full check of the node.
+func (p *Poller) markChecked(nodeID string) {
+	p.watchMu.Lock()
+	w := p.watches[nodeID]
+	p.watchMu.Unlock()
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.checked = time.Now()
+	w.mu.Unlock()
+}
+
+// lockNode locks the node against concurrent checks and returns the unlock.
+func (p *Poller) lockNode(nodeID string) func() {
+	v, _ := p.nodeLocks.LoadOrStore(nodeID, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
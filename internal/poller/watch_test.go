@@ -0,0 +1,92 @@
+package poller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/events"
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"github.com/gsarma/localisprod-v2/internal/store"
+)
+
+func TestPublishEvent_UsesCachedResources(t *testing.T) {
+	ch, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	// No store: attributing an event must not read the resource tables.
+	p := &Poller{}
+	node := &models.Node{ID: "node-1", UserID: "user-1"}
+	w := &nodeWatch{}
+	w.setResources(&nodeBatch{node: node, targets: []healTarget{
+		{kind: models.HealResourceDeployment, id: "dep-1", containers: []string{"localisprod-api-1"}},
+	}})
+
+	for _, e := range []*sshexec.ContainerEvent{
+		{Container: "localisprod-api-1", Action: "die", Time: time.Now()},
+		{Container: "unmanaged", Action: "start", Time: time.Now()},
+	} {
+		target, _ := w.resource(e.Container)
+		p.publishEvent(node, target, e)
+	}
+
+	if e := <-ch; e.ResourceType != models.HealResourceDeployment || e.ResourceID != "dep-1" {
+		t.Errorf("managed container event attributed to %q %q", e.ResourceType, e.ResourceID)
+	}
+	if e := <-ch; e.ResourceType != "" || e.ResourceID != "" {
+		t.Errorf("unmanaged container event attributed to %q %q", e.ResourceType, e.ResourceID)
+	}
+}
+
+func TestApplyEvent_WritesStatusAndHealth(t *testing.T) {
+	s, err := store.New(":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &models.Node{ID: "node-1", Name: "node", Host: "127.0.0.1", Port: 22, Username: "root", Status: "online", IsLocal: true, CreatedAt: time.Now().UTC()}
+	svc := &models.Service{ID: "svc-1", Name: "api", DockerImage: "nginx:latest", EnvVars: "{}", Ports: "[]", Routes: "[]", CreatedAt: time.Now().UTC()}
+	dep := &models.Deployment{ID: "dep-1", ServiceID: svc.ID, NodeID: node.ID, ContainerName: "localisprod-api-1", ContainerID: "abc", Status: "running", HealPolicy: models.HealPolicyObserve, CreatedAt: time.Now().UTC()}
+	if err := s.CreateNode(node, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateService(svc, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateDeployment(dep, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := New(s, time.Minute, time.Minute)
+	batches, err := p.nodeBatches(node.ID)
+	if err != nil || len(batches) != 1 {
+		t.Fatalf("nodeBatches: %v, %d batches", err, len(batches))
+	}
+	w := &nodeWatch{}
+	w.setResources(batches[0])
+	apply := func(e *sshexec.ContainerEvent) *models.Deployment {
+		t.Helper()
+		target, ok := w.resource(e.Container)
+		if !ok {
+			t.Fatalf("container %s not mapped", e.Container)
+		}
+		p.applyEvent(target, e)
+		got, err := s.GetDeployment(dep.ID, "user-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	got := apply(&sshexec.ContainerEvent{Container: dep.ContainerName, Action: "health_status", Health: "unhealthy"})
+	if got.Health != "unhealthy" || got.Status != "running" {
+		t.Errorf("after unhealthy: status %q, health %q", got.Status, got.Health)
+	}
+	got = apply(&sshexec.ContainerEvent{Container: dep.ContainerName, Action: "die", ExitCode: "1"})
+	if got.Status != "failed" || got.Health != "" {
+		t.Errorf("after die: status %q, health %q", got.Status, got.Health)
+	}
+	got = apply(&sshexec.ContainerEvent{Container: dep.ContainerName, Action: "start"})
+	if got.Status != "running" {
+		t.Errorf("after start: status %q", got.Status)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/google/uuid"
+	"github.com/gsarma/localisprod-v2/internal/providers/cloudinit"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -197,6 +199,32 @@ func ensureSecurityGroup(ctx context.Context, ec2Client *ec2.Client) (string, er
 	return sgID, nil
 }
 
+// consoleHostKey polls the instance's console output until cloud-init has
+// printed the host key it generated, and returns it in pinned form. It gives
+// up and returns "" at the deadline or when ctx ends, leaving the key to be
+// pinned on first contact.
+func consoleHostKey(ctx context.Context, ec2Client *ec2.Client, instanceID string, deadline time.Time) string {
+	for time.Now().Before(deadline) {
+		out, err := ec2Client.GetConsoleOutput(ctx, &ec2.GetConsoleOutputInput{
+			InstanceId: aws.String(instanceID),
+			Latest:     aws.Bool(true),
+		})
+		if err == nil && out.Output != nil {
+			if console, err := base64.StdEncoding.DecodeString(aws.ToString(out.Output)); err == nil {
+				if key := cloudinit.HostKeyFromConsole(string(console)); key != "" {
+					return key
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ""
+		case <-time.After(10 * time.Second):
+		}
+	}
+	return ""
+}
+
 // ValidateCredentials checks that the AWS credentials are valid by calling
 // STS GetCallerIdentity, which requires no special permissions.
 func ValidateCredentials(ctx context.Context, accessKey, secretKey string) error {
@@ -215,21 +243,23 @@ func ValidateCredentials(ctx context.Context, accessKey, secretKey string) error
 }
 
 // ProvisionInstance creates an EC2 instance, waits for it to be running,
-// and returns (host IP, instance ID, private key PEM, error).
-func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instanceType, osID, name string) (host, instanceID, privateKeyPEM string, err error) {
+// and returns (host IP, instance ID, private key PEM, SSH host key, error).
+// The host key is the one the instance generated and printed to its console,
+// or "" if it did not show up in time.
+func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instanceType, osID, name string) (host, instanceID, privateKeyPEM, hostKey string, err error) {
 	cfg, err := config.LoadDefaultConfig(ctx,
 		config.WithRegion(region),
 		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")),
 	)
 	if err != nil {
-		return "", "", "", fmt.Errorf("load AWS config: %w", err)
+		return "", "", "", "", fmt.Errorf("load AWS config: %w", err)
 	}
 
 	ec2Client := ec2.NewFromConfig(cfg)
 
 	privPEM, pubKey, err := generateED25519KeyPair()
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", "", err
 	}
 
 	// Import key pair
@@ -239,7 +269,7 @@ func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instan
 		PublicKeyMaterial: []byte(pubKey),
 	})
 	if err != nil {
-		return "", "", "", fmt.Errorf("import key pair: %w", err)
+		return "", "", "", "", fmt.Errorf("import key pair: %w", err)
 	}
 	// Cleanup key pair after provisioning
 	defer func() {
@@ -251,13 +281,13 @@ func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instan
 	// Ensure security group
 	sgID, err := ensureSecurityGroup(ctx, ec2Client)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", "", err
 	}
 
 	// Get AMI ID
 	amiID, err := GetAMI(ctx, cfg, region, osID)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", "", err
 	}
 
 	// Launch instance
@@ -268,6 +298,7 @@ func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instan
 		MaxCount:         aws.Int32(1),
 		KeyName:          aws.String(keyName),
 		SecurityGroupIds: []string{sgID},
+		UserData:         aws.String(base64.StdEncoding.EncodeToString([]byte(cloudinit.HostKeyUserData))),
 		TagSpecifications: []ec2types.TagSpecification{
 			{
 				ResourceType: ec2types.ResourceTypeInstance,
@@ -279,10 +310,10 @@ func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instan
 		},
 	})
 	if err != nil {
-		return "", "", "", fmt.Errorf("run instances: %w", err)
+		return "", "", "", "", fmt.Errorf("run instances: %w", err)
 	}
 	if len(runOut.Instances) == 0 {
-		return "", "", "", fmt.Errorf("no instance returned from RunInstances")
+		return "", "", "", "", fmt.Errorf("no instance returned from RunInstances")
 	}
 
 	ec2InstanceID := aws.ToString(runOut.Instances[0].InstanceId)
@@ -293,7 +324,7 @@ func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instan
 	for time.Now().Before(deadline) {
 		select {
 		case <-ctx.Done():
-			return "", "", "", ctx.Err()
+			return "", "", "", "", ctx.Err()
 		default:
 		}
 
@@ -301,7 +332,7 @@ func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instan
 			InstanceIds: []string{ec2InstanceID},
 		})
 		if err != nil {
-			return "", "", "", fmt.Errorf("describe instance: %w", err)
+			return "", "", "", "", fmt.Errorf("describe instance: %w", err)
 		}
 		if len(descOut.Reservations) > 0 && len(descOut.Reservations[0].Instances) > 0 {
 			inst := descOut.Reservations[0].Instances[0]
@@ -316,8 +347,11 @@ func ProvisionInstance(ctx context.Context, accessKey, secretKey, region, instan
 	}
 
 	if publicIP == "" {
-		return "", "", "", fmt.Errorf("instance did not become running within 5 minutes")
+		return "", "", "", "", fmt.Errorf("instance did not become running within 5 minutes")
 	}
 
-	return publicIP, ec2InstanceID, privPEM, nil
+	// The host generated its own key; read it back from the console.
+	hostKey = consoleHostKey(ctx, ec2Client, ec2InstanceID, time.Now().Add(3*time.Minute))
+
+	return publicIP, ec2InstanceID, privPEM, hostKey, nil
 }
@@ -0,0 +1,50 @@
+// Package cloudinit holds the cloud-init user data shared by the cloud
+// providers nodes are provisioned on.
+package cloudinit
+
+import (
+	"strings"
+
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+// HostKeyUserData is cloud-init user data that replaces any SSH host keys
+// baked into the image with an ed25519 key generated on the host, and prints
+// its public half to the console so it can be read back with
+// HostKeyFromConsole. The private key never leaves the host.
+const HostKeyUserData = `#cloud-config
+ssh_deletekeys: true
+ssh_genkeytypes: [ed25519]
+ssh:
+  emit_keys_to_console: true
+ssh_key_console_blacklist: []
+`
+
+const (
+	keysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	keysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// HostKeyFromConsole returns the ed25519 host key cloud-init printed to the
+// console, in pinned form, or "" if the console output does not hold one yet.
+// Console lines may carry a prefix such as "ec2: ", which is skipped.
+func HostKeyFromConsole(output string) string {
+	inKeys := false
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.Contains(line, keysBegin):
+			inKeys = true
+		case strings.Contains(line, keysEnd):
+			inKeys = false
+		case inKeys:
+			i := strings.Index(line, "ssh-ed25519 ")
+			if i < 0 {
+				continue
+			}
+			if key, err := sshexec.NormalizeHostKey(line[i:]); err == nil {
+				return key
+			}
+		}
+	}
+	return ""
+}
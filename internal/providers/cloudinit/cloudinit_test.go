@@ -0,0 +1,35 @@
+package cloudinit_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/providers/cloudinit"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeyFromConsole(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sshexec.MarshalHostKey(key)
+
+	console := "[   12.345678] cloud-init[812]: Generating public/private ed25519 key pair.\n" +
+		"ec2: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBogusBogusBogusBogusBogusBogusBogusBogus\n" +
+		"ec2: -----BEGIN SSH HOST KEY KEYS-----\n" +
+		"ec2: " + want + " root@ip-10-0-0-5\n" +
+		"ec2: -----END SSH HOST KEY KEYS-----\n"
+	if got := cloudinit.HostKeyFromConsole(console); got != want {
+		t.Errorf("HostKeyFromConsole = %q, want %q", got, want)
+	}
+	if got := cloudinit.HostKeyFromConsole("[    1.0] Booting\n"); got != "" {
+		t.Errorf("HostKeyFromConsole before cloud-init ran = %q, want empty", got)
+	}
+}
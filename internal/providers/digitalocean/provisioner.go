@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/digitalocean/godo"
+	"github.com/gsarma/localisprod-v2/internal/providers/cloudinit"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -152,7 +153,9 @@ func generateED25519KeyPair() (privateKeyPEM string, authorizedKey string, err e
 }
 
 // ProvisionDroplet creates a new DigitalOcean Droplet, waits for it to be active,
-// and returns (host IP, droplet ID, private key PEM, error).
+// and returns (host IP, droplet ID, private key PEM, error). The droplet
+// generates its own SSH host key, which DigitalOcean offers no way to read back,
+// so it is pinned on first contact.
 func ProvisionDroplet(ctx context.Context, token, region, size, image, name string) (host, instanceID, privateKeyPEM string, err error) {
 	client := newClient(token)
 
@@ -186,6 +189,7 @@ func ProvisionDroplet(ctx context.Context, token, region, size, image, name stri
 		SSHKeys: []godo.DropletCreateSSHKey{
 			{ID: doKey.ID},
 		},
+		UserData: cloudinit.HostKeyUserData,
 	}
 	droplet, _, err := client.Droplets.Create(ctx, createReq)
 	if err != nil {
@@ -0,0 +1,221 @@
+package sshexec
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// parseSigner parses an OpenSSH or PEM private key, decrypting it with
+// passphrase when it is protected.
+func parseSigner(privateKey, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("parse private key: %w", err)
+		}
+		return signer, nil
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("parse private key: the key is passphrase-protected; set key_passphrase")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+	return signer, nil
+}
+
+// parseUserCertificate parses an OpenSSH user certificate and checks that it
+// certifies signer's key.
+func parseUserCertificate(certificate string, signer ssh.Signer) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(certificate))
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("certificate is a plain public key, not an OpenSSH certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("certificate is a host certificate, not a user certificate")
+	}
+	if signer != nil && string(cert.Key.Marshal()) != string(signer.PublicKey().Marshal()) {
+		return nil, errors.New("certificate does not certify the private key")
+	}
+	return cert, nil
+}
+
+// authMethods returns the ways c logs in, in order of preference: the
+// certificate, the private key, then the password.
+func (c *Client) authMethods() ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if c.privateKey != "" {
+		signer, err := parseSigner(c.privateKey, c.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signers := []ssh.Signer{signer}
+		if c.certificate != "" {
+			cert, err := parseUserCertificate(c.certificate, signer)
+			if err != nil {
+				return nil, err
+			}
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, fmt.Errorf("certificate signer: %w", err)
+			}
+			signers = []ssh.Signer{certSigner, signer}
+		}
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if c.password != "" {
+		password := c.password
+		methods = append(methods,
+			ssh.Password(password),
+			// Servers with PasswordAuthentication off often still prompt
+			// for the password through keyboard-interactive.
+			ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}),
+		)
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH credentials: set a private key or a password")
+	}
+	return methods, nil
+}
+
+// ValidateCredentials checks that a passphrase opens the private key and that
+// a certificate certifies it, without connecting. A plain key is only parsed
+// when it is first used.
+func ValidateCredentials(privateKey, passphrase, certificate string) error {
+	if passphrase == "" && certificate == "" {
+		return nil
+	}
+	if privateKey == "" {
+		return errors.New("key_passphrase and certificate need a private_key")
+	}
+	signer, err := parseSigner(privateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	if certificate != "" {
+		_, err = parseUserCertificate(certificate, signer)
+	}
+	return err
+}
+
+// PublicKey returns the public key of a private key in authorized_keys form.
+func PublicKey(privateKey, passphrase string) (string, error) {
+	signer, err := parseSigner(privateKey, passphrase)
+	if err != nil {
+		return "", err
+	}
+	return MarshalHostKey(signer.PublicKey()), nil
+}
+
+// GenerateKeyPair returns a new ed25519 key as an unencrypted OpenSSH private
+// key and its public key in authorized_keys form.
+func GenerateKeyPair() (privateKeyPEM, publicKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("generate ed25519 key: %w", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return "", "", fmt.Errorf("marshal private key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", "", fmt.Errorf("create ssh public key: %w", err)
+	}
+	return string(pem.EncodeToMemory(block)), MarshalHostKey(sshPub), nil
+}
+
+// SignUserCertificate signs publicKey with the CA private key caKey and
+// returns an OpenSSH user certificate valid for principal until validFor from
+// now, with the usual interactive-session permissions.
+func SignUserCertificate(caKey, publicKey, principal, keyID string, validFor time.Duration) (string, time.Time, error) {
+	ca, err := ssh.ParsePrivateKey([]byte(caKey))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parse CA key: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parse public key: %w", err)
+	}
+	now := time.Now()
+	validBefore := now.Add(validFor).UTC().Truncate(time.Second)
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{principal},
+		// Allow for clock skew between the control plane and the node.
+		ValidAfter:  uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore: uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{Extensions: map[string]string{
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+			"permit-port-forwarding":  "",
+			"permit-agent-forwarding": "",
+		}},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return "", time.Time{}, fmt.Errorf("sign certificate: %w", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))), validBefore, nil
+}
+
+// InstallAuthorizedKey logs into node once with password and appends
+// publicKey to the login user's authorized_keys unless it is already there.
+// The connection is not pooled, so the password is not kept. It returns the
+// host key the node presented, for pinning when the node is not stored yet.
+func InstallAuthorizedKey(node *models.Node, password, publicKey string) (string, error) {
+	c := newClient(node)
+	// Without a password the node's current credentials are used, e.g. to
+	// rotate its key.
+	if password != "" {
+		c.privateKey, c.passphrase, c.certificate, c.password = "", "", "", password
+	}
+	methods, err := c.authMethods()
+	if err != nil {
+		return "", err
+	}
+	client, err := c.dialConfig(&ssh.ClientConfig{
+		User:              c.username,
+		Auth:              methods,
+		HostKeyCallback:   c.checkHostKey,
+		HostKeyAlgorithms: hostKeyAlgorithms(c.hostKey),
+		Timeout:           15 * time.Second,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("new session: %w", err)
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(strings.TrimSpace(publicKey) + "\n")
+	cmd := `umask 077 && mkdir -p ~/.ssh && touch ~/.ssh/authorized_keys && ` +
+		`k=$(cat) && { grep -qxF "$k" ~/.ssh/authorized_keys || printf '%s\n' "$k" >> ~/.ssh/authorized_keys; }`
+	if out, err := session.CombinedOutput(cmd); err != nil {
+		return "", fmt.Errorf("install authorized key: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return c.hostKey, nil
+}
@@ -0,0 +1,122 @@
+package sshexec_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPassphraseProtectedKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := string(pem.EncodeToMemory(block))
+
+	if err := sshexec.ValidateCredentials(key, "wrong", ""); err == nil {
+		t.Error("expected error for wrong passphrase")
+	}
+	if err := sshexec.ValidateCredentials(key, "s3cret", ""); err != nil {
+		t.Errorf("ValidateCredentials: %v", err)
+	}
+
+	hostSigner, _ := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+	node := &models.Node{ID: "auth-passphrase", Host: srv.host, Port: srv.port, Username: "root", PrivateKey: key}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+	if err := sshexec.NewRunner(node).Ping(); err == nil || !strings.Contains(err.Error(), "key_passphrase") {
+		t.Errorf("expected missing passphrase error, got %v", err)
+	}
+	node.KeyPassphrase = "s3cret"
+	if err := sshexec.NewRunner(node).Ping(); err != nil {
+		t.Errorf("Ping with passphrase: %v", err)
+	}
+}
+
+func TestUserCertificate(t *testing.T) {
+	caPriv, caPub, err := sshexec.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, clientKey := newSigner(t)
+	pub := sshexec.MarshalHostKey(clientSigner.PublicKey())
+
+	cert, validBefore, err := sshexec.SignUserCertificate(caPriv, pub, "deploy", "test", time.Hour)
+	if err != nil {
+		t.Fatalf("SignUserCertificate: %v", err)
+	}
+	if time.Until(validBefore) > time.Hour || time.Until(validBefore) < 59*time.Minute {
+		t.Errorf("unexpected validity %v", validBefore)
+	}
+	if err := sshexec.ValidateCredentials(clientKey, "", cert); err != nil {
+		t.Errorf("ValidateCredentials: %v", err)
+	}
+	_, otherKey := newSigner(t)
+	if err := sshexec.ValidateCredentials(otherKey, "", cert); err == nil {
+		t.Error("expected error for a certificate of another key")
+	}
+
+	caPubKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(caPub))
+	checker := &ssh.CertChecker{IsUserAuthority: func(auth ssh.PublicKey) bool {
+		return bytes.Equal(auth.Marshal(), caPubKey.Marshal())
+	}}
+	hostSigner, _ := newSigner(t)
+	srv := startSSHServerConfig(t, hostSigner, &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate})
+
+	node := &models.Node{ID: "auth-cert", Host: srv.host, Port: srv.port, Username: "deploy", PrivateKey: clientKey}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+	if err := sshexec.NewRunner(node).Ping(); err == nil {
+		t.Fatal("expected plain key to be refused by a certificate-only server")
+	}
+	node.Certificate = cert
+	if err := sshexec.NewRunner(node).Ping(); err != nil {
+		t.Errorf("Ping with certificate: %v", err)
+	}
+}
+
+func TestPasswordAuthAndKeyInstall(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	srv := startSSHServerConfig(t, hostSigner, &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "hunter2" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	})
+
+	node := &models.Node{ID: "auth-password", Host: srv.host, Port: srv.port, Username: "root", Password: "hunter2"}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+	if err := sshexec.NewRunner(node).Ping(); err != nil {
+		t.Errorf("Ping with password: %v", err)
+	}
+
+	_, pub, err := sshexec.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	install := &models.Node{Host: srv.host, Port: srv.port, Username: "root"}
+	hostKey, err := sshexec.InstallAuthorizedKey(install, "hunter2", pub)
+	if err != nil {
+		t.Fatalf("InstallAuthorizedKey: %v", err)
+	}
+	if hostKey != sshexec.MarshalHostKey(hostSigner.PublicKey()) {
+		t.Errorf("expected presented host key, got %q", hostKey)
+	}
+	if _, err := sshexec.InstallAuthorizedKey(install, "wrong", pub); err == nil {
+		t.Error("expected error for wrong password")
+	}
+}
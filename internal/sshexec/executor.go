@@ -1,10 +1,14 @@
 package sshexec
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +21,9 @@ type Runner interface {
 	Run(cmd string) (string, error)
 	WriteFile(path, content string) error
 	Ping() error
+	// Stream runs cmd and calls onLine with each line it prints until it
+	// exits or ctx is cancelled.
+	Stream(ctx context.Context, cmd string, onLine func(line string)) error
 }
 
 // NewRunner returns a LocalRunner for local nodes, SSHClient otherwise.
@@ -24,12 +31,7 @@ func NewRunner(node *models.Node) Runner {
 	if node.IsLocal {
 		return &LocalRunner{}
 	}
-	return &Client{
-		host:       node.Host,
-		port:       node.Port,
-		username:   node.Username,
-		privateKey: node.PrivateKey,
-	}
+	return newClient(node)
 }
 
 // LocalRunner executes commands directly on the local machine via sh.
@@ -49,46 +51,92 @@ func (l *LocalRunner) Ping() error {
 	return err
 }
 
-// Client executes commands on a remote host via SSH.
+// Client executes commands on a remote host via SSH. The host must present
+// hostKey; when it is empty the first key seen is pinned for nodeID or
+// jumpHostID. Commands run as sessions on a connection pooled per host, dialed
+// through proxy when the host is only reachable via a jump host.
 type Client struct {
-	host       string
-	port       int
-	username   string
-	privateKey string
+	nodeID      string
+	jumpHostID  string
+	host        string
+	port        int
+	username    string
+	privateKey  string
+	passphrase  string // decrypts privateKey
+	certificate string // OpenSSH user certificate for privateKey
+	password    string // tried after the key
+	hostKey     string
+	proxy       *Client
+	proxyErr    error // resolving the proxy chain failed
+}
+
+func newClient(node *models.Node) *Client {
+	c := &Client{
+		nodeID:      node.ID,
+		host:        node.Host,
+		port:        node.Port,
+		username:    node.Username,
+		privateKey:  node.PrivateKey,
+		passphrase:  node.KeyPassphrase,
+		certificate: node.Certificate,
+		password:    node.Password,
+		hostKey:     node.HostKey,
+	}
+	c.proxy, c.proxyErr = proxyChain(node)
+	return c
 }
 
 func (c *Client) dial() (*ssh.Client, error) {
-	signer, err := ssh.ParsePrivateKey([]byte(c.privateKey))
+	methods, err := c.authMethods()
 	if err != nil {
-		return nil, fmt.Errorf("parse private key: %w", err)
-	}
-	config := &ssh.ClientConfig{
-		User: c.username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         15 * time.Second,
+		return nil, err
 	}
+	return c.dialConfig(&ssh.ClientConfig{
+		User:              c.username,
+		Auth:              methods,
+		HostKeyCallback:   c.checkHostKey,
+		HostKeyAlgorithms: hostKeyAlgorithms(c.hostKey),
+		Timeout:           15 * time.Second,
+	})
+}
+
+// dialConfig connects to the host directly, or through the pooled connection
+// of its proxy.
+func (c *Client) dialConfig(config *ssh.ClientConfig) (*ssh.Client, error) {
 	addr := net.JoinHostPort(c.host, fmt.Sprintf("%d", c.port))
-	client, err := ssh.Dial("tcp", addr, config)
+	if c.proxyErr != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, c.proxyErr)
+	}
+	if c.proxy == nil {
+		client, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, fmt.Errorf("dial %s: %w", addr, err)
+		}
+		return client, nil
+	}
+	proxy, err := c.proxy.conn()
+	if err != nil {
+		return nil, fmt.Errorf("dial %s via %s: %w", addr, c.proxy.host, err)
+	}
+	conn, err := proxy.Dial("tcp", addr)
+	if err != nil {
+		// The proxy may have gone away since it was pooled.
+		c.proxy.drop(proxy)
+		return nil, fmt.Errorf("dial %s via %s: %w", addr, c.proxy.host, err)
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
-		return nil, fmt.Errorf("dial %s: %w", addr, err)
+		conn.Close()
+		return nil, fmt.Errorf("dial %s via %s: %w", addr, c.proxy.host, err)
 	}
-	return client, nil
+	return ssh.NewClient(sc, chans, reqs), nil
 }
 
 func (c *Client) Run(cmd string) (string, error) {
-	client, err := c.dial()
+	session, err := c.session()
 	if err != nil {
 		return "", err
 	}
-	defer client.Close()
-
-	session, err := client.NewSession()
-	if err != nil {
-		return "", fmt.Errorf("new session: %w", err)
-	}
 	defer session.Close()
 
 	out, err := session.CombinedOutput(cmd)
@@ -98,16 +146,10 @@ func (c *Client) Run(cmd string) (string, error) {
 // WriteFile writes content to path on the remote host with mode 0600.
 // Content is piped via stdin to avoid exposing it in the process list.
 func (c *Client) WriteFile(path, content string) error {
-	client, err := c.dial()
+	session, err := c.session()
 	if err != nil {
 		return err
 	}
-	defer client.Close()
-
-	session, err := client.NewSession()
-	if err != nil {
-		return fmt.Errorf("new session: %w", err)
-	}
 	defer session.Close()
 
 	session.Stdin = strings.NewReader(content)
@@ -129,6 +171,10 @@ func DockerLoginCmd(username, token string) string {
 		shellEscape(token), shellEscape(username))
 }
 
+// ManagedLabel is set on every container DockerRunCmd starts, so the node's
+// docker events can be filtered down to the containers localisprod manages.
+const ManagedLabel = "localisprod.managed"
+
 // RunConfig holds parameters for docker run.
 type RunConfig struct {
 	ContainerName string
@@ -138,6 +184,7 @@ type RunConfig struct {
 	Command       string            // trusted raw shell fragment appended as-is (for programmatic use)
 	CommandArgs   []string          // user-supplied args: each token is individually shell-escaped
 	Network       string            // "" = no --network flag
+	Networks      []string          // additional networks connected after the container starts
 	Labels        map[string]string // arbitrary docker labels
 	Volumes       []string          // "volume-name:/mount/path"
 	Restart       string            // e.g. "unless-stopped"; "" = no --restart flag
@@ -175,6 +222,8 @@ func DockerRunCmd(cfg RunConfig) string {
 		sb.WriteString(shellEscape(cfg.Network))
 	}
 
+	sb.WriteString(" --label ")
+	sb.WriteString(ManagedLabel + "=true")
 	for k, v := range cfg.Labels {
 		sb.WriteString(" --label ")
 		sb.WriteString(shellEscape(k + "=" + v))
@@ -193,39 +242,361 @@ func DockerRunCmd(cfg RunConfig) string {
 		sb.WriteString(cfg.Command)
 	}
 
+	// docker run accepts a single --network; further networks are connected
+	// once the container exists. docker network connect prints nothing on
+	// success, so the output is still just the container ID.
+	for _, n := range cfg.Networks {
+		sb.WriteString(" && docker network connect ")
+		sb.WriteString(shellEscape(n))
+		sb.WriteString(" ")
+		sb.WriteString(shellEscape(cfg.ContainerName))
+	}
+
 	return sb.String()
 }
 
+// DockerNetworkCreateCmd returns a command that creates a bridge network unless
+// it already exists. Unlike "create || true", real failures are still reported.
+func DockerNetworkCreateCmd(name string) string {
+	n := shellEscape(name)
+	return fmt.Sprintf("docker network inspect %s >/dev/null 2>&1 || docker network create %s", n, n)
+}
+
+// DockerNetworkConnectCmd returns a command that connects an existing
+// container to a network. It succeeds when the container is already connected.
+func DockerNetworkConnectCmd(network, containerName string) string {
+	return fmt.Sprintf("docker network connect %s %s 2>/dev/null || true",
+		shellEscape(network), shellEscape(containerName))
+}
+
 // DockerVolumeCreateCmd returns a command to create a named Docker volume (idempotent).
 func DockerVolumeCreateCmd(name string) string {
 	return "docker volume create " + shellEscape(name)
 }
 
-// TraefikSetupCmd returns a shell command that installs Traefik on a node.
-func TraefikSetupCmd() string {
+// TraefikDynamicDir is the directory on a node watched by Traefik's file
+// provider. Routing that cannot be expressed as container labels (e.g. weighted
+// canary services, uploaded TLS certificates) is written here as one YAML file
+// per router or certificate.
+const TraefikDynamicDir = "/opt/localisprod/traefik/dynamic"
+
+// TraefikCertsDir holds uploaded certificate and key files on a node. It is
+// mounted into the Traefik container at /etc/traefik/certs.
+const TraefikCertsDir = "/opt/localisprod/traefik/certs"
+
+// TraefikACMEDir holds Traefik's ACME storage (acme.json) and, optionally, the
+// CA certificate of a private ACME server. It is mounted at /etc/traefik/acme.
+const TraefikACMEDir = "/opt/localisprod/traefik/acme"
+
+// TraefikACMEStoragePath is the node path of Traefik's ACME storage file.
+const TraefikACMEStoragePath = TraefikACMEDir + "/acme.json"
+
+// TraefikACMECAPath is the node path of the CA certificate Traefik trusts when
+// talking to the ACME server (e.g. a local Pebble instance).
+const TraefikACMECAPath = TraefikACMEDir + "/ca.pem"
+
+// TraefikOptions configures TLS for TraefikSetupCmd.
+type TraefikOptions struct {
+	// ACMEEmail enables the "acme" certificate resolver (HTTP-01 challenge on
+	// the web entrypoint) as the default for routers on websecure. Without it,
+	// websecure only serves uploaded certificates.
+	ACMEEmail string
+	// ACMEDirectoryURL overrides the ACME directory; empty uses Let's Encrypt.
+	ACMEDirectoryURL string
+	// ACMETrustCA makes Traefik trust TraefikACMECAPath for the ACME server.
+	ACMETrustCA bool
+}
+
+// TraefikSetupCmd returns a shell command that installs Traefik on a node with
+// a plain-HTTP entrypoint "web" on :80 and a TLS entrypoint "websecure" on :443.
+func TraefikSetupCmd(opts TraefikOptions) string {
+	run := "docker run -d --name traefik --restart unless-stopped" +
+		" -p 80:80 -p 443:443" +
+		" -v /var/run/docker.sock:/var/run/docker.sock:ro" +
+		" -v " + TraefikDynamicDir + ":/etc/traefik/dynamic:ro" +
+		" -v " + TraefikCertsDir + ":/etc/traefik/certs:ro" +
+		" -v " + TraefikACMEDir + ":/etc/traefik/acme"
+	if opts.ACMETrustCA {
+		run += " -e LEGO_CA_CERTIFICATES=/etc/traefik/acme/ca.pem"
+	}
+	run += " --network traefik-net" +
+		" traefik:v3" +
+		" --providers.docker=true" +
+		" --providers.docker.exposedbydefault=false" +
+		" --providers.docker.network=traefik-net" +
+		" --providers.file.directory=/etc/traefik/dynamic" +
+		" --providers.file.watch=true" +
+		" --entrypoints.web.address=:80" +
+		" --entrypoints.websecure.address=:443" +
+		" --entrypoints.websecure.http.tls=true"
+	if opts.ACMEEmail != "" {
+		run += " --certificatesresolvers.acme.acme.email=" + shellEscape(opts.ACMEEmail) +
+			" --certificatesresolvers.acme.acme.storage=/etc/traefik/acme/acme.json" +
+			" --certificatesresolvers.acme.acme.httpchallenge.entrypoint=web" +
+			" --entrypoints.websecure.http.tls.certresolver=acme"
+		if opts.ACMEDirectoryURL != "" {
+			run += " --certificatesresolvers.acme.acme.caserver=" + shellEscape(opts.ACMEDirectoryURL)
+		}
+	}
 	return strings.Join([]string{
 		"docker network create traefik-net 2>/dev/null || true",
+		"mkdir -p " + TraefikDynamicDir + " " + TraefikCertsDir + " " + TraefikACMEDir,
 		"docker stop traefik 2>/dev/null || true && docker rm traefik 2>/dev/null || true",
-		"docker run -d --name traefik --restart unless-stopped" +
-			" -p 80:80" +
-			" -v /var/run/docker.sock:/var/run/docker.sock:ro" +
-			" --network traefik-net" +
-			" traefik:v3" +
-			" --providers.docker=true" +
-			" --providers.docker.exposedbydefault=false" +
-			" --providers.docker.network=traefik-net" +
-			" --entrypoints.web.address=:80",
+		run,
 	}, " && ")
 }
 
-// TraefikLabels returns the docker labels needed for Traefik to route to a container.
-func TraefikLabels(routerName, domain, containerPort string) map[string]string {
-	return map[string]string{
-		"traefik.enable": "true",
-		fmt.Sprintf("traefik.http.routers.%s.rule", routerName):                      fmt.Sprintf("Host(`%s`)", domain),
-		fmt.Sprintf("traefik.http.routers.%s.entrypoints", routerName):               "web",
-		fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port", routerName): containerPort,
+// TraefikCertificatePaths returns the node paths of an uploaded certificate's
+// certificate and key files.
+func TraefikCertificatePaths(id string) (certPath, keyPath string) {
+	return fmt.Sprintf("%s/%s.crt", TraefikCertsDir, id), fmt.Sprintf("%s/%s.key", TraefikCertsDir, id)
+}
+
+// TraefikCertificateConfigName returns the file-provider config name for an
+// uploaded certificate.
+func TraefikCertificateConfigName(id string) string {
+	return "cert-" + id
+}
+
+// TraefikCertificateConfig returns file-provider YAML adding an uploaded
+// certificate to Traefik's default TLS store. Traefik picks it by SNI for any
+// websecure router whose host it covers, in preference to requesting one from
+// ACME.
+func TraefikCertificateConfig(id string) string {
+	var sb strings.Builder
+	sb.WriteString("# Managed by localisprod. Do not edit.\n")
+	sb.WriteString("tls:\n")
+	sb.WriteString("  certificates:\n")
+	fmt.Fprintf(&sb, "    - certFile: /etc/traefik/certs/%s.crt\n", id)
+	fmt.Fprintf(&sb, "      keyFile: /etc/traefik/certs/%s.key\n", id)
+	return sb.String()
+}
+
+// TraefikRouterName returns the Traefik router name for the i-th route of a
+// container.
+func TraefikRouterName(containerName string, i int) string {
+	return fmt.Sprintf("%s-r%d", containerName, i)
+}
+
+// TraefikServiceName returns the Traefik service name that load-balances to
+// port on a container.
+func TraefikServiceName(containerName, port string) string {
+	return fmt.Sprintf("%s-p%s", containerName, port)
+}
+
+// TraefikMiddlewareName returns the name of a middleware of the i-th route of
+// a container, e.g. kind "strip" or "auth".
+func TraefikMiddlewareName(containerName string, i int, kind string) string {
+	return TraefikRouterName(containerName, i) + "-" + kind
+}
+
+// TraefikRouteMiddlewares returns the middlewares of the i-th route of a
+// container, in the order requests pass them, and the labels defining them.
+func TraefikRouteMiddlewares(containerName string, i int, route models.Route) ([]string, map[string]string) {
+	var names []string
+	labels := map[string]string{}
+	add := func(kind string, options map[string]string) {
+		name := TraefikMiddlewareName(containerName, i, kind)
+		names = append(names, name)
+		for option, value := range options {
+			labels[fmt.Sprintf("traefik.http.middlewares.%s.%s", name, option)] = value
+		}
 	}
+	mw := route.Middlewares
+	if mw == nil {
+		mw = &models.RouteMiddlewares{}
+	}
+	if len(mw.IPAllowList) > 0 {
+		add("allow", map[string]string{"ipallowlist.sourcerange": strings.Join(mw.IPAllowList, ",")})
+	}
+	if len(mw.BasicAuth) > 0 {
+		add("auth", map[string]string{"basicauth.users": strings.Join(mw.BasicAuth, ",")})
+	}
+	if rl := mw.RateLimit; rl != nil {
+		options := map[string]string{"ratelimit.average": strconv.Itoa(rl.Average)}
+		if rl.Burst > 0 {
+			options["ratelimit.burst"] = strconv.Itoa(rl.Burst)
+		}
+		if rl.Period != "" {
+			options["ratelimit.period"] = rl.Period
+		}
+		add("ratelimit", options)
+	}
+	if rr := mw.RedirectRegex; rr != nil {
+		add("redirect", map[string]string{
+			"redirectregex.regex":       rr.Regex,
+			"redirectregex.replacement": rr.Replacement,
+			"redirectregex.permanent":   strconv.FormatBool(rr.Permanent),
+		})
+	}
+	if len(mw.RequestHeaders) > 0 || len(mw.ResponseHeaders) > 0 {
+		options := map[string]string{}
+		for k, v := range mw.RequestHeaders {
+			options["headers.customrequestheaders."+k] = v
+		}
+		for k, v := range mw.ResponseHeaders {
+			options["headers.customresponseheaders."+k] = v
+		}
+		add("headers", options)
+	}
+	if route.StripPrefix && route.PathPrefix != "" {
+		add("strip", map[string]string{"stripprefix.prefixes": route.PathPrefix})
+	}
+	if mw.Compress {
+		add("compress", map[string]string{"compress": "true"})
+	}
+	return names, labels
+}
+
+// TraefikRouteRule returns the Traefik rule matching route.
+func TraefikRouteRule(route models.Route) string {
+	rule := fmt.Sprintf("Host(`%s`)", route.Host)
+	if route.PathPrefix != "" {
+		rule += fmt.Sprintf(" && PathPrefix(`%s`)", route.PathPrefix)
+	}
+	return rule
+}
+
+func routePort(route models.Route, defaultPort string) string {
+	if route.ContainerPort > 0 {
+		return strconv.Itoa(route.ContainerPort)
+	}
+	return defaultPort
+}
+
+func routeEntrypoint(route models.Route) string {
+	if route.Entrypoint != "" {
+		return route.Entrypoint
+	}
+	return "web"
+}
+
+// TraefikRedirectMiddlewareName returns the name of the HTTP→HTTPS redirect
+// middleware of a container.
+func TraefikRedirectMiddlewareName(containerName string) string {
+	return containerName + "-https"
+}
+
+// TraefikLabels returns the docker labels needed for Traefik to route to a
+// container: one router per route and one service per distinct container port.
+// Routes without a ContainerPort use defaultPort. Every websecure route also
+// gets a router on web that redirects to HTTPS, unless another route already
+// serves the same rule over plain HTTP.
+func TraefikLabels(containerName string, routes []models.Route, defaultPort string) map[string]string {
+	labels := traefikLabels(containerName, routes, defaultPort, "", 0)
+	plain := map[string]bool{}
+	for _, route := range routes {
+		if routeEntrypoint(route) == "web" {
+			plain[TraefikRouteRule(route)] = true
+		}
+	}
+	redirect := TraefikRedirectMiddlewareName(containerName)
+	for i, route := range routes {
+		rule := TraefikRouteRule(route)
+		if routeEntrypoint(route) != "websecure" || plain[rule] {
+			continue
+		}
+		plain[rule] = true
+		router := TraefikRouterName(containerName, i) + "-http"
+		labels[fmt.Sprintf("traefik.http.routers.%s.rule", router)] = rule
+		labels[fmt.Sprintf("traefik.http.routers.%s.entrypoints", router)] = "web"
+		labels[fmt.Sprintf("traefik.http.routers.%s.middlewares", router)] = redirect
+		labels[fmt.Sprintf("traefik.http.routers.%s.service", router)] = TraefikServiceName(containerName, routePort(route, defaultPort))
+		labels[fmt.Sprintf("traefik.http.middlewares.%s.redirectscheme.scheme", redirect)] = "https"
+		labels[fmt.Sprintf("traefik.http.middlewares.%s.redirectscheme.permanent", redirect)] = "true"
+	}
+	return labels
+}
+
+// traefikLabels builds route labels. extraRule is ANDed onto every router rule
+// and, when priority > 0, routers get priority plus their rule length so more
+// specific rules still win among routers of the same kind.
+func traefikLabels(containerName string, routes []models.Route, defaultPort, extraRule string, priority int) map[string]string {
+	labels := map[string]string{"traefik.enable": "true"}
+	for i, route := range routes {
+		router := TraefikRouterName(containerName, i)
+		port := routePort(route, defaultPort)
+		service := TraefikServiceName(containerName, port)
+		rule := TraefikRouteRule(route) + extraRule
+		labels[fmt.Sprintf("traefik.http.routers.%s.rule", router)] = rule
+		labels[fmt.Sprintf("traefik.http.routers.%s.entrypoints", router)] = routeEntrypoint(route)
+		labels[fmt.Sprintf("traefik.http.routers.%s.service", router)] = service
+		if priority > 0 {
+			labels[fmt.Sprintf("traefik.http.routers.%s.priority", router)] = strconv.Itoa(priority + len(rule))
+		}
+		if names, mwLabels := TraefikRouteMiddlewares(containerName, i, route); len(names) > 0 {
+			for k, v := range mwLabels {
+				labels[k] = v
+			}
+			labels[fmt.Sprintf("traefik.http.routers.%s.middlewares", router)] = strings.Join(names, ",")
+		}
+		labels[fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port", service)] = port
+	}
+	return labels
+}
+
+// CanaryHeader is the request header that pins a request to the canary
+// container regardless of the configured weight.
+const CanaryHeader = "X-Localisprod-Canary"
+
+// TraefikCanaryLabels returns the docker labels for a canary container. The
+// container's Traefik services are used by the weighted services written with
+// TraefikWeightedConfig; its own routers only match requests that carry
+// CanaryHeader: always, so the canary can be tested directly.
+func TraefikCanaryLabels(containerName string, routes []models.Route, defaultPort string) map[string]string {
+	return traefikLabels(containerName, routes, defaultPort, fmt.Sprintf(" && Header(`%s`, `always`)", CanaryHeader), 2000)
+}
+
+// TraefikDynamicConfigPath returns the path of the file-provider config for name.
+func TraefikDynamicConfigPath(name string) string {
+	return fmt.Sprintf("%s/%s.yml", TraefikDynamicDir, name)
+}
+
+// TraefikWeightedConfig returns Traefik file-provider YAML that mirrors the
+// stable container's routes, sending each to a weighted service that splits
+// traffic between the stable and canary containers' docker-provider services
+// for the same port. canaryWeight is a percentage (0-100). The routers'
+// priority is above the stable container's label routers so they take over
+// the routes while the file exists; route middlewares are reused from the
+// stable container's labels.
+func TraefikWeightedConfig(name string, routes []models.Route, defaultPort, stableContainer, canaryContainer string, canaryWeight int) string {
+	var sb strings.Builder
+	sb.WriteString("# Managed by localisprod. Do not edit.\n")
+	sb.WriteString("http:\n")
+	sb.WriteString("  routers:\n")
+	var ports []string
+	seen := map[string]bool{}
+	for i, route := range routes {
+		port := routePort(route, defaultPort)
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+		rule := TraefikRouteRule(route)
+		fmt.Fprintf(&sb, "    %s:\n", TraefikRouterName(name, i))
+		fmt.Fprintf(&sb, "      rule: %q\n", rule)
+		sb.WriteString("      entryPoints:\n")
+		fmt.Fprintf(&sb, "        - %s\n", routeEntrypoint(route))
+		fmt.Fprintf(&sb, "      priority: %d\n", 1000+len(rule))
+		if names, _ := TraefikRouteMiddlewares(stableContainer, i, route); len(names) > 0 {
+			sb.WriteString("      middlewares:\n")
+			for _, name := range names {
+				fmt.Fprintf(&sb, "        - %s@docker\n", name)
+			}
+		}
+		fmt.Fprintf(&sb, "      service: %s\n", TraefikServiceName(name, port))
+	}
+	sb.WriteString("  services:\n")
+	for _, port := range ports {
+		fmt.Fprintf(&sb, "    %s:\n", TraefikServiceName(name, port))
+		sb.WriteString("      weighted:\n")
+		sb.WriteString("        services:\n")
+		fmt.Fprintf(&sb, "          - name: %s@docker\n", TraefikServiceName(stableContainer, port))
+		fmt.Fprintf(&sb, "            weight: %d\n", 100-canaryWeight)
+		fmt.Fprintf(&sb, "          - name: %s@docker\n", TraefikServiceName(canaryContainer, port))
+		fmt.Fprintf(&sb, "            weight: %d\n", canaryWeight)
+	}
+	return sb.String()
 }
 
 // DockerInspectStatusCmd returns a command that prints the container's State.Status
@@ -234,6 +605,12 @@ func DockerInspectStatusCmd(containerName string) string {
 	return fmt.Sprintf("docker inspect --format='{{.State.Status}}' %s", shellEscape(containerName))
 }
 
+// DockerImageIDCmd returns a command that prints the ID (sha256:…) of the
+// image a container runs. Exits non-zero if the container doesn't exist.
+func DockerImageIDCmd(containerName string) string {
+	return fmt.Sprintf("docker inspect --format='{{.Image}}' %s", shellEscape(containerName))
+}
+
 func DockerPullCmd(image string) string {
 	return "docker pull " + shellEscape(image)
 }
@@ -242,10 +619,67 @@ func DockerStopRemoveCmd(containerName string) string {
 	return fmt.Sprintf("docker stop %s && docker rm %s", shellEscape(containerName), shellEscape(containerName))
 }
 
+// DockerForceRemoveCmd removes a container whether or not it is running.
+// Succeeds when the container does not exist.
+func DockerForceRemoveCmd(containerName string) string {
+	return fmt.Sprintf("docker rm -f %s 2>/dev/null || true", shellEscape(containerName))
+}
+
 func DockerRestartCmd(containerName string) string {
 	return fmt.Sprintf("docker restart %s", shellEscape(containerName))
 }
 
+func DockerStartCmd(containerName string) string {
+	return fmt.Sprintf("docker start %s", shellEscape(containerName))
+}
+
+// ContainerMissing is printed by ContainerStateCmd when the container does not exist.
+const ContainerMissing = "missing"
+
+// ContainerStateCmd returns a command that prints the container's State.Status,
+// or ContainerMissing when no such container exists on the node. Unlike
+// DockerInspectStatusCmd it exits zero in both cases, so a non-nil error from
+// the runner always means the node itself could not be reached.
+func ContainerStateCmd(containerName string) string {
+	return fmt.Sprintf("docker inspect --format='{{.State.Status}}' %s 2>/dev/null || echo %s",
+		shellEscape(containerName), ContainerMissing)
+}
+
+// dockerUnavailable is printed by ContainerStatesCmd when docker ps fails.
+const dockerUnavailable = "docker-unavailable"
+
+// ContainerStatesCmd returns a command that prints every container on the node,
+// running or not, as one JSON object per line. Like ContainerStateCmd it exits
+// zero when docker itself fails, so a runner error means the node could not be
+// reached.
+func ContainerStatesCmd() string {
+	return `docker ps -a --no-trunc --format '{{json .}}' 2>/dev/null || echo ` + dockerUnavailable
+}
+
+// ParseContainerStates parses the output of ContainerStatesCmd into each
+// container's state (running, exited, ...) keyed by container name. Lines that
+// do not parse are skipped.
+func ParseContainerStates(output string) (map[string]string, error) {
+	states := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == dockerUnavailable {
+			return nil, errors.New("docker ps failed; is the docker daemon running?")
+		}
+		var c struct {
+			Names string
+			State string
+		}
+		if err := json.Unmarshal([]byte(line), &c); err != nil || c.Names == "" {
+			continue
+		}
+		for _, name := range strings.Split(c.Names, ",") {
+			states[name] = c.State
+		}
+	}
+	return states, nil
+}
+
 func DockerLogsCmd(containerName string) string {
 	return fmt.Sprintf("docker logs --tail 200 %s", shellEscape(containerName))
 }
@@ -346,6 +780,425 @@ func CheckContainersHealthCmd(names []string) string {
 	return "docker inspect --format='{{.State.Running}}' " + strings.Join(args, " ")
 }
 
+// WireGuardInterface is the interface carrying a user's node mesh.
+const WireGuardInterface = "lpwg0"
+
+// WireGuardPort is the UDP port every mesh node listens on.
+const WireGuardPort = 51820
+
+// WireGuardConfigPath is the wg-quick config of the mesh interface on a node.
+const WireGuardConfigPath = "/etc/wireguard/" + WireGuardInterface + ".conf"
+
+// WireGuardPeerConfig is one remote node in a WireGuard config.
+type WireGuardPeerConfig struct {
+	PublicKey string
+	Endpoint  string // host:port
+	OverlayIP string
+}
+
+// WireGuardConfig renders the wg-quick config for a mesh node with overlay
+// address address (CIDR) and a /32 route to every peer.
+func WireGuardConfig(address, privateKey string, peers []WireGuardPeerConfig) string {
+	var sb strings.Builder
+	sb.WriteString("[Interface]\n")
+	fmt.Fprintf(&sb, "Address = %s\n", address)
+	fmt.Fprintf(&sb, "ListenPort = %d\n", WireGuardPort)
+	fmt.Fprintf(&sb, "PrivateKey = %s\n", privateKey)
+	for _, p := range peers {
+		sb.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&sb, "PublicKey = %s\n", p.PublicKey)
+		fmt.Fprintf(&sb, "Endpoint = %s\n", p.Endpoint)
+		fmt.Fprintf(&sb, "AllowedIPs = %s/32\n", p.OverlayIP)
+		sb.WriteString("PersistentKeepalive = 25\n")
+	}
+	return sb.String()
+}
+
+// WireGuardInstallCmd installs wireguard-tools unless wg-quick is already
+// present. Only apt-based nodes are supported.
+func WireGuardInstallCmd() string {
+	return "command -v wg-quick >/dev/null 2>&1 || " +
+		"(apt-get update -qq && DEBIAN_FRONTEND=noninteractive apt-get install -y -qq wireguard-tools)"
+}
+
+// WireGuardApplyCmd brings the mesh interface up from WireGuardConfigPath, or
+// reloads its peers in place (without dropping existing sessions) when it is
+// already up, and enables it at boot.
+func WireGuardApplyCmd() string {
+	i := WireGuardInterface
+	stripped := "/tmp/" + i + ".conf"
+	return fmt.Sprintf("chmod 600 %[2]s && "+
+		"if ip link show %[1]s >/dev/null 2>&1; then wg-quick strip %[1]s > %[3]s && wg syncconf %[1]s %[3]s && rm -f %[3]s; "+
+		"else wg-quick up %[1]s; fi && "+
+		"{ systemctl enable wg-quick@%[1]s >/dev/null 2>&1 || true; }",
+		i, WireGuardConfigPath, stripped)
+}
+
+// WireGuardRemoveCmd takes the mesh interface down and deletes its config.
+func WireGuardRemoveCmd() string {
+	i := WireGuardInterface
+	return fmt.Sprintf("wg-quick down %[1]s >/dev/null 2>&1; "+
+		"systemctl disable wg-quick@%[1]s >/dev/null 2>&1; "+
+		"rm -f %[2]s", i, WireGuardConfigPath)
+}
+
+// FirewallTable is the nftables table holding a node's managed firewall. It is
+// separate from Docker's own tables, so rebuilding it never touches them.
+const FirewallTable = "localisprod"
+
+// FirewallConfigPath is the node path of the generated nftables ruleset.
+const FirewallConfigPath = "/etc/localisprod/firewall.nft"
+
+// FirewallAllow opens a port to Sources (IPs or CIDRs). A host port without
+// sources is open to anywhere; a published port without sources is closed.
+type FirewallAllow struct {
+	Protocol string // tcp, udp
+	Port     int
+	Sources  []string
+}
+
+// FirewallConfig is the ruleset of one node. Host ports are filtered on the
+// input hook; everything else addressed to the node itself is dropped.
+// Published ports are Docker-published container ports, which are DNATed and
+// so only visible on the forward hook; connections to them from outside the
+// node are dropped unless the client is one of their sources. Other published
+// ports, and containers' own connections out, are left open.
+type FirewallConfig struct {
+	Host      []FirewallAllow
+	Published []FirewallAllow
+}
+
+// FirewallRuleset renders cfg as an nftables script that atomically replaces
+// the FirewallTable table.
+func FirewallRuleset(cfg FirewallConfig) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "table inet %s\ndelete table inet %s\n", FirewallTable, FirewallTable)
+	fmt.Fprintf(&sb, "table inet %s {\n", FirewallTable)
+
+	sb.WriteString("\tchain input {\n")
+	sb.WriteString("\t\ttype filter hook input priority filter - 1; policy drop;\n")
+	sb.WriteString("\t\tct state established,related accept\n")
+	sb.WriteString("\t\tct state invalid drop\n")
+	sb.WriteString("\t\tiif \"lo\" accept\n")
+	// Containers talk to the host over Docker bridges.
+	sb.WriteString("\t\tiifname \"docker0\" accept\n")
+	sb.WriteString("\t\tiifname \"br-*\" accept\n")
+	sb.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n")
+	for _, a := range cfg.Host {
+		writeFirewallMatch(&sb, a, fmt.Sprintf("%s dport %d", a.Protocol, a.Port), "accept")
+	}
+	sb.WriteString("\t}\n")
+
+	sb.WriteString("\tchain forward {\n")
+	sb.WriteString("\t\ttype filter hook forward priority filter - 1; policy accept;\n")
+	sb.WriteString("\t\tct state established,related accept\n")
+	for _, a := range cfg.Published {
+		// Only inbound connections Docker DNATed to a container: a container
+		// reaching a remote host on the same port comes in on a bridge and
+		// is not DNATed.
+		match := fmt.Sprintf("iifname != \"docker0\" iifname != \"br-*\" ct status dnat meta l4proto %s ct original proto-dst %d", a.Protocol, a.Port)
+		if len(a.Sources) > 0 {
+			writeFirewallMatch(&sb, a, match, "accept")
+		}
+		fmt.Fprintf(&sb, "\t\t%s drop\n", match)
+	}
+	sb.WriteString("\t}\n")
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// writeFirewallMatch writes one rule per address family of a.Sources, or a
+// single rule without a source match when a has no sources.
+func writeFirewallMatch(sb *strings.Builder, a FirewallAllow, match, verdict string) {
+	if len(a.Sources) == 0 {
+		fmt.Fprintf(sb, "\t\t%s %s\n", match, verdict)
+		return
+	}
+	var v4, v6 []string
+	for _, src := range a.Sources {
+		if strings.Contains(src, ":") {
+			v6 = append(v6, src)
+		} else {
+			v4 = append(v4, src)
+		}
+	}
+	if len(v4) > 0 {
+		fmt.Fprintf(sb, "\t\tip saddr { %s } %s %s\n", strings.Join(v4, ", "), match, verdict)
+	}
+	if len(v6) > 0 {
+		fmt.Fprintf(sb, "\t\tip6 saddr { %s } %s %s\n", strings.Join(v6, ", "), match, verdict)
+	}
+}
+
+// FirewallApplyCmd installs nftables if needed and loads FirewallConfigPath.
+// nft -f applies the whole file in one transaction, so a bad ruleset leaves
+// the previous one in place.
+func FirewallApplyCmd() string {
+	return "(command -v nft >/dev/null 2>&1 || " +
+		"(apt-get update -qq && DEBIAN_FRONTEND=noninteractive apt-get install -y -qq nftables)) && " +
+		"nft -f " + shellEscape(FirewallConfigPath)
+}
+
+// FirewallRemoveCmd deletes the managed table, opening the node up again.
+func FirewallRemoveCmd() string {
+	return fmt.Sprintf("nft delete table inet %s 2>/dev/null; rm -f %s", FirewallTable, shellEscape(FirewallConfigPath))
+}
+
+// BootstrapScriptPath is where the bootstrap script is written on a node.
+const BootstrapScriptPath = "/tmp/localisprod-bootstrap.sh"
+
+// bootstrapPrefix marks the version lines of the bootstrap script output.
+const bootstrapPrefix = "localisprod-bootstrap: "
+
+// BootstrapScript returns a POSIX sh script that prepares a fresh Debian,
+// Ubuntu, RHEL-family or Amazon Linux host: it installs rsync, ss, mkfs.ext4
+// and Docker Engine, adds username to the docker group, enables json-file log
+// rotation unless /etc/docker/daemon.json already exists, and prints the
+// installed versions. It uses sudo when not run as root and is safe to re-run.
+func BootstrapScript(username string) string {
+	return `set -e
+SUDO=""
+[ "$(id -u)" = 0 ] || SUDO="sudo -n"
+. /etc/os-release
+case "$ID $ID_LIKE" in
+*debian*|*ubuntu*)
+	$SUDO env DEBIAN_FRONTEND=noninteractive apt-get update -qq
+	$SUDO env DEBIAN_FRONTEND=noninteractive apt-get install -y -qq ca-certificates curl rsync iproute2 e2fsprogs >/dev/null
+	;;
+*rhel*|*fedora*|*centos*|*amzn*)
+	PM=dnf
+	command -v dnf >/dev/null 2>&1 || PM=yum
+	$SUDO $PM install -y -q rsync iproute e2fsprogs >/dev/null
+	;;
+*)
+	echo "unsupported distribution: $ID" >&2
+	exit 1
+	;;
+esac
+if ! command -v docker >/dev/null 2>&1; then
+	if [ "$ID" = amzn ]; then
+		$SUDO $PM install -y -q docker >/dev/null
+	else
+		curl -fsSL https://get.docker.com | $SUDO sh >/dev/null
+	fi
+fi
+$SUDO systemctl enable --now docker >/dev/null 2>&1 || true
+USER_NAME=` + shellEscape(username) + `
+[ "$USER_NAME" = root ] || $SUDO usermod -aG docker "$USER_NAME"
+if [ ! -f /etc/docker/daemon.json ]; then
+	$SUDO mkdir -p /etc/docker
+	echo '{"log-driver":"json-file","log-opts":{"max-size":"10m","max-file":"3"}}' | $SUDO tee /etc/docker/daemon.json >/dev/null
+	$SUDO systemctl restart docker
+fi
+P="` + bootstrapPrefix + `"
+echo "${P}os=$ID $VERSION_ID"
+echo "${P}kernel=$(uname -r)"
+echo "${P}docker=$($SUDO docker version --format '{{.Server.Version}}')"
+echo "${P}rsync=$(rsync --version | head -n1 | awk '{print $3}')"
+echo "${P}iproute2=$(ss -V | sed 's/.*iproute2-//')"
+echo "${P}e2fsprogs=$(mkfs.ext4 -V 2>&1 | head -n1 | awk '{print $2}')"
+`
+}
+
+// BootstrapRunCmd runs the script written to BootstrapScriptPath and removes
+// it, keeping the script's exit status.
+func BootstrapRunCmd() string {
+	p := shellEscape(BootstrapScriptPath)
+	return fmt.Sprintf("sh %[1]s; rc=$?; rm -f %[1]s; exit $rc", p)
+}
+
+// ParseBootstrapVersions extracts the key=value version lines printed by
+// BootstrapScript from its combined output.
+func ParseBootstrapVersions(output string) map[string]string {
+	versions := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), bootstrapPrefix)
+		if !ok {
+			continue
+		}
+		if k, v, ok := strings.Cut(rest, "="); ok && v != "" {
+			versions[k] = v
+		}
+	}
+	return versions
+}
+
+// NodeStats is one usage sample of a node. NetRx and NetTx are cumulative
+// byte counters of the physical interfaces since boot.
+type NodeStats struct {
+	CPUPercent float64
+	MemUsed    int64
+	MemTotal   int64
+	DiskUsed   int64
+	DiskTotal  int64
+	NetRx      int64
+	NetTx      int64
+	Load1      float64
+	Load5      float64
+	Load15     float64
+}
+
+// NodeStatsCmd samples /proc/stat one second apart for CPU usage and prints
+// memory, root filesystem, network and load figures, one labelled line each.
+// Docker bridges, veths and the mesh interface are left out of the network
+// counters since their traffic also crosses a physical interface.
+func NodeStatsCmd() string {
+	return `echo "cpu1 $(head -n1 /proc/stat)"; sleep 1; echo "cpu2 $(head -n1 /proc/stat)"; ` +
+		`awk '/^(MemTotal|MemAvailable):/ {printf "mem %s %.0f\n", $1, $2 * 1024}' /proc/meminfo; ` +
+		`df -P -B1 / | awk 'NR == 2 {print "disk", $2, $3}'; ` +
+		`sed 1,2d /proc/net/dev | tr ':' ' ' | awk '$1 !~ /^(lo|docker|br-|veth|` + WireGuardInterface + `)/ {rx += $2; tx += $10} END {printf "net %.0f %.0f\n", rx, tx}'; ` +
+		`echo "load $(cut -d' ' -f1-3 /proc/loadavg)"`
+}
+
+// ParseNodeStats parses the output of NodeStatsCmd.
+func ParseNodeStats(output string) (*NodeStats, error) {
+	st := &NodeStats{}
+	var cpu1, cpu2 []int64
+	var memAvailable int64
+	for _, line := range strings.Split(output, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "cpu1":
+			cpu1 = parseInts(f[2:])
+		case "cpu2":
+			cpu2 = parseInts(f[2:])
+		case "mem":
+			if len(f) == 3 {
+				v, _ := strconv.ParseInt(f[2], 10, 64)
+				if f[1] == "MemTotal:" {
+					st.MemTotal = v
+				} else {
+					memAvailable = v
+				}
+			}
+		case "disk":
+			if v := parseInts(f[1:]); len(v) == 2 {
+				st.DiskTotal, st.DiskUsed = v[0], v[1]
+			}
+		case "net":
+			if v := parseInts(f[1:]); len(v) == 2 {
+				st.NetRx, st.NetTx = v[0], v[1]
+			}
+		case "load":
+			if len(f) == 4 {
+				st.Load1, _ = strconv.ParseFloat(f[1], 64)
+				st.Load5, _ = strconv.ParseFloat(f[2], 64)
+				st.Load15, _ = strconv.ParseFloat(f[3], 64)
+			}
+		}
+	}
+	// cpu user nice system idle iowait irq softirq steal ...
+	if len(cpu1) < 4 || len(cpu2) < 4 || st.MemTotal == 0 {
+		return nil, fmt.Errorf("unexpected stats output: %q", output)
+	}
+	// Guest time is already counted in user, so only the first 8 fields add up.
+	var total int64
+	for i := 0; i < 8 && i < len(cpu1) && i < len(cpu2); i++ {
+		total += cpu2[i] - cpu1[i]
+	}
+	idle := cpu2[3] - cpu1[3]
+	if len(cpu1) > 4 && len(cpu2) > 4 {
+		idle += cpu2[4] - cpu1[4] // iowait
+	}
+	if total > 0 {
+		st.CPUPercent = float64(total-idle) * 100 / float64(total)
+	}
+	st.MemUsed = st.MemTotal - memAvailable
+	return st, nil
+}
+
+func parseInts(fields []string) []int64 {
+	out := make([]int64, 0, len(fields))
+	for _, f := range fields {
+		v, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// ContainerStats is one usage sample of a container. MemTotal is the
+// container's memory limit (the node's memory when unlimited); NetRx and NetTx
+// are cumulative since the container started.
+type ContainerStats struct {
+	CPUPercent float64
+	MemUsed    int64
+	MemTotal   int64
+	NetRx      int64
+	NetTx      int64
+}
+
+// DockerStatsCmd prints one tab-separated stats line per running container.
+func DockerStatsCmd() string {
+	return `docker stats --no-stream --format '{{.Name}}\t{{.CPUPerc}}\t{{.MemUsage}}\t{{.NetIO}}'`
+}
+
+// ParseDockerStats parses the output of DockerStatsCmd into stats keyed by
+// container name. Lines that do not parse are skipped.
+func ParseDockerStats(output string) map[string]*ContainerStats {
+	stats := map[string]*ContainerStats{}
+	for _, line := range strings.Split(output, "\n") {
+		f := strings.Split(strings.TrimSpace(line), "\t")
+		if len(f) != 4 {
+			continue
+		}
+		cpu, err := strconv.ParseFloat(strings.TrimSuffix(f[1], "%"), 64)
+		if err != nil {
+			continue
+		}
+		memUsed, memTotal, ok := parseSizePair(f[2])
+		if !ok {
+			continue
+		}
+		rx, tx, ok := parseSizePair(f[3])
+		if !ok {
+			continue
+		}
+		stats[f[0]] = &ContainerStats{CPUPercent: cpu, MemUsed: memUsed, MemTotal: memTotal, NetRx: rx, NetTx: tx}
+	}
+	return stats
+}
+
+// parseSizePair parses docker's "12.5MiB / 1.944GiB" notation.
+func parseSizePair(s string) (int64, int64, bool) {
+	a, b, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	x, okA := parseSize(strings.TrimSpace(a))
+	y, okB := parseSize(strings.TrimSpace(b))
+	return x, y, okA && okB
+}
+
+var sizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	// Longest suffixes first so "MiB" is not read as "B".
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+// parseSize parses a docker size such as "1.2kB" or "512MiB" into bytes.
+func parseSize(s string) (int64, bool) {
+	for _, u := range sizeUnits {
+		if num, ok := strings.CutSuffix(s, u.suffix); ok {
+			v, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, false
+			}
+			return int64(v * u.factor), true
+		}
+	}
+	return 0, false
+}
+
 // ShellEscape wraps a string in single quotes for safe shell usage.
 func ShellEscape(s string) string {
 	return "'" + strings.ReplaceAll(s, "'", "'\\''") + "'"
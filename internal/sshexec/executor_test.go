@@ -1,6 +1,7 @@
 package sshexec_test
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
@@ -102,6 +103,30 @@ func TestDockerRunCmd_WithNetwork(t *testing.T) {
 	}
 }
 
+func TestDockerRunCmd_WithExtraNetworks(t *testing.T) {
+	cmd := sshexec.DockerRunCmd(sshexec.RunConfig{
+		ContainerName: "app",
+		Image:         "myimage",
+		Network:       "traefik-net",
+		Networks:      []string{"localisprod-u-abc"},
+	})
+	want := "'myimage' && docker network connect 'localisprod-u-abc' 'app'"
+	if !strings.HasSuffix(cmd, want) {
+		t.Errorf("expected network connect after run, got: %s", cmd)
+	}
+	if strings.Count(cmd, "--network") != 1 {
+		t.Errorf("expected a single --network flag, got: %s", cmd)
+	}
+}
+
+func TestDockerNetworkCreateCmd(t *testing.T) {
+	cmd := sshexec.DockerNetworkCreateCmd("localisprod-u-abc")
+	want := "docker network inspect 'localisprod-u-abc' >/dev/null 2>&1 || docker network create 'localisprod-u-abc'"
+	if cmd != want {
+		t.Errorf("got %q, want %q", cmd, want)
+	}
+}
+
 func TestDockerRunCmd_WithLabels(t *testing.T) {
 	cmd := sshexec.DockerRunCmd(sshexec.RunConfig{
 		ContainerName: "app",
@@ -155,6 +180,13 @@ func TestDockerPullCmd(t *testing.T) {
 	}
 }
 
+func TestDockerImageIDCmd(t *testing.T) {
+	cmd := sshexec.DockerImageIDCmd("my app")
+	if cmd != "docker inspect --format='{{.Image}}' 'my app'" {
+		t.Errorf("unexpected command: %s", cmd)
+	}
+}
+
 func TestDockerStopRemoveCmd(t *testing.T) {
 	cmd := sshexec.DockerStopRemoveCmd("mycontainer")
 	if !strings.Contains(cmd, "docker stop") {
@@ -168,6 +200,33 @@ func TestDockerStopRemoveCmd(t *testing.T) {
 	}
 }
 
+func TestDockerForceRemoveCmd(t *testing.T) {
+	cmd := sshexec.DockerForceRemoveCmd("mycontainer")
+	if !strings.Contains(cmd, "docker rm -f 'mycontainer'") {
+		t.Errorf("expected docker rm -f, got: %s", cmd)
+	}
+	if !strings.Contains(cmd, "|| true") {
+		t.Errorf("expected missing containers to be ignored, got: %s", cmd)
+	}
+}
+
+func TestDockerStartCmd(t *testing.T) {
+	cmd := sshexec.DockerStartCmd("mycontainer")
+	if cmd != "docker start 'mycontainer'" {
+		t.Errorf("unexpected command: %s", cmd)
+	}
+}
+
+func TestContainerStateCmd(t *testing.T) {
+	cmd := sshexec.ContainerStateCmd("mycontainer")
+	if !strings.Contains(cmd, "{{.State.Status}}") {
+		t.Errorf("expected state format, got: %s", cmd)
+	}
+	if !strings.Contains(cmd, "echo "+sshexec.ContainerMissing) {
+		t.Errorf("expected fallback to %q, got: %s", sshexec.ContainerMissing, cmd)
+	}
+}
+
 func TestDockerRestartCmd(t *testing.T) {
 	cmd := sshexec.DockerRestartCmd("mycontainer")
 	if !strings.HasPrefix(cmd, "docker restart") {
@@ -202,7 +261,7 @@ func TestRemoveFileCmd(t *testing.T) {
 }
 
 func TestTraefikSetupCmd(t *testing.T) {
-	cmd := sshexec.TraefikSetupCmd()
+	cmd := sshexec.TraefikSetupCmd(sshexec.TraefikOptions{})
 	if !strings.Contains(cmd, "docker network create traefik-net") {
 		t.Errorf("expected network creation, got: %s", cmd)
 	}
@@ -215,22 +274,196 @@ func TestTraefikSetupCmd(t *testing.T) {
 	if !strings.Contains(cmd, "-p 80:80") {
 		t.Errorf("expected port 80 published, got: %s", cmd)
 	}
+	if !strings.Contains(cmd, "--providers.file.directory=/etc/traefik/dynamic") {
+		t.Errorf("expected file provider flag, got: %s", cmd)
+	}
+	if !strings.Contains(cmd, "-v "+sshexec.TraefikDynamicDir+":/etc/traefik/dynamic:ro") {
+		t.Errorf("expected dynamic config dir mounted, got: %s", cmd)
+	}
+	if !strings.Contains(cmd, "-p 443:443") || !strings.Contains(cmd, "--entrypoints.websecure.address=:443") {
+		t.Errorf("expected websecure entrypoint on 443, got: %s", cmd)
+	}
+	if strings.Contains(cmd, "certificatesresolvers") {
+		t.Errorf("expected no ACME resolver without an email, got: %s", cmd)
+	}
+}
+
+func TestTraefikSetupCmd_ACME(t *testing.T) {
+	cmd := sshexec.TraefikSetupCmd(sshexec.TraefikOptions{
+		ACMEEmail:        "ops@example.com",
+		ACMEDirectoryURL: "https://pebble:14000/dir",
+		ACMETrustCA:      true,
+	})
+	for _, want := range []string{
+		"--certificatesresolvers.acme.acme.email='ops@example.com'",
+		"--certificatesresolvers.acme.acme.caserver='https://pebble:14000/dir'",
+		"--certificatesresolvers.acme.acme.httpchallenge.entrypoint=web",
+		"--entrypoints.websecure.http.tls.certresolver=acme",
+		"-e LEGO_CA_CERTIFICATES=/etc/traefik/acme/ca.pem",
+		"-v " + sshexec.TraefikACMEDir + ":/etc/traefik/acme",
+	} {
+		if !strings.Contains(cmd, want) {
+			t.Errorf("expected %q in: %s", want, cmd)
+		}
+	}
+}
+
+func TestTraefikCertificateConfig(t *testing.T) {
+	cfg := sshexec.TraefikCertificateConfig("abc")
+	if !strings.Contains(cfg, "certFile: /etc/traefik/certs/abc.crt") || !strings.Contains(cfg, "keyFile: /etc/traefik/certs/abc.key") {
+		t.Errorf("unexpected config:\n%s", cfg)
+	}
+	certPath, keyPath := sshexec.TraefikCertificatePaths("abc")
+	if certPath != sshexec.TraefikCertsDir+"/abc.crt" || keyPath != sshexec.TraefikCertsDir+"/abc.key" {
+		t.Errorf("unexpected paths: %s %s", certPath, keyPath)
+	}
+}
+
+func TestTraefikLabels_Middlewares(t *testing.T) {
+	labels := sshexec.TraefikLabels("app", []models.Route{{
+		Host:        "tools.example.com",
+		PathPrefix:  "/admin",
+		StripPrefix: true,
+		Middlewares: &models.RouteMiddlewares{
+			IPAllowList:     []string{"10.0.0.0/8", "192.168.1.10"},
+			BasicAuth:       []string{"admin:$2a$10$hash"},
+			RateLimit:       &models.RateLimit{Average: 100, Burst: 50, Period: "1m"},
+			RedirectRegex:   &models.RedirectRegex{Regex: "^/old/(.*)", Replacement: "/${1}", Permanent: true},
+			RequestHeaders:  map[string]string{"X-Env": "prod"},
+			ResponseHeaders: map[string]string{"X-Frame-Options": "DENY"},
+			Compress:        true,
+		},
+	}}, "80")
+	want := map[string]string{
+		"traefik.http.routers.app-r0.middlewares":                                               "app-r0-allow,app-r0-auth,app-r0-ratelimit,app-r0-redirect,app-r0-headers,app-r0-strip,app-r0-compress",
+		"traefik.http.middlewares.app-r0-allow.ipallowlist.sourcerange":                         "10.0.0.0/8,192.168.1.10",
+		"traefik.http.middlewares.app-r0-auth.basicauth.users":                                  "admin:$2a$10$hash",
+		"traefik.http.middlewares.app-r0-ratelimit.ratelimit.average":                           "100",
+		"traefik.http.middlewares.app-r0-ratelimit.ratelimit.burst":                             "50",
+		"traefik.http.middlewares.app-r0-ratelimit.ratelimit.period":                            "1m",
+		"traefik.http.middlewares.app-r0-redirect.redirectregex.regex":                          "^/old/(.*)",
+		"traefik.http.middlewares.app-r0-redirect.redirectregex.replacement":                    "/${1}",
+		"traefik.http.middlewares.app-r0-redirect.redirectregex.permanent":                      "true",
+		"traefik.http.middlewares.app-r0-headers.headers.customrequestheaders.X-Env":            "prod",
+		"traefik.http.middlewares.app-r0-headers.headers.customresponseheaders.X-Frame-Options": "DENY",
+		"traefik.http.middlewares.app-r0-strip.stripprefix.prefixes":                            "/admin",
+		"traefik.http.middlewares.app-r0-compress.compress":                                     "true",
+	}
+	for k, v := range want {
+		if labels[k] != v {
+			t.Errorf("label %s: expected %q, got %q", k, v, labels[k])
+		}
+	}
+}
+
+func TestTraefikLabels_HTTPSRedirect(t *testing.T) {
+	labels := sshexec.TraefikLabels("app", []models.Route{
+		{Host: "secure.example.com", Entrypoint: "websecure"},
+		{Host: "both.example.com", Entrypoint: "websecure"},
+		{Host: "both.example.com"},
+	}, "80")
+	if labels["traefik.http.routers.app-r0-http.entrypoints"] != "web" {
+		t.Errorf("expected redirect router on web, got: %v", labels)
+	}
+	if labels["traefik.http.routers.app-r0-http.middlewares"] != "app-https" {
+		t.Errorf("expected redirect middleware, got: %v", labels)
+	}
+	if labels["traefik.http.middlewares.app-https.redirectscheme.scheme"] != "https" {
+		t.Errorf("expected redirectscheme https, got: %v", labels)
+	}
+	if _, ok := labels["traefik.http.routers.app-r1-http.rule"]; ok {
+		t.Errorf("expected no redirect when the same rule is served over http")
+	}
+}
+
+func TestTraefikCanaryLabels(t *testing.T) {
+	labels := sshexec.TraefikCanaryLabels("canary", []models.Route{{Host: "example.com"}}, "8080")
+	rule := labels["traefik.http.routers.canary-r0.rule"]
+	if !strings.Contains(rule, "Host(`example.com`)") || !strings.Contains(rule, sshexec.CanaryHeader) {
+		t.Errorf("expected host and canary header in rule, got: %s", rule)
+	}
+	if labels["traefik.http.routers.canary-r0.priority"] == "" {
+		t.Errorf("expected router priority, got: %v", labels)
+	}
+	if labels["traefik.http.services.canary-p8080.loadbalancer.server.port"] != "8080" {
+		t.Errorf("expected port 8080, got: %v", labels)
+	}
+}
+
+func TestTraefikWeightedConfig(t *testing.T) {
+	routes := []models.Route{
+		{Host: "example.com"},
+		{Host: "example.com", PathPrefix: "/api", StripPrefix: true, ContainerPort: 9000},
+	}
+	cfg := sshexec.TraefikWeightedConfig("app-split", routes, "8080", "app-stable", "app-canary", 25)
+	for _, want := range []string{
+		"    app-split-r0:\n",
+		`rule: "Host(` + "`example.com`" + `)"`,
+		"service: app-split-p8080\n",
+		"    app-split-r1:\n",
+		"- app-stable-r1-strip@docker\n",
+		"service: app-split-p9000\n",
+		"weighted:",
+		"- name: app-stable-p8080@docker\n            weight: 75\n",
+		"- name: app-canary-p8080@docker\n            weight: 25\n",
+		"- name: app-canary-p9000@docker\n            weight: 25\n",
+	} {
+		if !strings.Contains(cfg, want) {
+			t.Errorf("expected %q in config:\n%s", want, cfg)
+		}
+	}
+}
+
+func TestTraefikDynamicConfigPath(t *testing.T) {
+	got := sshexec.TraefikDynamicConfigPath("app-split")
+	if got != sshexec.TraefikDynamicDir+"/app-split.yml" {
+		t.Errorf("unexpected path: %s", got)
+	}
 }
 
 func TestTraefikLabels(t *testing.T) {
-	labels := sshexec.TraefikLabels("myrouter", "example.com", "8080")
+	labels := sshexec.TraefikLabels("myrouter", []models.Route{{Host: "example.com"}}, "8080")
 	if labels["traefik.enable"] != "true" {
 		t.Errorf("expected traefik.enable=true, got: %v", labels["traefik.enable"])
 	}
-	if !strings.Contains(labels["traefik.http.routers.myrouter.rule"], "example.com") {
-		t.Errorf("expected domain in router rule, got: %v", labels["traefik.http.routers.myrouter.rule"])
+	if labels["traefik.http.routers.myrouter-r0.rule"] != "Host(`example.com`)" {
+		t.Errorf("expected domain in router rule, got: %v", labels["traefik.http.routers.myrouter-r0.rule"])
 	}
-	portKey := "traefik.http.services.myrouter.loadbalancer.server.port"
+	if labels["traefik.http.routers.myrouter-r0.service"] != "myrouter-p8080" {
+		t.Errorf("expected router service myrouter-p8080, got: %v", labels["traefik.http.routers.myrouter-r0.service"])
+	}
+	portKey := "traefik.http.services.myrouter-p8080.loadbalancer.server.port"
 	if labels[portKey] != "8080" {
 		t.Errorf("expected port 8080, got: %v", labels[portKey])
 	}
-	if labels["traefik.http.routers.myrouter.entrypoints"] != "web" {
-		t.Errorf("expected entrypoints=web, got: %v", labels["traefik.http.routers.myrouter.entrypoints"])
+	if labels["traefik.http.routers.myrouter-r0.entrypoints"] != "web" {
+		t.Errorf("expected entrypoints=web, got: %v", labels["traefik.http.routers.myrouter-r0.entrypoints"])
+	}
+}
+
+func TestTraefikLabels_MultipleRoutes(t *testing.T) {
+	labels := sshexec.TraefikLabels("app", []models.Route{
+		{Host: "api.example.com"},
+		{Host: "example.com", PathPrefix: "/api", StripPrefix: true},
+		{Host: "admin.example.com", ContainerPort: 9000, Entrypoint: "websecure"},
+	}, "8080")
+	if got := labels["traefik.http.routers.app-r1.rule"]; got != "Host(`example.com`) && PathPrefix(`/api`)" {
+		t.Errorf("unexpected path rule: %s", got)
+	}
+	if labels["traefik.http.routers.app-r1.middlewares"] != "app-r1-strip" {
+		t.Errorf("expected strip middleware on r1, got: %v", labels)
+	}
+	if labels["traefik.http.middlewares.app-r1-strip.stripprefix.prefixes"] != "/api" {
+		t.Errorf("expected stripprefix /api, got: %v", labels)
+	}
+	if _, ok := labels["traefik.http.routers.app-r0.middlewares"]; ok {
+		t.Errorf("expected no middleware on r0")
+	}
+	if labels["traefik.http.routers.app-r2.service"] != "app-p9000" || labels["traefik.http.routers.app-r2.entrypoints"] != "websecure" {
+		t.Errorf("unexpected admin router: %v", labels)
+	}
+	if labels["traefik.http.services.app-p9000.loadbalancer.server.port"] != "9000" {
+		t.Errorf("expected admin service on 9000, got: %v", labels)
 	}
 }
 
@@ -345,3 +578,212 @@ func TestLocalRunner_WriteFile(t *testing.T) {
 		t.Errorf("expected mode 0600, got %o", perm)
 	}
 }
+
+func TestWireGuardConfig(t *testing.T) {
+	cfg := sshexec.WireGuardConfig("10.77.0.1/16", "PRIV", []sshexec.WireGuardPeerConfig{
+		{PublicKey: "PUB2", Endpoint: "203.0.113.2:51820", OverlayIP: "10.77.0.2"},
+	})
+	for _, want := range []string{
+		"[Interface]\nAddress = 10.77.0.1/16\nListenPort = 51820\nPrivateKey = PRIV\n",
+		"[Peer]\nPublicKey = PUB2\nEndpoint = 203.0.113.2:51820\nAllowedIPs = 10.77.0.2/32\n",
+	} {
+		if !strings.Contains(cfg, want) {
+			t.Errorf("expected %q in config:\n%s", want, cfg)
+		}
+	}
+}
+
+func TestWireGuardApplyCmd(t *testing.T) {
+	cmd := sshexec.WireGuardApplyCmd()
+	if !strings.Contains(cmd, "wg syncconf lpwg0") || !strings.Contains(cmd, "wg-quick up lpwg0") {
+		t.Errorf("expected reload or bring-up of the interface, got: %s", cmd)
+	}
+}
+
+func TestBootstrapScript(t *testing.T) {
+	script := sshexec.BootstrapScript("ubuntu")
+	for _, want := range []string{
+		"USER_NAME='ubuntu'",
+		"usermod -aG docker",
+		"get.docker.com",
+		`"max-size":"10m"`,
+		"rsync iproute2 e2fsprogs",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("expected %q in script", want)
+		}
+	}
+}
+
+func TestParseBootstrapVersions(t *testing.T) {
+	out := "Reading package lists...\n" +
+		"localisprod-bootstrap: os=ubuntu 24.04\n" +
+		"localisprod-bootstrap: docker=27.3.1\n" +
+		"localisprod-bootstrap: rsync=\n" +
+		"docker=not-a-version-line\n"
+	v := sshexec.ParseBootstrapVersions(out)
+	if len(v) != 2 || v["os"] != "ubuntu 24.04" || v["docker"] != "27.3.1" {
+		t.Errorf("unexpected versions: %v", v)
+	}
+}
+
+func TestParseNodeStats(t *testing.T) {
+	out := "cpu1 cpu  100 0 100 700 100 0 0 0 0 0\n" +
+		"cpu2 cpu  150 0 150 850 150 0 0 0 0 0\n" +
+		"mem MemTotal: 2048\n" +
+		"mem MemAvailable: 512\n" +
+		"disk 1000 250\n" +
+		"net 12345 678\n" +
+		"load 0.50 0.25 0.10\n"
+	st, err := sshexec.ParseNodeStats(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100 busy jiffies out of 300, with iowait counted as idle.
+	if st.CPUPercent < 33.3 || st.CPUPercent > 33.4 {
+		t.Errorf("expected cpu 33.3%%, got %v", st.CPUPercent)
+	}
+	if st.MemTotal != 2048 || st.MemUsed != 1536 || st.DiskTotal != 1000 || st.DiskUsed != 250 ||
+		st.NetRx != 12345 || st.NetTx != 678 || st.Load1 != 0.5 || st.Load15 != 0.1 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	if _, err := sshexec.ParseNodeStats("sh: /proc/stat: not found"); err == nil {
+		t.Error("expected an error for unparseable output")
+	}
+}
+
+func TestParseDockerStats(t *testing.T) {
+	out := "web\t1.50%\t12.5MiB / 1GiB\t1.2kB / 3MB\n" +
+		"broken\tn/a\n"
+	stats := sshexec.ParseDockerStats(out)
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 container, got %v", stats)
+	}
+	st := stats["web"]
+	if st.CPUPercent != 1.5 || st.MemUsed != 12.5*(1<<20) || st.MemTotal != 1<<30 || st.NetRx != 1200 || st.NetTx != 3000000 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestParseContainerStates(t *testing.T) {
+	out := `{"ID":"abc","Names":"web","State":"running","Status":"Up 2 hours"}
+{"ID":"def","Names":"db,web/db","State":"exited","Status":"Exited (1) 3 minutes ago"}
+not json`
+	states, err := sshexec.ParseContainerStates(out)
+	if err != nil {
+		t.Fatalf("ParseContainerStates: %v", err)
+	}
+	if len(states) != 3 || states["web"] != "running" || states["db"] != "exited" || states["web/db"] != "exited" {
+		t.Errorf("unexpected states: %v", states)
+	}
+	if states, err := sshexec.ParseContainerStates(""); err != nil || len(states) != 0 {
+		t.Errorf("expected no containers, got %v, %v", states, err)
+	}
+	if !strings.Contains(sshexec.ContainerStatesCmd(), "docker ps -a") {
+		t.Errorf("unexpected command: %s", sshexec.ContainerStatesCmd())
+	}
+	if _, err := sshexec.ParseContainerStates("docker-unavailable"); err == nil {
+		t.Error("expected an error when docker ps fails")
+	}
+}
+
+func TestDockerRunCmd_ManagedLabel(t *testing.T) {
+	cmd := sshexec.DockerRunCmd(sshexec.RunConfig{ContainerName: "web", Image: "nginx"})
+	if !strings.Contains(cmd, "--label "+sshexec.ManagedLabel+"=true") {
+		t.Errorf("expected managed label, got: %s", cmd)
+	}
+}
+
+func TestParseDockerEvent(t *testing.T) {
+	e, err := sshexec.ParseDockerEvent(`{"status":"die","id":"abc","Type":"container","Action":"die","Actor":{"ID":"abc","Attributes":{"exitCode":"137","image":"nginx","name":"web"}},"time":1700000000,"timeNano":1700000000123456789}`)
+	if err != nil {
+		t.Fatalf("ParseDockerEvent: %v", err)
+	}
+	if e.Container != "web" || e.Action != "die" || e.ExitCode != "137" || e.Time.Unix() != 1700000000 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	e, err = sshexec.ParseDockerEvent(`{"Type":"container","Action":"health_status: unhealthy","Actor":{"Attributes":{"name":"db"}},"timeNano":1}`)
+	if err != nil {
+		t.Fatalf("ParseDockerEvent: %v", err)
+	}
+	if e.Action != "health_status" || e.Health != "unhealthy" {
+		t.Errorf("unexpected health event: %+v", e)
+	}
+
+	if _, err := sshexec.ParseDockerEvent("Error response from daemon"); err == nil {
+		t.Error("expected an error for a non-JSON line")
+	}
+}
+
+func TestLocalRunner_Stream(t *testing.T) {
+	var lines []string
+	err := (&sshexec.LocalRunner{}).Stream(context.Background(), "echo one; echo two", func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if strings.Join(lines, ",") != "one,two" {
+		t.Errorf("unexpected lines %v", lines)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = (&sshexec.LocalRunner{}).Stream(ctx, "echo ready; sleep 30", func(string) { cancel() })
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestFirewallRuleset(t *testing.T) {
+	rs := sshexec.FirewallRuleset(sshexec.FirewallConfig{
+		Host: []sshexec.FirewallAllow{
+			{Protocol: "tcp", Port: 22},
+			{Protocol: "udp", Port: 51820},
+			{Protocol: "tcp", Port: 8443, Sources: []string{"198.51.100.0/24", "2001:db8::1"}},
+		},
+		Published: []sshexec.FirewallAllow{
+			{Protocol: "tcp", Port: 15432, Sources: []string{"203.0.113.7"}},
+			{Protocol: "tcp", Port: 16379},
+		},
+	})
+	for _, want := range []string{
+		"table inet localisprod\ndelete table inet localisprod\n",
+		"type filter hook input priority filter - 1; policy drop;",
+		"tcp dport 22 accept",
+		"udp dport 51820 accept",
+		"ip saddr { 198.51.100.0/24 } tcp dport 8443 accept",
+		"ip6 saddr { 2001:db8::1 } tcp dport 8443 accept",
+		"type filter hook forward priority filter - 1; policy accept;",
+		"ip saddr { 203.0.113.7 } iifname != \"docker0\" iifname != \"br-*\" ct status dnat meta l4proto tcp ct original proto-dst 15432 accept",
+		"iifname != \"docker0\" iifname != \"br-*\" ct status dnat meta l4proto tcp ct original proto-dst 15432 drop",
+		"iifname != \"docker0\" iifname != \"br-*\" ct status dnat meta l4proto tcp ct original proto-dst 16379 drop",
+	} {
+		if !strings.Contains(rs, want) {
+			t.Errorf("expected %q in ruleset:\n%s", want, rs)
+		}
+	}
+	if strings.Contains(rs, "proto-dst 16379 accept") {
+		t.Errorf("published port without sources must not be opened:\n%s", rs)
+	}
+}
+
+// A container connecting out to a remote host on a port the node also
+// publishes, e.g. a service reaching a linked database on another node, must
+// not hit the published port's drop rule.
+func TestFirewallRuleset_DropsOnlyInboundDNAT(t *testing.T) {
+	rs := sshexec.FirewallRuleset(sshexec.FirewallConfig{
+		Published: []sshexec.FirewallAllow{{Protocol: "tcp", Port: 5432}},
+	})
+	forward := rs[strings.Index(rs, "chain forward"):]
+	for _, line := range strings.Split(forward, "\n") {
+		if !strings.HasSuffix(line, " drop") {
+			continue
+		}
+		for _, cond := range []string{"ct status dnat", `iifname != "docker0"`, `iifname != "br-*"`} {
+			if !strings.Contains(line, cond) {
+				t.Errorf("forward drop rule lacks %q: %s", cond, line)
+			}
+		}
+	}
+}
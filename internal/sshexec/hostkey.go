@@ -0,0 +1,145 @@
+package sshexec
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyStore persists node and jump host keys pinned on first contact.
+type HostKeyStore interface {
+	// PinNodeHostKey stores key for the node unless one is already pinned and
+	// returns the key pinned after the call.
+	PinNodeHostKey(nodeID, key string) (string, error)
+	// PinJumpHostHostKey does the same for a jump host.
+	PinJumpHostHostKey(jumpHostID, key string) (string, error)
+}
+
+var hostKeyStore HostKeyStore
+
+// SetHostKeyStore sets where host keys are pinned on first contact. Without a
+// store, first-contact keys are only trusted for the lifetime of the Client.
+func SetHostKeyStore(s HostKeyStore) {
+	hostKeyStore = s
+}
+
+// HostKeyMismatchError is returned when a node presents a host key other than
+// the pinned one. The connection is refused before any command is sent.
+type HostKeyMismatchError struct {
+	Host      string
+	Pinned    string
+	Presented string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: pinned %s, presented %s; accept the new key only if it was rotated on purpose",
+		e.Host, HostKeyFingerprint(e.Pinned), HostKeyFingerprint(e.Presented))
+}
+
+// MarshalHostKey renders key as "<type> <base64>", the form host keys are
+// pinned in.
+func MarshalHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// NormalizeHostKey parses a host key in authorized_keys or known_hosts line
+// form (an optional host list and trailing comment are dropped) and returns it
+// in pinned form.
+func NormalizeHostKey(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		// known_hosts lines start with the host list.
+		_, _, key, _, _, err = ssh.ParseKnownHosts([]byte(s))
+		if err != nil {
+			return "", errors.New("host key must be an OpenSSH public key such as \"ssh-ed25519 AAAA...\"")
+		}
+	}
+	return MarshalHostKey(key), nil
+}
+
+// HostKeyFingerprint returns the SHA256 fingerprint of a pinned host key, as
+// printed by ssh-keygen -l, or "" if key does not parse.
+func HostKeyFingerprint(key string) string {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(pub)
+}
+
+// hostKeyAlgorithms returns the algorithms to offer for a pinned key, so the
+// server presents that key rather than another of its host keys.
+func hostKeyAlgorithms(key string) []string {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return nil
+	}
+	if pub.Type() == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{pub.Type()}
+}
+
+// checkHostKey verifies the key presented by the node against the pinned one,
+// pinning it on first contact.
+func (c *Client) checkHostKey(hostname string, _ net.Addr, key ssh.PublicKey) error {
+	presented := MarshalHostKey(key)
+	if c.hostKey == "" {
+		pinned := presented
+		var err error
+		switch {
+		case hostKeyStore == nil:
+		case c.nodeID != "":
+			pinned, err = hostKeyStore.PinNodeHostKey(c.nodeID, presented)
+		case c.jumpHostID != "":
+			pinned, err = hostKeyStore.PinJumpHostHostKey(c.jumpHostID, presented)
+		}
+		if err != nil {
+			return fmt.Errorf("pin host key: %w", err)
+		}
+		c.hostKey = pinned
+	}
+	if presented != c.hostKey {
+		return &HostKeyMismatchError{Host: hostname, Pinned: c.hostKey, Presented: presented}
+	}
+	return nil
+}
+
+// ScanHostKey connects to host:port and returns the host key it presents,
+// without authenticating or trusting it. When pinned is set, the key of the
+// same type is requested.
+func ScanHostKey(host string, port int, pinned string) (string, error) {
+	return (&Client{host: host, port: port, hostKey: pinned}).scanHostKey()
+}
+
+// ScanNodeHostKey is ScanHostKey for a node, dialing through its proxies.
+func ScanNodeHostKey(node *models.Node) (string, error) {
+	return newClient(node).scanHostKey()
+}
+
+func (c *Client) scanHostKey() (string, error) {
+	var presented string
+	config := &ssh.ClientConfig{
+		User:              "localisprod-hostkey-scan",
+		HostKeyAlgorithms: hostKeyAlgorithms(c.hostKey),
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			presented = MarshalHostKey(key)
+			return errors.New("scan only")
+		},
+		Timeout: 15 * time.Second,
+	}
+	client, err := c.dialConfig(config)
+	if client != nil {
+		client.Close()
+	}
+	if presented == "" {
+		return "", err
+	}
+	return presented, nil
+}
@@ -0,0 +1,257 @@
+package sshexec_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) (ssh.Signer, string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, string(pem.EncodeToMemory(block))
+}
+
+// testSSHServer accepts any client key, answers every exec request with the
+// command line itself and forwards direct-tcpip channels, so it can act as a
+// jump host. conns counts completed handshakes.
+type testSSHServer struct {
+	host  string
+	port  int
+	conns atomic.Int32
+
+	mu   sync.Mutex
+	open []*ssh.ServerConn
+}
+
+// closeConns drops every open connection, as a network failure would.
+func (s *testSSHServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.open {
+		c.Close()
+	}
+	s.open = nil
+}
+
+func startSSHServer(t *testing.T, hostKey ssh.Signer) *testSSHServer {
+	t.Helper()
+	return startSSHServerConfig(t, hostKey, &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	})
+}
+
+// startSSHServerConfig is startSSHServer with the authentication in config.
+func startSSHServerConfig(t *testing.T, hostKey ssh.Signer, config *ssh.ServerConfig) *testSSHServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	config.AddHostKey(hostKey)
+	addr := ln.Addr().(*net.TCPAddr)
+	srv := &testSSHServer{host: addr.IP.String(), port: addr.Port}
+	t.Cleanup(srv.closeConns)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				srv.conns.Add(1)
+				srv.mu.Lock()
+				srv.open = append(srv.open, sc)
+				srv.mu.Unlock()
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					go serveChannel(nc)
+				}
+			}()
+		}
+	}()
+	return srv
+}
+
+func serveChannel(nc ssh.NewChannel) {
+	if nc.ChannelType() == "direct-tcpip" {
+		serveDirectTCPIP(nc)
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		_ = ssh.Unmarshal(req.Payload, &payload)
+		_ = req.Reply(true, nil)
+		_, _ = ch.Write([]byte(payload.Command + "\n"))
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
+
+func serveDirectTCPIP(nc ssh.NewChannel) {
+	var target struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+	if err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		_, _ = io.Copy(ch, conn)
+		ch.Close()
+	}()
+	_, _ = io.Copy(conn, ch)
+	conn.Close()
+}
+
+type memHostKeyStore map[string]string
+
+func (m memHostKeyStore) PinNodeHostKey(nodeID, key string) (string, error) {
+	if m[nodeID] == "" {
+		m[nodeID] = key
+	}
+	return m[nodeID], nil
+}
+
+func (m memHostKeyStore) PinJumpHostHostKey(jumpHostID, key string) (string, error) {
+	return m.PinNodeHostKey("jump:"+jumpHostID, key)
+}
+
+func TestNormalizeHostKey(t *testing.T) {
+	signer, _ := newSigner(t)
+	want := sshexec.MarshalHostKey(signer.PublicKey())
+	for _, in := range []string{
+		want,
+		want + " root@node\n",
+		"10.0.0.5,node.example.com " + want,
+	} {
+		got, err := sshexec.NormalizeHostKey(in)
+		if err != nil {
+			t.Fatalf("NormalizeHostKey(%q): %v", in, err)
+		}
+		if got != want {
+			t.Errorf("NormalizeHostKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if _, err := sshexec.NormalizeHostKey("not a key"); err == nil {
+		t.Error("expected error for invalid key")
+	}
+}
+
+func TestHostKeyFingerprint(t *testing.T) {
+	signer, _ := newSigner(t)
+	key := sshexec.MarshalHostKey(signer.PublicKey())
+	if fp := sshexec.HostKeyFingerprint(key); fp != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Errorf("unexpected fingerprint %q", fp)
+	}
+	if fp := sshexec.HostKeyFingerprint(""); fp != "" {
+		t.Errorf("expected empty fingerprint for empty key, got %q", fp)
+	}
+}
+
+func TestHostKey_PinnedOnFirstContact(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	_, clientKey := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+
+	pins := memHostKeyStore{}
+	sshexec.SetHostKeyStore(pins)
+	t.Cleanup(func() { sshexec.SetHostKeyStore(nil) })
+
+	node := &models.Node{ID: "pin-first", Host: srv.host, Port: srv.port, Username: "root", PrivateKey: clientKey}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+	err := sshexec.NewRunner(node).Ping()
+	var mismatch *sshexec.HostKeyMismatchError
+	if errors.As(err, &mismatch) {
+		t.Fatalf("unexpected mismatch on first contact: %v", err)
+	}
+	if want := sshexec.MarshalHostKey(hostSigner.PublicKey()); pins["pin-first"] != want {
+		t.Errorf("expected host key pinned, got %q", pins["pin-first"])
+	}
+}
+
+func TestHostKey_MismatchRefused(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	otherSigner, _ := newSigner(t)
+	_, clientKey := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+
+	node := &models.Node{ID: "pin-mismatch", Host: srv.host, Port: srv.port, Username: "root", PrivateKey: clientKey,
+		HostKey: sshexec.MarshalHostKey(otherSigner.PublicKey())}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+	err := sshexec.NewRunner(node).Ping()
+	var mismatch *sshexec.HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected HostKeyMismatchError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), ssh.FingerprintSHA256(hostSigner.PublicKey())) {
+		t.Errorf("expected presented fingerprint in error, got %v", err)
+	}
+}
+
+func TestScanHostKey(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+
+	got, err := sshexec.ScanHostKey(srv.host, srv.port, "")
+	if err != nil {
+		t.Fatalf("ScanHostKey: %v", err)
+	}
+	if want := sshexec.MarshalHostKey(hostSigner.PublicKey()); got != want {
+		t.Errorf("ScanHostKey = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,220 @@
+package sshexec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Pooled connections are probed every keepaliveInterval and closed when the
+// probe goes unanswered for keepaliveTimeout or nothing ran on them for
+// poolIdleTimeout.
+const (
+	keepaliveInterval = 30 * time.Second
+	keepaliveTimeout  = 15 * time.Second
+	poolIdleTimeout   = 10 * time.Minute
+)
+
+// pool keeps one SSH connection per node; commands open sessions on it.
+var pool = struct {
+	mu    sync.Mutex
+	conns map[string]*poolConn
+}{conns: map[string]*poolConn{}}
+
+// poolConn is the pooled connection of one node. mu is held while dialing so
+// concurrent callers share a single handshake.
+type poolConn struct {
+	mu       sync.Mutex
+	client   *ssh.Client
+	creds    string // hash of the credentials client was opened with
+	hostKey  string // host key client was verified against
+	lastUsed time.Time
+}
+
+// EvictNode closes the pooled connection of a node. Call it when the node is
+// deleted or its pinned host key is replaced.
+func EvictNode(nodeID string) {
+	evict(nodeID)
+}
+
+// EvictJumpHost closes the pooled connection of a jump host.
+func EvictJumpHost(jumpHostID string) {
+	evict("jump:" + jumpHostID)
+}
+
+func evict(key string) {
+	pool.mu.Lock()
+	pc := pool.conns[key]
+	delete(pool.conns, key)
+	pool.mu.Unlock()
+	if pc == nil {
+		return
+	}
+	pc.mu.Lock()
+	if pc.client != nil {
+		pc.client.Close()
+		pc.client = nil
+	}
+	pc.mu.Unlock()
+}
+
+// poolKey identifies c's connection in the pool.
+func (c *Client) poolKey() string {
+	if c.nodeID != "" {
+		return c.nodeID
+	}
+	if c.jumpHostID != "" {
+		return "jump:" + c.jumpHostID
+	}
+	return fmt.Sprintf("%s@%s:%d", c.username, c.host, c.port)
+}
+
+// credsHash changes whenever anything used to open the connection changes,
+// including the proxies it was dialed through.
+func (c *Client) credsHash() string {
+	via := ""
+	if c.proxy != nil {
+		via = c.proxy.poolKey() + "/" + c.proxy.credsHash()
+	}
+	h := sha256.Sum256([]byte(strings.Join([]string{
+		c.host, strconv.Itoa(c.port), c.username, c.privateKey, c.passphrase, c.certificate, c.password, via,
+	}, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+// conn returns the pooled connection for c's node, dialing a new one when
+// there is none, it was closed, or the node's credentials or pinned host key
+// changed since it was opened.
+func (c *Client) conn() (*ssh.Client, error) {
+	key := c.poolKey()
+	pool.mu.Lock()
+	pc := pool.conns[key]
+	if pc == nil {
+		pc = &poolConn{}
+		pool.conns[key] = pc
+	}
+	pool.mu.Unlock()
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	creds := c.credsHash()
+	if pc.client != nil && (pc.creds != creds || (c.hostKey != "" && c.hostKey != pc.hostKey)) {
+		pc.client.Close()
+		pc.client = nil
+	}
+	if pc.client == nil {
+		client, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		pc.client, pc.creds, pc.hostKey = client, creds, c.hostKey
+		go pc.keepalive(client)
+	}
+	pc.lastUsed = time.Now()
+	c.proxy.touch()
+	return pc.client, nil
+}
+
+// touch marks the pooled connections of c and the proxies before it as used,
+// so a jump host is not closed as idle while connections run through it.
+func (c *Client) touch() {
+	for ; c != nil; c = c.proxy {
+		pool.mu.Lock()
+		pc := pool.conns[c.poolKey()]
+		pool.mu.Unlock()
+		if pc == nil {
+			continue
+		}
+		pc.mu.Lock()
+		pc.lastUsed = time.Now()
+		pc.mu.Unlock()
+	}
+}
+
+// session opens a session on the pooled connection. A connection that fails
+// to open one is assumed dead and replaced once.
+func (c *Client) session() (*ssh.Session, error) {
+	client, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	c.drop(client)
+	if client, err = c.conn(); err != nil {
+		return nil, err
+	}
+	session, err = client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("new session: %w", err)
+	}
+	return session, nil
+}
+
+// drop closes client and removes it from the pool if it is still current.
+func (c *Client) drop(client *ssh.Client) {
+	pool.mu.Lock()
+	pc := pool.conns[c.poolKey()]
+	pool.mu.Unlock()
+	client.Close()
+	if pc != nil {
+		pc.release(client)
+	}
+}
+
+func (pc *poolConn) release(client *ssh.Client) {
+	pc.mu.Lock()
+	if pc.client == client {
+		pc.client = nil
+	}
+	pc.mu.Unlock()
+}
+
+// keepalive probes client until it closes, closing it when the node stops
+// answering or the connection has been idle too long.
+func (pc *poolConn) keepalive(client *ssh.Client) {
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			pc.release(client)
+			return
+		case <-ticker.C:
+			pc.mu.Lock()
+			idle := time.Since(pc.lastUsed) > poolIdleTimeout
+			pc.mu.Unlock()
+			if idle {
+				client.Close()
+				continue
+			}
+			replied := make(chan error, 1)
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replied <- err
+			}()
+			select {
+			case err := <-replied:
+				if err != nil {
+					client.Close()
+				}
+			case <-time.After(keepaliveTimeout):
+				client.Close()
+			case <-closed:
+			}
+		}
+	}
+}
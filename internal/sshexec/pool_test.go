@@ -0,0 +1,100 @@
+package sshexec_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+func TestPool_ReusesConnection(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	_, clientKey := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+	node := &models.Node{ID: "pool-reuse", Host: srv.host, Port: srv.port, Username: "root", PrivateKey: clientKey}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+
+	for i := 0; i < 3; i++ {
+		out, err := sshexec.NewRunner(node).Run("echo hi")
+		if err != nil || out != "echo hi" {
+			t.Fatalf("Run: %q, %v", out, err)
+		}
+	}
+	if err := sshexec.NewRunner(node).WriteFile("/tmp/x", "data"); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if n := srv.conns.Load(); n != 1 {
+		t.Errorf("expected 1 handshake, got %d", n)
+	}
+}
+
+func TestPool_ReconnectsAfterFailure(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	_, clientKey := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+	node := &models.Node{ID: "pool-reconnect", Host: srv.host, Port: srv.port, Username: "root", PrivateKey: clientKey}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+
+	if _, err := sshexec.NewRunner(node).Run("one"); err != nil {
+		t.Fatal(err)
+	}
+	srv.closeConns()
+	out, err := sshexec.NewRunner(node).Run("two")
+	if err != nil || out != "two" {
+		t.Fatalf("expected reconnect, got %q, %v", out, err)
+	}
+	if n := srv.conns.Load(); n != 2 {
+		t.Errorf("expected 2 handshakes, got %d", n)
+	}
+}
+
+func TestPool_EvictsOnCredentialChange(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	_, clientKey := newSigner(t)
+	_, rotatedKey := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+	node := &models.Node{ID: "pool-creds", Host: srv.host, Port: srv.port, Username: "root", PrivateKey: clientKey}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+
+	if _, err := sshexec.NewRunner(node).Run("one"); err != nil {
+		t.Fatal(err)
+	}
+	node.PrivateKey = rotatedKey
+	if _, err := sshexec.NewRunner(node).Run("two"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.conns.Load(); n != 2 {
+		t.Errorf("expected new handshake after key change, got %d", n)
+	}
+
+	sshexec.EvictNode(node.ID)
+	if _, err := sshexec.NewRunner(node).Run("three"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.conns.Load(); n != 3 {
+		t.Errorf("expected new handshake after eviction, got %d", n)
+	}
+}
+
+func TestPool_StreamSharesConnection(t *testing.T) {
+	hostSigner, _ := newSigner(t)
+	_, clientKey := newSigner(t)
+	srv := startSSHServer(t, hostSigner)
+	node := &models.Node{ID: "pool-stream", Host: srv.host, Port: srv.port, Username: "root", PrivateKey: clientKey}
+	t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+
+	var lines []string
+	err := sshexec.NewRunner(node).Stream(context.Background(), "docker events", func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil || len(lines) != 1 || lines[0] != "docker events" {
+		t.Fatalf("Stream: %v, %v", lines, err)
+	}
+	if _, err := sshexec.NewRunner(node).Run("echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.conns.Load(); n != 1 {
+		t.Errorf("expected 1 handshake, got %d", n)
+	}
+}
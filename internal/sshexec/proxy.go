@@ -0,0 +1,48 @@
+package sshexec
+
+import "github.com/gsarma/localisprod-v2/internal/models"
+
+// ProxyResolver looks up the jump hosts and proxy nodes a node is dialed
+// through.
+type ProxyResolver interface {
+	// NodeSSHHops returns the chain ordered from the host reached directly to
+	// the node's own proxy.
+	NodeSSHHops(node *models.Node) ([]*models.SSHHop, error)
+}
+
+var proxyResolver ProxyResolver
+
+// SetProxyResolver sets how proxy chains are resolved. Without a resolver,
+// nodes with a proxy are dialed directly.
+func SetProxyResolver(r ProxyResolver) {
+	proxyResolver = r
+}
+
+// proxyChain returns the client for the last hop before node, linked to the
+// hops before it, or nil when the node is reached directly.
+func proxyChain(node *models.Node) (*Client, error) {
+	if proxyResolver == nil || (node.ProxyNodeID == "" && node.ProxyJumpHostID == "") {
+		return nil, nil
+	}
+	hops, err := proxyResolver.NodeSSHHops(node)
+	if err != nil {
+		return nil, err
+	}
+	var prev *Client
+	for _, h := range hops {
+		prev = &Client{
+			nodeID:      h.NodeID,
+			jumpHostID:  h.JumpHostID,
+			host:        h.Host,
+			port:        h.Port,
+			username:    h.Username,
+			privateKey:  h.PrivateKey,
+			passphrase:  h.KeyPassphrase,
+			certificate: h.Certificate,
+			password:    h.Password,
+			hostKey:     h.HostKey,
+			proxy:       prev,
+		}
+	}
+	return prev, nil
+}
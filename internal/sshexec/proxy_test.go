@@ -0,0 +1,70 @@
+package sshexec_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gsarma/localisprod-v2/internal/models"
+	"github.com/gsarma/localisprod-v2/internal/sshexec"
+)
+
+type staticProxyResolver struct {
+	hops []*models.SSHHop
+	err  error
+}
+
+func (r staticProxyResolver) NodeSSHHops(*models.Node) ([]*models.SSHHop, error) {
+	return r.hops, r.err
+}
+
+func TestProxy_ChainOfJumpHosts(t *testing.T) {
+	_, clientKey := newSigner(t)
+	outerSigner, _ := newSigner(t)
+	innerSigner, _ := newSigner(t)
+	targetSigner, _ := newSigner(t)
+	outer := startSSHServer(t, outerSigner)
+	inner := startSSHServer(t, innerSigner)
+	target := startSSHServer(t, targetSigner)
+
+	sshexec.SetProxyResolver(staticProxyResolver{hops: []*models.SSHHop{
+		{JumpHostID: "outer", Host: outer.host, Port: outer.port, Username: "root", PrivateKey: clientKey},
+		{JumpHostID: "inner", Host: inner.host, Port: inner.port, Username: "root", PrivateKey: clientKey},
+	}})
+	t.Cleanup(func() {
+		sshexec.SetProxyResolver(nil)
+		sshexec.EvictJumpHost("outer")
+		sshexec.EvictJumpHost("inner")
+	})
+
+	for _, id := range []string{"behind-1", "behind-2"} {
+		node := &models.Node{ID: id, Host: target.host, Port: target.port, Username: "root", PrivateKey: clientKey, ProxyJumpHostID: "inner"}
+		t.Cleanup(func() { sshexec.EvictNode(node.ID) })
+		out, err := sshexec.NewRunner(node).Run("hostname")
+		if err != nil || out != "hostname" {
+			t.Fatalf("Run via jump hosts: %q, %v", out, err)
+		}
+	}
+	if outer.conns.Load() != 1 || inner.conns.Load() != 1 {
+		t.Errorf("expected one connection per jump host, got outer=%d inner=%d", outer.conns.Load(), inner.conns.Load())
+	}
+	if n := target.conns.Load(); n != 2 {
+		t.Errorf("expected a connection per node, got %d", n)
+	}
+
+	node := &models.Node{ID: "behind-1", Host: target.host, Port: target.port, ProxyJumpHostID: "inner"}
+	got, err := sshexec.ScanNodeHostKey(node)
+	if err != nil || got != sshexec.MarshalHostKey(targetSigner.PublicKey()) {
+		t.Errorf("ScanNodeHostKey via jump hosts: %q, %v", got, err)
+	}
+}
+
+func TestProxy_ResolveError(t *testing.T) {
+	_, clientKey := newSigner(t)
+	sshexec.SetProxyResolver(staticProxyResolver{err: errors.New("jump host gone")})
+	t.Cleanup(func() { sshexec.SetProxyResolver(nil) })
+
+	node := &models.Node{ID: "behind-missing", Host: "10.0.0.9", Port: 22, Username: "root", PrivateKey: clientKey, ProxyJumpHostID: "gone"}
+	if err := sshexec.NewRunner(node).Ping(); err == nil {
+		t.Fatal("expected error when the proxy chain cannot be resolved")
+	}
+}
@@ -0,0 +1,127 @@
+package sshexec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func (l *LocalRunner) Stream(ctx context.Context, cmd string, onLine func(line string)) error {
+	c := exec.CommandContext(ctx, "sh", "-c", cmd)
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := c.Start(); err != nil {
+		return fmt.Errorf("start %q: %w", cmd, err)
+	}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		onLine(scanner.Text())
+	}
+	err = c.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Stream runs cmd in a session on the pooled connection. The connection is
+// kept from idling out while the command runs; cancelling ctx closes the
+// session.
+func (c *Client) Stream(ctx context.Context, cmd string, onLine func(line string)) error {
+	session, err := c.session()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("stdout pipe: %w", err)
+	}
+	if err := session.Start(cmd); err != nil {
+		return fmt.Errorf("start %q: %w", cmd, err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				session.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				c.touch()
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		onLine(scanner.Text())
+	}
+	err = session.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// EventsReady is the first line DockerEventsCmd prints, once the node has been
+// reached and before any event.
+const EventsReady = "localisprod-events-ready"
+
+// DockerEventsCmd returns a command that follows the start, die, oom and
+// health_status events of the containers carrying ManagedLabel, one JSON
+// object per line, after printing EventsReady.
+func DockerEventsCmd() string {
+	return "echo " + EventsReady + " && exec docker events --format '{{json .}}'" +
+		" --filter type=container --filter label=" + ManagedLabel +
+		" --filter event=start --filter event=die --filter event=oom --filter event=health_status"
+}
+
+// ContainerEvent is one line of DockerEventsCmd output.
+type ContainerEvent struct {
+	Container string
+	Action    string // start, die, oom or health_status
+	Health    string // healthy or unhealthy, for health_status
+	ExitCode  string // for die
+	Time      time.Time
+}
+
+// ParseDockerEvent parses one line of DockerEventsCmd output.
+func ParseDockerEvent(line string) (*ContainerEvent, error) {
+	var e struct {
+		Action string
+		Actor  struct {
+			Attributes map[string]string
+		}
+		TimeNano int64 `json:"timeNano"`
+	}
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		return nil, fmt.Errorf("parse docker event: %w", err)
+	}
+	name := e.Actor.Attributes["name"]
+	if e.Action == "" || name == "" {
+		return nil, fmt.Errorf("parse docker event: no action or container name in %q", line)
+	}
+	// health_status events carry the new status in the action,
+	// e.g. "health_status: unhealthy".
+	action, health, _ := strings.Cut(e.Action, ": ")
+	return &ContainerEvent{
+		Container: name,
+		Action:    action,
+		Health:    health,
+		ExitCode:  e.Actor.Attributes["exitCode"],
+		Time:      time.Unix(0, e.TimeNano).UTC(),
+	}, nil
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -43,6 +44,20 @@ func (s *Store) decryptEnvVars(stored string) (string, error) {
 	return s.cipher.Decrypt(stored)
 }
 
+func (s *Store) encryptSecret(plain string) (string, error) {
+	if s.cipher == nil || plain == "" {
+		return plain, nil
+	}
+	return s.cipher.Encrypt(plain)
+}
+
+func (s *Store) decryptSecret(stored string) (string, error) {
+	if s.cipher == nil || stored == "" {
+		return stored, nil
+	}
+	return s.cipher.Decrypt(stored)
+}
+
 func (s *Store) migrate() error {
 	// Idempotent: add columns to existing tables (ignored if already present)
 	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN is_local INTEGER NOT NULL DEFAULT 0`)
@@ -50,6 +65,14 @@ func (s *Store) migrate() error {
 	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN provider TEXT NOT NULL DEFAULT ''`)
 	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN provider_region TEXT NOT NULL DEFAULT ''`)
 	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN provider_instance_id TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN schedule TEXT NOT NULL DEFAULT 'active'`)
+	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN host_key TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN proxy_node_id TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN proxy_jump_host_id TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN key_passphrase TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN certificate TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE nodes ADD COLUMN password TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE jump_hosts ADD COLUMN key_passphrase TEXT NOT NULL DEFAULT ''`)
 	// Rename applications table to services (idempotent — fails silently if already renamed)
 	_, _ = s.db.Exec(`ALTER TABLE applications RENAME TO services`)
 	_, _ = s.db.Exec(`ALTER TABLE deployments RENAME COLUMN application_id TO service_id`)
@@ -74,6 +97,25 @@ func (s *Store) migrate() error {
 	_, _ = s.db.Exec(`ALTER TABLE object_storages ADD COLUMN last_deployed_at DATETIME`)
 	_, _ = s.db.Exec(`ALTER TABLE services ADD COLUMN volumes TEXT NOT NULL DEFAULT '[]'`)
 	_, _ = s.db.Exec(`ALTER TABLE caches ADD COLUMN volumes TEXT NOT NULL DEFAULT '[]'`)
+	// Self-healing policy per resource
+	_, _ = s.db.Exec(`ALTER TABLE deployments ADD COLUMN heal_policy TEXT NOT NULL DEFAULT 'observe'`)
+	_, _ = s.db.Exec(`ALTER TABLE databases   ADD COLUMN heal_policy TEXT NOT NULL DEFAULT 'observe'`)
+	_, _ = s.db.Exec(`ALTER TABLE caches      ADD COLUMN heal_policy TEXT NOT NULL DEFAULT 'observe'`)
+	_, _ = s.db.Exec(`ALTER TABLE kafkas      ADD COLUMN heal_policy TEXT NOT NULL DEFAULT 'observe'`)
+	_, _ = s.db.Exec(`ALTER TABLE monitorings ADD COLUMN heal_policy TEXT NOT NULL DEFAULT 'observe'`)
+	// Container health reported by docker events, per resource
+	_, _ = s.db.Exec(`ALTER TABLE deployments ADD COLUMN health TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE databases   ADD COLUMN health TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE caches      ADD COLUMN health TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE kafkas      ADD COLUMN health TEXT NOT NULL DEFAULT ''`)
+	_, _ = s.db.Exec(`ALTER TABLE monitorings ADD COLUMN health TEXT NOT NULL DEFAULT ''`)
+	// Image a deployment ran before it was last recreated, for rollback
+	_, _ = s.db.Exec(`ALTER TABLE deployments ADD COLUMN previous_image TEXT NOT NULL DEFAULT ''`)
+	// Image a rollback pinned a deployment to, until the next redeploy
+	_, _ = s.db.Exec(`ALTER TABLE deployments ADD COLUMN pinned_image TEXT NOT NULL DEFAULT ''`)
+	// Multiple Traefik routes per service; the legacy domain column becomes a single route
+	_, _ = s.db.Exec(`ALTER TABLE services ADD COLUMN routes TEXT NOT NULL DEFAULT '[]'`)
+	_, _ = s.db.Exec(`UPDATE services SET routes = json_array(json_object('host', domain)), domain = '' WHERE domain != '' AND routes = '[]'`)
 
 	_, err := s.db.Exec(`
 CREATE TABLE IF NOT EXISTS users (
@@ -105,6 +147,13 @@ CREATE TABLE IF NOT EXISTS nodes (
   provider TEXT NOT NULL DEFAULT '',
   provider_region TEXT NOT NULL DEFAULT '',
   provider_instance_id TEXT NOT NULL DEFAULT '',
+  schedule TEXT NOT NULL DEFAULT 'active',
+  host_key TEXT NOT NULL DEFAULT '',
+  proxy_node_id TEXT NOT NULL DEFAULT '',
+  proxy_jump_host_id TEXT NOT NULL DEFAULT '',
+  key_passphrase TEXT NOT NULL DEFAULT '',
+  certificate TEXT NOT NULL DEFAULT '',
+  password TEXT NOT NULL DEFAULT '',
   user_id TEXT REFERENCES users(id),
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
@@ -120,6 +169,7 @@ CREATE TABLE IF NOT EXISTS services (
   command TEXT NOT NULL DEFAULT '',
   github_repo TEXT NOT NULL DEFAULT '',
   domain TEXT NOT NULL DEFAULT '',
+  routes TEXT NOT NULL DEFAULT '[]',
   databases TEXT NOT NULL DEFAULT '[]',
   caches TEXT NOT NULL DEFAULT '[]',
   kafkas TEXT NOT NULL DEFAULT '[]',
@@ -141,6 +191,8 @@ CREATE TABLE IF NOT EXISTS databases (
   port INTEGER NOT NULL DEFAULT 0,
   container_name TEXT NOT NULL DEFAULT '',
   status TEXT NOT NULL DEFAULT 'pending',
+  heal_policy TEXT NOT NULL DEFAULT 'observe',
+  health TEXT NOT NULL DEFAULT '',
   user_id TEXT REFERENCES users(id),
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   last_deployed_at DATETIME
@@ -156,6 +208,8 @@ CREATE TABLE IF NOT EXISTS caches (
   volumes TEXT NOT NULL DEFAULT '[]',
   container_name TEXT NOT NULL DEFAULT '',
   status TEXT NOT NULL DEFAULT 'pending',
+  heal_policy TEXT NOT NULL DEFAULT 'observe',
+  health TEXT NOT NULL DEFAULT '',
   user_id TEXT REFERENCES users(id),
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   last_deployed_at DATETIME
@@ -169,6 +223,8 @@ CREATE TABLE IF NOT EXISTS kafkas (
   port INTEGER NOT NULL DEFAULT 9092,
   container_name TEXT NOT NULL DEFAULT '',
   status TEXT NOT NULL DEFAULT 'pending',
+  heal_policy TEXT NOT NULL DEFAULT 'observe',
+  health TEXT NOT NULL DEFAULT '',
   user_id TEXT REFERENCES users(id),
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   last_deployed_at DATETIME
@@ -184,6 +240,8 @@ CREATE TABLE IF NOT EXISTS monitorings (
   prometheus_container_name TEXT NOT NULL DEFAULT '',
   grafana_container_name TEXT NOT NULL DEFAULT '',
   status TEXT NOT NULL DEFAULT 'pending',
+  heal_policy TEXT NOT NULL DEFAULT 'observe',
+  health TEXT NOT NULL DEFAULT '',
   user_id TEXT REFERENCES users(id),
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   last_deployed_at DATETIME
@@ -214,6 +272,10 @@ CREATE TABLE IF NOT EXISTS deployments (
   container_name TEXT NOT NULL,
   container_id TEXT NOT NULL DEFAULT '',
   status TEXT NOT NULL DEFAULT 'pending',
+  heal_policy TEXT NOT NULL DEFAULT 'observe',
+  health TEXT NOT NULL DEFAULT '',
+  previous_image TEXT NOT NULL DEFAULT '',
+  pinned_image TEXT NOT NULL DEFAULT '',
   user_id TEXT REFERENCES users(id),
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   last_deployed_at DATETIME
@@ -223,6 +285,16 @@ CREATE TABLE IF NOT EXISTS settings (
   key TEXT PRIMARY KEY,
   value TEXT NOT NULL
 );
+
+CREATE TABLE IF NOT EXISTS heal_states (
+  resource_type TEXT NOT NULL,
+  resource_id TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  last_attempt_at DATETIME,
+  next_attempt_at DATETIME,
+  last_error TEXT NOT NULL DEFAULT '',
+  PRIMARY KEY (resource_type, resource_id)
+);
 `)
 	if err != nil {
 		return err
@@ -239,6 +311,172 @@ CREATE TABLE IF NOT EXISTS node_volume_migrations (
   created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
   updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
+`)
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS canaries (
+  id TEXT PRIMARY KEY,
+  deployment_id TEXT NOT NULL,
+  service_id TEXT NOT NULL,
+  node_id TEXT NOT NULL,
+  docker_image TEXT NOT NULL,
+  container_name TEXT NOT NULL,
+  container_id TEXT NOT NULL DEFAULT '',
+  weight INTEGER NOT NULL DEFAULT 10,
+  status TEXT NOT NULL DEFAULT 'pending',
+  user_id TEXT REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+`)
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS certificates (
+  id TEXT PRIMARY KEY,
+  domains TEXT NOT NULL DEFAULT '[]',
+  source TEXT NOT NULL,
+  node_id TEXT NOT NULL DEFAULT '',
+  issuer TEXT NOT NULL DEFAULT '',
+  not_before DATETIME,
+  not_after DATETIME,
+  cert_pem TEXT NOT NULL,
+  key_pem TEXT NOT NULL DEFAULT '',
+  user_id TEXT REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_certificates_acme ON certificates(node_id, domains) WHERE source = 'acme';
+`)
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS wireguard_peers (
+  node_id TEXT PRIMARY KEY,
+  overlay_ip TEXT NOT NULL,
+  public_key TEXT NOT NULL,
+  private_key TEXT NOT NULL,
+  user_id TEXT REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_wireguard_peers_ip ON wireguard_peers(user_id, overlay_ip);
+`)
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS jump_hosts (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  host TEXT NOT NULL,
+  port INTEGER NOT NULL DEFAULT 22,
+  username TEXT NOT NULL,
+  private_key TEXT NOT NULL,
+  host_key TEXT NOT NULL DEFAULT '',
+  proxy_jump_host_id TEXT NOT NULL DEFAULT '',
+  key_passphrase TEXT NOT NULL DEFAULT '',
+  user_id TEXT REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+`)
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS firewall_rules (
+  id TEXT PRIMARY KEY,
+  node_id TEXT NOT NULL DEFAULT '',
+  protocol TEXT NOT NULL DEFAULT 'tcp',
+  port INTEGER NOT NULL,
+  source TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  user_id TEXT REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS node_firewalls (
+  node_id TEXT PRIMARY KEY,
+  applied_at DATETIME,
+  last_error TEXT NOT NULL DEFAULT '',
+  user_id TEXT REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+`)
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS node_bootstraps (
+  node_id TEXT PRIMARY KEY,
+  os TEXT NOT NULL DEFAULT '',
+  versions TEXT NOT NULL DEFAULT '{}',
+  bootstrapped_at DATETIME,
+  last_error TEXT NOT NULL DEFAULT '',
+  user_id TEXT REFERENCES users(id),
+  updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+`)
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS audit_events (
+  id TEXT PRIMARY KEY,
+  actor_type TEXT NOT NULL,
+  actor_id TEXT NOT NULL DEFAULT '',
+  actor_name TEXT NOT NULL DEFAULT '',
+  action TEXT NOT NULL,
+  resource_type TEXT NOT NULL DEFAULT '',
+  resource_id TEXT NOT NULL DEFAULT '',
+  before TEXT NOT NULL DEFAULT '',
+  after TEXT NOT NULL DEFAULT '',
+  source_ip TEXT NOT NULL DEFAULT '',
+  result TEXT NOT NULL,
+  error TEXT NOT NULL DEFAULT '',
+  user_id TEXT REFERENCES users(id),
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user ON audit_events(user_id, created_at);
+`)
+	// Resources keep their user_id column, which holds the owning
+	// organization's ID; a user's personal organization has the user's ID.
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS organizations (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL,
+  personal INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS org_members (
+  org_id TEXT NOT NULL REFERENCES organizations(id),
+  user_id TEXT NOT NULL REFERENCES users(id),
+  role TEXT NOT NULL,
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (org_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_org_members_user ON org_members(user_id);
+INSERT OR IGNORE INTO organizations (id, name, personal) SELECT id, email, 1 FROM users;
+INSERT OR IGNORE INTO org_members (org_id, user_id, role) SELECT id, id, 'owner' FROM users;
+`)
+	// API tokens belong to a user rather than an organization; only their
+	// hash is stored.
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id TEXT PRIMARY KEY,
+  user_id TEXT NOT NULL REFERENCES users(id),
+  name TEXT NOT NULL,
+  prefix TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  scope TEXT NOT NULL,
+  expires_at DATETIME,
+  last_used_at DATETIME,
+  last_used_ip TEXT NOT NULL DEFAULT '',
+  created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+`)
+	// ts is a unix timestamp so samples can be bucketed in SQL.
+	_, _ = s.db.Exec(`
+CREATE TABLE IF NOT EXISTS metric_samples (
+  kind TEXT NOT NULL,
+  target_id TEXT NOT NULL,
+  resolution INTEGER NOT NULL DEFAULT 0,
+  ts INTEGER NOT NULL,
+  cpu_percent REAL NOT NULL DEFAULT 0,
+  mem_used INTEGER NOT NULL DEFAULT 0,
+  mem_total INTEGER NOT NULL DEFAULT 0,
+  disk_used INTEGER NOT NULL DEFAULT 0,
+  disk_total INTEGER NOT NULL DEFAULT 0,
+  net_rx INTEGER NOT NULL DEFAULT 0,
+  net_tx INTEGER NOT NULL DEFAULT 0,
+  load1 REAL NOT NULL DEFAULT 0,
+  load5 REAL NOT NULL DEFAULT 0,
+  load15 REAL NOT NULL DEFAULT 0,
+  user_id TEXT REFERENCES users(id),
+  PRIMARY KEY (kind, target_id, resolution, ts)
+);
 `)
 	return nil
 }
@@ -276,6 +514,18 @@ func (s *Store) UpsertUser(googleID, email, name, avatarURL string) (*models.Use
 		_ = s.SetUserSetting(u.ID, "webhook_token", newTok)
 	}
 
+	// Ensure the user's personal organization exists
+	if _, err := s.db.Exec(
+		`INSERT OR IGNORE INTO organizations (id, name, personal) VALUES (?, ?, 1)`, u.ID, u.Email,
+	); err != nil {
+		return nil, fmt.Errorf("create personal organization: %w", err)
+	}
+	if _, err := s.db.Exec(
+		`INSERT OR IGNORE INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)`, u.ID, u.ID, models.RoleOwner,
+	); err != nil {
+		return nil, fmt.Errorf("create personal organization: %w", err)
+	}
+
 	return u, nil
 }
 
@@ -304,6 +554,32 @@ func (s *Store) GetUserByWebhookToken(token string) (*models.User, error) {
 	return s.GetUserByID(userID)
 }
 
+// GetUserByEmail returns the user with the given email, or nil if no such
+// user has signed in yet.
+func (s *Store) GetUserByEmail(email string) (*models.User, error) {
+	u := &models.User{}
+	err := s.db.QueryRow(
+		`SELECT id, google_id, email, name, avatar_url, created_at FROM users WHERE email = ? COLLATE NOCASE`, email,
+	).Scan(&u.ID, &u.GoogleID, &u.Email, &u.Name, &u.AvatarURL, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+// GetWebhookOwner returns the ID of the organization a webhook token belongs
+// to, or "" if the token is unknown.
+func (s *Store) GetWebhookOwner(token string) (string, error) {
+	var ownerID string
+	err := s.db.QueryRow(
+		`SELECT user_id FROM user_settings WHERE key = 'webhook_token' AND value = ?`, token,
+	).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return ownerID, err
+}
+
 // User settings
 
 func (s *Store) GetUserSetting(userID, key string) (string, error) {
@@ -351,17 +627,56 @@ func (s *Store) SetSecretUserSetting(userID, key, value string) error {
 // Nodes
 
 func (s *Store) CreateNode(n *models.Node, userID string) error {
-	_, err := s.db.Exec(
-		`INSERT INTO nodes (id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, user_id, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		n.ID, n.Name, n.Host, n.Port, n.Username, n.PrivateKey, n.Status, n.IsLocal, n.TraefikEnabled, n.Provider, n.ProviderRegion, n.ProviderInstanceID, userID, n.CreatedAt,
+	if n.Schedule == "" {
+		n.Schedule = models.NodeScheduleActive
+	}
+	passphrase, err := s.encryptSecret(n.KeyPassphrase)
+	if err != nil {
+		return fmt.Errorf("encrypt key passphrase: %w", err)
+	}
+	password, err := s.encryptSecret(n.Password)
+	if err != nil {
+		return fmt.Errorf("encrypt password: %w", err)
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO nodes (id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, schedule, host_key, proxy_node_id, proxy_jump_host_id, key_passphrase, certificate, password, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		n.ID, n.Name, n.Host, n.Port, n.Username, n.PrivateKey, n.Status, n.IsLocal, n.TraefikEnabled, n.Provider, n.ProviderRegion, n.ProviderInstanceID, n.Schedule, n.HostKey, n.ProxyNodeID, n.ProxyJumpHostID, passphrase, n.Certificate, password, userID, n.CreatedAt,
 	)
 	return err
 }
 
+// decryptNodeSecrets decrypts the key passphrase and password of a scanned
+// node in place.
+func (s *Store) decryptNodeSecrets(n *models.Node) error {
+	var err error
+	if n.KeyPassphrase, err = s.decryptSecret(n.KeyPassphrase); err != nil {
+		return fmt.Errorf("decrypt key passphrase: %w", err)
+	}
+	if n.Password, err = s.decryptSecret(n.Password); err != nil {
+		return fmt.Errorf("decrypt password: %w", err)
+	}
+	return nil
+}
+
+// UpdateNodeCredentials replaces how the control plane logs into a node.
+func (s *Store) UpdateNodeCredentials(n *models.Node, userID string) error {
+	passphrase, err := s.encryptSecret(n.KeyPassphrase)
+	if err != nil {
+		return fmt.Errorf("encrypt key passphrase: %w", err)
+	}
+	password, err := s.encryptSecret(n.Password)
+	if err != nil {
+		return fmt.Errorf("encrypt password: %w", err)
+	}
+	_, err = s.db.Exec(`UPDATE nodes SET private_key = ?, key_passphrase = ?, certificate = ?, password = ? WHERE id = ? AND user_id = ?`,
+		n.PrivateKey, passphrase, n.Certificate, password, n.ID, userID)
+	return err
+}
+
 func (s *Store) ListNodes(userID string) ([]*models.Node, error) {
 	rows, err := s.db.Query(
-		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, created_at
+		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, schedule, host_key, proxy_node_id, proxy_jump_host_id, key_passphrase, certificate, password, created_at
 		 FROM nodes WHERE user_id = ? ORDER BY is_local DESC, created_at DESC`, userID)
 	if err != nil {
 		return nil, err
@@ -370,7 +685,10 @@ func (s *Store) ListNodes(userID string) ([]*models.Node, error) {
 	var nodes []*models.Node
 	for rows.Next() {
 		n := &models.Node{}
-		if err := rows.Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.CreatedAt); err != nil {
+		if err := rows.Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.Schedule, &n.HostKey, &n.ProxyNodeID, &n.ProxyJumpHostID, &n.KeyPassphrase, &n.Certificate, &n.Password, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := s.decryptNodeSecrets(n); err != nil {
 			return nil, err
 		}
 		nodes = append(nodes, n)
@@ -381,13 +699,16 @@ func (s *Store) ListNodes(userID string) ([]*models.Node, error) {
 func (s *Store) GetNode(id, userID string) (*models.Node, error) {
 	n := &models.Node{}
 	err := s.db.QueryRow(
-		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, created_at
+		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, schedule, host_key, proxy_node_id, proxy_jump_host_id, key_passphrase, certificate, password, created_at
 		 FROM nodes WHERE id = ? AND user_id = ?`, id, userID,
-	).Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.CreatedAt)
+	).Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.Schedule, &n.HostKey, &n.ProxyNodeID, &n.ProxyJumpHostID, &n.KeyPassphrase, &n.Certificate, &n.Password, &n.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return n, err
+	if err != nil {
+		return nil, err
+	}
+	return n, s.decryptNodeSecrets(n)
 }
 
 // EnsureManagementNode creates the local management node if it does not exist.
@@ -404,13 +725,16 @@ func (s *Store) EnsureManagementNode() error {
 func (s *Store) GetManagementNode() (*models.Node, error) {
 	n := &models.Node{}
 	err := s.db.QueryRow(
-		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, created_at
+		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, schedule, host_key, proxy_node_id, proxy_jump_host_id, key_passphrase, certificate, password, created_at
 		 FROM nodes WHERE id = 'management' AND is_local = 1 AND user_id IS NULL`,
-	).Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.CreatedAt)
+	).Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.Schedule, &n.HostKey, &n.ProxyNodeID, &n.ProxyJumpHostID, &n.KeyPassphrase, &n.Certificate, &n.Password, &n.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return n, err
+	if err != nil {
+		return nil, err
+	}
+	return n, s.decryptNodeSecrets(n)
 }
 
 // GetNodeForUser returns a node by ID. Root users can also access the management node.
@@ -420,19 +744,22 @@ func (s *Store) GetNodeForUser(id, userID string, isRoot bool) (*models.Node, er
 	}
 	n := &models.Node{}
 	err := s.db.QueryRow(
-		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, created_at
+		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, schedule, host_key, proxy_node_id, proxy_jump_host_id, key_passphrase, certificate, password, created_at
 		 FROM nodes WHERE id = ? AND (user_id = ? OR (id = 'management' AND user_id IS NULL))`, id, userID,
-	).Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.CreatedAt)
+	).Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.Schedule, &n.HostKey, &n.ProxyNodeID, &n.ProxyJumpHostID, &n.KeyPassphrase, &n.Certificate, &n.Password, &n.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return n, err
+	if err != nil {
+		return nil, err
+	}
+	return n, s.decryptNodeSecrets(n)
 }
 
 // ListAllNodes returns every node across all users. Used by the background poller.
 func (s *Store) ListAllNodes() ([]*models.Node, error) {
 	rows, err := s.db.Query(
-		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, created_at, user_id
+		`SELECT id, name, host, port, username, private_key, status, is_local, traefik_enabled, provider, provider_region, provider_instance_id, schedule, host_key, proxy_node_id, proxy_jump_host_id, key_passphrase, certificate, password, created_at, user_id
 		 FROM nodes WHERE user_id IS NOT NULL ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
@@ -441,7 +768,10 @@ func (s *Store) ListAllNodes() ([]*models.Node, error) {
 	var nodes []*models.Node
 	for rows.Next() {
 		n := &models.Node{}
-		if err := rows.Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.CreatedAt, &n.UserID); err != nil {
+		if err := rows.Scan(&n.ID, &n.Name, &n.Host, &n.Port, &n.Username, &n.PrivateKey, &n.Status, &n.IsLocal, &n.TraefikEnabled, &n.Provider, &n.ProviderRegion, &n.ProviderInstanceID, &n.Schedule, &n.HostKey, &n.ProxyNodeID, &n.ProxyJumpHostID, &n.KeyPassphrase, &n.Certificate, &n.Password, &n.CreatedAt, &n.UserID); err != nil {
+			return nil, err
+		}
+		if err := s.decryptNodeSecrets(n); err != nil {
 			return nil, err
 		}
 		nodes = append(nodes, n)
@@ -454,6 +784,45 @@ func (s *Store) UpdateNodeStatus(id, userID, status string) error {
 	return err
 }
 
+func (s *Store) UpdateNodeSchedule(id, userID, schedule string) error {
+	_, err := s.db.Exec(`UPDATE nodes SET schedule = ? WHERE id = ? AND user_id = ?`, schedule, id, userID)
+	return err
+}
+
+// ResetDrainingNodes cordons the nodes left draining by a drain that never
+// finished, e.g. because the server restarted during it, and returns how many
+// there were. A draining node refuses cordon, uncordon and drain, so it would
+// otherwise stay stuck.
+func (s *Store) ResetDrainingNodes() (int64, error) {
+	res, err := s.db.Exec(`UPDATE nodes SET schedule = ? WHERE schedule = ?`, models.NodeScheduleCordoned, models.NodeScheduleDraining)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PinNodeHostKey stores the host key first seen for a node, unless one is
+// already pinned, and returns the pinned key. It implements
+// sshexec.HostKeyStore.
+func (s *Store) PinNodeHostKey(nodeID, key string) (string, error) {
+	if _, err := s.db.Exec(`UPDATE nodes SET host_key = ? WHERE id = ? AND host_key = ''`, key, nodeID); err != nil {
+		return "", err
+	}
+	var pinned string
+	err := s.db.QueryRow(`SELECT host_key FROM nodes WHERE id = ?`, nodeID).Scan(&pinned)
+	if err == sql.ErrNoRows {
+		// Not a stored node (e.g. a connection test): trust for this dial only.
+		return key, nil
+	}
+	return pinned, err
+}
+
+// SetNodeHostKey replaces a node's pinned host key, e.g. after a rotation.
+func (s *Store) SetNodeHostKey(id, userID, key string) error {
+	_, err := s.db.Exec(`UPDATE nodes SET host_key = ? WHERE id = ? AND user_id = ?`, key, id, userID)
+	return err
+}
+
 func (s *Store) UpdateNodeTraefik(id, userID string, enabled bool) error {
 	val := 0
 	if enabled {
@@ -468,6 +837,162 @@ func (s *Store) DeleteNode(id, userID string) error {
 	return err
 }
 
+// NodeUsedAsProxy reports whether another node dials through the node.
+func (s *Store) NodeUsedAsProxy(id string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM nodes WHERE proxy_node_id = ?`, id).Scan(&n)
+	return n > 0, err
+}
+
+// maxSSHHops bounds proxy chains so a cycle cannot loop forever.
+const maxSSHHops = 8
+
+// NodeSSHHops resolves the chain of proxies a node is dialed through, ordered
+// from the host reached directly to the node's own proxy. It implements
+// sshexec.ProxyResolver.
+func (s *Store) NodeSSHHops(n *models.Node) ([]*models.SSHHop, error) {
+	var hops []*models.SSHHop
+	proxyNodeID, jumpHostID := n.ProxyNodeID, n.ProxyJumpHostID
+	for proxyNodeID != "" || jumpHostID != "" {
+		if len(hops) == maxSSHHops {
+			return nil, fmt.Errorf("proxy chain of node %s is longer than %d hops or loops", n.Name, maxSSHHops)
+		}
+		hop := &models.SSHHop{}
+		if proxyNodeID != "" {
+			p := &models.Node{}
+			err := s.db.QueryRow(
+				`SELECT id, name, host, port, username, private_key, is_local, host_key, proxy_node_id, proxy_jump_host_id, key_passphrase, certificate, password FROM nodes WHERE id = ?`, proxyNodeID,
+			).Scan(&p.ID, &p.Name, &p.Host, &p.Port, &p.Username, &p.PrivateKey, &p.IsLocal, &p.HostKey, &p.ProxyNodeID, &p.ProxyJumpHostID, &p.KeyPassphrase, &p.Certificate, &p.Password)
+			if err == sql.ErrNoRows {
+				return nil, fmt.Errorf("proxy node %s of node %s not found", proxyNodeID, n.Name)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if p.IsLocal {
+				return nil, fmt.Errorf("local node %s cannot be an SSH proxy", p.Name)
+			}
+			if err := s.decryptNodeSecrets(p); err != nil {
+				return nil, err
+			}
+			*hop = models.SSHHop{NodeID: p.ID, Host: p.Host, Port: p.Port, Username: p.Username, PrivateKey: p.PrivateKey,
+				KeyPassphrase: p.KeyPassphrase, Certificate: p.Certificate, Password: p.Password, HostKey: p.HostKey}
+			proxyNodeID, jumpHostID = p.ProxyNodeID, p.ProxyJumpHostID
+		} else {
+			j, err := s.getJumpHost(`id = ?`, jumpHostID)
+			if err != nil {
+				return nil, err
+			}
+			if j == nil {
+				return nil, fmt.Errorf("jump host %s of node %s not found", jumpHostID, n.Name)
+			}
+			*hop = models.SSHHop{JumpHostID: j.ID, Host: j.Host, Port: j.Port, Username: j.Username, PrivateKey: j.PrivateKey,
+				KeyPassphrase: j.KeyPassphrase, HostKey: j.HostKey}
+			proxyNodeID, jumpHostID = "", j.ProxyJumpHostID
+		}
+		hops = append([]*models.SSHHop{hop}, hops...)
+	}
+	return hops, nil
+}
+
+// Jump hosts
+
+func (s *Store) CreateJumpHost(j *models.JumpHost, userID string) error {
+	privateKey, err := s.encryptSecret(j.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("encrypt private key: %w", err)
+	}
+	passphrase, err := s.encryptSecret(j.KeyPassphrase)
+	if err != nil {
+		return fmt.Errorf("encrypt key passphrase: %w", err)
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO jump_hosts (id, name, host, port, username, private_key, key_passphrase, host_key, proxy_jump_host_id, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		j.ID, j.Name, j.Host, j.Port, j.Username, privateKey, passphrase, j.HostKey, j.ProxyJumpHostID, userID, j.CreatedAt,
+	)
+	return err
+}
+
+const jumpHostColumns = `id, name, host, port, username, private_key, key_passphrase, host_key, proxy_jump_host_id, user_id, created_at`
+
+func (s *Store) scanJumpHost(sc interface{ Scan(...any) error }) (*models.JumpHost, error) {
+	j := &models.JumpHost{}
+	var userID sql.NullString
+	if err := sc.Scan(&j.ID, &j.Name, &j.Host, &j.Port, &j.Username, &j.PrivateKey, &j.KeyPassphrase, &j.HostKey, &j.ProxyJumpHostID, &userID, &j.CreatedAt); err != nil {
+		return nil, err
+	}
+	j.UserID = userID.String
+	key, err := s.decryptSecret(j.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt private key: %w", err)
+	}
+	j.PrivateKey = key
+	if j.KeyPassphrase, err = s.decryptSecret(j.KeyPassphrase); err != nil {
+		return nil, fmt.Errorf("decrypt key passphrase: %w", err)
+	}
+	return j, nil
+}
+
+func (s *Store) getJumpHost(where string, args ...any) (*models.JumpHost, error) {
+	j, err := s.scanJumpHost(s.db.QueryRow(`SELECT `+jumpHostColumns+` FROM jump_hosts WHERE `+where, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return j, err
+}
+
+func (s *Store) GetJumpHost(id, userID string) (*models.JumpHost, error) {
+	return s.getJumpHost(`id = ? AND user_id = ?`, id, userID)
+}
+
+func (s *Store) ListJumpHosts(userID string) ([]*models.JumpHost, error) {
+	rows, err := s.db.Query(`SELECT `+jumpHostColumns+` FROM jump_hosts WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*models.JumpHost
+	for rows.Next() {
+		j, err := s.scanJumpHost(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
+
+// JumpHostInUse reports whether a node or another jump host dials through the
+// jump host.
+func (s *Store) JumpHostInUse(id string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM nodes WHERE proxy_jump_host_id = ?) + (SELECT COUNT(*) FROM jump_hosts WHERE proxy_jump_host_id = ?)`,
+		id, id).Scan(&n)
+	return n > 0, err
+}
+
+// PinJumpHostHostKey stores the host key first seen for a jump host, unless
+// one is already pinned, and returns the pinned key. It implements
+// sshexec.HostKeyStore.
+func (s *Store) PinJumpHostHostKey(id, key string) (string, error) {
+	if _, err := s.db.Exec(`UPDATE jump_hosts SET host_key = ? WHERE id = ? AND host_key = ''`, key, id); err != nil {
+		return "", err
+	}
+	var pinned string
+	err := s.db.QueryRow(`SELECT host_key FROM jump_hosts WHERE id = ?`, id).Scan(&pinned)
+	if err == sql.ErrNoRows {
+		return key, nil
+	}
+	return pinned, err
+}
+
+func (s *Store) DeleteJumpHost(id, userID string) error {
+	_, err := s.db.Exec(`DELETE FROM jump_hosts WHERE id = ? AND user_id = ?`, id, userID)
+	return err
+}
+
 // Services
 
 func (s *Store) CreateService(a *models.Service, userID string) error {
@@ -476,16 +1001,16 @@ func (s *Store) CreateService(a *models.Service, userID string) error {
 		return fmt.Errorf("encrypt env_vars: %w", err)
 	}
 	_, err = s.db.Exec(
-		`INSERT INTO services (id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, domain, databases, caches, kafkas, monitorings, user_id, created_at)
+		`INSERT INTO services (id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, routes, databases, caches, kafkas, monitorings, user_id, created_at)
 		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		a.ID, a.Name, a.DockerImage, a.DockerfilePath, envVars, a.Ports, a.Volumes, a.Command, a.GithubRepo, a.Domain, a.Databases, a.Caches, a.Kafkas, a.Monitorings, userID, a.CreatedAt,
+		a.ID, a.Name, a.DockerImage, a.DockerfilePath, envVars, a.Ports, a.Volumes, a.Command, a.GithubRepo, a.Routes, a.Databases, a.Caches, a.Kafkas, a.Monitorings, userID, a.CreatedAt,
 	)
 	return err
 }
 
 func (s *Store) ListServices(userID string) ([]*models.Service, error) {
 	rows, err := s.db.Query(
-		`SELECT id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, domain, databases, caches, kafkas, monitorings, created_at, last_deployed_at
+		`SELECT id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, routes, databases, caches, kafkas, monitorings, created_at, last_deployed_at
 		 FROM services WHERE user_id = ? ORDER BY created_at DESC`, userID)
 	if err != nil {
 		return nil, err
@@ -494,7 +1019,7 @@ func (s *Store) ListServices(userID string) ([]*models.Service, error) {
 	var svcs []*models.Service
 	for rows.Next() {
 		a := &models.Service{}
-		if err := rows.Scan(&a.ID, &a.Name, &a.DockerImage, &a.DockerfilePath, &a.EnvVars, &a.Ports, &a.Volumes, &a.Command, &a.GithubRepo, &a.Domain, &a.Databases, &a.Caches, &a.Kafkas, &a.Monitorings, &a.CreatedAt, &a.LastDeployedAt); err != nil {
+		if err := rows.Scan(&a.ID, &a.Name, &a.DockerImage, &a.DockerfilePath, &a.EnvVars, &a.Ports, &a.Volumes, &a.Command, &a.GithubRepo, &a.Routes, &a.Databases, &a.Caches, &a.Kafkas, &a.Monitorings, &a.CreatedAt, &a.LastDeployedAt); err != nil {
 			return nil, err
 		}
 		if a.EnvVars, err = s.decryptEnvVars(a.EnvVars); err != nil {
@@ -508,9 +1033,9 @@ func (s *Store) ListServices(userID string) ([]*models.Service, error) {
 func (s *Store) GetService(id, userID string) (*models.Service, error) {
 	a := &models.Service{}
 	err := s.db.QueryRow(
-		`SELECT id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, domain, databases, caches, kafkas, monitorings, created_at, last_deployed_at
+		`SELECT id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, routes, databases, caches, kafkas, monitorings, created_at, last_deployed_at
 		 FROM services WHERE id = ? AND user_id = ?`, id, userID,
-	).Scan(&a.ID, &a.Name, &a.DockerImage, &a.DockerfilePath, &a.EnvVars, &a.Ports, &a.Volumes, &a.Command, &a.GithubRepo, &a.Domain, &a.Databases, &a.Caches, &a.Kafkas, &a.Monitorings, &a.CreatedAt, &a.LastDeployedAt)
+	).Scan(&a.ID, &a.Name, &a.DockerImage, &a.DockerfilePath, &a.EnvVars, &a.Ports, &a.Volumes, &a.Command, &a.GithubRepo, &a.Routes, &a.Databases, &a.Caches, &a.Kafkas, &a.Monitorings, &a.CreatedAt, &a.LastDeployedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -529,9 +1054,9 @@ func (s *Store) UpdateService(a *models.Service, userID string) error {
 		return fmt.Errorf("encrypt env_vars: %w", err)
 	}
 	_, err = s.db.Exec(
-		`UPDATE services SET name=?, docker_image=?, dockerfile_path=?, env_vars=?, ports=?, volumes=?, command=?, domain=?, databases=?, caches=?, kafkas=?, monitorings=?
+		`UPDATE services SET name=?, docker_image=?, dockerfile_path=?, env_vars=?, ports=?, volumes=?, command=?, routes=?, databases=?, caches=?, kafkas=?, monitorings=?
 		 WHERE id=? AND user_id=?`,
-		a.Name, a.DockerImage, a.DockerfilePath, envVars, a.Ports, a.Volumes, a.Command, a.Domain, a.Databases, a.Caches, a.Kafkas, a.Monitorings, a.ID, userID,
+		a.Name, a.DockerImage, a.DockerfilePath, envVars, a.Ports, a.Volumes, a.Command, a.Routes, a.Databases, a.Caches, a.Kafkas, a.Monitorings, a.ID, userID,
 	)
 	return err
 }
@@ -543,7 +1068,7 @@ func (s *Store) DeleteService(id, userID string) error {
 
 func (s *Store) ListServicesByUserAndRepo(userID, githubRepo string) ([]*models.Service, error) {
 	rows, err := s.db.Query(
-		`SELECT id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, domain, databases, caches, kafkas, monitorings, created_at, last_deployed_at
+		`SELECT id, name, docker_image, dockerfile_path, env_vars, ports, volumes, command, github_repo, routes, databases, caches, kafkas, monitorings, created_at, last_deployed_at
 		 FROM services WHERE user_id = ? AND github_repo = ? ORDER BY created_at DESC`, userID, githubRepo)
 	if err != nil {
 		return nil, err
@@ -552,7 +1077,7 @@ func (s *Store) ListServicesByUserAndRepo(userID, githubRepo string) ([]*models.
 	var svcs []*models.Service
 	for rows.Next() {
 		a := &models.Service{}
-		if err := rows.Scan(&a.ID, &a.Name, &a.DockerImage, &a.DockerfilePath, &a.EnvVars, &a.Ports, &a.Volumes, &a.Command, &a.GithubRepo, &a.Domain, &a.Databases, &a.Caches, &a.Kafkas, &a.Monitorings, &a.CreatedAt, &a.LastDeployedAt); err != nil {
+		if err := rows.Scan(&a.ID, &a.Name, &a.DockerImage, &a.DockerfilePath, &a.EnvVars, &a.Ports, &a.Volumes, &a.Command, &a.GithubRepo, &a.Routes, &a.Databases, &a.Caches, &a.Kafkas, &a.Monitorings, &a.CreatedAt, &a.LastDeployedAt); err != nil {
 			return nil, err
 		}
 		if a.EnvVars, err = s.decryptEnvVars(a.EnvVars); err != nil {
@@ -567,17 +1092,17 @@ func (s *Store) ListServicesByUserAndRepo(userID, githubRepo string) ([]*models.
 
 func (s *Store) CreateDeployment(d *models.Deployment, userID string) error {
 	_, err := s.db.Exec(
-		`INSERT INTO deployments (id, service_id, node_id, container_name, container_id, status, user_id, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		d.ID, d.ServiceID, d.NodeID, d.ContainerName, d.ContainerID, d.Status, userID, d.CreatedAt,
+		`INSERT INTO deployments (id, service_id, node_id, container_name, container_id, status, heal_policy, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.ServiceID, d.NodeID, d.ContainerName, d.ContainerID, d.Status, healPolicyOrDefault(d.HealPolicy), userID, d.CreatedAt,
 	)
 	return err
 }
 
 func (s *Store) ListDeployments(userID string) ([]*models.Deployment, error) {
 	rows, err := s.db.Query(`
-		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.created_at, d.last_deployed_at,
-		       a.name, n.name, a.docker_image
+		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.heal_policy, d.health, d.created_at, d.last_deployed_at,
+		       a.name, n.name, a.docker_image, d.previous_image, d.pinned_image
 		FROM deployments d
 		JOIN services a ON d.service_id = a.id
 		JOIN nodes n ON d.node_id = n.id
@@ -591,7 +1116,7 @@ func (s *Store) ListDeployments(userID string) ([]*models.Deployment, error) {
 	var deployments []*models.Deployment
 	for rows.Next() {
 		d := &models.Deployment{}
-		if err := rows.Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage); err != nil {
+		if err := rows.Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.HealPolicy, &d.Health, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage, &d.PreviousImage, &d.PinnedImage); err != nil {
 			return nil, err
 		}
 		deployments = append(deployments, d)
@@ -602,13 +1127,13 @@ func (s *Store) ListDeployments(userID string) ([]*models.Deployment, error) {
 func (s *Store) GetDeployment(id, userID string) (*models.Deployment, error) {
 	d := &models.Deployment{}
 	err := s.db.QueryRow(`
-		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.created_at, d.last_deployed_at,
-		       a.name, n.name, a.docker_image
+		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.heal_policy, d.health, d.created_at, d.last_deployed_at,
+		       a.name, n.name, a.docker_image, d.previous_image, d.pinned_image
 		FROM deployments d
 		JOIN services a ON d.service_id = a.id
 		JOIN nodes n ON d.node_id = n.id
 		WHERE d.id = ? AND d.user_id = ?
-	`, id, userID).Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage)
+	`, id, userID).Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.HealPolicy, &d.Health, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage, &d.PreviousImage, &d.PinnedImage)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -617,8 +1142,8 @@ func (s *Store) GetDeployment(id, userID string) (*models.Deployment, error) {
 
 func (s *Store) GetDeploymentsByServiceID(serviceID, userID string) ([]*models.Deployment, error) {
 	rows, err := s.db.Query(`
-		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.created_at, d.last_deployed_at,
-		       a.name, n.name, a.docker_image
+		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.heal_policy, d.health, d.created_at, d.last_deployed_at,
+		       a.name, n.name, a.docker_image, d.previous_image, d.pinned_image
 		FROM deployments d
 		JOIN services a ON d.service_id = a.id
 		JOIN nodes n ON d.node_id = n.id
@@ -632,7 +1157,7 @@ func (s *Store) GetDeploymentsByServiceID(serviceID, userID string) ([]*models.D
 	var deployments []*models.Deployment
 	for rows.Next() {
 		d := &models.Deployment{}
-		if err := rows.Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage); err != nil {
+		if err := rows.Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.HealPolicy, &d.Health, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage, &d.PreviousImage, &d.PinnedImage); err != nil {
 			return nil, err
 		}
 		deployments = append(deployments, d)
@@ -644,8 +1169,8 @@ func (s *Store) GetDeploymentsByServiceID(serviceID, userID string) ([]*models.D
 // Used by the background poller to check for new images.
 func (s *Store) ListAllRunningDeployments() ([]*models.Deployment, error) {
 	rows, err := s.db.Query(`
-		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.created_at, d.last_deployed_at,
-		       a.name, n.name, a.docker_image, d.user_id
+		SELECT d.id, d.service_id, d.node_id, d.container_name, d.container_id, d.status, d.heal_policy, d.health, d.created_at, d.last_deployed_at,
+		       a.name, n.name, a.docker_image, d.previous_image, d.pinned_image, d.user_id
 		FROM deployments d
 		JOIN services a ON d.service_id = a.id
 		JOIN nodes n ON d.node_id = n.id
@@ -658,7 +1183,31 @@ func (s *Store) ListAllRunningDeployments() ([]*models.Deployment, error) {
 	var deployments []*models.Deployment
 	for rows.Next() {
 		d := &models.Deployment{}
-		if err := rows.Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage, &d.UserID); err != nil {
+		if err := rows.Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.HealPolicy, &d.Health, &d.CreatedAt, &d.LastDeployedAt, &d.AppName, &d.NodeName, &d.DockerImage, &d.PreviousImage, &d.PinnedImage, &d.UserID); err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, rows.Err()
+}
+
+// ListDeploymentsForHealthCheck returns every deployment with status "running"
+// or "restarting" across all users. Used by the background poller to reconcile
+// container state and apply heal policies.
+func (s *Store) ListDeploymentsForHealthCheck() ([]*models.Deployment, error) {
+	rows, err := s.db.Query(`
+		SELECT id, service_id, node_id, container_name, container_id, status, heal_policy, health, pinned_image, user_id
+		FROM deployments
+		WHERE status IN ('running', 'restarting') AND user_id IS NOT NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deployments []*models.Deployment
+	for rows.Next() {
+		d := &models.Deployment{}
+		if err := rows.Scan(&d.ID, &d.ServiceID, &d.NodeID, &d.ContainerName, &d.ContainerID, &d.Status, &d.HealPolicy, &d.Health, &d.PinnedImage, &d.UserID); err != nil {
 			return nil, err
 		}
 		deployments = append(deployments, d)
@@ -671,6 +1220,26 @@ func (s *Store) UpdateDeploymentStatus(id, userID, status, containerID string) e
 	return err
 }
 
+// UpdateDeploymentNode records that a deployment now runs on another node.
+func (s *Store) UpdateDeploymentNode(id, userID, nodeID, containerID string) error {
+	_, err := s.db.Exec(`UPDATE deployments SET node_id = ?, container_id = ?, status = 'running' WHERE id = ? AND user_id = ?`, nodeID, containerID, id, userID)
+	return err
+}
+
+// SetDeploymentPreviousImage records the image a deployment ran before it
+// was last recreated, for rolling back to.
+func (s *Store) SetDeploymentPreviousImage(id, userID, image string) error {
+	_, err := s.db.Exec(`UPDATE deployments SET previous_image = ? WHERE id = ? AND user_id = ?`, image, id, userID)
+	return err
+}
+
+// SetDeploymentPinnedImage pins the image a deployment is recreated from, or
+// with "" goes back to the service's image.
+func (s *Store) SetDeploymentPinnedImage(id, userID, image string) error {
+	_, err := s.db.Exec(`UPDATE deployments SET pinned_image = ? WHERE id = ? AND user_id = ?`, image, id, userID)
+	return err
+}
+
 func (s *Store) UpdateDeploymentLastDeployedAt(id, userID string, t time.Time) error {
 	_, err := s.db.Exec(`UPDATE deployments SET last_deployed_at = ? WHERE id = ? AND user_id = ?`, t, id, userID)
 	return err
@@ -724,9 +1293,9 @@ func (s *Store) CreateDatabase(d *models.Database, userID string) error {
 		return fmt.Errorf("encrypt password: %w", err)
 	}
 	_, err = s.db.Exec(
-		`INSERT INTO databases (id, name, type, version, node_id, dbname, db_user, password, port, container_name, status, user_id, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		d.ID, d.Name, d.Type, d.Version, d.NodeID, d.DBName, d.DBUser, password, d.Port, d.ContainerName, d.Status, userID, d.CreatedAt,
+		`INSERT INTO databases (id, name, type, version, node_id, dbname, db_user, password, port, container_name, status, heal_policy, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.Name, d.Type, d.Version, d.NodeID, d.DBName, d.DBUser, password, d.Port, d.ContainerName, d.Status, healPolicyOrDefault(d.HealPolicy), userID, d.CreatedAt,
 	)
 	return err
 }
@@ -734,7 +1303,7 @@ func (s *Store) CreateDatabase(d *models.Database, userID string) error {
 func (s *Store) ListDatabases(userID string) ([]*models.Database, error) {
 	rows, err := s.db.Query(`
 		SELECT d.id, d.name, d.type, d.version, d.node_id, d.dbname, d.db_user, d.password,
-		       d.port, d.container_name, d.status, d.created_at, d.last_deployed_at, n.host, n.name
+		       d.port, d.container_name, d.status, d.heal_policy, d.health, d.created_at, d.last_deployed_at, n.host, n.name
 		FROM databases d
 		JOIN nodes n ON d.node_id = n.id
 		WHERE d.user_id = ?
@@ -747,7 +1316,7 @@ func (s *Store) ListDatabases(userID string) ([]*models.Database, error) {
 	for rows.Next() {
 		d := &models.Database{}
 		if err := rows.Scan(&d.ID, &d.Name, &d.Type, &d.Version, &d.NodeID, &d.DBName, &d.DBUser, &d.Password,
-			&d.Port, &d.ContainerName, &d.Status, &d.CreatedAt, &d.LastDeployedAt, &d.NodeHost, &d.NodeName); err != nil {
+			&d.Port, &d.ContainerName, &d.Status, &d.HealPolicy, &d.Health, &d.CreatedAt, &d.LastDeployedAt, &d.NodeHost, &d.NodeName); err != nil {
 			return nil, err
 		}
 		if d.Password, err = s.decryptEnvVars(d.Password); err != nil {
@@ -762,12 +1331,12 @@ func (s *Store) GetDatabase(id, userID string) (*models.Database, error) {
 	d := &models.Database{}
 	err := s.db.QueryRow(`
 		SELECT d.id, d.name, d.type, d.version, d.node_id, d.dbname, d.db_user, d.password,
-		       d.port, d.container_name, d.status, d.created_at, d.last_deployed_at, n.host, n.name
+		       d.port, d.container_name, d.status, d.heal_policy, d.health, d.created_at, d.last_deployed_at, n.host, n.name
 		FROM databases d
 		JOIN nodes n ON d.node_id = n.id
 		WHERE d.id = ? AND d.user_id = ?`, id, userID,
 	).Scan(&d.ID, &d.Name, &d.Type, &d.Version, &d.NodeID, &d.DBName, &d.DBUser, &d.Password,
-		&d.Port, &d.ContainerName, &d.Status, &d.CreatedAt, &d.LastDeployedAt, &d.NodeHost, &d.NodeName)
+		&d.Port, &d.ContainerName, &d.Status, &d.HealPolicy, &d.Health, &d.CreatedAt, &d.LastDeployedAt, &d.NodeHost, &d.NodeName)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -780,13 +1349,13 @@ func (s *Store) GetDatabase(id, userID string) (*models.Database, error) {
 	return d, nil
 }
 
-// ListAllRunningDatabases returns every database with status="running" across all users.
+// ListAllRunningDatabases returns every database with status "running" or "restarting" across all users.
 // Used by the background poller to health-check containers.
 func (s *Store) ListAllRunningDatabases() ([]*models.Database, error) {
 	rows, err := s.db.Query(`
-		SELECT id, container_name, node_id, user_id
+		SELECT id, container_name, node_id, status, heal_policy, health, user_id
 		FROM databases
-		WHERE status = 'running' AND user_id IS NOT NULL
+		WHERE status IN ('running', 'restarting') AND user_id IS NOT NULL
 	`)
 	if err != nil {
 		return nil, err
@@ -795,7 +1364,7 @@ func (s *Store) ListAllRunningDatabases() ([]*models.Database, error) {
 	var dbs []*models.Database
 	for rows.Next() {
 		d := &models.Database{}
-		if err := rows.Scan(&d.ID, &d.ContainerName, &d.NodeID, &d.UserID); err != nil {
+		if err := rows.Scan(&d.ID, &d.ContainerName, &d.NodeID, &d.Status, &d.HealPolicy, &d.Health, &d.UserID); err != nil {
 			return nil, err
 		}
 		dbs = append(dbs, d)
@@ -826,9 +1395,9 @@ func (s *Store) CreateCache(c *models.Cache, userID string) error {
 		return fmt.Errorf("encrypt password: %w", err)
 	}
 	_, err = s.db.Exec(
-		`INSERT INTO caches (id, name, version, node_id, password, port, volumes, container_name, status, user_id, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		c.ID, c.Name, c.Version, c.NodeID, password, c.Port, c.Volumes, c.ContainerName, c.Status, userID, c.CreatedAt,
+		`INSERT INTO caches (id, name, version, node_id, password, port, volumes, container_name, status, heal_policy, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, c.Name, c.Version, c.NodeID, password, c.Port, c.Volumes, c.ContainerName, c.Status, healPolicyOrDefault(c.HealPolicy), userID, c.CreatedAt,
 	)
 	return err
 }
@@ -836,7 +1405,7 @@ func (s *Store) CreateCache(c *models.Cache, userID string) error {
 func (s *Store) ListCaches(userID string) ([]*models.Cache, error) {
 	rows, err := s.db.Query(`
 		SELECT c.id, c.name, c.version, c.node_id, c.password,
-		       c.port, c.volumes, c.container_name, c.status, c.created_at, c.last_deployed_at, n.host, n.name
+		       c.port, c.volumes, c.container_name, c.status, c.heal_policy, c.health, c.created_at, c.last_deployed_at, n.host, n.name
 		FROM caches c
 		JOIN nodes n ON c.node_id = n.id
 		WHERE c.user_id = ?
@@ -849,7 +1418,7 @@ func (s *Store) ListCaches(userID string) ([]*models.Cache, error) {
 	for rows.Next() {
 		c := &models.Cache{}
 		if err := rows.Scan(&c.ID, &c.Name, &c.Version, &c.NodeID, &c.Password,
-			&c.Port, &c.Volumes, &c.ContainerName, &c.Status, &c.CreatedAt, &c.LastDeployedAt, &c.NodeHost, &c.NodeName); err != nil {
+			&c.Port, &c.Volumes, &c.ContainerName, &c.Status, &c.HealPolicy, &c.Health, &c.CreatedAt, &c.LastDeployedAt, &c.NodeHost, &c.NodeName); err != nil {
 			return nil, err
 		}
 		if c.Password, err = s.decryptEnvVars(c.Password); err != nil {
@@ -864,12 +1433,12 @@ func (s *Store) GetCache(id, userID string) (*models.Cache, error) {
 	c := &models.Cache{}
 	err := s.db.QueryRow(`
 		SELECT c.id, c.name, c.version, c.node_id, c.password,
-		       c.port, c.volumes, c.container_name, c.status, c.created_at, c.last_deployed_at, n.host, n.name
+		       c.port, c.volumes, c.container_name, c.status, c.heal_policy, c.health, c.created_at, c.last_deployed_at, n.host, n.name
 		FROM caches c
 		JOIN nodes n ON c.node_id = n.id
 		WHERE c.id = ? AND c.user_id = ?`, id, userID,
 	).Scan(&c.ID, &c.Name, &c.Version, &c.NodeID, &c.Password,
-		&c.Port, &c.Volumes, &c.ContainerName, &c.Status, &c.CreatedAt, &c.LastDeployedAt, &c.NodeHost, &c.NodeName)
+		&c.Port, &c.Volumes, &c.ContainerName, &c.Status, &c.HealPolicy, &c.Health, &c.CreatedAt, &c.LastDeployedAt, &c.NodeHost, &c.NodeName)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -919,13 +1488,13 @@ func (s *Store) IsPortUsedOnNode(nodeID string, port int) (bool, error) {
 	return count > 0, err
 }
 
-// ListAllRunningCaches returns every cache with status="running" across all users.
+// ListAllRunningCaches returns every cache with status "running" or "restarting" across all users.
 // Used by the background poller to health-check containers.
 func (s *Store) ListAllRunningCaches() ([]*models.Cache, error) {
 	rows, err := s.db.Query(`
-		SELECT id, container_name, node_id, user_id
+		SELECT id, container_name, node_id, status, heal_policy, health, user_id
 		FROM caches
-		WHERE status = 'running' AND user_id IS NOT NULL
+		WHERE status IN ('running', 'restarting') AND user_id IS NOT NULL
 	`)
 	if err != nil {
 		return nil, err
@@ -934,7 +1503,7 @@ func (s *Store) ListAllRunningCaches() ([]*models.Cache, error) {
 	var caches []*models.Cache
 	for rows.Next() {
 		c := &models.Cache{}
-		if err := rows.Scan(&c.ID, &c.ContainerName, &c.NodeID, &c.UserID); err != nil {
+		if err := rows.Scan(&c.ID, &c.ContainerName, &c.NodeID, &c.Status, &c.HealPolicy, &c.Health, &c.UserID); err != nil {
 			return nil, err
 		}
 		caches = append(caches, c)
@@ -946,9 +1515,9 @@ func (s *Store) ListAllRunningCaches() ([]*models.Cache, error) {
 
 func (s *Store) CreateKafka(k *models.Kafka, userID string) error {
 	_, err := s.db.Exec(
-		`INSERT INTO kafkas (id, name, version, node_id, port, container_name, status, user_id, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		k.ID, k.Name, k.Version, k.NodeID, k.Port, k.ContainerName, k.Status, userID, k.CreatedAt,
+		`INSERT INTO kafkas (id, name, version, node_id, port, container_name, status, heal_policy, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.ID, k.Name, k.Version, k.NodeID, k.Port, k.ContainerName, k.Status, healPolicyOrDefault(k.HealPolicy), userID, k.CreatedAt,
 	)
 	return err
 }
@@ -956,7 +1525,7 @@ func (s *Store) CreateKafka(k *models.Kafka, userID string) error {
 func (s *Store) ListKafkas(userID string) ([]*models.Kafka, error) {
 	rows, err := s.db.Query(`
 		SELECT k.id, k.name, k.version, k.node_id,
-		       k.port, k.container_name, k.status, k.created_at, k.last_deployed_at, n.host, n.name
+		       k.port, k.container_name, k.status, k.heal_policy, k.health, k.created_at, k.last_deployed_at, n.host, n.name
 		FROM kafkas k
 		JOIN nodes n ON k.node_id = n.id
 		WHERE k.user_id = ?
@@ -969,7 +1538,7 @@ func (s *Store) ListKafkas(userID string) ([]*models.Kafka, error) {
 	for rows.Next() {
 		k := &models.Kafka{}
 		if err := rows.Scan(&k.ID, &k.Name, &k.Version, &k.NodeID,
-			&k.Port, &k.ContainerName, &k.Status, &k.CreatedAt, &k.LastDeployedAt, &k.NodeHost, &k.NodeName); err != nil {
+			&k.Port, &k.ContainerName, &k.Status, &k.HealPolicy, &k.Health, &k.CreatedAt, &k.LastDeployedAt, &k.NodeHost, &k.NodeName); err != nil {
 			return nil, err
 		}
 		kafkas = append(kafkas, k)
@@ -981,12 +1550,12 @@ func (s *Store) GetKafka(id, userID string) (*models.Kafka, error) {
 	k := &models.Kafka{}
 	err := s.db.QueryRow(`
 		SELECT k.id, k.name, k.version, k.node_id,
-		       k.port, k.container_name, k.status, k.created_at, k.last_deployed_at, n.host, n.name
+		       k.port, k.container_name, k.status, k.heal_policy, k.health, k.created_at, k.last_deployed_at, n.host, n.name
 		FROM kafkas k
 		JOIN nodes n ON k.node_id = n.id
 		WHERE k.id = ? AND k.user_id = ?`, id, userID,
 	).Scan(&k.ID, &k.Name, &k.Version, &k.NodeID,
-		&k.Port, &k.ContainerName, &k.Status, &k.CreatedAt, &k.LastDeployedAt, &k.NodeHost, &k.NodeName)
+		&k.Port, &k.ContainerName, &k.Status, &k.HealPolicy, &k.Health, &k.CreatedAt, &k.LastDeployedAt, &k.NodeHost, &k.NodeName)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -1008,13 +1577,13 @@ func (s *Store) DeleteKafka(id, userID string) error {
 	return err
 }
 
-// ListAllRunningKafkas returns every Kafka cluster with status="running" across all users.
+// ListAllRunningKafkas returns every Kafka cluster with status "running" or "restarting" across all users.
 // Used by the background poller to health-check containers.
 func (s *Store) ListAllRunningKafkas() ([]*models.Kafka, error) {
 	rows, err := s.db.Query(`
-		SELECT id, container_name, node_id, user_id
+		SELECT id, container_name, node_id, status, heal_policy, health, user_id
 		FROM kafkas
-		WHERE status = 'running' AND user_id IS NOT NULL
+		WHERE status IN ('running', 'restarting') AND user_id IS NOT NULL
 	`)
 	if err != nil {
 		return nil, err
@@ -1023,7 +1592,7 @@ func (s *Store) ListAllRunningKafkas() ([]*models.Kafka, error) {
 	var kafkas []*models.Kafka
 	for rows.Next() {
 		k := &models.Kafka{}
-		if err := rows.Scan(&k.ID, &k.ContainerName, &k.NodeID, &k.UserID); err != nil {
+		if err := rows.Scan(&k.ID, &k.ContainerName, &k.NodeID, &k.Status, &k.HealPolicy, &k.Health, &k.UserID); err != nil {
 			return nil, err
 		}
 		kafkas = append(kafkas, k)
@@ -1039,9 +1608,9 @@ func (s *Store) CreateMonitoring(m *models.Monitoring, userID string) error {
 		return fmt.Errorf("encrypt grafana_password: %w", err)
 	}
 	_, err = s.db.Exec(
-		`INSERT INTO monitorings (id, name, node_id, prometheus_port, grafana_port, grafana_password, prometheus_container_name, grafana_container_name, status, user_id, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		m.ID, m.Name, m.NodeID, m.PrometheusPort, m.GrafanaPort, password, m.PrometheusContainerName, m.GrafanaContainerName, m.Status, userID, m.CreatedAt,
+		`INSERT INTO monitorings (id, name, node_id, prometheus_port, grafana_port, grafana_password, prometheus_container_name, grafana_container_name, status, heal_policy, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.ID, m.Name, m.NodeID, m.PrometheusPort, m.GrafanaPort, password, m.PrometheusContainerName, m.GrafanaContainerName, m.Status, healPolicyOrDefault(m.HealPolicy), userID, m.CreatedAt,
 	)
 	return err
 }
@@ -1049,7 +1618,7 @@ func (s *Store) CreateMonitoring(m *models.Monitoring, userID string) error {
 func (s *Store) ListMonitorings(userID string) ([]*models.Monitoring, error) {
 	rows, err := s.db.Query(`
 		SELECT m.id, m.name, m.node_id, m.prometheus_port, m.grafana_port,
-		       m.prometheus_container_name, m.grafana_container_name, m.status, m.created_at, m.last_deployed_at, n.host, n.name
+		       m.prometheus_container_name, m.grafana_container_name, m.status, m.heal_policy, m.health, m.created_at, m.last_deployed_at, n.host, n.name
 		FROM monitorings m
 		JOIN nodes n ON m.node_id = n.id
 		WHERE m.user_id = ?
@@ -1062,7 +1631,7 @@ func (s *Store) ListMonitorings(userID string) ([]*models.Monitoring, error) {
 	for rows.Next() {
 		m := &models.Monitoring{}
 		if err := rows.Scan(&m.ID, &m.Name, &m.NodeID, &m.PrometheusPort, &m.GrafanaPort,
-			&m.PrometheusContainerName, &m.GrafanaContainerName, &m.Status, &m.CreatedAt, &m.LastDeployedAt, &m.NodeHost, &m.NodeName); err != nil {
+			&m.PrometheusContainerName, &m.GrafanaContainerName, &m.Status, &m.HealPolicy, &m.Health, &m.CreatedAt, &m.LastDeployedAt, &m.NodeHost, &m.NodeName); err != nil {
 			return nil, err
 		}
 		monitorings = append(monitorings, m)
@@ -1074,12 +1643,12 @@ func (s *Store) GetMonitoring(id, userID string) (*models.Monitoring, error) {
 	m := &models.Monitoring{}
 	err := s.db.QueryRow(`
 		SELECT m.id, m.name, m.node_id, m.prometheus_port, m.grafana_port, m.grafana_password,
-		       m.prometheus_container_name, m.grafana_container_name, m.status, m.created_at, m.last_deployed_at, n.host, n.name
+		       m.prometheus_container_name, m.grafana_container_name, m.status, m.heal_policy, m.health, m.created_at, m.last_deployed_at, n.host, n.name
 		FROM monitorings m
 		JOIN nodes n ON m.node_id = n.id
 		WHERE m.id = ? AND m.user_id = ?`, id, userID,
 	).Scan(&m.ID, &m.Name, &m.NodeID, &m.PrometheusPort, &m.GrafanaPort, &m.GrafanaPassword,
-		&m.PrometheusContainerName, &m.GrafanaContainerName, &m.Status, &m.CreatedAt, &m.LastDeployedAt, &m.NodeHost, &m.NodeName)
+		&m.PrometheusContainerName, &m.GrafanaContainerName, &m.Status, &m.HealPolicy, &m.Health, &m.CreatedAt, &m.LastDeployedAt, &m.NodeHost, &m.NodeName)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -1108,13 +1677,13 @@ func (s *Store) DeleteMonitoring(id, userID string) error {
 	return err
 }
 
-// ListAllRunningMonitorings returns every monitoring stack with status="running" across all users.
+// ListAllRunningMonitorings returns every monitoring stack with status "running" or "restarting" across all users.
 // Used by the background poller to health-check containers.
 func (s *Store) ListAllRunningMonitorings() ([]*models.Monitoring, error) {
 	rows, err := s.db.Query(`
-		SELECT id, prometheus_container_name, node_id, user_id
+		SELECT id, prometheus_container_name, grafana_container_name, node_id, status, heal_policy, health, user_id
 		FROM monitorings
-		WHERE status = 'running' AND user_id IS NOT NULL
+		WHERE status IN ('running', 'restarting') AND user_id IS NOT NULL
 	`)
 	if err != nil {
 		return nil, err
@@ -1123,7 +1692,7 @@ func (s *Store) ListAllRunningMonitorings() ([]*models.Monitoring, error) {
 	var monitorings []*models.Monitoring
 	for rows.Next() {
 		m := &models.Monitoring{}
-		if err := rows.Scan(&m.ID, &m.PrometheusContainerName, &m.NodeID, &m.UserID); err != nil {
+		if err := rows.Scan(&m.ID, &m.PrometheusContainerName, &m.GrafanaContainerName, &m.NodeID, &m.Status, &m.HealPolicy, &m.Health, &m.UserID); err != nil {
 			return nil, err
 		}
 		monitorings = append(monitorings, m)
@@ -1131,13 +1700,212 @@ func (s *Store) ListAllRunningMonitorings() ([]*models.Monitoring, error) {
 	return monitorings, rows.Err()
 }
 
-// Settings (global, kept for legacy; prefer user settings)
+// Canaries
 
-func (s *Store) GetSetting(key string) (string, error) {
-	var value string
-	err := s.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
-	if err == sql.ErrNoRows {
-		return "", nil
+const canaryColumns = `c.id, c.deployment_id, c.service_id, c.node_id, c.docker_image, c.container_name,
+		       c.container_id, c.weight, c.status, c.created_at, c.updated_at, a.name, a.docker_image`
+
+func scanCanary(sc interface{ Scan(...any) error }) (*models.Canary, error) {
+	c := &models.Canary{}
+	err := sc.Scan(&c.ID, &c.DeploymentID, &c.ServiceID, &c.NodeID, &c.DockerImage, &c.ContainerName,
+		&c.ContainerID, &c.Weight, &c.Status, &c.CreatedAt, &c.UpdatedAt, &c.AppName, &c.StableImage)
+	return c, err
+}
+
+func (s *Store) CreateCanary(c *models.Canary, userID string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO canaries (id, deployment_id, service_id, node_id, docker_image, container_name, container_id, weight, status, user_id, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, c.DeploymentID, c.ServiceID, c.NodeID, c.DockerImage, c.ContainerName, c.ContainerID, c.Weight, c.Status, userID, c.CreatedAt, c.UpdatedAt,
+	)
+	return err
+}
+
+func (s *Store) GetCanary(id, userID string) (*models.Canary, error) {
+	c, err := scanCanary(s.db.QueryRow(`
+		SELECT `+canaryColumns+`
+		FROM canaries c
+		JOIN services a ON c.service_id = a.id
+		WHERE c.id = ? AND c.user_id = ?`, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Store) ListCanaries(userID string) ([]*models.Canary, error) {
+	rows, err := s.db.Query(`
+		SELECT `+canaryColumns+`
+		FROM canaries c
+		JOIN services a ON c.service_id = a.id
+		WHERE c.user_id = ?
+		ORDER BY c.created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var canaries []*models.Canary
+	for rows.Next() {
+		c, err := scanCanary(rows)
+		if err != nil {
+			return nil, err
+		}
+		canaries = append(canaries, c)
+	}
+	return canaries, rows.Err()
+}
+
+// GetActiveCanaryForDeployment returns the pending or running canary of a
+// deployment, or nil when there is none.
+func (s *Store) GetActiveCanaryForDeployment(deploymentID, userID string) (*models.Canary, error) {
+	c, err := scanCanary(s.db.QueryRow(`
+		SELECT `+canaryColumns+`
+		FROM canaries c
+		JOIN services a ON c.service_id = a.id
+		WHERE c.deployment_id = ? AND c.user_id = ? AND c.status IN ('pending', 'running')
+		ORDER BY c.created_at DESC LIMIT 1`, deploymentID, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Store) UpdateCanaryStatus(id, userID, status, containerID string) error {
+	_, err := s.db.Exec(`UPDATE canaries SET status = ?, container_id = ?, updated_at = ? WHERE id = ? AND user_id = ?`,
+		status, containerID, time.Now().UTC(), id, userID)
+	return err
+}
+
+func (s *Store) UpdateCanaryWeight(id, userID string, weight int) error {
+	_, err := s.db.Exec(`UPDATE canaries SET weight = ?, updated_at = ? WHERE id = ? AND user_id = ?`,
+		weight, time.Now().UTC(), id, userID)
+	return err
+}
+
+// Heal policies and state
+
+// healPolicyTables maps a heal resource type to the table holding its policy.
+var healPolicyTables = map[string]string{
+	models.HealResourceDeployment: "deployments",
+	models.HealResourceDatabase:   "databases",
+	models.HealResourceCache:      "caches",
+	models.HealResourceKafka:      "kafkas",
+	models.HealResourceMonitoring: "monitorings",
+}
+
+func healPolicyOrDefault(policy string) string {
+	if policy == "" {
+		return models.HealPolicyObserve
+	}
+	return policy
+}
+
+// UpdateHealPolicy sets the heal policy of a resource. It returns false when
+// the resource does not exist or belongs to another user.
+func (s *Store) UpdateHealPolicy(resourceType, id, userID, policy string) (bool, error) {
+	table, ok := healPolicyTables[resourceType]
+	if !ok {
+		return false, fmt.Errorf("unknown heal resource type %q", resourceType)
+	}
+	res, err := s.db.Exec(`UPDATE `+table+` SET heal_policy = ? WHERE id = ? AND user_id = ?`, policy, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetHealPolicy returns the heal policy of a resource, or "" when the resource
+// does not exist or belongs to another user.
+func (s *Store) GetHealPolicy(resourceType, id, userID string) (string, error) {
+	table, ok := healPolicyTables[resourceType]
+	if !ok {
+		return "", fmt.Errorf("unknown heal resource type %q", resourceType)
+	}
+	var policy string
+	err := s.db.QueryRow(`SELECT heal_policy FROM `+table+` WHERE id = ? AND user_id = ?`, id, userID).Scan(&policy)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return policy, err
+}
+
+// GetResourceStatus returns the status of a deployment or managed resource,
+// or "" when it does not exist.
+func (s *Store) GetResourceStatus(resourceType, id string) (string, error) {
+	table, ok := healPolicyTables[resourceType]
+	if !ok {
+		return "", fmt.Errorf("unknown heal resource type %q", resourceType)
+	}
+	var status string
+	err := s.db.QueryRow(`SELECT status FROM `+table+` WHERE id = ?`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// UpdateResourceHealth records the health of a deployment's or managed
+// resource's container: healthy, unhealthy, or "" when it reports none.
+func (s *Store) UpdateResourceHealth(resourceType, id, health string) error {
+	table, ok := healPolicyTables[resourceType]
+	if !ok {
+		return fmt.Errorf("unknown heal resource type %q", resourceType)
+	}
+	_, err := s.db.Exec(`UPDATE `+table+` SET health = ? WHERE id = ?`, health, id)
+	return err
+}
+
+// GetHealState returns the heal bookkeeping for a resource, or nil when it has
+// never needed healing (or recovered since).
+func (s *Store) GetHealState(resourceType, id string) (*models.HealState, error) {
+	h := &models.HealState{}
+	err := s.db.QueryRow(`
+		SELECT resource_type, resource_id, attempts, last_attempt_at, next_attempt_at, last_error
+		FROM heal_states WHERE resource_type = ? AND resource_id = ?
+	`, resourceType, id).Scan(&h.ResourceType, &h.ResourceID, &h.Attempts, &h.LastAttemptAt, &h.NextAttemptAt, &h.LastError)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// SaveHealState inserts or replaces the heal bookkeeping for a resource.
+func (s *Store) SaveHealState(h *models.HealState) error {
+	_, err := s.db.Exec(`
+		INSERT INTO heal_states (resource_type, resource_id, attempts, last_attempt_at, next_attempt_at, last_error)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(resource_type, resource_id) DO UPDATE SET
+			attempts = excluded.attempts,
+			last_attempt_at = excluded.last_attempt_at,
+			next_attempt_at = excluded.next_attempt_at,
+			last_error = excluded.last_error
+	`, h.ResourceType, h.ResourceID, h.Attempts, h.LastAttemptAt, h.NextAttemptAt, h.LastError)
+	return err
+}
+
+// ClearHealState forgets previous heal attempts for a resource.
+func (s *Store) ClearHealState(resourceType, id string) error {
+	_, err := s.db.Exec(`DELETE FROM heal_states WHERE resource_type = ? AND resource_id = ?`, resourceType, id)
+	return err
+}
+
+// Settings (global, kept for legacy; prefer user settings)
+
+func (s *Store) GetSetting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
 	return value, err
 }
@@ -1360,3 +2128,741 @@ func (s *Store) EnsureLocalNode() error {
 	}
 	return s.CreateNode(node, "")
 }
+
+// Certificates
+
+const certificateColumns = `c.id, c.domains, c.source, c.node_id, c.issuer, c.not_before, c.not_after,
+		       c.cert_pem, c.user_id, c.created_at, c.updated_at, COALESCE(n.name, '')`
+
+func scanCertificate(sc interface{ Scan(...any) error }) (*models.Certificate, error) {
+	c := &models.Certificate{}
+	var userID sql.NullString
+	err := sc.Scan(&c.ID, &c.Domains, &c.Source, &c.NodeID, &c.Issuer, &c.NotBefore, &c.NotAfter,
+		&c.CertPEM, &userID, &c.CreatedAt, &c.UpdatedAt, &c.NodeName)
+	c.UserID = userID.String
+	return c, err
+}
+
+func (s *Store) CreateCertificate(c *models.Certificate, userID string) error {
+	keyPEM, err := s.encryptSecret(c.KeyPEM)
+	if err != nil {
+		return fmt.Errorf("encrypt key: %w", err)
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO certificates (id, domains, source, node_id, issuer, not_before, not_after, cert_pem, key_pem, user_id, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, c.Domains, c.Source, c.NodeID, c.Issuer, c.NotBefore, c.NotAfter, c.CertPEM, keyPEM, userID, c.CreatedAt, c.UpdatedAt,
+	)
+	return err
+}
+
+// ListCertificates returns a user's certificates, soonest expiry first. Keys
+// are not loaded.
+func (s *Store) ListCertificates(userID string) ([]*models.Certificate, error) {
+	rows, err := s.db.Query(`
+		SELECT `+certificateColumns+`
+		FROM certificates c
+		LEFT JOIN nodes n ON c.node_id = n.id
+		WHERE c.user_id = ?
+		ORDER BY c.not_after ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var certs []*models.Certificate
+	for rows.Next() {
+		c, err := scanCertificate(rows)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	return certs, rows.Err()
+}
+
+// GetCertificate returns a certificate with its decrypted key.
+func (s *Store) GetCertificate(id, userID string) (*models.Certificate, error) {
+	c, err := scanCertificate(s.db.QueryRow(`
+		SELECT `+certificateColumns+`
+		FROM certificates c
+		LEFT JOIN nodes n ON c.node_id = n.id
+		WHERE c.id = ? AND c.user_id = ?`, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadCertificateKey(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListUploadedCertificates returns a user's uploaded certificates with their
+// decrypted keys, for pushing to Traefik nodes.
+func (s *Store) ListUploadedCertificates(userID string) ([]*models.Certificate, error) {
+	rows, err := s.db.Query(`
+		SELECT `+certificateColumns+`
+		FROM certificates c
+		LEFT JOIN nodes n ON c.node_id = n.id
+		WHERE c.user_id = ? AND c.source = ?
+		ORDER BY c.created_at ASC`, userID, models.CertificateSourceUploaded)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*models.Certificate
+	for rows.Next() {
+		c, err := scanCertificate(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, c := range certs {
+		if err := s.loadCertificateKey(c); err != nil {
+			return nil, err
+		}
+	}
+	return certs, nil
+}
+
+func (s *Store) loadCertificateKey(c *models.Certificate) error {
+	var stored string
+	if err := s.db.QueryRow(`SELECT key_pem FROM certificates WHERE id = ?`, c.ID).Scan(&stored); err != nil {
+		return err
+	}
+	key, err := s.decryptSecret(stored)
+	if err != nil {
+		return fmt.Errorf("decrypt key for certificate %s: %w", c.ID, err)
+	}
+	c.KeyPEM = key
+	return nil
+}
+
+func (s *Store) DeleteCertificate(id, userID string) error {
+	_, err := s.db.Exec(`DELETE FROM certificates WHERE id = ? AND user_id = ?`, id, userID)
+	return err
+}
+
+// UpsertACMECertificate records a certificate Traefik obtained from ACME on a
+// node, keyed by node and domains. Renewals update the existing row.
+func (s *Store) UpsertACMECertificate(c *models.Certificate) error {
+	_, err := s.db.Exec(
+		`INSERT INTO certificates (id, domains, source, node_id, issuer, not_before, not_after, cert_pem, user_id, created_at, updated_at)
+		 VALUES (?, ?, 'acme', ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(node_id, domains) WHERE source = 'acme' DO UPDATE SET
+			issuer     = excluded.issuer,
+			not_before = excluded.not_before,
+			not_after  = excluded.not_after,
+			cert_pem   = excluded.cert_pem,
+			updated_at = excluded.updated_at`,
+		c.ID, c.Domains, c.NodeID, c.Issuer, c.NotBefore, c.NotAfter, c.CertPEM, c.UserID, c.CreatedAt, c.UpdatedAt,
+	)
+	return err
+}
+
+// PruneACMECertificates deletes a node's ACME certificates not seen since
+// before, i.e. no longer present in Traefik's ACME storage.
+func (s *Store) PruneACMECertificates(nodeID string, before time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM certificates WHERE source = 'acme' AND node_id = ? AND updated_at < ?`, nodeID, before)
+	return err
+}
+
+// WireGuard mesh
+
+func (s *Store) CreateWireGuardPeer(p *models.WireGuardPeer, userID string) error {
+	privateKey, err := s.encryptSecret(p.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("encrypt private key: %w", err)
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO wireguard_peers (node_id, overlay_ip, public_key, private_key, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		p.NodeID, p.OverlayIP, p.PublicKey, privateKey, userID, p.CreatedAt,
+	)
+	return err
+}
+
+const wireGuardPeerColumns = `w.node_id, w.overlay_ip, w.public_key, w.private_key, w.user_id, w.created_at, n.name, n.host`
+
+func (s *Store) scanWireGuardPeer(sc interface{ Scan(...any) error }) (*models.WireGuardPeer, error) {
+	p := &models.WireGuardPeer{}
+	var userID sql.NullString
+	if err := sc.Scan(&p.NodeID, &p.OverlayIP, &p.PublicKey, &p.PrivateKey, &userID, &p.CreatedAt, &p.NodeName, &p.NodeHost); err != nil {
+		return nil, err
+	}
+	p.UserID = userID.String
+	key, err := s.decryptSecret(p.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt private key for node %s: %w", p.NodeID, err)
+	}
+	p.PrivateKey = key
+	return p, nil
+}
+
+// ListWireGuardPeers returns the user's mesh peers in the order they joined,
+// with decrypted private keys.
+func (s *Store) ListWireGuardPeers(userID string) ([]*models.WireGuardPeer, error) {
+	rows, err := s.db.Query(`
+		SELECT `+wireGuardPeerColumns+`
+		FROM wireguard_peers w
+		JOIN nodes n ON w.node_id = n.id
+		WHERE w.user_id = ?
+		ORDER BY w.created_at ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var peers []*models.WireGuardPeer
+	for rows.Next() {
+		p, err := s.scanWireGuardPeer(rows)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+	return peers, rows.Err()
+}
+
+// GetWireGuardPeer returns a node's mesh membership, or nil if the node has
+// not joined the mesh.
+func (s *Store) GetWireGuardPeer(nodeID, userID string) (*models.WireGuardPeer, error) {
+	p, err := s.scanWireGuardPeer(s.db.QueryRow(`
+		SELECT `+wireGuardPeerColumns+`
+		FROM wireguard_peers w
+		JOIN nodes n ON w.node_id = n.id
+		WHERE w.node_id = ? AND w.user_id = ?`, nodeID, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+func (s *Store) DeleteWireGuardPeer(nodeID, userID string) error {
+	_, err := s.db.Exec(`DELETE FROM wireguard_peers WHERE node_id = ? AND user_id = ?`, nodeID, userID)
+	return err
+}
+
+// Firewall
+
+func (s *Store) CreateFirewallRule(r *models.FirewallRule, userID string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO firewall_rules (id, node_id, protocol, port, source, description, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ID, r.NodeID, r.Protocol, r.Port, r.Source, r.Description, userID, r.CreatedAt,
+	)
+	return err
+}
+
+func (s *Store) ListFirewallRules(userID string) ([]*models.FirewallRule, error) {
+	rows, err := s.db.Query(`
+		SELECT id, node_id, protocol, port, source, description, created_at
+		FROM firewall_rules
+		WHERE user_id = ?
+		ORDER BY created_at ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []*models.FirewallRule
+	for rows.Next() {
+		r := &models.FirewallRule{}
+		if err := rows.Scan(&r.ID, &r.NodeID, &r.Protocol, &r.Port, &r.Source, &r.Description, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *Store) DeleteFirewallRule(id, userID string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM firewall_rules WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// EnableNodeFirewall marks the firewall as managed on a node. It is a no-op if
+// it already is.
+func (s *Store) EnableNodeFirewall(nodeID, userID string, createdAt time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT OR IGNORE INTO node_firewalls (node_id, user_id, created_at) VALUES (?, ?, ?)`,
+		nodeID, userID, createdAt,
+	)
+	return err
+}
+
+func (s *Store) DisableNodeFirewall(nodeID, userID string) error {
+	_, err := s.db.Exec(`DELETE FROM node_firewalls WHERE node_id = ? AND user_id = ?`, nodeID, userID)
+	return err
+}
+
+// ListNodeFirewalls returns the user's nodes whose firewall is managed.
+func (s *Store) ListNodeFirewalls(userID string) ([]*models.NodeFirewall, error) {
+	rows, err := s.db.Query(`
+		SELECT f.node_id, f.applied_at, f.last_error, f.created_at, n.name
+		FROM node_firewalls f
+		JOIN nodes n ON f.node_id = n.id
+		WHERE f.user_id = ?
+		ORDER BY f.created_at ASC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fws []*models.NodeFirewall
+	for rows.Next() {
+		f := &models.NodeFirewall{UserID: userID}
+		if err := rows.Scan(&f.NodeID, &f.AppliedAt, &f.LastError, &f.CreatedAt, &f.NodeName); err != nil {
+			return nil, err
+		}
+		fws = append(fws, f)
+	}
+	return fws, rows.Err()
+}
+
+// ListFirewallUserIDs returns the users that have at least one firewalled node.
+func (s *Store) ListFirewallUserIDs() ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT user_id FROM node_firewalls WHERE user_id IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// RecordFirewallApply stores the outcome of applying a node's ruleset. On
+// failure the previous applied_at is kept.
+func (s *Store) RecordFirewallApply(nodeID string, at time.Time, applyErr string) error {
+	if applyErr != "" {
+		_, err := s.db.Exec(`UPDATE node_firewalls SET last_error = ? WHERE node_id = ?`, applyErr, nodeID)
+		return err
+	}
+	_, err := s.db.Exec(`UPDATE node_firewalls SET applied_at = ?, last_error = '' WHERE node_id = ?`, at, nodeID)
+	return err
+}
+
+// Node bootstraps
+
+// RecordNodeBootstrap stores the outcome of bootstrapping a node. On failure
+// the previous bootstrapped_at, OS and versions are kept.
+func (s *Store) RecordNodeBootstrap(b *models.NodeBootstrap, userID string) error {
+	if b.LastError != "" {
+		_, err := s.db.Exec(
+			`INSERT INTO node_bootstraps (node_id, last_error, user_id, updated_at) VALUES (?, ?, ?, ?)
+			 ON CONFLICT(node_id) DO UPDATE SET last_error = excluded.last_error, updated_at = excluded.updated_at`,
+			b.NodeID, b.LastError, userID, b.UpdatedAt,
+		)
+		return err
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO node_bootstraps (node_id, os, versions, bootstrapped_at, last_error, user_id, updated_at)
+		 VALUES (?, ?, ?, ?, '', ?, ?)
+		 ON CONFLICT(node_id) DO UPDATE SET os = excluded.os, versions = excluded.versions,
+		   bootstrapped_at = excluded.bootstrapped_at, last_error = '', updated_at = excluded.updated_at`,
+		b.NodeID, b.OS, b.Versions, b.BootstrappedAt, userID, b.UpdatedAt,
+	)
+	return err
+}
+
+// GetNodeBootstrap returns the bootstrap record of a node, or nil if it has
+// never been bootstrapped.
+func (s *Store) GetNodeBootstrap(nodeID, userID string) (*models.NodeBootstrap, error) {
+	b := &models.NodeBootstrap{}
+	err := s.db.QueryRow(`
+		SELECT node_id, os, versions, bootstrapped_at, last_error, updated_at
+		FROM node_bootstraps WHERE node_id = ? AND user_id = ?`, nodeID, userID,
+	).Scan(&b.NodeID, &b.OS, &b.Versions, &b.BootstrappedAt, &b.LastError, &b.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Metrics
+
+func (s *Store) InsertMetricSample(m *models.MetricSample) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO metric_samples (kind, target_id, resolution, ts, cpu_percent, mem_used, mem_total, disk_used, disk_total, net_rx, net_tx, load1, load5, load15, user_id)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Kind, m.TargetID, m.Resolution, m.Timestamp.Unix(), m.CPUPercent, m.MemUsed, m.MemTotal, m.DiskUsed, m.DiskTotal, m.NetRx, m.NetTx, m.Load1, m.Load5, m.Load15, m.UserID,
+	)
+	return err
+}
+
+// ListMetricSamples returns the samples of a target since the given time at
+// every resolution, oldest first.
+func (s *Store) ListMetricSamples(kind, targetID, userID string, since time.Time) ([]*models.MetricSample, error) {
+	rows, err := s.db.Query(`
+		SELECT resolution, ts, cpu_percent, mem_used, mem_total, disk_used, disk_total, net_rx, net_tx, load1, load5, load15
+		FROM metric_samples
+		WHERE kind = ? AND target_id = ? AND user_id = ? AND ts >= ?
+		ORDER BY ts ASC, resolution DESC`, kind, targetID, userID, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var samples []*models.MetricSample
+	for rows.Next() {
+		m := &models.MetricSample{Kind: kind, TargetID: targetID, UserID: userID}
+		var ts int64
+		if err := rows.Scan(&m.Resolution, &ts, &m.CPUPercent, &m.MemUsed, &m.MemTotal, &m.DiskUsed, &m.DiskTotal, &m.NetRx, &m.NetTx, &m.Load1, &m.Load5, &m.Load15); err != nil {
+			return nil, err
+		}
+		m.Timestamp = time.Unix(ts, 0).UTC()
+		samples = append(samples, m)
+	}
+	return samples, rows.Err()
+}
+
+// DownsampleMetrics replaces the samples of resolution from older than before
+// with one sample per bucket of resolution to. Gauges are averaged and the
+// cumulative network counters keep their maximum. before should be aligned to
+// to, so a bucket is never split between two runs.
+func (s *Store) DownsampleMetrics(from, to int, before time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`
+		INSERT OR REPLACE INTO metric_samples (kind, target_id, resolution, ts, cpu_percent, mem_used, mem_total, disk_used, disk_total, net_rx, net_tx, load1, load5, load15, user_id)
+		SELECT kind, target_id, ?, ts - ts % ?, AVG(cpu_percent), CAST(AVG(mem_used) AS INTEGER), MAX(mem_total),
+		       CAST(AVG(disk_used) AS INTEGER), MAX(disk_total), MAX(net_rx), MAX(net_tx), AVG(load1), AVG(load5), AVG(load15), user_id
+		FROM metric_samples
+		WHERE resolution = ? AND ts < ?
+		GROUP BY kind, target_id, ts - ts % ?`,
+		to, to, from, before.Unix(), to); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM metric_samples WHERE resolution = ? AND ts < ?`, from, before.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PruneMetrics deletes the samples of a resolution older than before.
+func (s *Store) PruneMetrics(resolution int, before time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM metric_samples WHERE resolution = ? AND ts < ?`, resolution, before.Unix())
+	return err
+}
+
+// DeleteMetricSamples deletes the whole history of a target.
+func (s *Store) DeleteMetricSamples(kind, targetID string) error {
+	_, err := s.db.Exec(`DELETE FROM metric_samples WHERE kind = ? AND target_id = ?`, kind, targetID)
+	return err
+}
+
+// Audit events
+
+func (s *Store) InsertAuditEvent(e *models.AuditEvent) error {
+	_, err := s.db.Exec(
+		`INSERT INTO audit_events (id, actor_type, actor_id, actor_name, action, resource_type, resource_id, before, after, source_ip, result, error, user_id, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, e.ActorType, e.ActorID, e.ActorName, e.Action, e.ResourceType, e.ResourceID, e.Before, e.After, e.SourceIP, e.Result, e.Error, e.UserID, e.CreatedAt,
+	)
+	return err
+}
+
+// ListAuditEvents returns the user's audit events matching f, newest first.
+func (s *Store) ListAuditEvents(userID string, f models.AuditFilter) ([]*models.AuditEvent, error) {
+	query := `SELECT id, actor_type, actor_id, actor_name, action, resource_type, resource_id, before, after, source_ip, result, error, created_at
+		FROM audit_events WHERE user_id = ?`
+	args := []any{userID}
+	for col, v := range map[string]string{
+		"actor_type":    f.ActorType,
+		"resource_type": f.ResourceType,
+		"resource_id":   f.ResourceID,
+		"result":        f.Result,
+	} {
+		if v != "" {
+			query += " AND " + col + " = ?"
+			args = append(args, v)
+		}
+	}
+	if strings.HasSuffix(f.Action, ".") {
+		query += " AND substr(action, 1, ?) = ?"
+		args = append(args, len(f.Action), f.Action)
+	} else if f.Action != "" {
+		query += " AND action = ?"
+		args = append(args, f.Action)
+	}
+	if !f.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, f.Until.UTC())
+	}
+	query += " ORDER BY created_at DESC, rowid DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*models.AuditEvent
+	for rows.Next() {
+		e := &models.AuditEvent{UserID: userID}
+		if err := rows.Scan(&e.ID, &e.ActorType, &e.ActorID, &e.ActorName, &e.Action, &e.ResourceType, &e.ResourceID,
+			&e.Before, &e.After, &e.SourceIP, &e.Result, &e.Error, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// Organizations
+
+// CreateOrganization creates a team organization with ownerID as its owner.
+func (s *Store) CreateOrganization(name, ownerID string) (*models.Organization, error) {
+	o := &models.Organization{ID: uuid.New().String(), Name: name, Role: models.RoleOwner, CreatedAt: time.Now().UTC()}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec(
+		`INSERT INTO organizations (id, name, personal, created_at) VALUES (?, ?, 0, ?)`, o.ID, o.Name, o.CreatedAt,
+	); err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)`, o.ID, ownerID, models.RoleOwner,
+	); err != nil {
+		return nil, fmt.Errorf("add organization owner: %w", err)
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO user_settings (user_id, key, value) VALUES (?, 'webhook_token', ?)`, o.ID, uuid.New().String(),
+	); err != nil {
+		return nil, fmt.Errorf("create organization webhook token: %w", err)
+	}
+	return o, tx.Commit()
+}
+
+// GetOrganization returns an organization, or nil if it does not exist.
+func (s *Store) GetOrganization(id string) (*models.Organization, error) {
+	o := &models.Organization{}
+	err := s.db.QueryRow(
+		`SELECT id, name, personal, created_at FROM organizations WHERE id = ?`, id,
+	).Scan(&o.ID, &o.Name, &o.Personal, &o.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return o, err
+}
+
+// ListUserOrganizations returns the organizations a user is a member of with
+// the user's role in each, the personal organization first.
+func (s *Store) ListUserOrganizations(userID string) ([]*models.Organization, error) {
+	rows, err := s.db.Query(`
+		SELECT o.id, o.name, o.personal, o.created_at, m.role
+		FROM organizations o JOIN org_members m ON m.org_id = o.id
+		WHERE m.user_id = ?
+		ORDER BY o.personal DESC, o.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*models.Organization
+	for rows.Next() {
+		o := &models.Organization{}
+		if err := rows.Scan(&o.ID, &o.Name, &o.Personal, &o.CreatedAt, &o.Role); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+// RenameOrganization changes an organization's name.
+func (s *Store) RenameOrganization(id, name string) error {
+	_, err := s.db.Exec(`UPDATE organizations SET name = ? WHERE id = ?`, name, id)
+	return err
+}
+
+// DeleteOrganization removes an organization with its members and settings.
+// Callers make sure it owns no resources first.
+func (s *Store) DeleteOrganization(id string) error {
+	for _, q := range []string{
+		`DELETE FROM org_members WHERE org_id = ?`,
+		`DELETE FROM user_settings WHERE user_id = ?`,
+		`DELETE FROM organizations WHERE id = ?`,
+	} {
+		if _, err := s.db.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OrganizationHasResources reports whether an organization still owns nodes,
+// services, deployments or managed services.
+func (s *Store) OrganizationHasResources(id string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM nodes WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM services WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM deployments WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM databases WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM caches WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM kafkas WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM monitorings WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM object_storages WHERE user_id = ?)`,
+		id, id, id, id, id, id, id, id).Scan(&n)
+	return n > 0, err
+}
+
+// GetOrgRole returns a user's role in an organization, or "" if the user is
+// not a member.
+func (s *Store) GetOrgRole(orgID, userID string) (string, error) {
+	var role string
+	err := s.db.QueryRow(
+		`SELECT role FROM org_members WHERE org_id = ? AND user_id = ?`, orgID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// ListOrgMembers returns the members of an organization, most privileged
+// first.
+func (s *Store) ListOrgMembers(orgID string) ([]*models.OrgMember, error) {
+	rows, err := s.db.Query(`
+		SELECT m.org_id, m.user_id, u.email, u.name, m.role, m.created_at
+		FROM org_members m JOIN users u ON u.id = m.user_id
+		WHERE m.org_id = ?
+		ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 WHEN 'deployer' THEN 2 ELSE 3 END, u.email`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*models.OrgMember
+	for rows.Next() {
+		m := &models.OrgMember{}
+		if err := rows.Scan(&m.OrgID, &m.UserID, &m.Email, &m.Name, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// SetOrgMember adds a user to an organization, or changes the role of a
+// member.
+func (s *Store) SetOrgMember(orgID, userID, role string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO org_members (org_id, user_id, role) VALUES (?, ?, ?)
+		 ON CONFLICT(org_id, user_id) DO UPDATE SET role = excluded.role`,
+		orgID, userID, role,
+	)
+	return err
+}
+
+// RemoveOrgMember removes a user from an organization.
+func (s *Store) RemoveOrgMember(orgID, userID string) error {
+	_, err := s.db.Exec(`DELETE FROM org_members WHERE org_id = ? AND user_id = ?`, orgID, userID)
+	return err
+}
+
+// CountOrgOwners returns how many owners an organization has.
+func (s *Store) CountOrgOwners(orgID string) (int, error) {
+	var n int
+	err := s.db.QueryRow(
+		`SELECT COUNT(*) FROM org_members WHERE org_id = ? AND role = ?`, orgID, models.RoleOwner,
+	).Scan(&n)
+	return n, err
+}
+
+// API tokens
+
+const apiTokenColumns = `id, name, prefix, scope, expires_at, last_used_at, last_used_ip, user_id, created_at`
+
+func scanAPIToken(sc interface{ Scan(...any) error }) (*models.APIToken, error) {
+	t := &models.APIToken{}
+	err := sc.Scan(&t.ID, &t.Name, &t.Prefix, &t.Scope, &t.ExpiresAt, &t.LastUsedAt, &t.LastUsedIP, &t.UserID, &t.CreatedAt)
+	return t, err
+}
+
+// CreateAPIToken stores a token under the hash of its secret.
+func (s *Store) CreateAPIToken(t *models.APIToken, hash string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO api_tokens (id, user_id, name, prefix, token_hash, scope, expires_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.UserID, t.Name, t.Prefix, hash, t.Scope, t.ExpiresAt, t.CreatedAt,
+	)
+	return err
+}
+
+// ListAPITokens returns a user's tokens, newest first.
+func (s *Store) ListAPITokens(userID string) ([]*models.APIToken, error) {
+	rows, err := s.db.Query(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*models.APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// GetAPITokenByHash returns the token with the given hash, or nil if there
+// is none.
+func (s *Store) GetAPITokenByHash(hash string) (*models.APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+// DeleteAPIToken revokes one of a user's tokens. It reports whether the
+// token existed.
+func (s *Store) DeleteAPIToken(id, userID string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// TouchAPIToken records a use of a token at the given time and IP. Uses
+// within a minute of the last recorded one are not written, so a busy script
+// does not write on every request.
+func (s *Store) TouchAPIToken(id string, at time.Time, ip string) error {
+	_, err := s.db.Exec(
+		`UPDATE api_tokens SET last_used_at = ?, last_used_ip = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ? OR last_used_ip != ?)`,
+		at.UTC(), ip, id, at.UTC().Add(-time.Minute), ip,
+	)
+	return err
+}
@@ -1,6 +1,7 @@
 package store_test
 
 import (
+	"strconv"
 	"testing"
 	"time"
 
@@ -58,7 +59,7 @@ func sampleApp(name string) *models.Service {
 		Ports:       `["8080:80"]`,
 		Command:     "",
 		GithubRepo:  "owner/repo",
-		Domain:      "",
+		Routes:      "[]",
 		CreatedAt:   time.Now().UTC(),
 	}
 }
@@ -240,6 +241,133 @@ func TestUpdateNodeTraefik(t *testing.T) {
 	}
 }
 
+func TestUpdateNodeSchedule(t *testing.T) {
+	s := newTestStore(t)
+	n := sampleNode("schedule-test")
+	_ = s.CreateNode(n, testUserID)
+
+	got, _ := s.GetNode(n.ID, testUserID)
+	if got.Schedule != models.NodeScheduleActive || !got.Schedulable() {
+		t.Errorf("expected new node active, got %q", got.Schedule)
+	}
+	if err := s.UpdateNodeSchedule(n.ID, testUserID, models.NodeScheduleCordoned); err != nil {
+		t.Fatalf("UpdateNodeSchedule: %v", err)
+	}
+	got, _ = s.GetNode(n.ID, testUserID)
+	if got.Schedule != models.NodeScheduleCordoned || got.Schedulable() {
+		t.Errorf("expected node cordoned, got %q", got.Schedule)
+	}
+}
+
+func TestResetDrainingNodes(t *testing.T) {
+	s := newTestStore(t)
+	draining, active := sampleNode("draining-test"), sampleNode("active-test")
+	_ = s.CreateNode(draining, testUserID)
+	_ = s.CreateNode(active, testUserID)
+	_ = s.UpdateNodeSchedule(draining.ID, testUserID, models.NodeScheduleDraining)
+
+	n, err := s.ResetDrainingNodes()
+	if err != nil || n != 1 {
+		t.Fatalf("ResetDrainingNodes = %d, %v; want 1", n, err)
+	}
+	if got, _ := s.GetNode(draining.ID, testUserID); got.Schedule != models.NodeScheduleCordoned {
+		t.Errorf("expected draining node cordoned, got %q", got.Schedule)
+	}
+	if got, _ := s.GetNode(active.ID, testUserID); got.Schedule != models.NodeScheduleActive {
+		t.Errorf("expected active node untouched, got %q", got.Schedule)
+	}
+}
+
+func TestPinNodeHostKey(t *testing.T) {
+	s := newTestStore(t)
+	n := sampleNode("hostkey-test")
+	_ = s.CreateNode(n, testUserID)
+
+	got, err := s.PinNodeHostKey(n.ID, "ssh-ed25519 AAAAfirst")
+	if err != nil || got != "ssh-ed25519 AAAAfirst" {
+		t.Fatalf("first pin: got %q, %v", got, err)
+	}
+	got, _ = s.PinNodeHostKey(n.ID, "ssh-ed25519 AAAAsecond")
+	if got != "ssh-ed25519 AAAAfirst" {
+		t.Errorf("expected first key to stay pinned, got %q", got)
+	}
+
+	if err := s.SetNodeHostKey(n.ID, testUserID, "ssh-ed25519 AAAAsecond"); err != nil {
+		t.Fatalf("SetNodeHostKey: %v", err)
+	}
+	node, _ := s.GetNode(n.ID, testUserID)
+	if node.HostKey != "ssh-ed25519 AAAAsecond" {
+		t.Errorf("expected replaced key, got %q", node.HostKey)
+	}
+}
+
+func TestNodeSSHHops(t *testing.T) {
+	s := newTestStore(t)
+	outer := &models.JumpHost{ID: "outer", Name: "outer", Host: "203.0.113.1", Port: 22, Username: "ops", PrivateKey: "outer-key", CreatedAt: time.Now().UTC()}
+	inner := &models.JumpHost{ID: "inner", Name: "inner", Host: "10.0.0.2", Port: 2222, Username: "ops", PrivateKey: "inner-key", ProxyJumpHostID: "outer", CreatedAt: time.Now().UTC()}
+	for _, j := range []*models.JumpHost{outer, inner} {
+		if err := s.CreateJumpHost(j, testUserID); err != nil {
+			t.Fatalf("CreateJumpHost: %v", err)
+		}
+	}
+	gateway := sampleNode("gateway")
+	gateway.ProxyJumpHostID = "inner"
+	_ = s.CreateNode(gateway, testUserID)
+	private := sampleNode("private")
+	private.ProxyNodeID = gateway.ID
+	_ = s.CreateNode(private, testUserID)
+
+	hops, err := s.NodeSSHHops(private)
+	if err != nil {
+		t.Fatalf("NodeSSHHops: %v", err)
+	}
+	if len(hops) != 3 {
+		t.Fatalf("expected 3 hops, got %d", len(hops))
+	}
+	if hops[0].JumpHostID != "outer" || hops[1].JumpHostID != "inner" || hops[2].NodeID != gateway.ID {
+		t.Errorf("unexpected hop order: %+v %+v %+v", hops[0], hops[1], hops[2])
+	}
+	if hops[1].PrivateKey != "inner-key" || hops[1].Port != 2222 {
+		t.Errorf("unexpected jump host credentials: %+v", hops[1])
+	}
+	if used, _ := s.NodeUsedAsProxy(gateway.ID); !used {
+		t.Error("expected gateway to be in use as a proxy")
+	}
+	if used, _ := s.JumpHostInUse("outer"); !used {
+		t.Error("expected outer jump host to be in use")
+	}
+
+	loop := sampleNode("loop")
+	loop.ProxyNodeID = loop.ID
+	_ = s.CreateNode(loop, testUserID)
+	if _, err := s.NodeSSHHops(loop); err == nil {
+		t.Error("expected error for a proxy loop")
+	}
+}
+
+func TestUpdateNodeCredentials_Encrypted(t *testing.T) {
+	s, _ := newTestStoreWithCipher(t)
+	n := sampleNode("creds-test")
+	n.KeyPassphrase = "s3cret"
+	n.Password = "hunter2"
+	if err := s.CreateNode(n, testUserID); err != nil {
+		t.Fatalf("CreateNode: %v", err)
+	}
+	got, _ := s.GetNode(n.ID, testUserID)
+	if got.KeyPassphrase != "s3cret" || got.Password != "hunter2" {
+		t.Errorf("expected decrypted secrets, got %q / %q", got.KeyPassphrase, got.Password)
+	}
+
+	got.PrivateKey, got.KeyPassphrase, got.Certificate, got.Password = "new-key", "", "ssh-ed25519-cert-v01@openssh.com AAAA", ""
+	if err := s.UpdateNodeCredentials(got, testUserID); err != nil {
+		t.Fatalf("UpdateNodeCredentials: %v", err)
+	}
+	nodes, _ := s.ListAllNodes()
+	if len(nodes) != 1 || nodes[0].PrivateKey != "new-key" || nodes[0].Password != "" || nodes[0].Certificate == "" {
+		t.Errorf("unexpected credentials after update: %+v", nodes)
+	}
+}
+
 func TestCountNodes(t *testing.T) {
 	s := newTestStore(t)
 	count, err := s.CountNodes(testUserID)
@@ -416,6 +544,23 @@ func sampleDeployment(serviceID, nodeID string) *models.Deployment {
 	}
 }
 
+func TestUpdateDeploymentNode(t *testing.T) {
+	s := newTestStore(t)
+	n, a := setupNodeAndApp(t, s)
+	other := sampleNode("other-node")
+	_ = s.CreateNode(other, testUserID)
+	d := sampleDeployment(a.ID, n.ID)
+	_ = s.CreateDeployment(d, testUserID)
+
+	if err := s.UpdateDeploymentNode(d.ID, testUserID, other.ID, "cid-2"); err != nil {
+		t.Fatalf("UpdateDeploymentNode: %v", err)
+	}
+	got, _ := s.GetDeployment(d.ID, testUserID)
+	if got.NodeID != other.ID || got.ContainerID != "cid-2" || got.Status != "running" {
+		t.Errorf("unexpected deployment after move: %+v", got)
+	}
+}
+
 func TestCreateDeployment_GetDeployment(t *testing.T) {
 	s := newTestStore(t)
 	n, a := setupNodeAndApp(t, s)
@@ -574,6 +719,234 @@ func TestCountDeploymentsByStatus(t *testing.T) {
 	}
 }
 
+// ---- Canaries ----
+
+func sampleCanary(d *models.Deployment) *models.Canary {
+	now := time.Now().UTC()
+	return &models.Canary{
+		ID:            "canary-id",
+		DeploymentID:  d.ID,
+		ServiceID:     d.ServiceID,
+		NodeID:        d.NodeID,
+		DockerImage:   "nginx:1.27",
+		ContainerName: d.ContainerName + "-canary-1234abcd",
+		Weight:        10,
+		Status:        "pending",
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+}
+
+func TestCreateCanary_GetCanary(t *testing.T) {
+	s := newTestStore(t)
+	n, a := setupNodeAndApp(t, s)
+	d := sampleDeployment(a.ID, n.ID)
+	_ = s.CreateDeployment(d, testUserID)
+	c := sampleCanary(d)
+
+	if err := s.CreateCanary(c, testUserID); err != nil {
+		t.Fatalf("CreateCanary: %v", err)
+	}
+	got, err := s.GetCanary(c.ID, testUserID)
+	if err != nil {
+		t.Fatalf("GetCanary: %v", err)
+	}
+	if got == nil {
+		t.Fatal("expected non-nil canary")
+	}
+	if got.DockerImage != "nginx:1.27" || got.Weight != 10 {
+		t.Errorf("unexpected canary: %+v", got)
+	}
+	if got.StableImage != a.DockerImage {
+		t.Errorf("expected stable image %q from join, got %q", a.DockerImage, got.StableImage)
+	}
+
+	other, _ := s.GetCanary(c.ID, "other-user")
+	if other != nil {
+		t.Error("expected nil for another user's canary")
+	}
+}
+
+func TestGetActiveCanaryForDeployment(t *testing.T) {
+	s := newTestStore(t)
+	n, a := setupNodeAndApp(t, s)
+	d := sampleDeployment(a.ID, n.ID)
+	_ = s.CreateDeployment(d, testUserID)
+	c := sampleCanary(d)
+	_ = s.CreateCanary(c, testUserID)
+
+	active, err := s.GetActiveCanaryForDeployment(d.ID, testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active == nil || active.ID != c.ID {
+		t.Fatalf("expected active canary, got %+v", active)
+	}
+
+	_ = s.UpdateCanaryStatus(c.ID, testUserID, "aborted", "")
+	active, _ = s.GetActiveCanaryForDeployment(d.ID, testUserID)
+	if active != nil {
+		t.Errorf("expected no active canary after abort, got %+v", active)
+	}
+}
+
+func TestUpdateCanaryWeight(t *testing.T) {
+	s := newTestStore(t)
+	n, a := setupNodeAndApp(t, s)
+	d := sampleDeployment(a.ID, n.ID)
+	_ = s.CreateDeployment(d, testUserID)
+	c := sampleCanary(d)
+	_ = s.CreateCanary(c, testUserID)
+
+	if err := s.UpdateCanaryWeight(c.ID, testUserID, 50); err != nil {
+		t.Fatalf("UpdateCanaryWeight: %v", err)
+	}
+	got, _ := s.GetCanary(c.ID, testUserID)
+	if got.Weight != 50 {
+		t.Errorf("expected weight 50, got %d", got.Weight)
+	}
+
+	list, err := s.ListCanaries(testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("expected 1 canary, got %d", len(list))
+	}
+}
+
+// ---- Heal policies ----
+
+func TestCreateDeployment_DefaultHealPolicy(t *testing.T) {
+	s := newTestStore(t)
+	n, a := setupNodeAndApp(t, s)
+	d := sampleDeployment(a.ID, n.ID)
+	_ = s.CreateDeployment(d, testUserID)
+
+	got, _ := s.GetDeployment(d.ID, testUserID)
+	if got.HealPolicy != models.HealPolicyObserve {
+		t.Errorf("expected default heal policy observe, got %q", got.HealPolicy)
+	}
+}
+
+func TestUpdateHealPolicy(t *testing.T) {
+	s := newTestStore(t)
+	n, a := setupNodeAndApp(t, s)
+	d := sampleDeployment(a.ID, n.ID)
+	_ = s.CreateDeployment(d, testUserID)
+
+	found, err := s.UpdateHealPolicy(models.HealResourceDeployment, d.ID, testUserID, models.HealPolicyRecreate)
+	if err != nil {
+		t.Fatalf("UpdateHealPolicy: %v", err)
+	}
+	if !found {
+		t.Fatal("expected deployment to be found")
+	}
+	policy, err := s.GetHealPolicy(models.HealResourceDeployment, d.ID, testUserID)
+	if err != nil {
+		t.Fatalf("GetHealPolicy: %v", err)
+	}
+	if policy != models.HealPolicyRecreate {
+		t.Errorf("expected recreate, got %q", policy)
+	}
+
+	// Another user's resource is not touched.
+	found, _ = s.UpdateHealPolicy(models.HealResourceDeployment, d.ID, "other-user", models.HealPolicyRestart)
+	if found {
+		t.Error("expected other user's update to find nothing")
+	}
+}
+
+func TestUpdateHealPolicy_UnknownType(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.UpdateHealPolicy("node", "id", testUserID, models.HealPolicyRestart); err == nil {
+		t.Error("expected error for unknown resource type")
+	}
+}
+
+func TestListDeploymentsForHealthCheck(t *testing.T) {
+	s := newTestStore(t)
+	n, a := setupNodeAndApp(t, s)
+	d := sampleDeployment(a.ID, n.ID)
+	_ = s.CreateDeployment(d, testUserID)
+
+	deps, _ := s.ListDeploymentsForHealthCheck()
+	if len(deps) != 0 {
+		t.Fatalf("expected pending deployment to be skipped, got %d", len(deps))
+	}
+
+	_ = s.UpdateDeploymentStatus(d.ID, testUserID, "restarting", "")
+	deps, err := s.ListDeploymentsForHealthCheck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 {
+		t.Fatalf("expected 1 deployment, got %d", len(deps))
+	}
+	if deps[0].UserID != testUserID || deps[0].HealPolicy != models.HealPolicyObserve {
+		t.Errorf("unexpected deployment: %+v", deps[0])
+	}
+
+	_ = s.UpdateDeploymentStatus(d.ID, testUserID, "crash_loop", "")
+	deps, _ = s.ListDeploymentsForHealthCheck()
+	if len(deps) != 0 {
+		t.Fatalf("expected crash_loop deployment to be skipped, got %d", len(deps))
+	}
+}
+
+func TestHealState_SaveGetClear(t *testing.T) {
+	s := newTestStore(t)
+
+	got, err := s.GetHealState(models.HealResourceCache, "c1")
+	if err != nil {
+		t.Fatalf("GetHealState: %v", err)
+	}
+	if got != nil {
+		t.Fatal("expected nil heal state")
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	next := now.Add(30 * time.Second)
+	h := &models.HealState{
+		ResourceType:  models.HealResourceCache,
+		ResourceID:    "c1",
+		Attempts:      1,
+		LastAttemptAt: &now,
+		NextAttemptAt: &next,
+		LastError:     "docker start failed",
+	}
+	if err := s.SaveHealState(h); err != nil {
+		t.Fatalf("SaveHealState: %v", err)
+	}
+	h.Attempts = 2
+	h.LastError = ""
+	if err := s.SaveHealState(h); err != nil {
+		t.Fatalf("SaveHealState (upsert): %v", err)
+	}
+
+	got, err = s.GetHealState(models.HealResourceCache, "c1")
+	if err != nil || got == nil {
+		t.Fatalf("GetHealState: %v, %v", got, err)
+	}
+	if got.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", got.Attempts)
+	}
+	if got.LastError != "" {
+		t.Errorf("expected last error cleared, got %q", got.LastError)
+	}
+	if got.NextAttemptAt == nil || !got.NextAttemptAt.Equal(next) {
+		t.Errorf("next_attempt_at: got %v, want %v", got.NextAttemptAt, next)
+	}
+
+	if err := s.ClearHealState(models.HealResourceCache, "c1"); err != nil {
+		t.Fatalf("ClearHealState: %v", err)
+	}
+	got, _ = s.GetHealState(models.HealResourceCache, "c1")
+	if got != nil {
+		t.Fatal("expected nil after clear")
+	}
+}
+
 // ---- Settings ----
 
 func TestGetSetting_Missing(t *testing.T) {
@@ -734,3 +1107,386 @@ func TestGetUserByWebhookToken(t *testing.T) {
 		t.Fatal("expected nil for unknown token")
 	}
 }
+
+func TestOrganizations(t *testing.T) {
+	s := newTestStore(t)
+	alice, _ := s.UpsertUser("sub-a", "alice@example.com", "Alice", "")
+	bob, _ := s.UpsertUser("sub-b", "bob@example.com", "Bob", "")
+
+	// Every user owns a personal organization with the user's ID.
+	if role, _ := s.GetOrgRole(alice.ID, alice.ID); role != models.RoleOwner {
+		t.Fatalf("personal organization role = %q", role)
+	}
+
+	org, err := s.CreateOrganization("Team", alice.ID)
+	if err != nil {
+		t.Fatalf("CreateOrganization: %v", err)
+	}
+	if err := s.SetOrgMember(org.ID, bob.ID, models.RoleViewer); err != nil {
+		t.Fatalf("SetOrgMember: %v", err)
+	}
+	if owner, _ := s.GetWebhookOwner(mustSetting(t, s, org.ID, "webhook_token")); owner != org.ID {
+		t.Errorf("GetWebhookOwner = %q, want %q", owner, org.ID)
+	}
+
+	orgs, err := s.ListUserOrganizations(bob.ID)
+	if err != nil || len(orgs) != 2 || orgs[0].ID != bob.ID || !orgs[0].Personal || orgs[1].Role != models.RoleViewer {
+		t.Fatalf("ListUserOrganizations = %+v, %v", orgs, err)
+	}
+	members, _ := s.ListOrgMembers(org.ID)
+	if len(members) != 2 || members[0].Email != "alice@example.com" || members[1].Role != models.RoleViewer {
+		t.Errorf("ListOrgMembers = %+v", members)
+	}
+	if n, _ := s.CountOrgOwners(org.ID); n != 1 {
+		t.Errorf("CountOrgOwners = %d", n)
+	}
+	if u, _ := s.GetUserByEmail("BOB@example.com"); u == nil || u.ID != bob.ID {
+		t.Errorf("GetUserByEmail = %+v", u)
+	}
+
+	n := sampleNode("n1")
+	if err := s.CreateNode(n, org.ID); err != nil {
+		t.Fatal(err)
+	}
+	if busy, _ := s.OrganizationHasResources(org.ID); !busy {
+		t.Error("expected the organization to have resources")
+	}
+	_ = s.DeleteNode(n.ID, org.ID)
+	if err := s.DeleteOrganization(org.ID); err != nil {
+		t.Fatalf("DeleteOrganization: %v", err)
+	}
+	if o, _ := s.GetOrganization(org.ID); o != nil {
+		t.Error("organization still exists")
+	}
+	if role, _ := s.GetOrgRole(org.ID, bob.ID); role != "" {
+		t.Errorf("membership survived deletion: %q", role)
+	}
+}
+
+func mustSetting(t *testing.T, s *store.Store, userID, key string) string {
+	t.Helper()
+	v, err := s.GetUserSetting(userID, key)
+	if err != nil || v == "" {
+		t.Fatalf("setting %s of %s: %q, %v", key, userID, v, err)
+	}
+	return v
+}
+
+// ---- Certificates ----
+
+func TestCertificate_KeyEncrypted(t *testing.T) {
+	s, _ := newTestStoreWithCipher(t)
+	now := time.Now().UTC()
+	c := &models.Certificate{
+		ID:        "cert-id",
+		Domains:   `["example.com"]`,
+		Source:    models.CertificateSourceUploaded,
+		NotBefore: now,
+		NotAfter:  now.Add(24 * time.Hour),
+		CertPEM:   "CERT",
+		KeyPEM:    "KEY",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.CreateCertificate(c, testUserID); err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	got, err := s.GetCertificate(c.ID, testUserID)
+	if err != nil || got == nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+	if got.KeyPEM != "KEY" {
+		t.Errorf("expected decrypted key, got %q", got.KeyPEM)
+	}
+	uploaded, err := s.ListUploadedCertificates(testUserID)
+	if err != nil || len(uploaded) != 1 || uploaded[0].KeyPEM != "KEY" {
+		t.Fatalf("ListUploadedCertificates: %v %+v", err, uploaded)
+	}
+	if other, _ := s.GetCertificate(c.ID, "other-user"); other != nil {
+		t.Error("expected nil for another user's certificate")
+	}
+}
+
+func TestUpsertACMECertificate_Prune(t *testing.T) {
+	s := newTestStore(t)
+	n, _ := setupNodeAndApp(t, s)
+	first := time.Now().UTC().Add(-time.Hour)
+	c := &models.Certificate{
+		ID:        "acme-1",
+		Domains:   `["example.com"]`,
+		NodeID:    n.ID,
+		Issuer:    "Pebble",
+		NotBefore: first,
+		NotAfter:  first.Add(24 * time.Hour),
+		CertPEM:   "CERT",
+		UserID:    testUserID,
+		CreatedAt: first,
+		UpdatedAt: first,
+	}
+	if err := s.UpsertACMECertificate(c); err != nil {
+		t.Fatalf("UpsertACMECertificate: %v", err)
+	}
+	renewed := *c
+	renewed.ID = "acme-2"
+	renewed.NotAfter = first.Add(90 * 24 * time.Hour)
+	renewed.UpdatedAt = time.Now().UTC()
+	if err := s.UpsertACMECertificate(&renewed); err != nil {
+		t.Fatalf("UpsertACMECertificate renewal: %v", err)
+	}
+
+	certs, err := s.ListCertificates(testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("expected renewal to update the existing row, got %d rows", len(certs))
+	}
+	if !certs[0].NotAfter.Equal(renewed.NotAfter) || certs[0].NodeName != n.Name {
+		t.Errorf("unexpected certificate: %+v", certs[0])
+	}
+
+	if err := s.PruneACMECertificates(n.ID, time.Now().UTC().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	certs, _ = s.ListCertificates(testUserID)
+	if len(certs) != 0 {
+		t.Errorf("expected stale ACME certificate pruned, got %d", len(certs))
+	}
+}
+
+func TestWireGuardPeer_CRUD(t *testing.T) {
+	s, _ := newTestStoreWithCipher(t)
+	n, _ := setupNodeAndApp(t, s)
+	p := &models.WireGuardPeer{
+		NodeID:     n.ID,
+		OverlayIP:  "10.77.0.1",
+		PublicKey:  "PUB",
+		PrivateKey: "PRIV",
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := s.CreateWireGuardPeer(p, testUserID); err != nil {
+		t.Fatalf("CreateWireGuardPeer: %v", err)
+	}
+	dup := *p
+	dup.NodeID = "other-node"
+	if err := s.CreateWireGuardPeer(&dup, testUserID); err == nil {
+		t.Error("expected overlay IPs to be unique per user")
+	}
+
+	got, err := s.GetWireGuardPeer(n.ID, testUserID)
+	if err != nil || got == nil {
+		t.Fatalf("GetWireGuardPeer: %v", err)
+	}
+	if got.PrivateKey != "PRIV" || got.NodeHost != n.Host || got.NodeName != n.Name {
+		t.Errorf("unexpected peer: %+v", got)
+	}
+	peers, err := s.ListWireGuardPeers(testUserID)
+	if err != nil || len(peers) != 1 {
+		t.Fatalf("ListWireGuardPeers: %v %d", err, len(peers))
+	}
+	if other, _ := s.GetWireGuardPeer(n.ID, "other-user"); other != nil {
+		t.Error("expected nil for another user's peer")
+	}
+
+	if err := s.DeleteWireGuardPeer(n.ID, testUserID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.GetWireGuardPeer(n.ID, testUserID); got != nil {
+		t.Error("expected peer deleted")
+	}
+}
+
+func TestFirewallRules_CRUD(t *testing.T) {
+	s := newTestStore(t)
+	r := &models.FirewallRule{ID: "rule-1", Protocol: "tcp", Port: 3000, Source: "198.51.100.0/24", CreatedAt: time.Now().UTC()}
+	if err := s.CreateFirewallRule(r, testUserID); err != nil {
+		t.Fatalf("CreateFirewallRule: %v", err)
+	}
+	rules, err := s.ListFirewallRules(testUserID)
+	if err != nil || len(rules) != 1 || rules[0].Source != r.Source {
+		t.Fatalf("ListFirewallRules: %v %+v", err, rules)
+	}
+	if deleted, _ := s.DeleteFirewallRule(r.ID, "other-user"); deleted {
+		t.Error("expected another user's delete to be a no-op")
+	}
+	if deleted, err := s.DeleteFirewallRule(r.ID, testUserID); err != nil || !deleted {
+		t.Fatalf("DeleteFirewallRule: %v %v", deleted, err)
+	}
+}
+
+func TestNodeFirewall_EnableRecordDisable(t *testing.T) {
+	s := newTestStore(t)
+	n, _ := setupNodeAndApp(t, s)
+	for i := 0; i < 2; i++ {
+		if err := s.EnableNodeFirewall(n.ID, testUserID, time.Now().UTC()); err != nil {
+			t.Fatalf("EnableNodeFirewall: %v", err)
+		}
+	}
+	if err := s.RecordFirewallApply(n.ID, time.Now().UTC(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RecordFirewallApply(n.ID, time.Now().UTC(), "nft: syntax error"); err != nil {
+		t.Fatal(err)
+	}
+	fws, err := s.ListNodeFirewalls(testUserID)
+	if err != nil || len(fws) != 1 {
+		t.Fatalf("ListNodeFirewalls: %v %d", err, len(fws))
+	}
+	if fws[0].AppliedAt == nil || fws[0].LastError != "nft: syntax error" || fws[0].NodeName != n.Name {
+		t.Errorf("unexpected firewall: %+v", fws[0])
+	}
+	if ids, _ := s.ListFirewallUserIDs(); len(ids) != 1 || ids[0] != testUserID {
+		t.Errorf("unexpected firewall users: %v", ids)
+	}
+
+	if err := s.DisableNodeFirewall(n.ID, testUserID); err != nil {
+		t.Fatal(err)
+	}
+	if fws, _ := s.ListNodeFirewalls(testUserID); len(fws) != 0 {
+		t.Errorf("expected firewall disabled, got %d", len(fws))
+	}
+}
+
+func TestNodeBootstrap_Record(t *testing.T) {
+	s := newTestStore(t)
+	n, _ := setupNodeAndApp(t, s)
+	if b, err := s.GetNodeBootstrap(n.ID, testUserID); err != nil || b != nil {
+		t.Fatalf("expected no record, got %+v %v", b, err)
+	}
+
+	now := time.Now().UTC()
+	ok := &models.NodeBootstrap{NodeID: n.ID, OS: "debian 12", Versions: `{"docker":"27.3.1"}`, BootstrappedAt: &now, UpdatedAt: now}
+	if err := s.RecordNodeBootstrap(ok, testUserID); err != nil {
+		t.Fatalf("RecordNodeBootstrap: %v", err)
+	}
+	failed := &models.NodeBootstrap{NodeID: n.ID, LastError: "apt-get: exit status 100", UpdatedAt: now}
+	if err := s.RecordNodeBootstrap(failed, testUserID); err != nil {
+		t.Fatalf("RecordNodeBootstrap: %v", err)
+	}
+
+	b, err := s.GetNodeBootstrap(n.ID, testUserID)
+	if err != nil || b == nil {
+		t.Fatalf("GetNodeBootstrap: %v %v", b, err)
+	}
+	if b.OS != "debian 12" || b.Versions != ok.Versions || b.BootstrappedAt == nil || b.LastError != failed.LastError {
+		t.Errorf("expected failure to keep the last versions, got %+v", b)
+	}
+	if b, _ := s.GetNodeBootstrap(n.ID, "other-user"); b != nil {
+		t.Error("expected other user to not see the record")
+	}
+}
+
+func TestMetricSamples_Downsample(t *testing.T) {
+	s := newTestStore(t)
+	hour := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i, cpu := range []float64{10, 30} {
+		if err := s.InsertMetricSample(&models.MetricSample{
+			Kind: models.MetricKindNode, TargetID: "n1", Timestamp: hour.Add(time.Duration(i) * 10 * time.Minute),
+			CPUPercent: cpu, NetRx: int64(100 * (i + 1)), UserID: testUserID,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	later := &models.MetricSample{Kind: models.MetricKindNode, TargetID: "n1", Timestamp: hour.Add(time.Hour), CPUPercent: 50, UserID: testUserID}
+	if err := s.InsertMetricSample(later); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DownsampleMetrics(0, 3600, hour.Add(time.Hour)); err != nil {
+		t.Fatalf("DownsampleMetrics: %v", err)
+	}
+	samples, err := s.ListMetricSamples(models.MetricKindNode, "n1", testUserID, hour)
+	if err != nil || len(samples) != 2 {
+		t.Fatalf("ListMetricSamples: %v %d", err, len(samples))
+	}
+	if got := samples[0]; got.Resolution != 3600 || !got.Timestamp.Equal(hour) || got.CPUPercent != 20 || got.NetRx != 200 {
+		t.Errorf("unexpected hourly sample: %+v", got)
+	}
+	if got := samples[1]; got.Resolution != 0 || got.CPUPercent != 50 {
+		t.Errorf("expected the newer raw sample untouched, got %+v", got)
+	}
+
+	if err := s.PruneMetrics(3600, hour.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if samples, _ := s.ListMetricSamples(models.MetricKindNode, "n1", testUserID, hour); len(samples) != 1 {
+		t.Errorf("expected the hourly sample pruned, got %d samples", len(samples))
+	}
+	if samples, _ := s.ListMetricSamples(models.MetricKindNode, "n1", "other-user", hour); len(samples) != 0 {
+		t.Errorf("expected other user to see no samples, got %d", len(samples))
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	s := newTestStore(t)
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, e := range []*models.AuditEvent{
+		{Action: "node.create", ResourceType: "node", ResourceID: "n1", ActorType: models.AuditActorUser, Result: models.AuditResultSuccess},
+		{Action: "database.delete", ResourceType: "database", ResourceID: "db1", ActorType: models.AuditActorUser, Result: models.AuditResultFailure, Error: "boom"},
+		{Action: "node.cordon", ResourceType: "node", ResourceID: "n1", ActorType: models.AuditActorPoller, Result: models.AuditResultSuccess},
+	} {
+		e.ID = "a" + strconv.Itoa(i)
+		e.UserID = testUserID
+		e.CreatedAt = now.Add(time.Duration(i) * time.Minute)
+		if err := s.InsertAuditEvent(e); err != nil {
+			t.Fatalf("InsertAuditEvent: %v", err)
+		}
+	}
+
+	all, err := s.ListAuditEvents(testUserID, models.AuditFilter{})
+	if err != nil || len(all) != 3 || all[0].ID != "a2" {
+		t.Fatalf("expected 3 events newest first, got %v %v", all, err)
+	}
+	if got, _ := s.ListAuditEvents(testUserID, models.AuditFilter{Action: "node."}); len(got) != 2 {
+		t.Errorf("expected 2 node events, got %d", len(got))
+	}
+	if got, _ := s.ListAuditEvents(testUserID, models.AuditFilter{ResourceType: "database", Result: models.AuditResultFailure}); len(got) != 1 || got[0].Error != "boom" {
+		t.Errorf("unexpected filtered events %v", got)
+	}
+	if got, _ := s.ListAuditEvents(testUserID, models.AuditFilter{Since: now.Add(30 * time.Second), Until: now.Add(90 * time.Second)}); len(got) != 1 || got[0].ID != "a1" {
+		t.Errorf("unexpected time-filtered events %v", got)
+	}
+	if got, _ := s.ListAuditEvents(testUserID, models.AuditFilter{Limit: 1}); len(got) != 1 {
+		t.Errorf("expected limit applied, got %d", len(got))
+	}
+	if got, _ := s.ListAuditEvents("other-user", models.AuditFilter{}); len(got) != 0 {
+		t.Errorf("expected other user to see no events, got %d", len(got))
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	s := newTestStore(t)
+	u, _ := s.UpsertUser("sub-tok", "tok@example.com", "Tok", "")
+	tok := &models.APIToken{ID: "t1", Name: "ci", Prefix: "lp_abcdef", Scope: models.ScopeRead, UserID: u.ID, CreatedAt: time.Now().UTC()}
+	if err := s.CreateAPIToken(tok, "hash-1"); err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	got, err := s.GetAPITokenByHash("hash-1")
+	if err != nil || got == nil || got.UserID != u.ID || got.ExpiresAt != nil || got.LastUsedAt != nil {
+		t.Fatalf("GetAPITokenByHash = %+v, %v", got, err)
+	}
+
+	first := time.Now().UTC()
+	_ = s.TouchAPIToken("t1", first, "10.0.0.1")
+	// A use within the minute from the same IP is not written.
+	_ = s.TouchAPIToken("t1", first.Add(10*time.Second), "10.0.0.1")
+	got, _ = s.GetAPITokenByHash("hash-1")
+	if got.LastUsedAt == nil || !got.LastUsedAt.Equal(first) || got.LastUsedIP != "10.0.0.1" {
+		t.Errorf("after touch: %+v", got)
+	}
+	_ = s.TouchAPIToken("t1", first.Add(20*time.Second), "10.0.0.2")
+	got, _ = s.GetAPITokenByHash("hash-1")
+	if got.LastUsedIP != "10.0.0.2" {
+		t.Errorf("new IP not recorded: %+v", got)
+	}
+
+	if ok, _ := s.DeleteAPIToken("t1", "someone-else"); ok {
+		t.Error("deleted another user's token")
+	}
+	if ok, _ := s.DeleteAPIToken("t1", u.ID); !ok {
+		t.Error("DeleteAPIToken reported no token")
+	}
+	if got, _ := s.GetAPITokenByHash("hash-1"); got != nil {
+		t.Error("token still found after revoke")
+	}
+}
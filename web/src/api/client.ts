@@ -1,8 +1,30 @@
 const BASE = '/api'
 
+// The organization requests act in; unset means the personal organization.
+let activeOrgId = localStorage.getItem('org_id') || ''
+
+export function getActiveOrg(): string {
+  return activeOrgId
+}
+
+export function setActiveOrg(id: string) {
+  activeOrgId = id
+  if (id) localStorage.setItem('org_id', id)
+  else localStorage.removeItem('org_id')
+}
+
+// withOrg adds the active organization to a URL that is opened without
+// request(), such as an EventSource or a download link.
+function withOrg(url: string): string {
+  if (!activeOrgId) return url
+  return `${url}${url.includes('?') ? '&' : '?'}org_id=${encodeURIComponent(activeOrgId)}`
+}
+
 async function request<T>(path: string, options?: RequestInit): Promise<T> {
+  const headers: Record<string, string> = { 'Content-Type': 'application/json' }
+  if (activeOrgId) headers['X-Org-ID'] = activeOrgId
   const res = await fetch(`${BASE}${path}`, {
-    headers: { 'Content-Type': 'application/json' },
+    headers,
     credentials: 'include',
     ...options,
   })
@@ -43,6 +65,11 @@ export interface Node {
   provider?: string
   provider_region?: string
   provider_instance_id?: string
+  schedule: 'active' | 'cordoned' | 'draining'
+  host_key: string
+  proxy_node_id?: string
+  proxy_jump_host_id?: string
+  certificate?: string
   created_at: string
 }
 
@@ -51,7 +78,40 @@ export interface CreateNodeInput {
   host: string
   port: number
   username: string
-  private_key: string
+  private_key?: string
+  key_passphrase?: string
+  certificate?: string
+  password?: string
+  generate_key?: boolean
+  host_key?: string
+  proxy_node_id?: string
+  proxy_jump_host_id?: string
+}
+
+export interface NodeHostKey {
+  pinned: string
+  pinned_fingerprint: string
+  presented?: string
+  presented_fingerprint?: string
+  match?: boolean
+  error?: string
+}
+
+export interface NodeBootstrap {
+  node_id: string
+  os: string
+  versions: string  // JSON object of package versions
+  bootstrapped_at: string | null
+  last_error: string
+  updated_at: string
+}
+
+export interface DrainReport {
+  node_id: string
+  moved: { deployment_id: string; service_name: string; to_node_id: string; to_node_name: string; container_id: string; warnings?: string[] }[]
+  failed: { deployment_id: string; service_name: string; error: string }[]
+  skipped: { deployment_id: string; service_name: string; status: string }[]
+  resources: { kind: string; id: string; name: string; plan: string }[]
 }
 
 export const nodes = {
@@ -65,6 +125,185 @@ export const nodes = {
     request<{ status: string; message: string }>(`/nodes/${id}/ping`, { method: 'POST' }),
   setupTraefik: (id: string) =>
     request<{ status: string; output: string }>(`/nodes/${id}/setup-traefik`, { method: 'POST' }),
+  cordon: (id: string) =>
+    request<Node>(`/nodes/${id}/cordon`, { method: 'POST' }),
+  uncordon: (id: string) =>
+    request<Node>(`/nodes/${id}/cordon`, { method: 'DELETE' }),
+  drain: (id: string, targetNodeId?: string) =>
+    request<DrainReport>(`/nodes/${id}/drain`, { method: 'POST', body: JSON.stringify({ target_node_id: targetNodeId ?? '' }) }),
+  getHostKey: (id: string) => request<NodeHostKey>(`/nodes/${id}/host-key`),
+  acceptHostKey: (id: string, hostKey: string) =>
+    request<{ host_key: string; fingerprint: string }>(`/nodes/${id}/host-key`, { method: 'PUT', body: JSON.stringify({ host_key: hostKey }) }),
+  getBootstrap: (id: string) => request<NodeBootstrap>(`/nodes/${id}/bootstrap`),
+  bootstrap: (id: string) =>
+    request<{ output: string; bootstrap?: NodeBootstrap; error?: string }>(`/nodes/${id}/bootstrap`, { method: 'POST' }),
+  rotateKey: (id: string, password?: string) =>
+    request<{ public_key?: string; error?: string }>(`/nodes/${id}/key`, { method: 'POST', body: JSON.stringify({ password: password ?? '' }) }),
+  issueCertificate: (id: string, validFor?: string) =>
+    request<{ certificate: string; valid_before: string }>(`/nodes/${id}/certificate`, { method: 'POST', body: JSON.stringify({ valid_for: validFor ?? '' }) }),
+}
+
+// SSH CA
+export const sshCA = {
+  get: () => request<{ public_key: string }>('/ssh-ca'),
+}
+
+// Jump Hosts
+export interface JumpHost {
+  id: string
+  name: string
+  host: string
+  port: number
+  username: string
+  host_key: string
+  proxy_jump_host_id?: string
+  created_at: string
+}
+
+export interface CreateJumpHostInput {
+  name: string
+  host: string
+  port?: number
+  username: string
+  private_key: string
+  key_passphrase?: string
+  host_key?: string
+  proxy_jump_host_id?: string
+}
+
+export const jumpHosts = {
+  list: () => request<JumpHost[]>('/jump-hosts'),
+  create: (data: CreateJumpHostInput) =>
+    request<JumpHost>('/jump-hosts', { method: 'POST', body: JSON.stringify(data) }),
+  delete: (id: string) =>
+    request<void>(`/jump-hosts/${id}`, { method: 'DELETE' }),
+}
+
+// Container Events
+export interface ContainerEvent {
+  node_id: string
+  container: string
+  action: 'start' | 'die' | 'oom' | 'health_status'
+  health?: string
+  exit_code?: string
+  resource_type?: string
+  resource_id?: string
+  time: string
+}
+
+export const containerEvents = {
+  // subscribe follows the container events of the organization's nodes; call the
+  // returned function to stop.
+  subscribe: (onEvent: (e: ContainerEvent) => void) => {
+    const source = new EventSource(withOrg(`${BASE}/events`), { withCredentials: true })
+    source.addEventListener('container', (msg) => onEvent(JSON.parse((msg as MessageEvent).data)))
+    return () => source.close()
+  },
+}
+
+// Audit Log
+export interface AuditEvent {
+  id: string
+  actor_type: 'user' | 'webhook' | 'poller'
+  actor_id: string
+  actor_name: string
+  action: string
+  resource_type: string
+  resource_id: string
+  before?: string  // JSON summary, secrets redacted
+  after?: string
+  source_ip?: string
+  result: 'success' | 'failure'
+  error?: string
+  created_at: string
+}
+
+export interface AuditQuery {
+  actor_type?: string
+  action?: string
+  resource_type?: string
+  resource_id?: string
+  result?: string
+  since?: string
+  until?: string
+  limit?: number
+}
+
+function auditParams(q: AuditQuery): URLSearchParams {
+  const params = new URLSearchParams()
+  Object.entries(q).forEach(([k, v]) => { if (v !== undefined && v !== '') params.set(k, String(v)) })
+  return params
+}
+
+export const auditLog = {
+  list: (q: AuditQuery = {}) => request<AuditEvent[]>(`/audit?${auditParams(q)}`),
+  csvUrl: (q: AuditQuery = {}) => {
+    const params = auditParams(q)
+    params.set('format', 'csv')
+    return withOrg(`${BASE}/audit?${params}`)
+  },
+}
+
+// Organizations
+export type OrgRole = 'owner' | 'admin' | 'deployer' | 'viewer'
+
+export interface Organization {
+  id: string
+  name: string
+  personal: boolean
+  role?: OrgRole  // the current user's role
+  created_at: string
+}
+
+export interface OrgMember {
+  org_id: string
+  user_id: string
+  email: string
+  name: string
+  role: OrgRole
+  created_at: string
+}
+
+export const orgs = {
+  list: () => request<Organization[]>('/orgs'),
+  get: (id: string) => request<Organization & { members: OrgMember[] }>(`/orgs/${id}`),
+  create: (name: string) =>
+    request<Organization>('/orgs', { method: 'POST', body: JSON.stringify({ name }) }),
+  rename: (id: string, name: string) =>
+    request<Organization>(`/orgs/${id}`, { method: 'PUT', body: JSON.stringify({ name }) }),
+  delete: (id: string) => request(`/orgs/${id}`, { method: 'DELETE' }),
+  members: (id: string) => request<OrgMember[]>(`/orgs/${id}/members`),
+  addMember: (id: string, email: string, role: OrgRole) =>
+    request<OrgMember>(`/orgs/${id}/members`, { method: 'POST', body: JSON.stringify({ email, role }) }),
+  updateMember: (id: string, userId: string, role: OrgRole) =>
+    request(`/orgs/${id}/members/${userId}`, { method: 'PUT', body: JSON.stringify({ role }) }),
+  removeMember: (id: string, userId: string) =>
+    request(`/orgs/${id}/members/${userId}`, { method: 'DELETE' }),
+}
+
+// API Tokens
+export type TokenScope = 'read' | 'deploy' | 'admin'
+
+export interface APIToken {
+  id: string
+  name: string
+  prefix: string
+  scope: TokenScope
+  expires_at?: string
+  last_used_at?: string
+  last_used_ip?: string
+  created_at: string
+}
+
+export const apiTokens = {
+  list: () => request<APIToken[]>('/tokens'),
+  // create returns the token secret, which is not shown again.
+  create: (name: string, scope: TokenScope, expiresInDays?: number) =>
+    request<APIToken & { token: string }>('/tokens', {
+      method: 'POST',
+      body: JSON.stringify({ name, scope, expires_in_days: expiresInDays }),
+    }),
+  revoke: (id: string) => request(`/tokens/${id}`, { method: 'DELETE' }),
 }
 
 // Node Volume Migration
@@ -92,6 +331,25 @@ export const volumeMigration = {
 }
 
 // Services
+export interface Route {
+  host: string
+  path_prefix?: string
+  strip_prefix?: boolean
+  container_port?: number  // defaults to the container side of the first port mapping
+  entrypoint?: string      // "web" (default) or "websecure" for HTTPS with an HTTP redirect
+  middlewares?: RouteMiddlewares
+}
+
+export interface RouteMiddlewares {
+  ip_allowlist?: string[]  // IPs or CIDRs
+  basic_auth?: string[]    // "user:password" on input, stored as "user:bcrypt-hash"
+  rate_limit?: { average: number; burst?: number; period?: string }
+  redirect_regex?: { regex: string; replacement: string; permanent?: boolean }
+  request_headers?: Record<string, string>
+  response_headers?: Record<string, string>
+  compress?: boolean
+}
+
 export interface Service {
   id: string
   name: string
@@ -102,7 +360,7 @@ export interface Service {
   volumes: string   // JSON string
   command: string
   github_repo: string
-  domain: string
+  routes: string       // JSON string — array of Route
   databases: string    // JSON string — array of database IDs
   caches: string       // JSON string — array of cache IDs
   kafkas: string       // JSON string — array of kafka cluster IDs
@@ -120,13 +378,41 @@ export interface CreateServiceInput {
   volumes?: string[]
   command: string
   github_repo?: string
-  domain?: string
+  routes?: Route[]
   databases?: string[]
   caches?: string[]
   kafkas?: string[]
   monitorings?: string[]
 }
 
+// Self-healing
+export type HealPolicy = 'observe' | 'restart' | 'recreate'
+
+export interface HealState {
+  resource_type: string
+  resource_id: string
+  attempts: number
+  last_attempt_at?: string
+  next_attempt_at?: string
+  last_error: string
+}
+
+export interface HealInfo {
+  heal_policy: HealPolicy
+  heal_state: HealState | null
+}
+
+function healPolicyClient(resource: string) {
+  return {
+    getHealPolicy: (id: string) => request<HealInfo>(`/${resource}/${id}/heal-policy`),
+    setHealPolicy: (id: string, healPolicy: HealPolicy) =>
+      request<{ heal_policy: HealPolicy }>(`/${resource}/${id}/heal-policy`, {
+        method: 'PUT',
+        body: JSON.stringify({ heal_policy: healPolicy }),
+      }),
+  }
+}
+
 // Databases
 export interface Database {
   id: string
@@ -141,6 +427,8 @@ export interface Database {
   port: number
   container_name: string
   status: string
+  heal_policy: HealPolicy
+  health?: string
   created_at: string
   last_deployed_at?: string
 }
@@ -154,6 +442,7 @@ export interface CreateDatabaseInput {
   db_user?: string
   password: string
   port?: number
+  heal_policy?: HealPolicy
 }
 
 export const databases = {
@@ -163,6 +452,7 @@ export const databases = {
     request<Database>('/databases', { method: 'POST', body: JSON.stringify(data) }),
   delete: (id: string) =>
     request<void>(`/databases/${id}`, { method: 'DELETE' }),
+  ...healPolicyClient('databases'),
 }
 
 // Caches
@@ -177,6 +467,8 @@ export interface Cache {
   volumes: string  // JSON string
   container_name: string
   status: string
+  heal_policy: HealPolicy
+  health?: string
   created_at: string
   last_deployed_at?: string
 }
@@ -188,6 +480,7 @@ export interface CreateCacheInput {
   password: string
   port?: number
   volumes?: string[]
+  heal_policy?: HealPolicy
 }
 
 export const caches = {
@@ -197,6 +490,7 @@ export const caches = {
     request<Cache>('/caches', { method: 'POST', body: JSON.stringify(data) }),
   delete: (id: string) =>
     request<void>(`/caches/${id}`, { method: 'DELETE' }),
+  ...healPolicyClient('caches'),
 }
 
 // Kafkas
@@ -210,6 +504,8 @@ export interface Kafka {
   port: number
   container_name: string
   status: string
+  heal_policy: HealPolicy
+  health?: string
   created_at: string
   last_deployed_at?: string
 }
@@ -219,6 +515,7 @@ export interface CreateKafkaInput {
   version?: string
   node_id: string
   port?: number
+  heal_policy?: HealPolicy
 }
 
 export const kafkas = {
@@ -228,6 +525,7 @@ export const kafkas = {
     request<Kafka>('/kafkas', { method: 'POST', body: JSON.stringify(data) }),
   delete: (id: string) =>
     request<void>(`/kafkas/${id}`, { method: 'DELETE' }),
+  ...healPolicyClient('kafkas'),
 }
 
 // Monitorings
@@ -242,6 +540,8 @@ export interface Monitoring {
   prometheus_container_name: string
   grafana_container_name: string
   status: string
+  heal_policy: HealPolicy
+  health?: string
   created_at: string
   last_deployed_at?: string
 }
@@ -252,6 +552,7 @@ export interface CreateMonitoringInput {
   prometheus_port?: number
   grafana_port?: number
   grafana_password: string
+  heal_policy?: HealPolicy
 }
 
 export const monitorings = {
@@ -261,6 +562,7 @@ export const monitorings = {
     request<Monitoring>('/monitorings', { method: 'POST', body: JSON.stringify(data) }),
   delete: (id: string) =>
     request<void>(`/monitorings/${id}`, { method: 'DELETE' }),
+  ...healPolicyClient('monitorings'),
 }
 
 // Object Storages
@@ -345,16 +647,21 @@ export interface Deployment {
   container_name: string
   container_id: string
   status: string
+  heal_policy: HealPolicy
+  health?: string
   created_at: string
   last_deployed_at?: string
   app_name?: string
   node_name?: string
   docker_image?: string
+  previous_image?: string
+  pinned_image?: string
 }
 
 export interface CreateDeploymentInput {
   service_id: string
   node_id: string
+  heal_policy?: HealPolicy
 }
 
 export const deployments = {
@@ -366,8 +673,154 @@ export const deployments = {
     request<void>(`/deployments/${id}`, { method: 'DELETE' }),
   restart: (id: string) =>
     request<{ status: string; message: string }>(`/deployments/${id}/restart`, { method: 'POST' }),
+  redeploy: (id: string) =>
+    request<{ status: string; message: string; container_id?: string }>(`/deployments/${id}/redeploy`, { method: 'POST' }),
+  rollback: (id: string) =>
+    request<{ status: string; message: string; image?: string; container_id?: string }>(`/deployments/${id}/rollback`, { method: 'POST' }),
   logs: (id: string) =>
     request<{ logs: string; error?: string }>(`/deployments/${id}/logs`),
+  ...healPolicyClient('deployments'),
+}
+
+// Canaries
+export interface Canary {
+  id: string
+  deployment_id: string
+  service_id: string
+  node_id: string
+  docker_image: string
+  container_name: string
+  container_id: string
+  weight: number
+  status: string  // pending, running, failed, promoted, aborted
+  created_at: string
+  updated_at: string
+  app_name?: string
+  stable_image?: string
+}
+
+export interface CreateCanaryInput {
+  deployment_id: string
+  docker_image: string
+  weight?: number
+}
+
+export const canaries = {
+  list: () => request<Canary[]>('/canaries'),
+  get: (id: string) => request<Canary>(`/canaries/${id}`),
+  create: (data: CreateCanaryInput) =>
+    request<Canary>('/canaries', { method: 'POST', body: JSON.stringify(data) }),
+  setWeight: (id: string, weight: number) =>
+    request<Canary>(`/canaries/${id}/weight`, { method: 'PUT', body: JSON.stringify({ weight }) }),
+  promote: (id: string) =>
+    request<Canary>(`/canaries/${id}/promote`, { method: 'POST' }),
+  abort: (id: string) =>
+    request<Canary>(`/canaries/${id}/abort`, { method: 'POST' }),
+}
+
+// TLS certificates
+export interface Certificate {
+  id: string
+  domains: string  // JSON string — array of hostnames
+  source: string   // uploaded, acme
+  node_id?: string // ACME certificates only
+  node_name?: string
+  issuer: string
+  not_before: string
+  not_after: string
+  cert_pem?: string
+  created_at: string
+  updated_at: string
+}
+
+export interface ACMESettings {
+  email: string
+  directory_url: string   // empty = Let's Encrypt
+  ca_certificate: string  // PEM, only for private ACME servers such as Pebble
+}
+
+export const certificates = {
+  list: () => request<Certificate[]>('/certificates'),
+  get: (id: string) => request<Certificate>(`/certificates/${id}`),
+  upload: (cert_pem: string, key_pem: string) =>
+    request<Certificate>('/certificates', { method: 'POST', body: JSON.stringify({ cert_pem, key_pem }) }),
+  delete: (id: string) =>
+    request<void>(`/certificates/${id}`, { method: 'DELETE' }),
+  getACME: () => request<ACMESettings>('/acme'),
+  updateACME: (data: ACMESettings) =>
+    request<ACMESettings>('/acme', { method: 'PUT', body: JSON.stringify(data) }),
+}
+
+// WireGuard mesh
+export interface WireGuardPeer {
+  node_id: string
+  node_name?: string
+  node_host?: string
+  overlay_ip: string
+  public_key: string
+  created_at: string
+}
+
+export const wireguard = {
+  list: () => request<WireGuardPeer[]>('/wireguard'),
+  join: (nodeId: string) =>
+    request<{ peer: WireGuardPeer; error?: string }>(`/nodes/${nodeId}/wireguard`, { method: 'POST' }),
+  leave: (nodeId: string) =>
+    request<void | { error: string }>(`/nodes/${nodeId}/wireguard`, { method: 'DELETE' }),
+}
+
+// Firewall
+export interface FirewallRule {
+  id: string
+  node_id: string   // empty = every firewalled node
+  protocol: string  // tcp, udp
+  port: number
+  source: string    // IP or CIDR; empty = anywhere
+  description: string
+  created_at: string
+}
+
+export interface NodeFirewall {
+  node_id: string
+  node_name?: string
+  applied_at: string | null
+  last_error: string
+  created_at: string
+}
+
+export const firewall = {
+  list: () => request<{ nodes: NodeFirewall[]; rules: FirewallRule[] }>('/firewall'),
+  createRule: (data: Omit<FirewallRule, 'id' | 'created_at'>) =>
+    request<FirewallRule>('/firewall/rules', { method: 'POST', body: JSON.stringify(data) }),
+  deleteRule: (id: string) =>
+    request<void>(`/firewall/rules/${id}`, { method: 'DELETE' }),
+  enable: (nodeId: string) =>
+    request<{ ruleset: string; error?: string }>(`/nodes/${nodeId}/firewall`, { method: 'POST' }),
+  disable: (nodeId: string) =>
+    request<void | { error: string }>(`/nodes/${nodeId}/firewall`, { method: 'DELETE' }),
+}
+
+// Metrics
+export interface MetricSample {
+  resolution: number  // seconds per bucket; 0 = raw sample
+  ts: string
+  cpu_percent: number
+  mem_used: number
+  mem_total: number
+  disk_used?: number
+  disk_total?: number
+  net_rx: number      // cumulative bytes
+  net_tx: number
+  load1?: number
+  load5?: number
+  load15?: number
+}
+
+export const metrics = {
+  node: (nodeId: string, range = '24h') =>
+    request<MetricSample[]>(`/nodes/${nodeId}/metrics?range=${encodeURIComponent(range)}`),
+  deployment: (deploymentId: string, range = '24h') =>
+    request<MetricSample[]>(`/deployments/${deploymentId}/metrics?range=${encodeURIComponent(range)}`),
 }
 
 // Cloud Providers
@@ -402,6 +855,33 @@ export interface ComposeParsedService {
   env_vars: Record<string, string>
   command?: string
   depends_on?: string[]
+  healthcheck?: ComposeHealthcheck
+  resources?: ComposeResources
+  replicas?: number
+  restart?: string
+  labels?: Record<string, string>
+  profiles?: string[]
+  networks?: string[]
+  secrets?: string[]
+}
+
+export interface ComposeHealthcheck {
+  test?: string[]
+  interval?: string
+  timeout?: string
+  start_period?: string
+  retries?: number
+  disable?: boolean
+}
+
+export interface ComposeResourceSpec {
+  cpus?: string
+  memory?: string
+}
+
+export interface ComposeResources {
+  limits: ComposeResourceSpec
+  reservations: ComposeResourceSpec
 }
 
 export interface ComposeParsedDatabase {
@@ -440,16 +920,79 @@ export interface ComposePreview {
   caches: ComposeParsedCache[]
   kafkas: ComposeParsedKafka[]
   object_storages: ComposeParsedObjectStorage[]
+  volumes?: ComposeParsedVolume[]
+  networks?: ComposeParsedVolume[]
+  secrets?: ComposeParsedSecret[]
+  warnings?: string[]
+}
+
+export interface ComposeParsedVolume {
+  name: string
+  external?: boolean
+  driver?: string
+}
+
+export interface ComposeParsedSecret {
+  name: string
+  file?: string
+  environment?: string
+  external?: boolean
+}
+
+export interface ComposeOptions {
+  overrides?: string[]
+  env?: Record<string, string>
+  dotenv?: string
+  files?: Record<string, string>
+  profiles?: string[]
 }
 
 export const composeImport = {
-  preview: (content: string) =>
+  preview: (content: string, options: ComposeOptions = {}) =>
     request<ComposePreview>('/import/docker-compose', {
       method: 'POST',
-      body: JSON.stringify({ content }),
+      body: JSON.stringify({ content, ...options }),
+    }),
+  apply: (preview: ComposePreview, nodeId: string, deploy = false, dryRun = false) =>
+    request<ManifestPlan>(`/import/docker-compose/apply${dryRun ? '?dry_run=true' : ''}`, {
+      method: 'POST',
+      body: JSON.stringify({ preview, node_id: nodeId, deploy }),
     }),
 }
 
+// Declarative manifests
+export interface ManifestChange {
+  action: 'create' | 'update' | 'delete'
+  kind: string
+  name: string
+  id?: string
+  fields?: string[]
+  status?: 'applied' | 'failed' | 'skipped'
+  error?: string
+}
+
+export interface ManifestPlan {
+  changes: ManifestChange[]
+  errors?: string[]
+  error?: string
+  undo?: ManifestPlan
+}
+
+export const manifests = {
+  apply: (content: string, dryRun = false, prune = false) => {
+    const params = new URLSearchParams()
+    if (dryRun) params.set('dry_run', 'true')
+    if (prune) params.set('prune', 'true')
+    const query = params.toString()
+    return request<ManifestPlan>(`/apply${query ? `?${query}` : ''}`, { method: 'POST', body: content })
+  },
+  exportUrl: (format: 'manifest' | 'compose' = 'manifest', maskSecrets = false) => {
+    const params = new URLSearchParams({ format })
+    if (maskSecrets) params.set('mask_secrets', 'true')
+    return withOrg(`${BASE}/export?${params}`)
+  },
+}
+
 // Dashboard
 export interface Stats {
   nodes: number
@@ -10,6 +10,10 @@ const colors: Record<string, string> = {
   stopped: 'bg-yellow-100 text-yellow-800',
   failed: 'bg-red-100 text-red-800',
   pending: 'bg-blue-100 text-blue-800',
+  restarting: 'bg-orange-100 text-orange-800',
+  crash_loop: 'bg-red-100 text-red-800',
+  promoted: 'bg-green-100 text-green-800',
+  aborted: 'bg-gray-100 text-gray-600',
 }
 
 export default function StatusBadge({ status }: StatusBadgeProps) {
@@ -1,7 +1,7 @@
 import { useEffect, useState } from 'react'
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome'
 import { faGithub } from '@fortawesome/free-brands-svg-icons'
-import { services, databases, caches, kafkas, monitorings, nodes as nodesApi, github, settings, Service, Database, Cache, Kafka, Monitoring, Node, CreateServiceInput, GithubRepo } from '../api/client'
+import { services, databases, caches, kafkas, monitorings, nodes as nodesApi, github, settings, Service, Database, Cache, Kafka, Monitoring, Node, CreateServiceInput, GithubRepo, Route } from '../api/client'
 import Modal from '../components/Modal'
 import ComposeImportWizard from '../components/ComposeImportWizard'
 
@@ -27,7 +27,7 @@ export default function Services() {
     dockerfile_path: string
     command: string
     github_repo: string
-    domain: string
+    routes: Route[]
     envPairs: { key: string; value: string }[]
     ports: string[]
     volumes: string[]
@@ -36,7 +36,7 @@ export default function Services() {
     kafkas: string[]
     monitorings: string[]
   }>({
-    name: '', docker_image: '', dockerfile_path: '', command: '', github_repo: '', domain: '',
+    name: '', docker_image: '', dockerfile_path: '', command: '', github_repo: '', routes: [],
     envPairs: [{ key: '', value: '' }],
     ports: [''],
     volumes: [],
@@ -50,7 +50,7 @@ export default function Services() {
   const [envPasteText, setEnvPasteText] = useState('')
 
   const resetForm = () => {
-    setForm({ name: '', docker_image: '', dockerfile_path: '', command: '', github_repo: '', domain: '', envPairs: [{ key: '', value: '' }], ports: [''], volumes: [], databases: [], caches: [], kafkas: [], monitorings: [] })
+    setForm({ name: '', docker_image: '', dockerfile_path: '', command: '', github_repo: '', routes: [], envPairs: [{ key: '', value: '' }], ports: [''], volumes: [], databases: [], caches: [], kafkas: [], monitorings: [] })
     setShowEnvPaste(false)
     setEnvPasteText('')
   }
@@ -100,7 +100,7 @@ export default function Services() {
         ports: form.ports.filter(Boolean),
         volumes: form.volumes.filter(Boolean).length > 0 ? form.volumes.filter(Boolean) : undefined,
         github_repo: form.github_repo || undefined,
-        domain: form.domain || undefined,
+        routes: form.routes.filter(r => r.host).map(r => ({ ...r, strip_prefix: r.path_prefix ? r.strip_prefix : undefined })),
         databases: form.databases.length > 0 ? form.databases : undefined,
         caches: form.caches.length > 0 ? form.caches : undefined,
         kafkas: form.kafkas.length > 0 ? form.kafkas : undefined,
@@ -154,13 +154,17 @@ export default function Services() {
     try {
       ms = JSON.parse(a.monitorings) as string[]
     } catch { /* keep default */ }
+    let rs: Route[] = []
+    try {
+      rs = JSON.parse(a.routes) as Route[]
+    } catch { /* keep default */ }
     setForm({
       name: a.name,
       docker_image: a.docker_image,
       dockerfile_path: a.dockerfile_path || '',
       command: a.command || '',
       github_repo: a.github_repo || '',
-      domain: a.domain || '',
+      routes: rs,
       envPairs,
       ports,
       volumes: vols,
@@ -216,7 +220,7 @@ export default function Services() {
       dockerfile_path: '',
       command: '',
       github_repo: repo.full_name,
-      domain: '',
+      routes: [],
       envPairs: [{ key: '', value: '' }],
       ports: [''],
       volumes: [],
@@ -232,6 +236,14 @@ export default function Services() {
     try { return JSON.parse(s) as string[] } catch { return [] }
   }
 
+  const parseRoutes = (s: string) => {
+    try { return JSON.parse(s) as Route[] } catch { return [] }
+  }
+
+  const updateRoute = (i: number, patch: Partial<Route>) => {
+    setForm(prev => ({ ...prev, routes: prev.routes.map((r, j) => (j === i ? { ...r, ...patch } : r)) }))
+  }
+
   return (
     <div>
       <div className="flex flex-wrap items-center justify-between gap-3 mb-6">
@@ -273,7 +285,7 @@ export default function Services() {
               <th className="text-left px-4 py-3 font-medium text-gray-600">Name</th>
               <th className="text-left px-4 py-3 font-medium text-gray-600">Image</th>
               <th className="text-left px-4 py-3 font-medium text-gray-600">Ports</th>
-              <th className="text-left px-4 py-3 font-medium text-gray-600">Domain</th>
+              <th className="text-left px-4 py-3 font-medium text-gray-600">Routes</th>
               <th className="text-left px-4 py-3 font-medium text-gray-600">Command</th>
               <th className="text-left px-4 py-3 font-medium text-gray-600">Last Deploy</th>
               <th className="text-left px-4 py-3 font-medium text-gray-600">Actions</th>
@@ -305,7 +317,9 @@ export default function Services() {
                 <td className="px-4 py-3 text-gray-600">
                   {parsePorts(a.ports).join(', ') || '—'}
                 </td>
-                <td className="px-4 py-3 text-gray-600 font-mono text-xs">{a.domain || '—'}</td>
+                <td className="px-4 py-3 text-gray-600 font-mono text-xs">
+                  {parseRoutes(a.routes).map(r => r.host + (r.path_prefix || '')).join(', ') || '—'}
+                </td>
                 <td className="px-4 py-3 text-gray-600 font-mono text-xs">{a.command || '—'}</td>
                 <td className="px-4 py-3 text-gray-500 text-xs">{a.last_deployed_at ? new Date(a.last_deployed_at).toLocaleString() : '—'}</td>
                 <td className="px-4 py-3 flex gap-2">
@@ -412,14 +426,55 @@ export default function Services() {
                 onChange={e => setForm(prev => ({ ...prev, command: e.target.value }))}
               />
             </div>
+            {/* Routes */}
             <div>
-              <label className="block text-sm font-medium text-gray-700 mb-1">Domain (optional)</label>
-              <input
-                className="w-full border rounded-lg px-3 py-2 text-sm font-mono focus:outline-none focus:ring-2 focus:ring-purple-500"
-                value={form.domain}
-                onChange={e => setForm(prev => ({ ...prev, domain: e.target.value }))}
-                placeholder="app.example.com"
-              />
+              <label className="block text-sm font-medium text-gray-700 mb-1">Routes (optional)</label>
+              {form.routes.map((r, i) => (
+                <div key={i} className="flex flex-wrap items-center gap-2 mb-1">
+                  <input
+                    className="flex-1 min-w-[10rem] border rounded-lg px-3 py-2 text-sm font-mono focus:outline-none focus:ring-2 focus:ring-purple-500"
+                    value={r.host}
+                    placeholder="app.example.com"
+                    onChange={e => updateRoute(i, { host: e.target.value })}
+                  />
+                  <input
+                    className="w-24 border rounded-lg px-3 py-2 text-sm font-mono focus:outline-none focus:ring-2 focus:ring-purple-500"
+                    value={r.path_prefix || ''}
+                    placeholder="/path"
+                    onChange={e => updateRoute(i, { path_prefix: e.target.value || undefined })}
+                  />
+                  <input
+                    className="w-20 border rounded-lg px-3 py-2 text-sm font-mono focus:outline-none focus:ring-2 focus:ring-purple-500"
+                    value={r.container_port || ''}
+                    placeholder="port"
+                    onChange={e => updateRoute(i, { container_port: Number(e.target.value) || undefined })}
+                  />
+                  <input
+                    className="w-24 border rounded-lg px-3 py-2 text-sm font-mono focus:outline-none focus:ring-2 focus:ring-purple-500"
+                    value={r.entrypoint || ''}
+                    placeholder="web"
+                    onChange={e => updateRoute(i, { entrypoint: e.target.value || undefined })}
+                  />
+                  <label className="flex items-center gap-1 text-xs text-gray-600">
+                    <input
+                      type="checkbox"
+                      checked={!!r.strip_prefix}
+                      disabled={!r.path_prefix}
+                      onChange={e => updateRoute(i, { strip_prefix: e.target.checked || undefined })}
+                    />
+                    strip
+                  </label>
+                  <button
+                    onClick={() => setForm(prev => ({ ...prev, routes: prev.routes.filter((_, j) => j !== i) }))}
+                    className="text-red-400 hover:text-red-600 px-2"
+                  >×</button>
+                </div>
+              ))}
+              <button
+                onClick={() => setForm(prev => ({ ...prev, routes: [...prev.routes, { host: '' }] }))}
+                className="text-xs text-purple-600 hover:underline"
+              >+ Add route</button>
+              <p className="text-xs text-gray-400 mt-1">Port defaults to the container side of the first port mapping.</p>
             </div>
 
             {/* Ports */}